@@ -0,0 +1,112 @@
+// migrate はブックマークDBのスキーマを操作するコマンド。
+//
+//	go run ./cmd/migrate              # 最新まで適用
+//	go run ./cmd/migrate -status      # 現在のバージョンを表示
+//	go run ./cmd/migrate -to 3        # バージョン3まで適用/ロールバック
+//	go run ./cmd/migrate -to 0 -dry-run
+//	go run ./cmd/migrate -claim-legacy alice  # 所有者のいないブックマークを alice のものにする
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/migrate"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+func main() {
+	dbPath := flag.String("db", "bookmarks.db",
+		"SQLite のファイルパス")
+	to := flag.Int("to", -1,
+		"目標のバージョン (省略時は最新)")
+	dryRun := flag.Bool("dry-run", false,
+		"実行してからロールバックし、変更を残さない")
+	status := flag.Bool("status", false,
+		"現在のバージョンを表示して終了する")
+	claim := flag.String("claim-legacy", "",
+		"ユーザー管理を導入する前のブックマークをこのユーザーのものにする")
+	flag.Parse()
+
+	if err := run(*dbPath, *to, *dryRun, *status, *claim); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dbPath string, to int, dryRun, status bool, claim string) error {
+	// サーバーと同じ設定で開く
+	db, err := repository.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if claim != "" {
+		return claimLegacy(ctx, db, m, claim)
+	}
+	cur, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+	if status {
+		fmt.Printf("current: %d, latest: %d\n",
+			cur, m.Latest())
+		return nil
+	}
+	if to < 0 {
+		to = m.Latest()
+	}
+	steps, err := m.Migrate(ctx, to, dryRun)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		fmt.Printf("already at version %d\n", cur)
+		return nil
+	}
+	for _, s := range steps {
+		fmt.Printf("%s %04d_%s\n",
+			s.Direction, s.Version, s.Name)
+		if dryRun {
+			fmt.Println(s.SQL())
+		}
+	}
+	if dryRun {
+		fmt.Println("dry run: rolled back")
+	}
+	return nil
+}
+
+// claimLegacy は所有者のいないブックマークを username のものにする。
+// 登録したユーザーが勝手に引き継がないよう、運用者が明示的に実行する。
+func claimLegacy(
+	ctx context.Context, db *sql.DB, m *migrate.Migrator, username string,
+) error {
+	if err := m.CheckApplied(ctx); err != nil {
+		return err
+	}
+	u, err := repository.NewUsers(db).FindByName(ctx, strings.ToLower(username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %q not found", username)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := repository.New(db).ClaimUnowned(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("claimed %d bookmarks for %s\n", n, u.Username)
+	return nil
+}
@@ -4,83 +4,258 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "modernc.org/sqlite"
 
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/accesslog"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/config"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/handler"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/health"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/linkcheck"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/metrics"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/migrate"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/pagemeta"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/ratelimit"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/safehttp"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/trash"
 )
 
-func loggingMiddleware(
-	next http.Handler,
-) http.Handler {
-	return http.HandlerFunc(
-		func(w http.ResponseWriter,
-			r *http.Request,
-		) {
-			slog.Info("リクエスト受信",
-				"method", r.Method,
-				"path", r.URL.Path,
-			)
-			next.ServeHTTP(w, r)
-		},
-	)
+// migrateDB はスキーマを最新にする。
+// DBのほうが新しい場合は、古いバイナリで
+// 書き換えてしまわないよう起動を中止する。
+func migrateDB(db *sql.DB) (*migrate.Migrator, error) {
+	m, err := migrate.New(db)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err := m.Check(ctx); err != nil {
+		return nil, err
+	}
+	steps, err := m.Up(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		slog.Info("マイグレーション適用",
+			"version", s.Version, "name", s.Name)
+	}
+	return m, nil
+}
+
+// loadConfig は設定を読み込む。-print-config が
+// 指定された場合は設定を表示して終了する。
+func loadConfig() config.Config {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	printConfig := fs.Bool("print-config", false,
+		"最終的な設定を JSON で表示して終了する")
+	cfg, err := config.Load(fs, os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "設定エラー:\n%v\n", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		cfg.Write(os.Stdout)
+		os.Exit(0)
+	}
+	return cfg
 }
 
 func main() {
-	db, err := sql.Open("sqlite", "bookmarks.db")
+	cfg := loadConfig()
+	slog.SetDefault(cfg.NewLogger(os.Stderr))
+
+	db, err := repository.Open(cfg.DBPath)
 	if err != nil {
 		slog.Error("DB接続失敗", "error", err)
 		os.Exit(1)
 	}
 	defer db.Close()
 
-	repo := repository.New(db)
-	if err := repo.InitTable(); err != nil {
-		slog.Error("テーブル作成失敗",
+	mig, err := migrateDB(db)
+	if err != nil {
+		slog.Error("マイグレーション失敗",
 			"error", err)
 		os.Exit(1)
 	}
 
-	h := handler.New(repo)
+	repo := repository.New(db)
+	n, err := repo.BackfillNormalizedURLs(
+		context.Background())
+	if err != nil {
+		slog.Error("URLの正規化失敗", "error", err)
+		os.Exit(1)
+	}
+	if n > 0 {
+		slog.Info("既存URLを正規化", "count", n)
+	}
+
+	ips := clientip.Resolver{Trusted: cfg.TrustedProxyPrefixes()}
+	limiter := handler.NewRateLimiter(
+		ratelimit.PerMinute(cfg.RateLimitRead, cfg.RateLimitReadBurst),
+		ratelimit.PerMinute(cfg.RateLimitWrite, cfg.RateLimitWriteBurst),
+		ips)
+	a := handler.NewAuth(repository.NewUsers(db),
+		handler.WithSessionTTL(cfg.SessionTTL),
+		handler.WithRateLimit(limiter),
+		handler.WithReservedNames(cfg.Admins()...))
+	checker := linkcheck.NewChecker(safehttp.NewClient(
+		safehttp.Options{Timeout: cfg.LinkCheckTimeout}))
+	fetcher := pagemeta.NewFetcher(safehttp.NewClient(
+		safehttp.Options{Timeout: cfg.MetadataTimeout}),
+		pagemeta.DefaultMaxBytes)
+	h := handler.New(repo,
+		handler.WithLinkChecker(checker),
+		handler.WithMetaFetcher(fetcher),
+		handler.WithAdmins(cfg.Admins()...))
 	mux := http.NewServeMux()
+	a.Routes(mux)
 	h.Routes(mux)
+	m := metrics.New(db, repo)
+	ready := health.New(
+		health.Check{Name: "database", Func: db.PingContext},
+		health.Check{Name: "migrations", Func: mig.CheckApplied},
+	)
+	ready.Routes(mux)
+
+	// 全リクエストの ctx の親。シャットダウンの猶予を
+	// 過ぎても終わらないリクエストのクエリを中断させる
+	baseCtx, cancelBase := context.WithCancel(
+		context.Background(),
+	)
+	defer cancelBase()
 
+	// リクエスト ID は監査ログやアクセスログにも記録するため、
+	// 最初に付ける。認証で拒否したリクエストも数えるよう、
+	// メトリクスは認証の外側で集める
+	root := requestid.Middleware(accesslog.Middleware(slog.Default(), ips,
+		m.Middleware(mux, a.Authenticate(mux))))
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: loggingMiddleware(mux),
+		Addr:         cfg.Addr,
+		Handler:      root,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
-	// Ctrl+C で graceful shutdown を実行
+	// メトリクスはリクエスト数や DB の状態などを認証なしで
+	// 返すため、API とは別の内部向けのアドレスで公開する
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		ln, err := net.Listen("tcp", cfg.MetricsAddr)
+		if err != nil {
+			slog.Error("メトリクスの待ち受け失敗",
+				"error", err)
+			os.Exit(1)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", m)
+		metricsSrv = &http.Server{
+			Handler:      metricsMux,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+		slog.Info("メトリクス公開", "addr", cfg.MetricsAddr)
+		go func() {
+			if err := metricsSrv.Serve(ln); err != nil &&
+				!errors.Is(err, http.ErrServerClosed) {
+				slog.Error("メトリクスのサーバーエラー",
+					"error", err)
+			}
+		}()
+	}
+
+	// リンク切れチェック、メタデータの再取得、ゴミ箱の削除は
+	// シャットダウンの開始とともに止める
+	workerCtx, stopWorker := context.WithCancel(
+		context.Background(),
+	)
+	defer stopWorker()
+	var workers sync.WaitGroup
+	if cfg.LinkCheckInterval > 0 {
+		w := linkcheck.NewWorker(repo, checker,
+			linkcheck.WithInterval(cfg.LinkCheckInterval),
+			linkcheck.WithMaxAge(cfg.LinkCheckMaxAge),
+			linkcheck.WithConcurrency(cfg.LinkCheckConcurrency),
+			linkcheck.WithHostDelay(cfg.LinkCheckHostDelay),
+		)
+		workers.Go(func() { w.Run(workerCtx) })
+	}
+	if cfg.MetadataRetryInterval > 0 {
+		w := pagemeta.NewWorker(repo, fetcher,
+			pagemeta.WithInterval(cfg.MetadataRetryInterval))
+		workers.Go(func() { w.Run(workerCtx) })
+	}
+	if cfg.TrashRetentionDays > 0 {
+		p := trash.NewPurger(repo, time.Duration(
+			cfg.TrashRetentionDays)*24*time.Hour)
+		workers.Go(func() { p.Run(workerCtx) })
+	}
+
+	// Ctrl+C か SIGTERM で graceful shutdown を実行する。
+	// 先に /readyz を 503 にし、ロードバランサーが送り先から
+	// 外すのを待ってから接続を閉じる
+	idleClosed := make(chan struct{})
 	go func() {
+		defer close(idleClosed)
 		ctx, stop := signal.NotifyContext(
 			context.Background(),
-			os.Interrupt,
+			os.Interrupt, syscall.SIGTERM,
 		)
-		defer stop()
 		<-ctx.Done()
-		slog.Info("シャットダウン開始")
+		// 2回目のシグナルでは待たずに終了できるよう、
+		// 既定の動作に戻す
+		stop()
+		slog.Info("シャットダウン開始",
+			"drain", cfg.ShutdownDrain)
+		ready.ShutDown()
+		stopWorker()
+		time.Sleep(cfg.ShutdownDrain)
 		shutCtx, cancel := context.WithTimeout(
 			context.Background(),
-			5*time.Second,
+			cfg.ShutdownTimeout,
 		)
 		defer cancel()
 		if err := srv.Shutdown(shutCtx); err != nil {
 			slog.Error("シャットダウン失敗",
 				"error", err)
 		}
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(shutCtx)
+		}
+		cancelBase()
 	}()
 
-	slog.Info("サーバー起動", "addr", ":8080")
+	slog.Info("サーバー起動", "addr", cfg.Addr)
 	if err := srv.ListenAndServe(); err != nil &&
 		!errors.Is(err, http.ErrServerClosed) {
 		slog.Error("サーバーエラー",
 			"error", err)
 		os.Exit(1)
 	}
+	// Shutdown を呼ぶと ListenAndServe はすぐに戻るため、
+	// 処理中のリクエストとバックグラウンドの処理が
+	// 終わるのを待ってから DB を閉じる
+	<-idleClosed
+	workers.Wait()
 }
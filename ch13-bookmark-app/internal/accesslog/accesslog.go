@@ -0,0 +1,56 @@
+// Package accesslog はリクエストごとに1行のアクセスログを出力する。
+package accesslog
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/respwriter"
+)
+
+// Middleware は next の処理が終わったあと、ステータスコード、
+// 本文のバイト数、処理時間、クライアントの IP アドレスを
+// logger に出力する。5xx と、途中で中断したリクエストは
+// Error、ほかは Info で出力する。
+//
+// ログはリクエストの ctx を渡して出力するため、
+// requestid.NewLogHandler を使っていればリクエスト ID も付く。
+// そのため requestid.Middleware より内側に置く。
+func Middleware(
+	logger *slog.Logger, ips clientip.Resolver, next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		start := time.Now()
+		rw := respwriter.Wrap(w)
+		defer func() {
+			// 中断 (http.ErrAbortHandler など) したリクエストも
+			// 記録してから、net/http にそのまま伝える
+			p := recover()
+			level := slog.LevelInfo
+			if p != nil || rw.Status() >= 500 {
+				level = slog.LevelError
+			}
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rw.Status()),
+				slog.Int64("bytes", rw.Size()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("client_ip", ips.ClientIP(r).String()),
+				slog.String("user_agent", r.UserAgent()),
+			}
+			if p != nil {
+				attrs = append(attrs, slog.Bool("aborted", true))
+			}
+			logger.LogAttrs(r.Context(), level, "リクエスト処理", attrs...)
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
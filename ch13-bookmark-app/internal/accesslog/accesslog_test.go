@@ -0,0 +1,85 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestid.NewLogHandler(
+		slog.NewJSONHandler(&buf, nil)))
+	trusted, _ := clientip.ParsePrefixes("10.0.0.0/8")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	mux.HandleFunc("GET /fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("GET /abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	h := requestid.Middleware(Middleware(logger,
+		clientip.Resolver{Trusted: trusted}, mux))
+
+	tests := []struct {
+		path    string
+		status  float64
+		bytes   float64
+		level   string
+		aborted bool
+	}{
+		{"/ok", 200, 5, "INFO", false},
+		{"/fail", 500, 5, "ERROR", false},
+		{"/abort", 200, 0, "ERROR", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			req.Header.Set("User-Agent", "test-agent")
+			req.Header.Set(requestid.Header, "req-1")
+			func() {
+				defer func() {
+					if p := recover(); (p != nil) != tt.aborted {
+						t.Errorf("panic = %v", p)
+					}
+				}()
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("log = %q: %v", buf.String(), err)
+			}
+			want := map[string]any{
+				"level": tt.level, "method": "GET", "path": tt.path,
+				"status": tt.status, "bytes": tt.bytes,
+				"client_ip": "198.51.100.7", "user_agent": "test-agent",
+				"request_id": "req-1",
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+			if _, ok := got["duration"]; !ok {
+				t.Error("duration is missing")
+			}
+			if (got["aborted"] == true) != tt.aborted {
+				t.Errorf("aborted = %v", got["aborted"])
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Package auth はパスワードとトークンのハッシュ化を行う。
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// パスワードのハッシュの設定。反復回数は OWASP の
+// 推奨値 (PBKDF2-HMAC-SHA256) に合わせている。
+// 回数はハッシュに埋め込むため、後から変えても
+// 既存のハッシュは検証できる。
+const (
+	scheme     = "pbkdf2-sha256"
+	iterations = 600_000
+	saltLen    = 16
+	keyLen     = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// HashPassword はパスワードをソルト付きでハッシュ化し、
+// "pbkdf2-sha256$反復回数$ソルト$ハッシュ" の形式で返す。
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(
+		sha256.New, password, salt, iterations, keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", scheme, iterations,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(key)), nil
+}
+
+// CheckPassword は password が hash と一致するかを判定する。
+// 比較にかかる時間から一致した長さを推測されないよう、
+// 定数時間で比較する。
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return false
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n <= 0 {
+		return false
+	}
+	salt, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := b64.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got, err := pbkdf2.Key(
+		sha256.New, password, salt, n, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyHash は存在しないユーザーでのログインでも
+// 同じ時間をかけるために検証する値。
+// 起動を遅らせないよう、初回の使用時に作る。
+var dummyHash = sync.OnceValue(func() string {
+	h, _ := HashPassword("dummy password")
+	return h
+})
+
+// CheckDummy は CheckPassword と同じ時間をかけて false を返す。
+// 存在しないユーザー名でのログインに使い、応答時間の差から
+// ユーザー名の有無を推測されないようにする。
+func CheckDummy(password string) bool {
+	CheckPassword(dummyHash(), password)
+	return false
+}
+
+// NewToken はセッションや API トークンに使う
+// 推測できないランダムな文字列を返す。
+func NewToken() string {
+	return rand.Text()
+}
+
+// HashToken はトークンを保存用にハッシュ化する。
+// トークンは十分な長さの乱数のため、ソルトや
+// 反復は不要で、SHA-256 で足りる。
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$600000$") {
+		t.Errorf("hash = %q", hash)
+	}
+	if !CheckPassword(hash, "correct horse") {
+		t.Error("correct password rejected")
+	}
+	if CheckPassword(hash, "correct horse ") {
+		t.Error("wrong password accepted")
+	}
+
+	// 同じパスワードでもソルトが異なる
+	other, _ := HashPassword("correct horse")
+	if other == hash {
+		t.Error("hashes are equal")
+	}
+
+	for _, bad := range []string{
+		"",
+		"plain",
+		"bcrypt$10$x$y",
+		"pbkdf2-sha256$x$c2FsdA$a2V5",
+		"pbkdf2-sha256$1$!!$a2V5",
+		"pbkdf2-sha256$1$c2FsdA$",
+	} {
+		if CheckPassword(bad, "") {
+			t.Errorf("CheckPassword(%q) = true", bad)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	a, b := NewToken(), NewToken()
+	if a == b || len(a) < 20 {
+		t.Errorf("tokens = %q, %q", a, b)
+	}
+	if HashToken(a) != HashToken(a) || HashToken(a) == HashToken(b) {
+		t.Error("HashToken is not deterministic")
+	}
+	if HashToken(a) == a {
+		t.Error("HashToken returned the token")
+	}
+}
@@ -0,0 +1,102 @@
+// Package clientip はリクエストを送ったクライアントの
+// IP アドレスを求める。
+//
+// リバースプロキシを経由する場合、接続元はプロキシになるため、
+// 信頼するプロキシが付けた X-Forwarded-For をたどる。
+// 信頼しない接続元の X-Forwarded-For は偽装できるため使わない。
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Resolver はクライアントの IP アドレスを求める。
+// ゼロ値はどのプロキシも信頼せず、接続元のアドレスを返す。
+type Resolver struct {
+	// Trusted は信頼するプロキシのアドレスの範囲。
+	Trusted []netip.Prefix
+}
+
+// ParsePrefixes は 10.0.0.0/8 のような範囲か、単独のアドレスの
+// カンマ区切りのリストを読む。単独のアドレスは /32 (IPv6 は /128) とする。
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes,
+				netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func (res Resolver) trusted(addr netip.Addr) bool {
+	return slices.ContainsFunc(res.Trusted, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// ClientIP はクライアントの IP アドレスを返す。
+// 接続元が信頼するプロキシなら、X-Forwarded-For を右 (接続元に
+// 近い側) からたどり、最初に現れた信頼しないアドレスを返す。
+// アドレスとして読めない値に当たったら、その手前で止める。
+func (res Resolver) ClientIP(r *http.Request) netip.Addr {
+	addr := remoteAddr(r)
+	if !addr.IsValid() || !res.trusted(addr) {
+		return addr
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return addr
+		}
+		addr = hop.Unmap()
+		if !res.trusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// forwardedFor はすべての X-Forwarded-For ヘッダーの
+// アドレスを順に返す。
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
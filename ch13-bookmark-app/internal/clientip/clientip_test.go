@@ -0,0 +1,66 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Resolver{Trusted: trusted}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"プロキシなし", "203.0.113.5:1234", nil, "203.0.113.5"},
+		// 信頼しない接続元のヘッダーは偽装できるため使わない
+		{"信頼しない接続元", "203.0.113.5:1234",
+			[]string{"198.51.100.7"}, "203.0.113.5"},
+		{"信頼するプロキシ", "10.1.2.3:1234",
+			[]string{"198.51.100.7"}, "198.51.100.7"},
+		// クライアントが付けた左側の値は使わない
+		{"偽装を含む", "10.1.2.3:1234",
+			[]string{"1.1.1.1, 198.51.100.7"}, "198.51.100.7"},
+		{"多段のプロキシ", "192.0.2.1:1234",
+			[]string{"198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"複数のヘッダー", "10.1.2.3:1234",
+			[]string{"198.51.100.7", "10.9.9.9"}, "198.51.100.7"},
+		{"すべて信頼するプロキシ", "10.1.2.3:1234",
+			[]string{"10.4.4.4"}, "10.4.4.4"},
+		{"読めない値", "10.1.2.3:1234",
+			[]string{"198.51.100.7, unknown"}, "10.1.2.3"},
+		{"IPv6", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := res.ClientIP(r).String(); got != tt.want {
+				t.Errorf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := ParsePrefixes(" 10.1.2.3/8 ,2001:db8::1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].String() != "10.0.0.0/8" ||
+		got[1].String() != "2001:db8::1/128" {
+		t.Errorf("got %v", got)
+	}
+	if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+		t.Error("invalid prefix: err = nil")
+	}
+}
@@ -0,0 +1,482 @@
+// Package config はサーバーの設定を読み込む。
+//
+// 設定は次の順に読み込み、後のものが前のものを上書きする。
+//
+//  1. 既定値
+//  2. JSON の設定ファイル (-config または BOOKMARK_CONFIG)
+//  3. 環境変数 (BOOKMARK_DB_PATH など)
+//  4. コマンドラインフラグ (-db-path など)
+//
+// 設定ファイルのキー、環境変数、フラグの名前は
+// いずれも同じ名前から作る (db_path, BOOKMARK_DB_PATH, -db-path)。
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+// EnvPrefix は環境変数の接頭辞。
+const EnvPrefix = "BOOKMARK_"
+
+// Config はサーバーの設定。
+type Config struct {
+	DBPath string
+	Addr   string
+	// MetricsAddr は /metrics を公開するアドレス。空なら公開しない。
+	// 認証をかけないため、Addr とは別の内部向けのアドレスにする。
+	MetricsAddr string
+
+	// http.Server のタイムアウト。0 は無制限。
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// ShutdownDrain は停止の合図を受けてから /readyz を 503 にし、
+	// ロードバランサーが送り先から外すのを待つ時間。
+	ShutdownDrain time.Duration
+	// ShutdownTimeout は処理中のリクエストを待つ時間。
+	ShutdownTimeout time.Duration
+
+	// SessionTTL はログインの有効期間。
+	SessionTTL time.Duration
+
+	// リンク切れチェック。LinkCheckInterval が 0 なら
+	// バックグラウンドでのチェックを行わない。
+	LinkCheckInterval    time.Duration
+	LinkCheckMaxAge      time.Duration
+	LinkCheckConcurrency int
+	LinkCheckHostDelay   time.Duration
+	LinkCheckTimeout     time.Duration
+
+	// タイトルを省略した登録でのページの取得。
+	// MetadataRetryInterval が 0 なら取得し直さない。
+	MetadataTimeout       time.Duration
+	MetadataRetryInterval time.Duration
+
+	// TrashRetentionDays はゴミ箱に入れたものを完全に削除する
+	// までの日数。0 なら自動では削除しない。
+	TrashRetentionDays int
+
+	// AdminUsers は監査ログを閲覧できるユーザー名の
+	// カンマ区切りのリスト。
+	AdminUsers string
+
+	// 呼び出し元ごとの1分あたりのリクエスト数の上限と、
+	// 連続して受け付ける数。上限が 0 なら制限しない。
+	RateLimitRead       int
+	RateLimitReadBurst  int
+	RateLimitWrite      int
+	RateLimitWriteBurst int
+	// TrustedProxies は X-Forwarded-For を信頼するプロキシの
+	// アドレス (CIDR) のカンマ区切りのリスト。
+	TrustedProxies string
+
+	LogLevel  string
+	LogFormat string
+}
+
+// Default は既定の設定を返す。
+func Default() Config {
+	return Config{
+		DBPath:          "bookmarks.db",
+		Addr:            ":8080",
+		ReadTimeout:     15 * time.Second,
+		WriteTimeout:    60 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownDrain:   5 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+		SessionTTL:      14 * 24 * time.Hour,
+
+		LinkCheckInterval:    time.Hour,
+		LinkCheckMaxAge:      7 * 24 * time.Hour,
+		LinkCheckConcurrency: 4,
+		LinkCheckHostDelay:   time.Second,
+		LinkCheckTimeout:     10 * time.Second,
+
+		MetadataTimeout:       5 * time.Second,
+		MetadataRetryInterval: 15 * time.Minute,
+
+		TrashRetentionDays: 30,
+
+		RateLimitRead:       600,
+		RateLimitReadBurst:  60,
+		RateLimitWrite:      120,
+		RateLimitWriteBurst: 20,
+
+		LogLevel:  "info",
+		LogFormat: "text",
+	}
+}
+
+// setting は設定項目1つ分の定義。
+type setting struct {
+	key   string
+	usage string
+	field func(*Config) flag.Value
+}
+
+var settings = []setting{
+	{"db_path", "SQLite のデータベースファイル",
+		func(c *Config) flag.Value { return (*stringValue)(&c.DBPath) }},
+	{"addr", "待ち受けるアドレス",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Addr) }},
+	{"metrics_addr", "/metrics を公開するアドレス (空で無効)",
+		func(c *Config) flag.Value { return (*stringValue)(&c.MetricsAddr) }},
+	{"read_timeout", "リクエストの読み込みの制限時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.ReadTimeout) }},
+	{"write_timeout", "レスポンスの書き込みの制限時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.WriteTimeout) }},
+	{"idle_timeout", "keep-alive の接続を待つ時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.IdleTimeout) }},
+	{"shutdown_drain", "停止時に /readyz を 503 にしてから待つ時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.ShutdownDrain) }},
+	{"shutdown_timeout", "停止時に処理中のリクエストを待つ時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.ShutdownTimeout) }},
+	{"session_ttl", "ログインの有効期間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.SessionTTL) }},
+	{"link_check_interval", "リンク切れチェックの間隔 (0 で無効)",
+		func(c *Config) flag.Value { return (*durationValue)(&c.LinkCheckInterval) }},
+	{"link_check_max_age", "前回のチェックからこの時間が経ったリンクを再チェックする",
+		func(c *Config) flag.Value { return (*durationValue)(&c.LinkCheckMaxAge) }},
+	{"link_check_concurrency", "同時にチェックするホストの数",
+		func(c *Config) flag.Value { return (*intValue)(&c.LinkCheckConcurrency) }},
+	{"link_check_host_delay", "同じホストへの要求の間隔",
+		func(c *Config) flag.Value { return (*durationValue)(&c.LinkCheckHostDelay) }},
+	{"link_check_timeout", "リンク1件のチェックの制限時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.LinkCheckTimeout) }},
+	{"metadata_timeout", "タイトルを省略した登録でページの取得を待つ時間",
+		func(c *Config) flag.Value { return (*durationValue)(&c.MetadataTimeout) }},
+	{"metadata_retry_interval", "取得に失敗したメタデータを取得し直す間隔 (0 で無効)",
+		func(c *Config) flag.Value { return (*durationValue)(&c.MetadataRetryInterval) }},
+	{"trash_retention_days", "ゴミ箱に入れたものを完全に削除するまでの日数 (0 で無効)",
+		func(c *Config) flag.Value { return (*intValue)(&c.TrashRetentionDays) }},
+	{"admin_users", "監査ログを閲覧できるユーザー名 (カンマ区切り)",
+		func(c *Config) flag.Value { return (*stringValue)(&c.AdminUsers) }},
+	{"rate_limit_read", "読み取りの1分あたりの上限 (0 で無効)",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimitRead) }},
+	{"rate_limit_read_burst", "読み取りを連続して受け付ける数",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimitReadBurst) }},
+	{"rate_limit_write", "書き込みの1分あたりの上限 (0 で無効)",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimitWrite) }},
+	{"rate_limit_write_burst", "書き込みを連続して受け付ける数",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimitWriteBurst) }},
+	{"trusted_proxies", "X-Forwarded-For を信頼するプロキシ (CIDR のカンマ区切り)",
+		func(c *Config) flag.Value { return (*stringValue)(&c.TrustedProxies) }},
+	{"log_level", "ログレベル (debug, info, warn, error)",
+		func(c *Config) flag.Value { return (*stringValue)(&c.LogLevel) }},
+	{"log_format", "ログの形式 (text, json)",
+		func(c *Config) flag.Value { return (*stringValue)(&c.LogFormat) }},
+}
+
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(s.key)
+}
+
+func (s setting) flagName() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+// Load は fs にフラグを登録して args を解析し、
+// 既定値・設定ファイル・環境変数・フラグの順に重ねた設定を返す。
+// 呼び出し側は事前に fs へ独自のフラグを追加できる。
+// getenv には通常 os.Getenv を渡す。
+func Load(
+	fs *flag.FlagSet, args []string,
+	getenv func(string) string,
+) (Config, error) {
+	// -h で既定値を表示するための、値の受け皿
+	shown := Default()
+	for _, s := range settings {
+		fs.Var(s.field(&shown), s.flagName(), s.usage+
+			" (環境変数 "+s.env()+")")
+	}
+	path := fs.String("config", "",
+		"JSON の設定ファイル (環境変数 "+EnvPrefix+"CONFIG)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if *path == "" {
+		*path = getenv(EnvPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := loadFile(&cfg, *path); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		v := getenv(s.env())
+		if v == "" {
+			continue
+		}
+		if err := s.field(&cfg).Set(v); err != nil {
+			return Config{}, fmt.Errorf(
+				"環境変数 %s: %w", s.env(), err)
+		}
+	}
+	// 明示的に指定されたフラグだけを反映する。
+	// 値の形式は fs.Parse で確認済み
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if f.Name == s.flagName() {
+				s.field(&cfg).Set(f.Value.String())
+			}
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile は設定ファイルの値を cfg に反映する。
+// 書き間違いに気づけるよう、未知のキーはエラーにする。
+// 数値と真偽値は文字列にしてから、フラグと同じ形式で解釈する。
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("設定ファイル: %w", err)
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("設定ファイル %s: %w", path, err)
+	}
+	for key, raw := range values {
+		i := indexOf(key)
+		if i < 0 {
+			return fmt.Errorf(
+				"設定ファイル %s: 不明なキー %q", path, key)
+		}
+		var v string
+		switch raw := raw.(type) {
+		case string:
+			v = raw
+		case float64:
+			v = strconv.FormatFloat(raw, 'f', -1, 64)
+		case bool:
+			v = strconv.FormatBool(raw)
+		default:
+			return fmt.Errorf(
+				"設定ファイル %s: %s は文字列か数値で指定してください",
+				path, key)
+		}
+		if err := settings[i].field(cfg).Set(v); err != nil {
+			return fmt.Errorf(
+				"設定ファイル %s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+func indexOf(key string) int {
+	for i, s := range settings {
+		if s.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate は値の組み合わせを確認する。
+func (c Config) Validate() error {
+	var errs []error
+	if c.DBPath == "" {
+		errs = append(errs, errors.New("db_path が空です"))
+	}
+	if c.Addr == "" {
+		errs = append(errs, errors.New("addr が空です"))
+	}
+	if c.MetricsAddr != "" && c.MetricsAddr == c.Addr {
+		errs = append(errs, fmt.Errorf(
+			"metrics_addr には addr と別のアドレスを指定してください: %s",
+			c.MetricsAddr))
+	}
+	for _, d := range []struct {
+		key string
+		v   time.Duration
+	}{
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_drain", c.ShutdownDrain},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"link_check_interval", c.LinkCheckInterval},
+		{"link_check_host_delay", c.LinkCheckHostDelay},
+		{"metadata_retry_interval", c.MetadataRetryInterval},
+	} {
+		if d.v < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%s に負の値は指定できません: %s", d.key, d.v))
+		}
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"session_ttl は正の値で指定してください: %s",
+			c.SessionTTL))
+	}
+	if c.LinkCheckMaxAge <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"link_check_max_age は正の値で指定してください: %s",
+			c.LinkCheckMaxAge))
+	}
+	if c.LinkCheckConcurrency < 1 {
+		errs = append(errs, fmt.Errorf(
+			"link_check_concurrency は1以上で指定してください: %d",
+			c.LinkCheckConcurrency))
+	}
+	if c.LinkCheckTimeout <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"link_check_timeout は正の値で指定してください: %s",
+			c.LinkCheckTimeout))
+	}
+	if c.MetadataTimeout <= 0 {
+		errs = append(errs, fmt.Errorf(
+			"metadata_timeout は正の値で指定してください: %s",
+			c.MetadataTimeout))
+	}
+	if c.TrashRetentionDays < 0 {
+		errs = append(errs, fmt.Errorf(
+			"trash_retention_days に負の値は指定できません: %d",
+			c.TrashRetentionDays))
+	}
+	for _, l := range []struct {
+		key, burstKey string
+		limit, burst  int
+	}{
+		{"rate_limit_read", "rate_limit_read_burst",
+			c.RateLimitRead, c.RateLimitReadBurst},
+		{"rate_limit_write", "rate_limit_write_burst",
+			c.RateLimitWrite, c.RateLimitWriteBurst},
+	} {
+		if l.limit < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%s に負の値は指定できません: %d", l.key, l.limit))
+		}
+		if l.limit > 0 && l.burst < 1 {
+			errs = append(errs, fmt.Errorf(
+				"%s は1以上で指定してください: %d", l.burstKey, l.burst))
+		}
+	}
+	if _, err := clientip.ParsePrefixes(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if _, err := c.level(); err != nil {
+		errs = append(errs, fmt.Errorf(
+			"log_level は debug, info, warn, error のいずれかです: %q",
+			c.LogLevel))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf(
+			"log_format は text か json です: %q", c.LogFormat))
+	}
+	return errors.Join(errs...)
+}
+
+// Admins は AdminUsers をユーザー名のリストにして返す。
+// ユーザー名は登録時と同じく小文字にそろえる。
+func (c Config) Admins() []string {
+	var names []string
+	for name := range strings.SplitSeq(c.AdminUsers, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TrustedProxyPrefixes は TrustedProxies を読んだ結果を返す。
+// c は Validate 済みであること。
+func (c Config) TrustedProxyPrefixes() []netip.Prefix {
+	prefixes, _ := clientip.ParsePrefixes(c.TrustedProxies)
+	return prefixes
+}
+
+func (c Config) level() (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(c.LogLevel))
+	return l, err
+}
+
+// NewLogger は設定に従って w に出力するロガーを返す。
+// slog.InfoContext などに渡した ctx にリクエスト ID があれば
+// request_id として出力する。c は Validate 済みであること。
+func (c Config) NewLogger(w io.Writer) *slog.Logger {
+	level, _ := c.level()
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if c.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(requestid.NewLogHandler(h))
+}
+
+// Write は設定を設定ファイルと同じ JSON 形式で書き出す。
+// 出力はそのまま -config に渡せる。
+func (c Config) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for i, s := range settings {
+		v, _ := json.Marshal(s.field(&c).String())
+		fmt.Fprintf(&buf, "  %q: %s", s.key, v)
+		if i < len(settings)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("整数で指定してください: %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string {
+	return time.Duration(*v).String()
+}
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("時間の形式が不正です (例: 5s, 1m30s): %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
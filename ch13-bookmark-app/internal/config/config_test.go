@@ -0,0 +1,291 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func load(
+	t *testing.T, args []string, env map[string]string,
+) (Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args, func(k string) string {
+		return env[k]
+	})
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_defaults(t *testing.T) {
+	cfg, err := load(t, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != Default() {
+		t.Errorf("cfg = %+v, want %+v", cfg, Default())
+	}
+}
+
+func TestLoad_precedence(t *testing.T) {
+	path := writeFile(t, `{
+		"db_path": "file.db",
+		"addr": ":7000",
+		"read_timeout": "1s",
+		"log_level": "warn"
+	}`)
+	env := map[string]string{
+		"BOOKMARK_CONFIG":       path,
+		"BOOKMARK_ADDR":         ":8000",
+		"BOOKMARK_READ_TIMEOUT": "2s",
+		"BOOKMARK_LOG_FORMAT":   "",
+	}
+	cfg, err := load(t, []string{"-read-timeout", "3s"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.DBPath = "file.db"            // 設定ファイル
+	want.Addr = ":8000"                // 環境変数がファイルより優先
+	want.ReadTimeout = 3 * time.Second // フラグが最優先
+	want.LogLevel = "warn"
+	if cfg != want {
+		t.Errorf("cfg = %+v, want %+v", cfg, want)
+	}
+
+	// -config は BOOKMARK_CONFIG より優先する
+	other := writeFile(t, `{"db_path": "other.db"}`)
+	cfg, err = load(t, []string{"-config", other}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBPath != "other.db" {
+		t.Errorf("db_path = %q, want other.db", cfg.DBPath)
+	}
+}
+
+func TestLoad_fileValues(t *testing.T) {
+	// 数値と真偽値は文字列で書いた場合と同じに解釈する
+	path := writeFile(t, `{
+		"link_check_concurrency": 8,
+		"trash_retention_days": 0,
+		"rate_limit_read": 1200,
+		"admin_users": false,
+		"addr": ":9000"
+	}`)
+	cfg, err := load(t, []string{"-config", path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.LinkCheckConcurrency = 8
+	want.TrashRetentionDays = 0
+	want.RateLimitRead = 1200
+	want.AdminUsers = "false"
+	want.Addr = ":9000"
+	if cfg != want {
+		t.Errorf("cfg = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoad_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{
+			name:    "bad duration flag",
+			args:    []string{"-shutdown-timeout", "soon"},
+			wantErr: "shutdown-timeout",
+		},
+		{
+			name:    "bad duration env",
+			env:     map[string]string{"BOOKMARK_IDLE_TIMEOUT": "10"},
+			wantErr: "BOOKMARK_IDLE_TIMEOUT",
+		},
+		{
+			name:    "negative timeout",
+			args:    []string{"-write-timeout", "-1s"},
+			wantErr: "write_timeout",
+		},
+		{
+			name:    "log level",
+			args:    []string{"-log-level", "verbose"},
+			wantErr: "log_level",
+		},
+		{
+			name:    "log format",
+			env:     map[string]string{"BOOKMARK_LOG_FORMAT": "xml"},
+			wantErr: "log_format",
+		},
+		{
+			name:    "bad int",
+			env:     map[string]string{"BOOKMARK_LINK_CHECK_CONCURRENCY": "many"},
+			wantErr: "BOOKMARK_LINK_CHECK_CONCURRENCY",
+		},
+		{
+			name:    "zero concurrency",
+			args:    []string{"-link-check-concurrency", "0"},
+			wantErr: "link_check_concurrency",
+		},
+		{
+			name:    "negative retention",
+			args:    []string{"-trash-retention-days", "-1"},
+			wantErr: "trash_retention_days",
+		},
+		{
+			name:    "negative rate limit",
+			args:    []string{"-rate-limit-read", "-1"},
+			wantErr: "rate_limit_read",
+		},
+		{
+			name:    "zero burst",
+			args:    []string{"-rate-limit-write-burst", "0"},
+			wantErr: "rate_limit_write_burst",
+		},
+		{
+			name:    "bad trusted proxy",
+			env:     map[string]string{"BOOKMARK_TRUSTED_PROXIES": "10.0.0.0/40"},
+			wantErr: "trusted_proxies",
+		},
+		{
+			name:    "metrics on the same addr",
+			args:    []string{"-addr", ":9000", "-metrics-addr", ":9000"},
+			wantErr: "metrics_addr",
+		},
+		{
+			name:    "empty addr",
+			args:    []string{"-addr", ""},
+			wantErr: "addr",
+		},
+		{
+			name:    "unknown key",
+			file:    `{"db": "x.db"}`,
+			wantErr: `不明なキー "db"`,
+		},
+		{
+			name:    "duration without unit",
+			file:    `{"read_timeout": 5}`,
+			wantErr: `read_timeout: 時間の形式が不正です (例: 5s, 1m30s): "5"`,
+		},
+		{
+			name:    "fractional int",
+			file:    `{"link_check_concurrency": 2.5}`,
+			wantErr: `link_check_concurrency: 整数で指定してください: "2.5"`,
+		},
+		{
+			name:    "bool for int",
+			file:    `{"trash_retention_days": true}`,
+			wantErr: `trash_retention_days: 整数で指定してください: "true"`,
+		},
+		{
+			name:    "null",
+			file:    `{"addr": null}`,
+			wantErr: "addr は文字列か数値で指定してください",
+		},
+		{
+			name:    "broken json",
+			file:    `{"addr": `,
+			wantErr: "設定ファイル",
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-port", "80"},
+			wantErr: "port",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, tt.file)}, args...)
+			}
+			_, err := load(t, args, tt.env)
+			if err == nil {
+				t.Fatal("err = nil")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// 複数の誤りはまとめて報告する
+	_, err := load(t, []string{"-log-level", "x", "-log-format", "y"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "log_level") ||
+		!strings.Contains(err.Error(), "log_format") {
+		t.Errorf("err = %v, want both fields", err)
+	}
+
+	if _, err := load(t, []string{"-config", "/nonexistent.json"}, nil); err == nil {
+		t.Error("missing config file: err = nil")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	cfg := Default()
+	cfg.Addr = `:9090`
+	cfg.IdleTimeout = 90 * time.Second
+	var buf bytes.Buffer
+	if err := cfg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 出力はそのまま設定ファイルとして読み込める
+	got, err := load(t, []string{"-config", writeFile(t, buf.String())}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cfg {
+		t.Errorf("got %+v, want %+v", got, cfg)
+	}
+}
+
+func TestAdmins(t *testing.T) {
+	cfg, err := load(t, []string{"-admin-users", " Alice, ,bob "}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cfg.Admins()
+	if len(got) != 2 || got[0] != "alice" || got[1] != "bob" {
+		t.Errorf("Admins() = %q, want [alice bob]", got)
+	}
+	if got := Default().Admins(); got != nil {
+		t.Errorf("default Admins() = %q, want nil", got)
+	}
+}
+
+func TestTrustedProxyPrefixes(t *testing.T) {
+	cfg, err := load(t, []string{"-trusted-proxies", "10.0.0.0/8, 192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cfg.TrustedProxyPrefixes()
+	if len(got) != 2 || got[0].String() != "10.0.0.0/8" ||
+		got[1].String() != "192.0.2.1/32" {
+		t.Errorf("TrustedProxyPrefixes() = %v", got)
+	}
+
+	// 制限しないなら連続数は問わない
+	if _, err := load(t, []string{"-rate-limit-write", "0",
+		"-rate-limit-write-burst", "0"}, nil); err != nil {
+		t.Errorf("disabled limit: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// requireAdmin は WithAdmins で設定したユーザー以外に 403 を返す。
+func (h *Handler) requireAdmin(
+	next http.HandlerFunc,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		if !h.admins[u.Username] {
+			writeProblem(w, r, probForbidden,
+				"管理者のみ利用できます")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bookmarkHistory はブックマークの変更履歴を古い順に返す。
+// ゴミ箱のものや完全に削除したものの履歴も返す。
+func (h *Handler) bookmarkHistory(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	entries, err := h.repo.History(r.Context(), ownerID(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound,
+			"ブックマークの履歴が見つかりません")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// auditOptions はクエリ文字列から監査ログの取得条件を作る。
+// since は RFC 3339 の日時、after は前のページの最後の ID。
+// 不正なパラメータは v に加える。
+func auditOptions(
+	r *http.Request, v *validation,
+) repository.AuditOptions {
+	q := r.URL.Query()
+	opts := repository.AuditOptions{
+		Limit: parseLimit(v, q.Get("limit")),
+	}
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			v.add("since", "since は RFC 3339 の日時で指定してください")
+		}
+		opts.Since = t
+	}
+	if s := q.Get("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			v.add("after", "after は0以上の整数で指定してください")
+		}
+		opts.After = n
+	}
+	return opts
+}
+
+// auditLog はすべてのユーザーの監査ログを古い順に
+// 1ページ分返す。続きがある場合は、次のページの URL を
+// Link ヘッダ (rel="next") で知らせる。
+func (h *Handler) auditLog(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var v validation
+	opts := auditOptions(r, &v)
+	if v.write(w, r) {
+		return
+	}
+	limit := opts.Limit
+	// 1件多く読み、次のページがあるかを判定する
+	opts.Limit++
+	entries, err := h.repo.AuditLog(r.Context(), opts)
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		w.Header().Set("Link", nextLink(r,
+			strconv.FormatInt(entries[limit-1].ID, 10)))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,489 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/auth"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// SessionCookie はセッションのトークンを入れる Cookie の名前。
+const SessionCookie = "session"
+
+// DefaultSessionTTL はログインしてからセッションが切れるまでの既定の時間。
+const DefaultSessionTTL = 14 * 24 * time.Hour
+
+// パスワードの長さの制限。上限はハッシュ化にかかる
+// 時間を抑えるためのもの。
+const (
+	minPasswordLength = 8
+	maxPasswordBytes  = 1024
+)
+
+// usernamePattern はユーザー名に使える文字。
+// 大文字は小文字にそろえてから確認する。
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_.-]{3,32}$`)
+
+// AuthHandler はユーザー登録とログインを処理する。
+type AuthHandler struct {
+	users        repository.UserStore
+	sessionTTL   time.Duration
+	queryTimeout time.Duration
+	limiter      *RateLimiter
+	// reserved は登録を受け付けないユーザー名。
+	reserved map[string]bool
+}
+
+// AuthOption は AuthHandler の設定を変更する。
+type AuthOption func(*AuthHandler)
+
+// WithSessionTTL はセッションの有効期間を設定する。
+func WithSessionTTL(d time.Duration) AuthOption {
+	return func(a *AuthHandler) {
+		a.sessionTTL = d
+	}
+}
+
+// WithAuthQueryTimeout はリクエストごとの
+// データベース操作の制限時間を設定する。
+func WithAuthQueryTimeout(d time.Duration) AuthOption {
+	return func(a *AuthHandler) {
+		a.queryTimeout = d
+	}
+}
+
+// WithRateLimit は Authenticate で呼び出し元ごとの
+// リクエスト数を制限する。
+func WithRateLimit(l *RateLimiter) AuthOption {
+	return func(a *AuthHandler) {
+		a.limiter = l
+	}
+}
+
+// WithReservedNames は names での新規登録を拒否する。
+// 管理者の権限はユーザー名で与えるため、WithAdmins と同じ名前を
+// 渡し、まだ登録されていない管理者の名前をほかの人が
+// 先に登録して権限を得られないようにする。
+func WithReservedNames(names ...string) AuthOption {
+	return func(a *AuthHandler) {
+		for _, name := range names {
+			a.reserved[name] = true
+		}
+	}
+}
+
+// NewAuth は AuthHandler を生成する。
+func NewAuth(
+	users repository.UserStore,
+	opts ...AuthOption,
+) *AuthHandler {
+	a := &AuthHandler{
+		users:        users,
+		sessionTTL:   DefaultSessionTTL,
+		queryTimeout: DefaultQueryTimeout,
+		reserved:     map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Routes はエンドポイントを mux に登録する。
+func (a *AuthHandler) Routes(mux *http.ServeMux) {
+	for _, rt := range a.routes() {
+		mux.HandleFunc(rt.pattern,
+			withTimeout(a.queryTimeout, rt.handler))
+	}
+}
+
+// routes は Routes で登録するエンドポイントの一覧。
+func (a *AuthHandler) routes() []route {
+	return []route{
+		{"POST /auth/register", a.register},
+		{"POST /auth/login", a.login},
+		{"POST /auth/logout", a.logout},
+		{"POST /auth/tokens", requireUser(a.createToken)},
+		{"GET /auth/tokens", requireUser(a.listTokens)},
+		{"DELETE /auth/tokens/{id}", requireUser(a.revokeToken)},
+	}
+}
+
+type identityKey struct{}
+
+// identity は認証済みの呼び出し元。
+type identity struct {
+	user model.User
+	// token は API トークンで認証した場合のトークン。
+	// セッションでログインした場合は nil で、
+	// すべての操作ができる。
+	token *model.APIToken
+}
+
+func (id identity) hasScope(scope string) bool {
+	return id.token == nil ||
+		slices.Contains(id.token.Scopes, scope)
+}
+
+// UserFromContext はログイン中のユーザーを返す。
+// Authenticate を通ったリクエストの ctx で使う。
+func UserFromContext(ctx context.Context) (model.User, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id.user, ok
+}
+
+// withIdentity は呼び出し元を ctx に設定する。
+// ストアが監査ログに記録できるよう、変更を行う
+// ユーザーとしても設定する。
+func withIdentity(
+	ctx context.Context, id identity,
+) context.Context {
+	ctx = repository.WithActor(ctx, id.user.ID)
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func withUser(
+	ctx context.Context, u model.User,
+) context.Context {
+	return withIdentity(ctx, identity{user: u})
+}
+
+// ownerID はログイン中のユーザーの ID を返す。
+// requireUser を通ったハンドラでだけ使う。
+func ownerID(r *http.Request) int64 {
+	u, _ := UserFromContext(r.Context())
+	return u.ID
+}
+
+// access はエンドポイントに必要な認証の種類。
+type access int
+
+const (
+	accessPublic  access = iota // 認証不要
+	accessSession               // パスワードでのログインが必要
+	accessRead                  // bookmarks:read が必要
+	accessWrite                 // bookmarks:write が必要
+)
+
+// publicPaths は認証なしで使えるパス。ドキュメントと、
+// 監視のために cmd/server が登録するエンドポイント。
+// /metrics は内部の情報を含むため、ここには含めず
+// cmd/server が別のアドレスで公開する。
+var publicPaths = []string{
+	"/openapi.json", "/docs", "/healthz", "/readyz",
+}
+
+// accessFor は mux のパターンから必要な認証を決める。
+// エンドポイントを追加しても設定漏れが起きないよう、
+// /auth/ と publicPaths 以外はメソッドで読み取りか書き込みかを判定する。
+// トークンの管理は、トークンで権限を広げられないよう
+// セッションでのログインに限る。
+func accessFor(pattern string) access {
+	method, path, _ := strings.Cut(pattern, " ")
+	switch {
+	case path == "/auth/tokens",
+		strings.HasPrefix(path, "/auth/tokens/"):
+		return accessSession
+	case strings.HasPrefix(path, "/auth/"),
+		slices.Contains(publicPaths, path):
+		return accessPublic
+	case method == http.MethodGet,
+		method == http.MethodHead:
+		return accessRead
+	default:
+		return accessWrite
+	}
+}
+
+// Authenticate はリクエストの呼び出し元を特定して ctx に設定し、
+// mux のエンドポイントごとに必要な認証を確認する。
+//
+// Authorization: Bearer の API トークンか、セッションの
+// Cookie で認証する。トークンが無効なら 401、スコープが
+// 足りなければ 403 を返す。WithRateLimit を指定した場合は、
+// 呼び出し元を特定したあとでリクエスト数を確認する。
+// 一致するエンドポイントがないリクエストは、mux が 404 や
+// 405 を返せるようそのまま渡す。
+func (a *AuthHandler) Authenticate(
+	mux *http.ServeMux,
+) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		id, ok := a.identify(w, r)
+		if !ok {
+			return
+		}
+		if id != nil {
+			r = r.WithContext(withIdentity(r.Context(), *id))
+		}
+		if a.limiter != nil && !a.limiter.allow(w, r, id) {
+			return
+		}
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		need := accessFor(pattern)
+		switch {
+		case need == accessPublic:
+		case id == nil:
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="bookmarks"`)
+			writeProblem(w, r, probUnauthorized, "")
+			return
+		case need == accessSession && id.token != nil:
+			writeProblem(w, r, probSessionRequired,
+				"トークンの管理にはパスワードでのログインが必要です")
+			return
+		case need == accessRead &&
+			!id.hasScope(model.ScopeBookmarksRead):
+			writeInsufficientScope(w, r, model.ScopeBookmarksRead)
+			return
+		case need == accessWrite &&
+			!id.hasScope(model.ScopeBookmarksWrite):
+			writeInsufficientScope(w, r, model.ScopeBookmarksWrite)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// identify は API トークンかセッションの Cookie から
+// 呼び出し元を特定する。どちらもなければ nil を返す。
+// 応答を書いた場合は false を返す。
+func (a *AuthHandler) identify(
+	w http.ResponseWriter, r *http.Request,
+) (*identity, bool) {
+	ctx, cancel := context.WithTimeout(
+		r.Context(), a.queryTimeout)
+	defer cancel()
+
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, _ := strings.Cut(h, " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			if !a.allowFailure(w, r) {
+				return nil, false
+			}
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="bookmarks", error="invalid_request"`)
+			writeProblem(w, r, probInvalidToken,
+				"Authorization ヘッダーは Bearer トークンで指定してください")
+			return nil, false
+		}
+		u, t, err := a.users.TokenUser(ctx,
+			auth.HashToken(strings.TrimSpace(token)))
+		if errors.Is(err, sql.ErrNoRows) {
+			if !a.allowFailure(w, r) {
+				return nil, false
+			}
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="bookmarks", error="invalid_token"`)
+			writeProblem(w, r, probInvalidToken,
+				"トークンが無効か期限切れです")
+			return nil, false
+		}
+		if err != nil {
+			writeStoreError(w, r.WithContext(ctx), err,
+				"認証に失敗しました")
+			return nil, false
+		}
+		return &identity{user: u, token: &t}, true
+	}
+
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, true
+	}
+	u, err := a.users.SessionUser(
+		ctx, auth.HashToken(c.Value))
+	if errors.Is(err, sql.ErrNoRows) {
+		// 期限切れの Cookie は未ログインとして扱う
+		return nil, true
+	}
+	if err != nil {
+		writeStoreError(w, r.WithContext(ctx), err,
+			"認証に失敗しました")
+		return nil, false
+	}
+	return &identity{user: u}, true
+}
+
+// allowFailure は認証の失敗をクライアントの IP アドレスの分として数える。
+// 上限を超えていれば 429 を返して false を返す。
+func (a *AuthHandler) allowFailure(
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	return a.limiter == nil || a.limiter.allowFailure(w, r)
+}
+
+// writeInsufficientScope はスコープ不足の 403 を返す。
+// WWW-Authenticate の形式は RFC 6750 に従う。
+func writeInsufficientScope(
+	w http.ResponseWriter, r *http.Request, scope string,
+) {
+	w.Header().Set("WWW-Authenticate",
+		`Bearer realm="bookmarks", error="insufficient_scope", scope="`+
+			scope+`"`)
+	writeProblem(w, r, probInsufficientScope,
+		"このトークンには "+scope+" の権限がありません")
+}
+
+// requireUser は未ログインのリクエストに 401 を返す。
+// Authenticate で確認済みのはずだが、ミドルウェアを
+// 通さずに登録された場合でもほかのユーザーとして
+// 扱わないよう、各エンドポイントでも確認する。
+func requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserFromContext(r.Context()); !ok {
+			writeProblem(w, r, probUnauthorized, "")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// decodeCredentials はユーザー名を小文字にそろえて返す。
+func decodeCredentials(
+	w http.ResponseWriter, r *http.Request,
+) (model.Credentials, bool) {
+	var c model.Credentials
+	if err := json.NewDecoder(r.Body).
+		Decode(&c); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return c, false
+	}
+	c.Username = strings.ToLower(
+		strings.TrimSpace(c.Username))
+	return c, true
+}
+
+func (a *AuthHandler) register(
+	w http.ResponseWriter, r *http.Request,
+) {
+	c, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+	var v validation
+	if !usernamePattern.MatchString(c.Username) {
+		v.add("username",
+			"username は英小文字・数字・_.- の3〜32文字で指定してください")
+	}
+	if utf8.RuneCountInString(c.Password) < minPasswordLength ||
+		len(c.Password) > maxPasswordBytes {
+		v.add("password", "password は8文字以上で指定してください")
+	}
+	if v.write(w, r) {
+		return
+	}
+	// 予約した名前は、既に登録済みの場合と同じ応答にする
+	if a.reserved[c.Username] {
+		writeProblem(w, r, probUsernameTaken, "")
+		return
+	}
+	hash, err := auth.HashPassword(c.Password)
+	if err != nil {
+		writeProblem(w, r, probInternal, "登録に失敗しました")
+		return
+	}
+	u, err := a.users.Create(r.Context(), c.Username, hash)
+	if errors.Is(err, repository.ErrUserExists) {
+		writeProblem(w, r, probUsernameTaken, "")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"登録に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// login はパスワードを確認してセッションを発行し、
+// トークンを HttpOnly の Cookie で返す。
+// SameSite=Lax のため、ほかのサイトからの POST には
+// Cookie が送られない。
+func (a *AuthHandler) login(
+	w http.ResponseWriter, r *http.Request,
+) {
+	c, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+	if len(c.Password) > maxPasswordBytes {
+		writeProblem(w, r, probInvalidCredentials, "")
+		return
+	}
+	u, err := a.users.FindByName(r.Context(), c.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		auth.CheckDummy(c.Password)
+		writeProblem(w, r, probInvalidCredentials, "")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"ログインに失敗しました")
+		return
+	}
+	if !auth.CheckPassword(u.PasswordHash, c.Password) {
+		writeProblem(w, r, probInvalidCredentials, "")
+		return
+	}
+
+	token := auth.NewToken()
+	expires := time.Now().Add(a.sessionTTL)
+	if err := a.users.CreateSession(r.Context(), u.ID,
+		auth.HashToken(token), expires); err != nil {
+		writeStoreError(w, r, err,
+			"ログインに失敗しました")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(a.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	writeJSON(w, http.StatusOK, u)
+}
+
+// logout はセッションを削除して Cookie を消す。
+// ログインしていなくても成功として扱う。
+func (a *AuthHandler) logout(
+	w http.ResponseWriter, r *http.Request,
+) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		if err := a.users.DeleteSession(r.Context(),
+			auth.HashToken(c.Value)); err != nil {
+			writeStoreError(w, r, err,
+				"ログアウトに失敗しました")
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
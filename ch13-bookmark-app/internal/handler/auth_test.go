@@ -0,0 +1,398 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/auth"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// setupAuthServer はログインを含めた全体を組み立てる。
+func setupAuthServer(t *testing.T) http.Handler {
+	t.Helper()
+	a := NewAuth(repository.NewMemoryUsers())
+	mux := http.NewServeMux()
+	a.Routes(mux)
+	New(repository.NewMemory()).Routes(mux)
+	return a.Authenticate(mux)
+}
+
+func doJSON(
+	t *testing.T, srv http.Handler,
+	method, path, body string, cookie *http.Cookie,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path,
+		strings.NewReader(body))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+// login はユーザーを登録してログインし、セッションの Cookie を返す。
+func login(
+	t *testing.T, srv http.Handler, name string,
+) *http.Cookie {
+	t.Helper()
+	body := `{"username":"` + name + `","password":"password1"}`
+	if rec := doJSON(t, srv, "POST", "/auth/register", body, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d: %s", rec.Code, rec.Body)
+	}
+	rec := doJSON(t, srv, "POST", "/auth/login", body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status = %d: %s", rec.Code, rec.Body)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == SessionCookie {
+			if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+				t.Errorf("cookie = %+v", c)
+			}
+			return c
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	srv := setupAuthServer(t)
+
+	// 未ログインでは 401
+	rec := doJSON(t, srv, "GET", "/bookmarks", "", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: status = %d, want %d",
+			rec.Code, http.StatusUnauthorized)
+	}
+	var res model.Problem
+	json.NewDecoder(rec.Body).Decode(&res)
+	if res.Code != "unauthorized" || res.Status != http.StatusUnauthorized {
+		t.Errorf("anonymous: problem = %+v", res)
+	}
+
+	alice := login(t, srv, "Alice")
+	bob := login(t, srv, "bob")
+
+	rec = doJSON(t, srv, "POST", "/bookmarks",
+		`{"url":"https://go.dev","title":"Go","tags":["go"]}`, alice)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d", rec.Code)
+	}
+	var bm model.Bookmark
+	json.NewDecoder(rec.Body).Decode(&bm)
+	path := "/bookmarks/" + strconv.FormatInt(bm.ID, 10)
+
+	if rec := doJSON(t, srv, "GET", path, "", alice); rec.Code != http.StatusOK {
+		t.Errorf("owner get: status = %d", rec.Code)
+	}
+	// ほかのユーザーのブックマークは存在しないものとして扱う
+	for _, tt := range []struct{ method, path, body string }{
+		{"GET", path, ""},
+		{"PUT", path, `{"url":"https://x.test","title":"X"}`},
+		{"DELETE", path, ""},
+	} {
+		rec := doJSON(t, srv, tt.method, tt.path, tt.body, bob)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s by other user: status = %d, want %d",
+				tt.method, rec.Code, http.StatusNotFound)
+		}
+	}
+	rec = doJSON(t, srv, "GET", "/bookmarks", "", bob)
+	if strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("other user list = %s", rec.Body)
+	}
+	rec = doJSON(t, srv, "GET", "/tags", "", bob)
+	if strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("other user tags = %s", rec.Body)
+	}
+	// 同じ URL でもユーザーが違えば登録できる
+	rec = doJSON(t, srv, "POST", "/bookmarks",
+		`{"url":"https://go.dev","title":"Go"}`, bob)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("same url by other user: status = %d", rec.Code)
+	}
+
+	// ログアウト後はセッションが使えない
+	rec = doJSON(t, srv, "POST", "/auth/logout", "", alice)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("logout: status = %d", rec.Code)
+	}
+	if rec := doJSON(t, srv, "GET", path, "", alice); rec.Code != http.StatusUnauthorized {
+		t.Errorf("after logout: status = %d, want %d",
+			rec.Code, http.StatusUnauthorized)
+	}
+}
+
+// 管理者として設定した名前のうち、まだ登録されていないものを
+// ほかの人が登録して監査ログを読めないことを確認する。
+func TestAuth_reservedAdminNames(t *testing.T) {
+	users := repository.NewMemoryUsers()
+	hash, err := auth.HashPassword("password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root は設定する前から登録済みの管理者
+	if _, err := users.Create(t.Context(), "root", hash); err != nil {
+		t.Fatal(err)
+	}
+	admins := []string{"root", "boss"}
+	a := NewAuth(users, WithReservedNames(admins...))
+	mux := http.NewServeMux()
+	a.Routes(mux)
+	New(repository.NewMemory(), WithAdmins(admins...)).Routes(mux)
+	srv := a.Authenticate(mux)
+
+	for _, name := range []string{"boss", "BOSS", "root"} {
+		body := `{"username":"` + name + `","password":"password2"}`
+		rec := doJSON(t, srv, "POST", "/auth/register", body, nil)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("register %s: status = %d, want 409", name, rec.Code)
+		}
+	}
+	body := `{"username":"boss","password":"password2"}`
+	if rec := doJSON(t, srv, "POST", "/auth/login", body, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("login as unregistered admin: status = %d, want 401", rec.Code)
+	}
+	mallory := login(t, srv, "mallory")
+	if rec := doJSON(t, srv, "GET", "/audit", "", mallory); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want 403", rec.Code)
+	}
+
+	rec := doJSON(t, srv, "POST", "/auth/login",
+		`{"username":"root","password":"password1"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("root login: status = %d", rec.Code)
+	}
+	root := rec.Result().Cookies()[0]
+	if rec := doJSON(t, srv, "GET", "/audit", "", root); rec.Code != http.StatusOK {
+		t.Errorf("registered admin: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestAuth_validation(t *testing.T) {
+	srv := setupAuthServer(t)
+	login(t, srv, "alice")
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"short name", "/auth/register",
+			`{"username":"ab","password":"password1"}`, http.StatusBadRequest},
+		{"bad name", "/auth/register",
+			`{"username":"a b c","password":"password1"}`, http.StatusBadRequest},
+		{"short password", "/auth/register",
+			`{"username":"carol","password":"short"}`, http.StatusBadRequest},
+		{"taken name", "/auth/register",
+			`{"username":"ALICE","password":"password1"}`, http.StatusConflict},
+		{"invalid json", "/auth/register", `{`, http.StatusBadRequest},
+		{"wrong password", "/auth/login",
+			`{"username":"alice","password":"password2"}`, http.StatusUnauthorized},
+		{"unknown user", "/auth/login",
+			`{"username":"nobody","password":"password1"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(t, srv, "POST", tt.path, tt.body, nil)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s",
+					rec.Code, tt.want, rec.Body)
+			}
+			if len(rec.Result().Cookies()) != 0 {
+				t.Error("cookie set on failure")
+			}
+		})
+	}
+
+	// 不正なトークンは未ログインとして扱う
+	rec := doJSON(t, srv, "GET", "/bookmarks", "",
+		&http.Cookie{Name: SessionCookie, Value: "forged"})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("forged cookie: status = %d, want %d",
+			rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func doBearer(
+	t *testing.T, srv http.Handler,
+	method, path, body, token string,
+) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path,
+		strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func createToken(
+	t *testing.T, srv http.Handler,
+	session *http.Cookie, body string,
+) model.CreatedToken {
+	t.Helper()
+	rec := doJSON(t, srv, "POST", "/auth/tokens", body, session)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create token: status = %d: %s", rec.Code, rec.Body)
+	}
+	var ct model.CreatedToken
+	json.NewDecoder(rec.Body).Decode(&ct)
+	return ct
+}
+
+func TestAPITokens(t *testing.T) {
+	srv := setupAuthServer(t)
+	alice := login(t, srv, "alice")
+
+	read := createToken(t, srv, alice,
+		`{"name":"reader","scopes":["bookmarks:read"]}`)
+	if !strings.HasPrefix(read.Token, tokenPrefix) {
+		t.Errorf("token = %q", read.Token)
+	}
+	rw := createToken(t, srv, alice,
+		`{"name":"ci","scopes":["bookmarks:write","bookmarks:read","bookmarks:write"]}`)
+	if want := []string{"bookmarks:read", "bookmarks:write"}; !slices.Equal(rw.Scopes, want) {
+		t.Errorf("scopes = %v, want %v", rw.Scopes, want)
+	}
+
+	// 書き込みのスコープがあれば登録できる
+	rec := doBearer(t, srv, "POST", "/bookmarks",
+		`{"url":"https://go.dev","title":"Go"}`, rw.Token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with rw token: status = %d", rec.Code)
+	}
+	// 読み取り専用のトークンでは 403
+	rec = doBearer(t, srv, "POST", "/bookmarks",
+		`{"url":"https://pkg.go.dev","title":"Pkg"}`, read.Token)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("create with read token: status = %d, want %d",
+			rec.Code, http.StatusForbidden)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, "insufficient_scope") {
+		t.Errorf("WWW-Authenticate = %q", got)
+	}
+	var res model.Problem
+	json.NewDecoder(rec.Body).Decode(&res)
+	if res.Code != "insufficient_scope" ||
+		!strings.Contains(res.Detail, "bookmarks:write") {
+		t.Errorf("problem = %+v", res)
+	}
+	for _, path := range []string{"/bookmarks", "/tags", "/bookmarks/export.html"} {
+		if rec := doBearer(t, srv, "GET", path, "", read.Token); rec.Code != http.StatusOK {
+			t.Errorf("GET %s with read token: status = %d", path, rec.Code)
+		}
+	}
+
+	// 無効なトークンや形式の誤りは 401
+	for _, h := range []string{"Bearer bm_unknown", "Basic YWxpY2U6cHc=", "Bearer"} {
+		req := httptest.NewRequest("GET", "/bookmarks", nil)
+		req.Header.Set("Authorization", h)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%q: status = %d, want %d", h, rec.Code, http.StatusUnauthorized)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: no WWW-Authenticate", h)
+		}
+	}
+
+	// トークンでトークンは管理できない
+	rec = doBearer(t, srv, "POST", "/auth/tokens",
+		`{"name":"escalate","scopes":["bookmarks:write"]}`, read.Token)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("create token with token: status = %d, want %d",
+			rec.Code, http.StatusForbidden)
+	}
+
+	// 一覧にはトークンの文字列を含めず、最終使用日時を含める
+	rec = doJSON(t, srv, "GET", "/auth/tokens", "", alice)
+	if strings.Contains(rec.Body.String(), read.Token) {
+		t.Error("token list leaks the token")
+	}
+	var tokens []model.APIToken
+	json.NewDecoder(rec.Body).Decode(&tokens)
+	if len(tokens) != 2 || tokens[0].LastUsedAt == nil {
+		t.Errorf("tokens = %+v", tokens)
+	}
+
+	// 失効後は使えない。ほかのユーザーからは 404
+	bob := login(t, srv, "bob")
+	path := "/auth/tokens/" + strconv.FormatInt(read.ID, 10)
+	if rec := doJSON(t, srv, "DELETE", path, "", bob); rec.Code != http.StatusNotFound {
+		t.Errorf("revoke by other user: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doJSON(t, srv, "DELETE", path, "", alice); rec.Code != http.StatusNoContent {
+		t.Errorf("revoke: status = %d", rec.Code)
+	}
+	if rec := doBearer(t, srv, "GET", "/bookmarks", "", read.Token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPITokens_validation(t *testing.T) {
+	srv := setupAuthServer(t)
+	alice := login(t, srv, "alice")
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	for _, body := range []string{
+		`{"name":"","scopes":["bookmarks:read"]}`,
+		`{"name":"x","scopes":[]}`,
+		`{"name":"x","scopes":["admin"]}`,
+		`{"name":"x","scopes":["bookmarks:read"],"expires_at":"` + past + `"}`,
+		`{`,
+	} {
+		rec := doJSON(t, srv, "POST", "/auth/tokens", body, alice)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := doJSON(t, srv, "GET", "/auth/tokens", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous list: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	ct := createToken(t, srv, alice, `{"name":"x","scopes":["bookmarks:read"],"expires_at":"`+
+		future.Format(time.RFC3339)+`"}`)
+	if ct.ExpiresAt == nil || !ct.ExpiresAt.Equal(future) {
+		t.Errorf("expires_at = %v, want %v", ct.ExpiresAt, future)
+	}
+}
+
+func TestAccessFor(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    access
+	}{
+		{"POST /auth/login", accessPublic},
+		{"POST /auth/register", accessPublic},
+		{"GET /openapi.json", accessPublic},
+		{"GET /docs", accessPublic},
+		{"GET /metrics", accessRead},
+		{"GET /readyz", accessPublic},
+		{"GET /auth/tokens", accessSession},
+		{"DELETE /auth/tokens/{id}", accessSession},
+		{"GET /bookmarks/{id}", accessRead},
+		{"GET /bookmarks/export.html", accessRead},
+		{"POST /bookmarks/import", accessWrite},
+		{"PATCH /bookmarks/{id}", accessWrite},
+		{"POST /tags/{name}/merge", accessWrite},
+	}
+	for _, tt := range tests {
+		if got := accessFor(tt.pattern); got != tt.want {
+			t.Errorf("accessFor(%q) = %d, want %d", tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// 一括操作の1リクエストあたりの操作数と本文の上限。
+const (
+	maxBatchOps   = 1000
+	maxBatchBytes = 2 << 20
+)
+
+// probRolledBack は atomic な一括操作で、ほかの操作が
+// 失敗したために取り消した操作の結果。
+var probRolledBack = problemKind{"rolled_back",
+	http.StatusFailedDependency, "ほかの操作が失敗したため取り消しました"}
+
+// probNotExecuted は atomic でない一括操作が、前の操作での
+// ストアの障害により中断したために実行しなかった操作の結果。
+var probNotExecuted = problemKind{"not_executed",
+	http.StatusFailedDependency, "前の操作で障害が起きたため実行しませんでした"}
+
+// batchBookmarks は登録・更新・削除をまとめて実行し、
+// 各操作の結果をリクエストと同じ順で返す。
+//
+// atomic なら1件でも失敗するとすべてを取り消し、
+// 失敗した操作のステータスで応答する。ほかの操作は
+// 424 (Failed Dependency) になる。atomic でなければ
+// 失敗したものを飛ばして残りを実行し、200 で応答する。
+// ストアの障害では途中で中断し、atomic でなければ
+// それまでの結果を返す。
+//
+// title を省略した登録ではページを取得せず、URL を仮の
+// タイトルにしてバックグラウンドで取得する。
+func (h *Handler) batchBookmarks(
+	w http.ResponseWriter, r *http.Request,
+) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	var req model.BatchRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(w, r, probTooLarge, "")
+			return
+		}
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	if len(req.Operations) == 0 ||
+		len(req.Operations) > maxBatchOps {
+		writeFieldError(w, r, "operations",
+			"operations は1〜"+strconv.Itoa(maxBatchOps)+
+				"件で指定してください")
+		return
+	}
+
+	resp := model.BatchResponse{
+		Atomic:  req.Atomic,
+		Results: make([]model.BatchResult, len(req.Operations)),
+	}
+	// 検証を通った操作だけをストアに渡す。
+	// index はストアに渡した操作の、リクエスト中の位置
+	var ops []repository.BatchOp
+	var index []int
+	invalid := -1
+	for i, o := range req.Operations {
+		resp.Results[i] = model.BatchResult{Op: o.Op, ID: o.ID}
+		var v validation
+		op := batchOp(&v, o)
+		if len(v) > 0 {
+			p := probValidation.problem(r, "")
+			p.Errors = v
+			resp.Results[i].Status = p.Status
+			resp.Results[i].Error = &p
+			if invalid < 0 {
+				invalid = i
+			}
+			continue
+		}
+		ops = append(ops, op)
+		index = append(index, i)
+	}
+	if req.Atomic && invalid >= 0 {
+		writeBatchAborted(w, r, resp, invalid)
+		return
+	}
+
+	if !req.Atomic {
+		h.runBatch(r, &resp, ops, index)
+		for _, res := range resp.Results {
+			if res.Error == nil {
+				resp.Succeeded++
+			} else {
+				resp.Failed++
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	// 1つのトランザクションで実行するため、
+	// 操作数分の制限時間をまとめて設ける
+	ctx, cancel := context.WithTimeout(r.Context(),
+		h.queryTimeout*time.Duration(len(ops)))
+	defer cancel()
+	r = r.WithContext(ctx)
+	results, err := h.repo.Batch(ctx, ownerID(r), ops, true)
+	var batchErr *repository.BatchError
+	if errors.As(err, &batchErr) {
+		i := index[batchErr.Index]
+		setBatchResult(r, &resp.Results[i], model.Bookmark{},
+			batchErr.Err)
+		writeBatchAborted(w, r, resp, i)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"一括操作に失敗しました")
+		return
+	}
+	for j, res := range results {
+		setBatchResult(r, &resp.Results[index[j]],
+			res.Bookmark, res.Err)
+	}
+	resp.Succeeded = len(resp.Results)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// runBatch は atomic でない一括操作を1件ずつ実行し、
+// 結果を resp に設定する。index は ops の各操作の
+// リクエスト中の位置。
+//
+// 件数が多くても途中で制限時間切れにならないよう、
+// 制限時間は1件ごとに設ける。ストアの障害で中断した
+// 場合は、その操作を障害の内容で、実行しなかった残りを
+// probNotExecuted で失敗にする。それまでの操作は確定済み。
+func (h *Handler) runBatch(
+	r *http.Request, resp *model.BatchResponse,
+	ops []repository.BatchOp, index []int,
+) {
+	for j := range ops {
+		ctx, cancel := context.WithTimeout(
+			r.Context(), h.queryTimeout)
+		results, err := h.repo.Batch(
+			ctx, ownerID(r), ops[j:j+1], false)
+		var kind problemKind
+		if err != nil {
+			kind = storeErrorKind(ctx, err)
+		}
+		cancel()
+		if err == nil {
+			setBatchResult(r, &resp.Results[index[j]],
+				results[0].Bookmark, results[0].Err)
+			continue
+		}
+
+		var p model.Problem
+		if kind == probInternal {
+			const message = "一括操作に失敗しました"
+			slog.ErrorContext(r.Context(), message,
+				"error", err)
+			p = kind.problem(r, message)
+		} else {
+			p = kind.problem(r, "")
+		}
+		resp.Results[index[j]].Status = p.Status
+		resp.Results[index[j]].Error = &p
+		for _, i := range index[j+1:] {
+			p := probNotExecuted.problem(r, "")
+			resp.Results[i].Status = p.Status
+			resp.Results[i].Error = &p
+		}
+		return
+	}
+}
+
+// batchOp は操作を検証してストアの形にする。
+// 不正なフィールドは v に加える。
+func batchOp(
+	v *validation, o model.BatchOperation,
+) repository.BatchOp {
+	op := repository.BatchOp{Op: o.Op, ID: o.ID}
+	switch o.Op {
+	case model.BatchCreate:
+		checkURL(v, o.URL)
+		op.Create = model.CreateBookmarkRequest{
+			URL: o.URL, Title: o.Title,
+			Tags:     checkTags(v, o.Tags),
+			FolderID: o.FolderID,
+		}
+		if o.Title == "" {
+			op.Create.Title = o.URL
+			op.Create.MetadataPending = true
+		}
+	case model.BatchUpdate:
+		checkBatchID(v, o.ID)
+		checkURL(v, o.URL)
+		if o.Title == "" {
+			v.add("title", "title は必須です")
+		}
+		op.Update = model.UpdateBookmarkRequest{
+			URL: o.URL, Title: o.Title,
+			Tags: checkTags(v, o.Tags),
+		}
+	case model.BatchDelete:
+		checkBatchID(v, o.ID)
+	default:
+		v.add("op", "op は create, update, delete のいずれかです")
+	}
+	return op
+}
+
+func checkBatchID(v *validation, id int64) {
+	if id <= 0 {
+		v.add("id", "id は必須です")
+	}
+}
+
+// setBatchResult はストアでの結果を res に設定する。
+// エラーは単独のエンドポイントと同じものにする。
+func setBatchResult(
+	r *http.Request, res *model.BatchResult,
+	bm model.Bookmark, err error,
+) {
+	var dup *repository.DuplicateError
+	var p model.Problem
+	switch {
+	case errors.As(err, &dup):
+		p = probDuplicate.problem(r, "")
+		p.ExistingID = dup.ID
+	case errors.Is(err, sql.ErrNoRows):
+		p = probNotFound.problem(r, bookmarkNotFoundMessage)
+	case errors.Is(err, repository.ErrFolderNotFound):
+		p = probValidation.problem(r, "")
+		p.Errors = []model.FieldError{
+			{Field: "folder_id", Reason: folderMissingMessage},
+		}
+	case res.Op == model.BatchCreate:
+		res.Status = http.StatusCreated
+		res.ID = bm.ID
+		res.Bookmark = &bm
+	case res.Op == model.BatchUpdate:
+		res.Status = http.StatusOK
+		res.Bookmark = &bm
+	default:
+		res.Status = http.StatusNoContent
+	}
+	if err != nil {
+		res.Status = p.Status
+		res.Error = &p
+	}
+}
+
+// writeBatchAborted は atomic な一括操作が failed 番目で
+// 失敗したことを、その操作のステータスで返す。
+// ほかに失敗した操作があれば、その理由も残す。
+func writeBatchAborted(
+	w http.ResponseWriter, r *http.Request,
+	resp model.BatchResponse, failed int,
+) {
+	for i := range resp.Results {
+		if resp.Results[i].Status == 0 {
+			p := probRolledBack.problem(r, "")
+			resp.Results[i].Status = p.Status
+			resp.Results[i].Error = &p
+		}
+	}
+	resp.Failed = len(resp.Results)
+	writeJSON(w, resp.Results[failed].Status, resp)
+}
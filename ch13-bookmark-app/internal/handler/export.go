@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/netscape"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// exportPageRows は書き出しで1回のクエリで読む件数。
+// 1ページずつ読み切ってから書き出し、クライアントへ送り出す。
+const exportPageRows = 256
+
+// exportPageWriteTimeout は書き出しで1ページ分を書き込む制限時間。
+// サーバーの WriteTimeout はリクエスト全体にかかり、件数が多いと
+// 途中で切れるため、ページごとに設け直す。
+const exportPageWriteTimeout = 30 * time.Second
+
+// exportWriter は1つの形式での書き出し。
+// Close で末尾を書き込み、バッファを吐き出す。
+type exportWriter interface {
+	Write(b model.Bookmark) error
+	Flush() error
+	Close() error
+}
+
+// exportFormat は書き出しの形式。
+type exportFormat struct {
+	// name は format パラメータの値で、ファイルの拡張子にも使う。
+	name        string
+	contentType string
+	// mediaTypes は Accept ヘッダでこの形式を選ぶメディアタイプ。
+	mediaTypes []string
+	newWriter  func(w io.Writer) exportWriter
+}
+
+// htmlExportFormat は GET /bookmarks/export.html の形式。
+var htmlExportFormat = exportFormat{"html", "text/html; charset=utf-8",
+	[]string{"text/html"}, newHTMLExport}
+
+// exportFormats は対応する形式。Accept が */* か省略された
+// 場合は先頭の形式にする。
+var exportFormats = []exportFormat{
+	{"csv", "text/csv; charset=utf-8",
+		[]string{"text/csv"}, newCSVExport},
+	{"jsonl", "application/x-ndjson",
+		[]string{"application/jsonl", "application/x-ndjson",
+			"application/x-jsonlines"}, newJSONLExport},
+	{"md", "text/markdown; charset=utf-8",
+		[]string{"text/markdown"}, newMarkdownExport},
+	htmlExportFormat,
+}
+
+// negotiateExport は format パラメータか Accept ヘッダから
+// 書き出しの形式を選ぶ。format を優先し、Accept では
+// q 値の大きいもの、同じなら先に書かれたものを選ぶ。
+func negotiateExport(
+	r *http.Request, v *validation,
+) (exportFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range exportFormats {
+			if f.name == name {
+				return f, true
+			}
+		}
+		v.add("format",
+			"format は csv, jsonl, md, html のいずれかで指定してください")
+		return exportFormat{}, false
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return exportFormats[0], true
+	}
+	var best exportFormat
+	bestQ := 0.0
+	for part := range strings.SplitSeq(accept, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if f, ok := exportFormatFor(mt); ok {
+			best, bestQ = f, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// exportFormatFor はメディアタイプに対応する形式を返す。
+func exportFormatFor(mediaType string) (exportFormat, bool) {
+	if mediaType == "*/*" {
+		return exportFormats[0], true
+	}
+	for _, f := range exportFormats {
+		for _, mt := range f.mediaTypes {
+			if mt == mediaType {
+				return f, true
+			}
+		}
+	}
+	return exportFormat{}, false
+}
+
+// exportBookmarks は一覧と同じ条件で絞り込んだブックマークを
+// format か Accept で選んだ形式で書き出す。limit を省略すると
+// 全件を書き出す。
+func (h *Handler) exportBookmarks(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var v validation
+	opts := listOptions(r, &v)
+	f, ok := negotiateExport(r, &v)
+	if v.write(w, r) {
+		return
+	}
+	if !ok {
+		writeProblem(w, r, probNotAcceptable,
+			"text/csv, application/jsonl, text/markdown, "+
+				"text/html のいずれかを指定してください")
+		return
+	}
+	if !r.URL.Query().Has("limit") {
+		opts.Limit = 0
+	}
+	h.streamExport(w, r, f, opts)
+}
+
+// exportHTML は全件をブラウザで読み込める HTML で返す。
+func (h *Handler) exportHTML(
+	w http.ResponseWriter, r *http.Request,
+) {
+	h.streamExport(w, r, htmlExportFormat,
+		repository.ListOptions{})
+}
+
+// streamExport はデータベースから exportPageRows 件ずつ読んで
+// 書き出す。全件をメモリに載せないため、件数が多くてもメモリの
+// 使用量は変わらない。クライアントへの書き込みが遅くても
+// クエリを開いたままにしないよう、ページは読み切ってから書く。
+// 書き込みの制限時間は exportPageWriteTimeout でページごとに設ける。
+func (h *Handler) streamExport(
+	w http.ResponseWriter, r *http.Request,
+	f exportFormat, opts repository.ListOptions,
+) {
+	rc := http.NewResponseController(w)
+	var ew exportWriter
+	start := func() {
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="bookmarks.`+f.name+`"`)
+		w.Header().Set("Vary", "Accept")
+		ew = f.newWriter(w)
+	}
+	// Limit が 0 なら全件、正ならその件数まで書き出す
+	remaining := opts.Limit
+	for {
+		n := exportPageRows
+		if opts.Limit > 0 {
+			n = min(n, remaining)
+		}
+		page, err := h.exportPage(r.Context(), ownerID(r), opts, n)
+		if err != nil {
+			if ew == nil {
+				writeStoreError(w, r, err,
+					"取得に失敗しました")
+				return
+			}
+			// 書き出し済みのファイルが完全なものと
+			// 誤解されないよう、接続ごと切断する
+			panic(http.ErrAbortHandler)
+		}
+		// 対応していない ResponseWriter では
+		// サーバーの WriteTimeout のままにする
+		rc.SetWriteDeadline(time.Now().Add(exportPageWriteTimeout))
+		if ew == nil {
+			start()
+		}
+		for _, b := range page {
+			if err := ew.Write(b); err != nil {
+				return
+			}
+		}
+		remaining -= len(page)
+		if len(page) < n || (opts.Limit > 0 && remaining == 0) {
+			break
+		}
+		after := repository.CursorOf(page[len(page)-1])
+		opts.After = &after
+		if err := ew.Flush(); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+	ew.Close()
+}
+
+// exportPage は opts の位置から n 件を読み切って返す。
+// 1回のクエリには、ほかのエンドポイントと同じ制限時間を設ける。
+func (h *Handler) exportPage(
+	ctx context.Context, ownerID int64,
+	opts repository.ListOptions, n int,
+) ([]model.Bookmark, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.queryTimeout)
+	defer cancel()
+	opts.Limit = n
+	page := make([]model.Bookmark, 0, n)
+	for b, err := range h.repo.Iter(ctx, ownerID, opts) {
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, b)
+	}
+	return page, nil
+}
+
+// csvExport は1行目に列名を書き、1件を1行で書き出す。
+// tags はカンマ区切りで1つの列に入れる。
+type csvExport struct {
+	cw *csv.Writer
+}
+
+var csvHeader = []string{
+	"id", "url", "title", "tags", "folder_id",
+	"description", "created_at", "updated_at",
+}
+
+func newCSVExport(w io.Writer) exportWriter {
+	e := &csvExport{cw: csv.NewWriter(w)}
+	e.cw.Write(csvHeader)
+	return e
+}
+
+func (e *csvExport) Write(b model.Bookmark) error {
+	folder := ""
+	if b.FolderID != nil {
+		folder = strconv.FormatInt(*b.FolderID, 10)
+	}
+	return e.cw.Write([]string{
+		strconv.FormatInt(b.ID, 10),
+		b.URL,
+		csvText(b.Title),
+		csvText(strings.Join(b.Tags, ",")),
+		folder,
+		csvText(b.Description),
+		b.CreatedAt.UTC().Format(time.RFC3339),
+		b.UpdatedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (e *csvExport) Flush() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+func (e *csvExport) Close() error { return e.Flush() }
+
+// csvText は表計算ソフトで開いたときに数式として
+// 実行されないよう、= + - @ などで始まる値の先頭に ' を付ける。
+// タイトルや説明は取得したページの内容をそのまま含むため。
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// jsonlExport は1件を1行の JSON で書き出す。
+// 各行は GET /bookmarks/{id} のレスポンスと同じ形式。
+type jsonlExport struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLExport(w io.Writer) exportWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonlExport{bw: bw, enc: json.NewEncoder(bw)}
+}
+
+func (e *jsonlExport) Write(b model.Bookmark) error {
+	return e.enc.Encode(b)
+}
+
+func (e *jsonlExport) Flush() error { return e.bw.Flush() }
+func (e *jsonlExport) Close() error { return e.bw.Flush() }
+
+// markdownExport は1件を "- [タイトル](URL) タグ, タグ" の
+// 箇条書き1行で書き出す。
+type markdownExport struct {
+	bw *bufio.Writer
+}
+
+// markdownEscaper はリンクのテキストとタグに含まれる
+// Markdown の記号をエスケープし、改行を空白にする。
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`,
+	`[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`,
+	`#`, `\#`, `|`, `\|`, "\r\n", " ", "\n", " ", "\r", " ",
+)
+
+// markdownURLEscaper はリンク先を閉じてしまう文字を
+// パーセントエンコードする。
+var markdownURLEscaper = strings.NewReplacer(
+	"(", "%28", ")", "%29", " ", "%20", "<", "%3C", ">", "%3E",
+)
+
+func newMarkdownExport(w io.Writer) exportWriter {
+	e := &markdownExport{bw: bufio.NewWriter(w)}
+	e.bw.WriteString("# Bookmarks\n\n")
+	return e
+}
+
+func (e *markdownExport) Write(b model.Bookmark) error {
+	e.bw.WriteString("- [" + markdownEscaper.Replace(b.Title) +
+		"](" + markdownURLEscaper.Replace(b.URL) + ")")
+	if len(b.Tags) > 0 {
+		e.bw.WriteString(" " + markdownEscaper.Replace(
+			strings.Join(b.Tags, ", ")))
+	}
+	_, err := e.bw.WriteString("\n")
+	return err
+}
+
+func (e *markdownExport) Flush() error { return e.bw.Flush() }
+func (e *markdownExport) Close() error { return e.bw.Flush() }
+
+// htmlExport はブラウザで読み込める形式で書き出す。
+type htmlExport struct {
+	nw *netscape.Writer
+}
+
+func newHTMLExport(w io.Writer) exportWriter {
+	return &htmlExport{nw: netscape.NewWriter(w)}
+}
+
+func (e *htmlExport) Write(b model.Bookmark) error {
+	return e.nw.Write(netscape.Entry{
+		URL: b.URL, Title: b.Title,
+		AddDate: b.CreatedAt, Tags: b.Tags,
+	})
+}
+
+func (e *htmlExport) Flush() error { return e.nw.Flush() }
+func (e *htmlExport) Close() error { return e.nw.Close() }
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// maxFolderNameLength はフォルダ名の最大文字数。
+const maxFolderNameLength = 100
+
+const invalidFolderNameMessage = "name は1〜100文字で指定してください"
+
+// deleteModes は DELETE /folders/{id} の contents パラメータの値。
+var deleteModes = map[string]repository.DeleteMode{
+	"cascade":  repository.DeleteCascade,
+	"reparent": repository.DeleteReparent,
+}
+
+// normalizeFolderName は前後の空白を除いた名前を返す。
+func normalizeFolderName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	n := utf8.RuneCountInString(name)
+	return name, n > 0 && n <= maxFolderNameLength
+}
+
+// pathID はパスの {id} を読む。不正なら 400 を返して false を返す。
+func pathID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeFieldError(w, r, "id", "id は整数で指定してください")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeFolderError はフォルダ操作の失敗を返す。
+// notFound は操作対象が見つからないときのメッセージ、
+// field は親や移動先のフォルダを指定するフィールド。
+func writeFolderError(
+	w http.ResponseWriter, r *http.Request,
+	err error, notFound, field, message string,
+) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeProblem(w, r, probNotFound, notFound)
+	case errors.Is(err, repository.ErrFolderNotFound):
+		writeFieldError(w, r, field, folderMissingMessage)
+	case errors.Is(err, repository.ErrFolderCycle):
+		writeProblem(w, r, probFolderCycle, "")
+	default:
+		writeStoreError(w, r, err, message)
+	}
+}
+
+const (
+	folderNotFoundMessage = "フォルダが見つかりません"
+	folderMissingMessage  = "指定したフォルダがありません"
+)
+
+func (h *Handler) createFolder(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req model.CreateFolderRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	name, ok := normalizeFolderName(req.Name)
+	if !ok {
+		writeFieldError(w, r, "name", invalidFolderNameMessage)
+		return
+	}
+	req.Name = name
+	f, err := h.repo.CreateFolder(r.Context(), ownerID(r), req)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"parent_id", "作成に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusCreated, f)
+}
+
+func (h *Handler) listFolders(
+	w http.ResponseWriter, r *http.Request,
+) {
+	folders, err := h.repo.Folders(r.Context(), ownerID(r))
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, folders)
+}
+
+func (h *Handler) getFolder(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	f, err := h.repo.FindFolder(r.Context(), ownerID(r), id)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"", "取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// renameFolder はフォルダ名を変更する。
+// 親フォルダの変更は POST /folders/{id}/move で行う。
+func (h *Handler) renameFolder(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req model.UpdateFolderRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	name, ok := normalizeFolderName(req.Name)
+	if !ok {
+		writeFieldError(w, r, "name", invalidFolderNameMessage)
+		return
+	}
+	f, err := h.repo.RenameFolder(
+		r.Context(), ownerID(r), id, name)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"", "更新に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// deleteFolder はフォルダを削除する。中身を消してしまう
+// 事故を防ぐため、中身の扱いを ?contents=cascade
+// (一緒に削除) か ?contents=reparent (親に移す) で
+// 必ず指定させる。
+func (h *Handler) deleteFolder(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	mode, ok := deleteModes[r.URL.Query().Get("contents")]
+	if !ok {
+		writeFieldError(w, r, "contents",
+			"contents に cascade か reparent を指定してください")
+		return
+	}
+	err := h.repo.DeleteFolder(r.Context(), ownerID(r), id, mode)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"", "削除に失敗しました")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) moveFolder(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req model.MoveFolderRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	f, err := h.repo.MoveFolder(
+		r.Context(), ownerID(r), id, req.ParentID)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"parent_id", "移動に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+func (h *Handler) folderTree(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	tree, err := h.repo.FolderTree(r.Context(), ownerID(r), id)
+	if err != nil {
+		writeFolderError(w, r, err, folderNotFoundMessage,
+			"", "取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
+
+func (h *Handler) moveBookmark(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req model.MoveBookmarkRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	bm, err := h.repo.MoveBookmark(
+		r.Context(), ownerID(r), id, req.FolderID)
+	if err != nil {
+		writeFolderError(w, r, err, bookmarkNotFoundMessage,
+			"folder_id", "移動に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, bm)
+}
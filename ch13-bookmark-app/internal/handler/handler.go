@@ -1,30 +1,113 @@
 package handler
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
-	"strconv"
+	"time"
 
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/linkcheck"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/pagemeta"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/safehttp"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
 )
 
+const invalidURLMessage = "url は http または https の" +
+	"絶対URLで指定してください"
+
+const bookmarkNotFoundMessage = "ブックマークが見つかりません"
+
+// checkURL は登録や更新の url を確かめる。
+func checkURL(v *validation, url string) {
+	if url == "" {
+		v.add("url", "url は必須です")
+		return
+	}
+	if err := urlnorm.Validate(url); err != nil {
+		v.add("url", invalidURLMessage)
+	}
+}
+
+// DefaultQueryTimeout は1リクエストあたりの
+// データベース操作の既定の制限時間。
+const DefaultQueryTimeout = 5 * time.Second
+
 // Handler は HTTP リクエストを処理する。
 type Handler struct {
-	repo *repository.BookmarkRepository
+	repo         repository.BookmarkStore
+	queryTimeout time.Duration
+	checker      *linkcheck.Checker
+	fetcher      *pagemeta.Fetcher
+	// admins は監査ログを閲覧できるユーザー名。
+	admins map[string]bool
+}
+
+// Option は Handler の設定を変更する。
+type Option func(*Handler)
+
+// WithQueryTimeout はリクエストごとの
+// データベース操作の制限時間を設定する。
+func WithQueryTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.queryTimeout = d
+	}
+}
+
+// WithLinkChecker は POST /bookmarks/{id}/check で
+// リンクを確かめる Checker を設定する。
+func WithLinkChecker(c *linkcheck.Checker) Option {
+	return func(h *Handler) {
+		h.checker = c
+	}
+}
+
+// WithMetaFetcher はタイトルを省略した登録で
+// ページのメタデータを取得する Fetcher を設定する。
+func WithMetaFetcher(f *pagemeta.Fetcher) Option {
+	return func(h *Handler) {
+		h.fetcher = f
+	}
+}
+
+// WithAdmins は GET /audit で監査ログを閲覧できる
+// ユーザーを名前で設定する。まだ登録されていない名前を
+// ほかの人に取られないよう、AuthHandler にも
+// WithReservedNames で同じ名前を渡すこと。
+func WithAdmins(names ...string) Option {
+	return func(h *Handler) {
+		for _, name := range names {
+			h.admins[name] = true
+		}
+	}
 }
 
 // New は Handler を生成する。
+// repo には SQLite の BookmarkRepository のほか、
+// テスト用の MemoryStore も渡せる。
 func New(
-	repo *repository.BookmarkRepository,
+	repo repository.BookmarkStore,
+	opts ...Option,
 ) *Handler {
-	return &Handler{repo: repo}
-}
-
-type errorResponse struct {
-	Error string `json:"error"`
+	h := &Handler{
+		repo:         repo,
+		queryTimeout: DefaultQueryTimeout,
+		checker: linkcheck.NewChecker(safehttp.NewClient(
+			safehttp.Options{Timeout: defaultCheckTimeout},
+		)),
+		fetcher: pagemeta.NewFetcher(safehttp.NewClient(
+			safehttp.Options{Timeout: defaultFetchTimeout},
+		), pagemeta.DefaultMaxBytes),
+		admins: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func writeJSON(
@@ -38,111 +121,296 @@ func writeJSON(
 	json.NewEncoder(w).Encode(data)
 }
 
-func writeError(
-	w http.ResponseWriter,
-	status int, message string,
+// writeDuplicate は重複エラーなら 409 を返して true を返す。
+func writeDuplicate(
+	w http.ResponseWriter, r *http.Request, err error,
+) bool {
+	var dup *repository.DuplicateError
+	if !errors.As(err, &dup) {
+		return false
+	}
+	p := probDuplicate.problem(r, "")
+	p.ExistingID = dup.ID
+	writeProblemValue(w, p)
+	return true
+}
+
+// writeStoreError はストア操作の失敗を返す。
+// 制限時間切れは 504、サーバーの停止などによる
+// キャンセルは 503 とし、それ以外は message を detail にして
+// 500 を返す。500 の原因はレスポンスには含めず、ログに出力する。
+func writeStoreError(
+	w http.ResponseWriter, r *http.Request,
+	err error, message string,
 ) {
-	writeJSON(w, status, errorResponse{
-		Error: message,
-	})
+	kind := storeErrorKind(r.Context(), err)
+	if kind != probInternal {
+		writeProblem(w, r, kind, "")
+		return
+	}
+	slog.ErrorContext(r.Context(), message, "error", err)
+	writeProblem(w, r, probInternal, message)
+}
+
+// storeErrorKind はストア操作の失敗を、制限時間切れ、
+// キャンセル、それ以外の障害に分ける。
+func storeErrorKind(ctx context.Context, err error) problemKind {
+	// ドライバによっては ctx のエラーを包まずに返すため、
+	// ctx の状態も合わせて確認する
+	ctxErr := ctx.Err()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(ctxErr, context.DeadlineExceeded):
+		return probTimeout
+	case errors.Is(err, context.Canceled),
+		ctxErr != nil:
+		return probCanceled
+	}
+	return probInternal
+}
+
+// withTimeout はリクエストの ctx に制限時間を設定する。
+// クライアントの切断やサーバーの停止で r.Context() が
+// キャンセルされた場合も、実行中のクエリが中断される。
+func withTimeout(
+	d time.Duration, next http.HandlerFunc,
+) http.HandlerFunc {
+	return func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// route は mux に登録するエンドポイント1つ分。
+type route struct {
+	pattern string
+	handler http.HandlerFunc
 }
 
 // Routes はエンドポイントを mux に登録する。
+// ドキュメント以外のエンドポイントはログインが必要で、
+// ログイン中のユーザーのブックマークだけを扱う。
 func (h *Handler) Routes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /bookmarks",
-		h.listBookmarks)
-	mux.HandleFunc("POST /bookmarks",
-		h.createBookmark)
-	mux.HandleFunc("GET /bookmarks/{id}",
-		h.getBookmark)
-	mux.HandleFunc("DELETE /bookmarks/{id}",
-		h.deleteBookmark)
+	for _, rt := range h.routes() {
+		mux.HandleFunc(rt.pattern, rt.handler)
+	}
 }
 
+// routes は Routes で登録するエンドポイントの一覧。
+// openapi.json に漏れがないかのテストにも使う。
+func (h *Handler) routes() []route {
+	routes := []route{
+		{"GET /bookmarks", h.listBookmarks},
+		{"GET /bookmarks/search", h.searchBookmarks},
+		{"GET /bookmarks/{id}", h.getBookmark},
+		{"PUT /bookmarks/{id}", h.replaceBookmark},
+		{"PATCH /bookmarks/{id}", h.patchBookmark},
+		{"DELETE /bookmarks/{id}", h.deleteBookmark},
+		{"POST /bookmarks/{id}/move", h.moveBookmark},
+		{"GET /tags", h.listTags},
+		{"POST /tags/{name}/rename", h.renameTag},
+		{"POST /tags/{name}/merge", h.mergeTags},
+		{"POST /folders", h.createFolder},
+		{"GET /folders", h.listFolders},
+		{"GET /folders/{id}", h.getFolder},
+		{"PATCH /folders/{id}", h.renameFolder},
+		{"DELETE /folders/{id}", h.deleteFolder},
+		{"POST /folders/{id}/move", h.moveFolder},
+		{"GET /folders/{id}/tree", h.folderTree},
+		{"GET /trash", h.listTrash},
+		{"POST /trash/{id}/restore", h.restoreBookmark},
+		{"DELETE /trash/{id}", h.deletePermanently},
+		{"GET /bookmarks/{id}/history", h.bookmarkHistory},
+		{"GET /audit", h.requireAdmin(h.auditLog)},
+	}
+	for i, rt := range routes {
+		routes[i].handler = requireUser(
+			withTimeout(h.queryTimeout, rt.handler))
+	}
+	return append(routes,
+		// 件数に比例して時間がかかるため、リクエスト全体には
+		// 制限時間を設けない。インポートと一括操作は1件ごとに設ける
+		route{"POST /bookmarks/import",
+			requireUser(h.importBookmarks)},
+		route{"POST /bookmarks/batch",
+			requireUser(h.batchBookmarks)},
+		route{"GET /bookmarks/export",
+			requireUser(h.exportBookmarks)},
+		route{"GET /bookmarks/export.html",
+			requireUser(h.exportHTML)},
+		// 相手のサーバーの応答を待つため、データベース操作とは
+		// 別の制限時間を Checker と Fetcher に持たせる
+		route{"POST /bookmarks",
+			requireUser(h.createBookmark)},
+		route{"POST /bookmarks/{id}/check",
+			requireUser(h.checkBookmark)},
+		route{"GET /openapi.json", serveOpenAPI},
+		route{"GET /docs", serveDocs},
+	)
+}
+
+// createBookmark はブックマークを登録する。
+// title を省略すると、ページを取得してタイトルなどの
+// メタデータを設定する。取得に失敗しても登録はし、
+// URL を仮のタイトルにして後で取得し直す。
 func (h *Handler) createBookmark(
 	w http.ResponseWriter, r *http.Request,
 ) {
 	var req model.CreateBookmarkRequest
 	if err := json.NewDecoder(r.Body).
 		Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest,
-			"無効なJSON")
+		writeProblem(w, r, probInvalidJSON, "")
 		return
 	}
-	if req.URL == "" || req.Title == "" {
-		writeError(w, http.StatusBadRequest,
-			"url と title は必須です")
+	var v validation
+	checkURL(&v, req.URL)
+	req.Tags = checkTags(&v, req.Tags)
+	if v.write(w, r) {
+		return
+	}
+	if req.Title == "" {
+		h.fillMetadata(r.Context(), &req)
+	}
+	ctx, cancel := context.WithTimeout(
+		r.Context(), h.queryTimeout)
+	defer cancel()
+	bm, err := h.repo.Create(ctx, ownerID(r), req)
+	if writeDuplicate(w, r, err) {
+		return
+	}
+	if errors.Is(err, repository.ErrFolderNotFound) {
+		writeFieldError(w, r, "folder_id", folderMissingMessage)
 		return
 	}
-	bm, err := h.repo.Create(req)
 	if err != nil {
-		writeError(w,
-			http.StatusInternalServerError,
+		writeStoreError(w, r, err,
 			"登録に失敗しました")
 		return
 	}
 	writeJSON(w, http.StatusCreated, bm)
 }
 
-func (h *Handler) listBookmarks(
+func (h *Handler) getBookmark(
 	w http.ResponseWriter, r *http.Request,
 ) {
-	bookmarks, err := h.repo.All()
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	bm, err := h.repo.FindByID(r.Context(), ownerID(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
+		return
+	}
 	if err != nil {
-		writeError(w,
-			http.StatusInternalServerError,
+		writeStoreError(w, r, err,
 			"取得に失敗しました")
 		return
 	}
-	writeJSON(w, http.StatusOK, bookmarks)
+	writeJSON(w, http.StatusOK, bm)
 }
 
-func (h *Handler) getBookmark(
+func (h *Handler) replaceBookmark(
 	w http.ResponseWriter, r *http.Request,
 ) {
-	id, err := strconv.ParseInt(
-		r.PathValue("id"), 10, 64,
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var req model.UpdateBookmarkRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	h.updateBookmark(w, r, id, req)
+}
+
+// patchBookmark は JSON Merge Patch (RFC 7396) を
+// 既存のブックマークに適用する。
+func (h *Handler) patchBookmark(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var patch any
+	if err := json.NewDecoder(r.Body).
+		Decode(&patch); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	bm, err := h.repo.FindByID(r.Context(), ownerID(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	req, err := applyMergePatch(
+		model.UpdateBookmarkRequest{
+			URL: bm.URL, Title: bm.Title,
+			Tags: bm.Tags,
+		}, patch,
 	)
 	if err != nil {
-		writeError(w, http.StatusBadRequest,
-			"無効なID")
+		writeProblem(w, r, probInvalidPatch, "")
+		return
+	}
+	h.updateBookmark(w, r, id, req)
+}
+
+func (h *Handler) updateBookmark(
+	w http.ResponseWriter, r *http.Request,
+	id int64, req model.UpdateBookmarkRequest,
+) {
+	var v validation
+	checkURL(&v, req.URL)
+	if req.Title == "" {
+		v.add("title", "title は必須です")
+	}
+	req.Tags = checkTags(&v, req.Tags)
+	if v.write(w, r) {
+		return
+	}
+	bm, err := h.repo.Update(r.Context(), ownerID(r), id, req)
+	if writeDuplicate(w, r, err) {
 		return
 	}
-	bm, err := h.repo.FindByID(id)
 	if errors.Is(err, sql.ErrNoRows) {
-		writeError(w, http.StatusNotFound,
-			"ブックマークが見つかりません")
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
 		return
 	}
 	if err != nil {
-		writeError(w,
-			http.StatusInternalServerError,
-			"取得に失敗しました")
+		writeStoreError(w, r, err,
+			"更新に失敗しました")
 		return
 	}
 	writeJSON(w, http.StatusOK, bm)
 }
 
+// deleteBookmark はブックマークをゴミ箱に移す。
 func (h *Handler) deleteBookmark(
 	w http.ResponseWriter, r *http.Request,
 ) {
-	id, err := strconv.ParseInt(
-		r.PathValue("id"), 10, 64,
-	)
-	if err != nil {
-		writeError(w, http.StatusBadRequest,
-			"無効なID")
+	id, ok := pathID(w, r)
+	if !ok {
 		return
 	}
-	err = h.repo.Delete(id)
+	err := h.repo.Delete(r.Context(), ownerID(r), id)
 	if errors.Is(err, sql.ErrNoRows) {
-		writeError(w, http.StatusNotFound,
-			"ブックマークが見つかりません")
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
 		return
 	}
 	if err != nil {
-		writeError(w,
-			http.StatusInternalServerError,
+		writeStoreError(w, r, err,
 			"削除に失敗しました")
 		return
 	}
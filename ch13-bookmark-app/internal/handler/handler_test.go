@@ -1,37 +1,70 @@
 package handler
 
 import (
-	"database/sql"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
-	_ "modernc.org/sqlite"
-
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/linkcheck"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/pagemeta"
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/safehttp"
 )
 
+// testUserID はテスト用のユーザーの ID。
+const testUserID = 1
+
 func setupTestHandler(
 	t *testing.T,
-) (*Handler, *http.ServeMux) {
+) (*Handler, http.Handler) {
 	t.Helper()
-	// ファイルではなくメモリ上にDBを作成
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Cleanup(func() { db.Close() })
-	repo := repository.New(db)
-	if err := repo.InitTable(); err != nil {
-		t.Fatal(err)
-	}
-	h := New(repo)
+	// SQLite 実装との振る舞いの一致は
+	// repository パッケージのテストで確認している
+	h := New(repository.NewMemory(),
+		WithLinkChecker(linkcheck.NewChecker(offlineClient)),
+		WithMetaFetcher(pagemeta.NewFetcher(
+			offlineClient, pagemeta.DefaultMaxBytes)))
 	mux := http.NewServeMux()
 	h.Routes(mux)
-	return h, mux
+	return h, asUser(mux, testUserID)
+}
+
+// offlineClient はネットワークに接続せず、
+// 常にエラーを返す HTTP クライアント。
+var offlineClient = &http.Client{
+	Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("offline")
+	}),
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// asUser はログイン済みのリクエストとして next を呼ぶ。
+// ログインの流れは TestAuth で確認する。
+func asUser(next http.Handler, id int64) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		ctx := withUser(r.Context(), model.User{ID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func TestCreateBookmark(t *testing.T) {
@@ -60,6 +93,53 @@ func TestCreateBookmark(t *testing.T) {
 	}
 }
 
+func TestCreateBookmark_metadata(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<head><title>Go</title>`+
+				`<meta property="og:description" content="Go言語">`+
+				`<meta property="og:image" content="/logo.png">`+
+				`</head>`)
+		}))
+	defer page.Close()
+
+	h := New(repository.NewMemory(), WithMetaFetcher(
+		pagemeta.NewFetcher(safehttp.NewClient(safehttp.Options{
+			Timeout: 2 * time.Second, AllowPrivate: true,
+		}), pagemeta.DefaultMaxBytes)))
+	m := http.NewServeMux()
+	h.Routes(m)
+	mux := asUser(m, testUserID)
+
+	bm := createTestBookmark(t, mux, fmt.Sprintf(`{"url":%q}`, page.URL))
+	want := model.Bookmark{
+		Title:       "Go",
+		Description: "Go言語",
+		ImageURL:    page.URL + "/logo.png",
+		FaviconURL:  page.URL + "/favicon.ico",
+	}
+	if bm.Title != want.Title || bm.Description != want.Description ||
+		bm.ImageURL != want.ImageURL || bm.FaviconURL != want.FaviconURL ||
+		bm.MetadataPending {
+		t.Errorf("got %+v", bm)
+	}
+
+	// タイトルを指定すればページは取得しない
+	bm = createTestBookmark(t, mux, fmt.Sprintf(
+		`{"url":%q,"title":"Mine"}`, page.URL+"/x"))
+	if bm.Title != "Mine" || bm.Description != "" {
+		t.Errorf("with title: got %+v", bm)
+	}
+
+	// 取得に失敗しても登録し、後で取得し直す
+	_, offline := setupTestHandler(t)
+	bm = createTestBookmark(t, offline, `{"url":"https://go.dev/doc"}`)
+	if bm.Title != "https://go.dev/doc" || !bm.MetadataPending {
+		t.Errorf("offline: got %+v", bm)
+	}
+}
+
 func TestCreateBookmark_validation(
 	t *testing.T,
 ) {
@@ -72,10 +152,12 @@ func TestCreateBookmark_validation(
 	}{
 		{"URL空",
 			`{"url":"","title":"T"}`, 400},
-		{"Title空",
-			`{"url":"https://x","title":""}`,
-			400},
 		{"不正JSON", `{bad`, 400},
+		{"javascriptスキーム",
+			`{"url":"javascript:alert(1)","title":"T"}`,
+			400},
+		{"相対パス",
+			`{"url":"/foo","title":"T"}`, 400},
 	}
 
 	for _, tt := range tests {
@@ -94,6 +176,44 @@ func TestCreateBookmark_validation(
 	}
 }
 
+func TestCreateBookmark_problem(t *testing.T) {
+	_, mux := setupTestHandler(t)
+
+	req := httptest.NewRequest("POST", "/bookmarks",
+		strings.NewReader(
+			`{"url":"ftp://example.com","tags":["go"," "]}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var p model.Problem
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Code != "validation_failed" || p.Status != 400 ||
+		p.Type != "urn:bookmarks:problem:validation_failed" ||
+		p.Instance != "/bookmarks" {
+		t.Errorf("problem = %+v", p)
+	}
+	// 最初のエラーで止めず、すべてのフィールドを返す
+	var fields []string
+	for _, e := range p.Errors {
+		if e.Reason == "" {
+			t.Errorf("%s: reason が空", e.Field)
+		}
+		fields = append(fields, e.Field)
+	}
+	want := []string{"url", "tags[1]"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+}
+
 func TestBookmarkFlow(t *testing.T) {
 	_, mux := setupTestHandler(t)
 
@@ -124,3 +244,1245 @@ func TestBookmarkFlow(t *testing.T) {
 			len(list))
 	}
 }
+
+// createTestBookmark はテスト用にブックマークを1件登録する。
+func createTestBookmark(
+	t *testing.T, mux http.Handler, body string,
+) model.Bookmark {
+	t.Helper()
+	req := httptest.NewRequest(
+		"POST", "/bookmarks",
+		strings.NewReader(body),
+	)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body = %s",
+			rec.Code, rec.Body)
+	}
+	var bm model.Bookmark
+	json.NewDecoder(rec.Body).Decode(&bm)
+	return bm
+}
+
+func TestUpdateBookmark(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	bm := createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go公式サイト"}`)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		status    int
+		wantURL   string
+		wantTitle string
+	}{
+		{"PUTで全置換", "PUT", "/bookmarks/1",
+			`{"url":"https://pkg.go.dev","title":"Pkg"}`,
+			200, "https://pkg.go.dev", "Pkg"},
+		{"PATCHでtitleのみ", "PATCH", "/bookmarks/1",
+			`{"title":"Go パッケージ"}`,
+			200, "https://pkg.go.dev", "Go パッケージ"},
+		{"PUTで必須項目欠落", "PUT", "/bookmarks/1",
+			`{"title":"T"}`, 400, "", ""},
+		{"PATCHでnullは削除扱い", "PATCH",
+			"/bookmarks/1", `{"url":null}`,
+			400, "", ""},
+		{"PATCHで不正JSON", "PATCH", "/bookmarks/1",
+			`{bad`, 400, "", ""},
+		{"存在しないID", "PUT", "/bookmarks/999",
+			`{"url":"https://x","title":"T"}`,
+			404, "", ""},
+		{"PATCHで存在しないID", "PATCH",
+			"/bookmarks/999", `{"title":"T"}`,
+			404, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				tt.method, tt.path,
+				strings.NewReader(tt.body),
+			)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d",
+					rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got model.Bookmark
+			json.NewDecoder(rec.Body).Decode(&got)
+			if got.ID != bm.ID {
+				t.Errorf("id = %d, want %d",
+					got.ID, bm.ID)
+			}
+			if got.URL != tt.wantURL ||
+				got.Title != tt.wantTitle {
+				t.Errorf("got (%q, %q), want (%q, %q)",
+					got.URL, got.Title,
+					tt.wantURL, tt.wantTitle)
+			}
+			if !got.CreatedAt.Equal(bm.CreatedAt) {
+				t.Errorf("created_at changed: %v -> %v",
+					bm.CreatedAt, got.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go",`+
+			`"tags":["Go"," http ","go"]}`)
+	createTestBookmark(t, mux,
+		`{"url":"https://pkg.go.dev","title":"Pkg",`+
+			`"tags":["go"]}`)
+	createTestBookmark(t, mux,
+		`{"url":"https://example.com","title":"Ex",`+
+			`"tags":["http"]}`)
+
+	listLen := func(t *testing.T, query string) int {
+		t.Helper()
+		req := httptest.NewRequest(
+			"GET", "/bookmarks"+query, nil,
+		)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200",
+				rec.Code)
+		}
+		var list []model.Bookmark
+		json.NewDecoder(rec.Body).Decode(&list)
+		return len(list)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"絞り込みなし", "", 3},
+		{"単一タグ", "?tag=go", 2},
+		{"AND", "?tag=go&tag=http", 1},
+		{"OR", "?tag=go&tag=http&match=any", 3},
+		{"大文字も同一視", "?tag=GO", 2},
+		{"該当なし", "?tag=rust", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listLen(t, tt.query); got != tt.want {
+				t.Errorf("len = %d, want %d",
+					got, tt.want)
+			}
+		})
+	}
+
+	tags := func(t *testing.T) []model.Tag {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/tags", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var got []model.Tag
+		json.NewDecoder(rec.Body).Decode(&got)
+		return got
+	}
+	want := []model.Tag{{Name: "go", Count: 2}, {Name: "http", Count: 2}}
+	if got := tags(t); !slices.Equal(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+
+	post := func(path, body string) int {
+		req := httptest.NewRequest(
+			"POST", path, strings.NewReader(body),
+		)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post("/tags/go/rename",
+		`{"name":"http"}`); code != http.StatusConflict {
+		t.Errorf("rename to existing: status = %d, want 409",
+			code)
+	}
+	if code := post("/tags/go/rename",
+		`{"name":"golang"}`); code != http.StatusOK {
+		t.Errorf("rename: status = %d, want 200", code)
+	}
+	if code := post("/tags/missing/rename",
+		`{"name":"x"}`); code != http.StatusNotFound {
+		t.Errorf("rename missing: status = %d, want 404",
+			code)
+	}
+	if code := post("/tags/http/merge",
+		`{"into":"golang"}`); code != http.StatusOK {
+		t.Errorf("merge: status = %d, want 200", code)
+	}
+	want = []model.Tag{{Name: "golang", Count: 3}}
+	if got := tags(t); !slices.Equal(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+}
+
+func TestFolders(t *testing.T) {
+	_, mux := setupTestHandler(t)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			method, path, strings.NewReader(body),
+		)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	// フォルダ 1 "Go" の下に 2 "Web" を作る
+	if rec := do("POST", "/folders",
+		`{"name":" Go "}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body = %s",
+			rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/folders",
+		`{"name":"Web","parent_id":1}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create child: status = %d, body = %s",
+			rec.Code, rec.Body)
+	}
+	createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go","folder_id":2}`)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"名前が空", "POST", "/folders", `{"name":"  "}`, 400},
+		{"存在しない親", "POST", "/folders",
+			`{"name":"X","parent_id":999}`, 400},
+		{"存在しないフォルダへ登録", "POST", "/bookmarks",
+			`{"url":"https://x.example","title":"X","folder_id":999}`,
+			400},
+		{"取得", "GET", "/folders/1", "", 200},
+		{"存在しないフォルダ", "GET", "/folders/999", "", 404},
+		{"名前の変更", "PATCH", "/folders/1",
+			`{"name":"Golang"}`, 200},
+		{"子孫の下へ移動", "POST", "/folders/1/move",
+			`{"parent_id":2}`, 409},
+		{"自分の下へ移動", "POST", "/folders/1/move",
+			`{"parent_id":1}`, 409},
+		{"ブックマークを存在しないフォルダへ", "POST",
+			"/bookmarks/1/move", `{"folder_id":999}`, 400},
+		{"存在しないブックマーク", "POST",
+			"/bookmarks/999/move", `{"folder_id":1}`, 404},
+		{"contents未指定", "DELETE", "/folders/1", "", 400},
+		{"contents不正", "DELETE", "/folders/1?contents=all",
+			"", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.method, tt.path, tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d, body = %s",
+					rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	rec := do("GET", "/folders/1/tree", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("tree: status = %d", rec.Code)
+	}
+	var tree model.FolderTree
+	json.NewDecoder(rec.Body).Decode(&tree)
+	if tree.Name != "Golang" || len(tree.Folders) != 1 ||
+		len(tree.Folders[0].Bookmarks) != 1 {
+		t.Fatalf("tree = %+v", tree)
+	}
+
+	// 親を消すと、中身は親の親 (ルート) に移る
+	if rec := do("DELETE", "/folders/1?contents=reparent",
+		""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	rec = do("GET", "/folders/2", "")
+	var f model.Folder
+	json.NewDecoder(rec.Body).Decode(&f)
+	if f.ParentID != nil {
+		t.Errorf("parent_id = %d, want null", *f.ParentID)
+	}
+
+	// ブックマークをルートへ移してからフォルダごと消す
+	rec = do("POST", "/bookmarks/1/move", `{"folder_id":null}`)
+	var bm model.Bookmark
+	json.NewDecoder(rec.Body).Decode(&bm)
+	if rec.Code != http.StatusOK || bm.FolderID != nil {
+		t.Fatalf("move: status = %d, folder_id = %v",
+			rec.Code, bm.FolderID)
+	}
+	if rec := do("DELETE", "/folders/2?contents=cascade",
+		""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if rec := do("GET", "/bookmarks/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("bookmark moved to root was deleted: status = %d",
+			rec.Code)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	bm := createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go"}`)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			method, path, strings.NewReader(body),
+		)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	trash := func(t *testing.T) []model.Bookmark {
+		t.Helper()
+		rec := do("GET", "/trash", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("trash: status = %d", rec.Code)
+		}
+		var list []model.Bookmark
+		json.NewDecoder(rec.Body).Decode(&list)
+		return list
+	}
+
+	if rec := do("DELETE", "/bookmarks/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if rec := do("GET", "/bookmarks/1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get deleted: status = %d, want 404", rec.Code)
+	}
+	list := trash(t)
+	if len(list) != 1 || list[0].ID != bm.ID || list[0].DeletedAt == nil {
+		t.Fatalf("trash = %+v", list)
+	}
+
+	// 同じ URL を登録し直すと、元のものは復元できない
+	createTestBookmark(t, mux,
+		`{"url":"https://go.dev/","title":"Go 2"}`)
+	rec := do("POST", "/trash/1/restore", "")
+	var errResp model.Problem
+	json.NewDecoder(rec.Body).Decode(&errResp)
+	if rec.Code != http.StatusConflict || errResp.ExistingID != 2 {
+		t.Errorf("restore duplicate: status = %d, body = %+v",
+			rec.Code, errResp)
+	}
+	if rec := do("DELETE", "/trash/2", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("purge outside trash: status = %d, want 404",
+			rec.Code)
+	}
+	if rec := do("DELETE", "/bookmarks/2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if rec := do("DELETE", "/trash/2", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("purge: status = %d, want 204", rec.Code)
+	}
+
+	rec = do("POST", "/trash/1/restore", "")
+	var got model.Bookmark
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusOK || got.ID != bm.ID || got.DeletedAt != nil {
+		t.Fatalf("restore: status = %d, body = %+v", rec.Code, got)
+	}
+	if rec := do("POST", "/trash/1/restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("restore twice: status = %d, want 404", rec.Code)
+	}
+	if list := trash(t); len(list) != 0 {
+		t.Errorf("trash = %+v, want empty", list)
+	}
+}
+
+func TestSearchBookmarks(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	createTestBookmark(t, mux,
+		`{"url":"https://go.dev/doc","title":"Go言語の教科書"}`)
+	createTestBookmark(t, mux,
+		`{"url":"https://example.com/rust","title":"Rust入門"}`)
+	bm := createTestBookmark(t, mux,
+		`{"url":"https://example.com/ts","title":"TypeScript入門"}`)
+	createTestBookmark(t, mux,
+		`{"url":"https://evil.test/","title":"<script>悪意"}`)
+
+	// 更新後の内容で検索できることも確認する
+	req := httptest.NewRequest("PATCH",
+		"/bookmarks/"+strconv.FormatInt(bm.ID, 10),
+		strings.NewReader(`{"title":"TypeScript実践"}`))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	tests := []struct {
+		name    string
+		q       string
+		wantIDs []int64
+		snippet string
+	}{
+		{"日本語3文字以上", "教科書", []int64{1},
+			"Go言語の<mark>教科書</mark>"},
+		{"日本語2文字", "入門", []int64{2}, "Rust<mark>入門</mark>"},
+		{"英字は大小無視", "RUST", []int64{2},
+			"<mark>Rust</mark>入門"},
+		{"URLにも一致", "go.dev", []int64{1},
+			"https://<mark>go.dev</mark>/doc"},
+		{"複数語はAND", "example 入門", []int64{2}, ""},
+		{"更新が反映される", "実践", []int64{3}, ""},
+		{"FTS構文は無効化", `"AND*`, []int64{}, ""},
+		// 抜粋をそのまま HTML に埋め込んでもスクリプトにならない
+		{"抜粋はエスケープ済み", "<script>", []int64{4},
+			"<mark>&lt;script&gt;</mark>悪意"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET",
+				"/bookmarks/search?q="+
+					url.QueryEscape(tt.q), nil)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s",
+					rec.Code, rec.Body)
+			}
+			var got []model.SearchResult
+			json.NewDecoder(rec.Body).Decode(&got)
+			ids := []int64{}
+			for _, r := range got {
+				ids = append(ids, r.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v",
+					ids, tt.wantIDs)
+			}
+			if tt.snippet != "" &&
+				got[0].Snippet != tt.snippet {
+				t.Errorf("snippet = %q, want %q",
+					got[0].Snippet, tt.snippet)
+			}
+		})
+	}
+
+	req = httptest.NewRequest(
+		"GET", "/bookmarks/search?q=", nil,
+	)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty q: status = %d, want 400",
+			rec.Code)
+	}
+}
+
+func TestListBookmarks_pagination(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	for i := range 5 {
+		createTestBookmark(t, mux, fmt.Sprintf(
+			`{"url":"https://example.com/%d","title":"T%d"}`,
+			i, i))
+	}
+
+	// Link ヘッダをたどって全件を取得する
+	var ids []int64
+	path := "/bookmarks?limit=2"
+	pages := 0
+	for path != "" {
+		req := httptest.NewRequest("GET", path, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		var list []model.Bookmark
+		json.NewDecoder(rec.Body).Decode(&list)
+		for _, b := range list {
+			ids = append(ids, b.ID)
+		}
+		pages++
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			path = strings.TrimPrefix(
+				strings.TrimSuffix(link, `>; rel="next"`),
+				"<")
+		}
+	}
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+	want := []int64{1, 2, 3, 4, 5}
+	if !slices.Equal(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+
+	for _, q := range []string{
+		"?limit=0", "?limit=1001", "?after=!!",
+		"?after=" + base64.RawURLEncoding.
+			EncodeToString([]byte("x,1")),
+	} {
+		req := httptest.NewRequest(
+			"GET", "/bookmarks"+q, nil,
+		)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400",
+				q, rec.Code)
+		}
+	}
+}
+
+func TestCheckBookmark(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ok" {
+				http.NotFound(w, r)
+			}
+		}))
+	defer target.Close()
+
+	// httptest のサーバーはループバックで待ち受けるため、
+	// 非公開アドレスへの接続を許可する
+	h := New(repository.NewMemory(), WithLinkChecker(
+		linkcheck.NewChecker(safehttp.NewClient(safehttp.Options{
+			Timeout: 2 * time.Second, AllowPrivate: true,
+		}))))
+	m := http.NewServeMux()
+	h.Routes(m)
+	mux := asUser(m, testUserID)
+
+	okBm := createTestBookmark(t, mux, fmt.Sprintf(
+		`{"url":%q,"title":"OK"}`, target.URL+"/ok"))
+	gone := createTestBookmark(t, mux, fmt.Sprintf(
+		`{"url":%q,"title":"Gone"}`, target.URL+"/gone"))
+
+	check := func(id int64) model.Bookmark {
+		t.Helper()
+		req := httptest.NewRequest("POST",
+			fmt.Sprintf("/bookmarks/%d/check", id), nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("check %d: status = %d, body = %s",
+				id, rec.Code, rec.Body)
+		}
+		var bm model.Bookmark
+		json.NewDecoder(rec.Body).Decode(&bm)
+		return bm
+	}
+	if bm := check(okBm.ID); bm.LastCheckedAt == nil ||
+		bm.HTTPStatus != http.StatusOK {
+		t.Errorf("ok = %+v", bm)
+	}
+	if bm := check(gone.ID); bm.HTTPStatus != http.StatusNotFound {
+		t.Errorf("gone = %+v", bm)
+	}
+
+	list := func(q string) []int64 {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/bookmarks"+q, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", q, rec.Code)
+		}
+		var bms []model.Bookmark
+		json.NewDecoder(rec.Body).Decode(&bms)
+		ids := []int64{}
+		for _, b := range bms {
+			ids = append(ids, b.ID)
+		}
+		return ids
+	}
+	if got := list("?status=broken"); !slices.Equal(got, []int64{gone.ID}) {
+		t.Errorf("status=broken: ids = %v, want [%d]", got, gone.ID)
+	}
+	if got := list("?status=ok"); !slices.Equal(got, []int64{okBm.ID}) {
+		t.Errorf("status=ok: ids = %v, want [%d]", got, okBm.ID)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/bookmarks?status=dead", http.StatusBadRequest},
+		{"POST", "/bookmarks/999/check", http.StatusNotFound},
+		{"POST", "/bookmarks/x/check", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d",
+				tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+// blockingStore は ctx が終わるまで応答しないストア。
+// 遅いクエリの代わりに使う。
+type blockingStore struct {
+	repository.BookmarkStore
+}
+
+func (blockingStore) FindByID(
+	ctx context.Context, ownerID, id int64,
+) (model.Bookmark, error) {
+	<-ctx.Done()
+	return model.Bookmark{}, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	h := New(
+		blockingStore{repository.NewMemory()},
+		WithQueryTimeout(10*time.Millisecond),
+	)
+	m := http.NewServeMux()
+	h.Routes(m)
+	mux := asUser(m, testUserID)
+
+	// 制限時間切れは 504
+	req := httptest.NewRequest(
+		"GET", "/bookmarks/1", nil,
+	)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("deadline: status = %d, want %d",
+			rec.Code, http.StatusGatewayTimeout)
+	}
+
+	// サーバー停止などによるキャンセルは 503
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req = httptest.NewRequestWithContext(
+		ctx, "GET", "/bookmarks/1", nil,
+	)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled: status = %d, want %d",
+			rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestCreateBookmark_duplicate(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	bm := createTestBookmark(t, mux,
+		`{"url":"https://go.dev/doc","title":"Go"}`)
+
+	req := httptest.NewRequest("POST", "/bookmarks",
+		strings.NewReader(`{"url":"https://GO.dev/doc`+
+			`?utm_source=x#intro","title":"Go"}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d",
+			rec.Code, http.StatusConflict)
+	}
+	var res model.Problem
+	json.NewDecoder(rec.Body).Decode(&res)
+	if res.ExistingID != bm.ID {
+		t.Errorf("existing_id = %d, want %d",
+			res.ExistingID, bm.ID)
+	}
+
+	// 更新で重複させた場合も 409
+	other := createTestBookmark(t, mux,
+		`{"url":"https://pkg.go.dev","title":"Pkg"}`)
+	req = httptest.NewRequest("PATCH",
+		"/bookmarks/"+strconv.FormatInt(other.ID, 10),
+		strings.NewReader(`{"url":"https://go.dev/doc"}`))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("patch: status = %d, want %d",
+			rec.Code, http.StatusConflict)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	existing := createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go"}`)
+
+	file := `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<DL><p>
+    <DT><H3 PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DL><p>
+        <DT><H3>Go</H3>
+        <DL><p>
+            <DT><H3>Docs</H3>
+            <DL><p>
+                <DT><A HREF="https://pkg.go.dev/" ADD_DATE="1600000000" TAGS="Ref">Packages</A>
+            </DL><p>
+            <DT><A HREF="https://GO.dev/#top">Go again</A>
+        </DL><p>
+        <DT><A HREF="https://blog.golang.org/"></A>
+        <DT><A HREF="javascript:void(0)">bookmarklet</A>
+    </DL><p>
+</DL><p>
+`
+	req := httptest.NewRequest("POST", "/bookmarks/import",
+		strings.NewReader(file))
+	req.Header.Set("Content-Type", "text/html")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import: status = %d, want %d: %s",
+			rec.Code, http.StatusOK, rec.Body)
+	}
+	var report model.ImportReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if report.Created != 2 || report.Skipped != 1 ||
+		report.Rejected != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+	wantStatus := []string{
+		model.ImportCreated, model.ImportSkipped,
+		model.ImportCreated, model.ImportRejected,
+	}
+	for i, item := range report.Items {
+		if item.Status != wantStatus[i] {
+			t.Errorf("items[%d].status = %q, want %q",
+				i, item.Status, wantStatus[i])
+		}
+	}
+	if got := report.Items[1].ID; got != existing.ID {
+		t.Errorf("skipped id = %d, want %d", got, existing.ID)
+	}
+	if report.Items[3].Reason == "" {
+		t.Error("rejected item has no reason")
+	}
+
+	// フォルダがタグに、ADD_DATE が登録日時になる
+	req = httptest.NewRequest("GET",
+		"/bookmarks/"+strconv.FormatInt(report.Items[0].ID, 10), nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var bm model.Bookmark
+	json.NewDecoder(rec.Body).Decode(&bm)
+	if want := []string{"docs", "go", "ref"}; !slices.Equal(bm.Tags, want) {
+		t.Errorf("tags = %v, want %v", bm.Tags, want)
+	}
+	if want := time.Unix(1600000000, 0); !bm.CreatedAt.Equal(want) {
+		t.Errorf("created_at = %v, want %v", bm.CreatedAt, want)
+	}
+	// タイトルが空なら URL を使う
+	if got := report.Items[2].Title; got != "https://blog.golang.org/" {
+		t.Errorf("title = %q, want url", got)
+	}
+
+	req = httptest.NewRequest("GET", "/bookmarks/export.html", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: status = %d, want %d",
+			rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "bookmarks.html") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	out := rec.Body.String()
+	for _, want := range []string{
+		"<!DOCTYPE NETSCAPE-Bookmark-file-1>",
+		`<A HREF="https://pkg.go.dev/" ADD_DATE="1600000000" TAGS="docs,go,ref">Packages</A>`,
+		`<A HREF="https://go.dev"`,
+		`<A HREF="https://blog.golang.org/"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("export missing %q:\n%s", want, out)
+		}
+	}
+
+	// 書き出したファイルを取り込み直すと、すべて重複になる
+	req = httptest.NewRequest("POST", "/bookmarks/import",
+		strings.NewReader(out))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	report = model.ImportReport{}
+	json.NewDecoder(rec.Body).Decode(&report)
+	if report.Created != 0 || report.Skipped != 3 {
+		t.Errorf("reimport report = %+v", report)
+	}
+}
+
+func TestExport(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	createTestBookmark(t, mux,
+		`{"url":"https://go.dev/","title":"Go [公式]","tags":["go","lang"]}`)
+	createTestBookmark(t, mux,
+		`{"url":"https://example.com/a_(b)","title":"=1+1","tags":["misc"]}`)
+
+	export := func(query, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/bookmarks/export"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name, query, accept string
+		contentType, file   string
+		want                []string
+	}{
+		{"CSV", "?format=csv", "", "text/csv; charset=utf-8",
+			"bookmarks.csv", []string{
+				"id,url,title,tags,folder_id,description,created_at,updated_at\n",
+				`1,https://go.dev/,Go [公式],"go,lang",,,`,
+				// 数式として実行されないよう ' を付ける
+				`2,https://example.com/a_(b),'=1+1,misc,,,`,
+			}},
+		{"JSON Lines", "", "application/jsonl",
+			"application/x-ndjson", "bookmarks.jsonl", []string{
+				`{"id":1,"url":"https://go.dev/","title":"Go [公式]"`,
+				"\n" + `{"id":2,`,
+			}},
+		{"Markdown", "", "text/html;q=0.5, text/markdown",
+			"text/markdown; charset=utf-8", "bookmarks.md", []string{
+				"# Bookmarks\n\n",
+				"- [Go \\[公式\\]](https://go.dev/) go, lang\n",
+				"- [=1+1](https://example.com/a_%28b%29) misc\n",
+			}},
+		{"Acceptなし", "", "", "text/csv; charset=utf-8",
+			"bookmarks.csv", nil},
+		{"タグで絞り込み", "?format=jsonl&tag=misc", "",
+			"application/x-ndjson", "bookmarks.jsonl",
+			[]string{`{"id":2,`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := export(tt.query, tt.accept)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			want := `attachment; filename="` + tt.file + `"`
+			if got := rec.Header().Get("Content-Disposition"); got != want {
+				t.Errorf("Content-Disposition = %q, want %q", got, want)
+			}
+			out := rec.Body.String()
+			for _, w := range tt.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("missing %q:\n%s", w, out)
+				}
+			}
+		})
+	}
+
+	if rec := export("?format=jsonl&tag=misc", ""); strings.Count(rec.Body.String(), "\n") != 1 {
+		t.Errorf("filtered export:\n%s", rec.Body)
+	}
+	if rec := export("?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status = %d, want 400", rec.Code)
+	}
+	if rec := export("", "application/xml"); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("unsupported Accept: status = %d, want 406", rec.Code)
+	}
+}
+
+// iterTracker は Iter で読み込み中かどうかを記録する。
+type iterTracker struct {
+	repository.BookmarkStore
+	open int
+}
+
+func (s *iterTracker) Iter(
+	ctx context.Context, ownerID int64, opts repository.ListOptions,
+) iter.Seq2[model.Bookmark, error] {
+	return func(yield func(model.Bookmark, error) bool) {
+		s.open++
+		defer func() { s.open-- }()
+		for b, err := range s.BookmarkStore.Iter(ctx, ownerID, opts) {
+			if !yield(b, err) {
+				return
+			}
+		}
+	}
+}
+
+// heldWriter は読み込み中にクライアントへ書き込んだかを記録する。
+type heldWriter struct {
+	*httptest.ResponseRecorder
+	store *iterTracker
+	held  bool
+}
+
+func (w *heldWriter) Write(p []byte) (int, error) {
+	if w.store.open > 0 {
+		w.held = true
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// 書き出しはページごとに読み切ってから書き込み、
+// クライアントへの書き込み中にクエリを開いたままにしない。
+func TestExport_pages(t *testing.T) {
+	store := &iterTracker{BookmarkStore: repository.NewMemory()}
+	total := exportPageRows*2 + 10
+	for i := range total {
+		_, err := store.Create(t.Context(), testUserID,
+			model.CreateBookmarkRequest{
+				URL:   fmt.Sprintf("https://example.com/%d", i),
+				Title: strconv.Itoa(i),
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	New(store).Routes(mux)
+	srv := asUser(mux, testUserID)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?format=jsonl", total},
+		{"?format=jsonl&limit=" + strconv.Itoa(exportPageRows+1), exportPageRows + 1},
+		{"?format=jsonl&limit=" + strconv.Itoa(exportPageRows), exportPageRows},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := &heldWriter{ResponseRecorder: httptest.NewRecorder(), store: store}
+			srv.ServeHTTP(w, httptest.NewRequest("GET", "/bookmarks/export"+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if w.held {
+				t.Error("wrote to the client while a query was open")
+			}
+			seen := map[int64]bool{}
+			for line := range strings.Lines(w.Body.String()) {
+				var b model.Bookmark
+				if err := json.Unmarshal([]byte(line), &b); err != nil {
+					t.Fatal(err)
+				}
+				seen[b.ID] = true
+			}
+			if len(seen) != tt.want {
+				t.Errorf("exported %d bookmarks, want %d", len(seen), tt.want)
+			}
+		})
+	}
+}
+
+// slowIterStore は Iter を呼ぶたびに delay だけ待つストア。
+type slowIterStore struct {
+	repository.BookmarkStore
+	delay time.Duration
+}
+
+func (s slowIterStore) Iter(
+	ctx context.Context, ownerID int64, opts repository.ListOptions,
+) iter.Seq2[model.Bookmark, error] {
+	time.Sleep(s.delay)
+	return s.BookmarkStore.Iter(ctx, ownerID, opts)
+}
+
+func TestExport_writeTimeout(t *testing.T) {
+	store := slowIterStore{repository.NewMemory(), 40 * time.Millisecond}
+	total := exportPageRows*3 + 10
+	for i := range total {
+		_, err := store.Create(t.Context(), testUserID,
+			model.CreateBookmarkRequest{
+				URL:   fmt.Sprintf("https://example.com/%d", i),
+				Title: strconv.Itoa(i),
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	New(store).Routes(mux)
+
+	// 書き出し全体はサーバーの WriteTimeout より長くかかる
+	srv := httptest.NewUnstartedServer(asUser(mux, testUserID))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL + "/bookmarks/export?format=jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("read after %d bytes: %v", len(body), err)
+	}
+	if n := strings.Count(string(body), "\n"); n != total {
+		t.Errorf("exported %d bookmarks, want %d", n, total)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	bm := createTestBookmark(t, mux,
+		`{"url":"https://go.dev","title":"Go"}`)
+	req := httptest.NewRequest("DELETE", "/bookmarks/1", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/bookmarks/1/history", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var entries []model.AuditEntry
+	json.NewDecoder(rec.Body).Decode(&entries)
+	if rec.Code != http.StatusOK || len(entries) != 2 {
+		t.Fatalf("status = %d, entries = %+v", rec.Code, entries)
+	}
+	// ゴミ箱に移したものの履歴も見られる
+	if entries[0].Action != model.AuditCreate ||
+		entries[1].Action != model.AuditDelete ||
+		entries[1].BookmarkID != bm.ID ||
+		entries[1].ActorID != testUserID {
+		t.Errorf("entries = %+v", entries)
+	}
+
+	req = httptest.NewRequest("GET", "/bookmarks/99/history", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("no history: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	h := New(repository.NewMemory(),
+		WithMetaFetcher(pagemeta.NewFetcher(
+			offlineClient, pagemeta.DefaultMaxBytes)),
+		WithAdmins("admin"))
+	mux := http.NewServeMux()
+	h.Routes(mux)
+	user := asUser(mux, testUserID)
+	admin := http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		ctx := withUser(r.Context(),
+			model.User{ID: 2, Username: "admin"})
+		mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+	for _, u := range []string{"https://a.test", "https://b.test", "https://c.test"} {
+		createTestBookmark(t, user,
+			`{"url":"`+u+`","title":"T"}`)
+	}
+
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get(user, "/audit"); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want 403", rec.Code)
+	}
+	if rec := get(admin, "/audit?since=yesterday"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid since: status = %d, want 400", rec.Code)
+	}
+
+	rec := get(admin, "/audit?limit=2")
+	var page []model.AuditEntry
+	json.NewDecoder(rec.Body).Decode(&page)
+	if rec.Code != http.StatusOK || len(page) != 2 {
+		t.Fatalf("status = %d, page = %+v", rec.Code, page)
+	}
+	link := rec.Header().Get("Link")
+	if link != `</audit?after=2&limit=2>; rel="next"` {
+		t.Fatalf("Link = %q", link)
+	}
+	rec = get(admin, "/audit?after=2&limit=2")
+	page = nil
+	json.NewDecoder(rec.Body).Decode(&page)
+	if len(page) != 1 || page[0].ID != 3 || rec.Header().Get("Link") != "" {
+		t.Errorf("last page: %+v, Link = %q",
+			page, rec.Header().Get("Link"))
+	}
+
+	since := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rec = get(admin, "/audit?since="+since)
+	page = nil
+	json.NewDecoder(rec.Body).Decode(&page)
+	if rec.Code != http.StatusOK || len(page) != 0 {
+		t.Errorf("since future: status = %d, page = %+v", rec.Code, page)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	_, mux := setupTestHandler(t)
+	a := createTestBookmark(t, mux,
+		`{"url":"https://a.test","title":"A"}`)
+
+	do := func(body string) (int, model.BatchResponse) {
+		req := httptest.NewRequest("POST", "/bookmarks/batch",
+			strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var resp model.BatchResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	statuses := func(resp model.BatchResponse) []int {
+		var got []int
+		for _, r := range resp.Results {
+			got = append(got, r.Status)
+		}
+		return got
+	}
+
+	code, resp := do(`{"operations":[
+		{"op":"create","url":"https://b.test","tags":["Go"]},
+		{"op":"create","url":"https://a.test/","title":"A2"},
+		{"op":"update","id":1,"url":"https://a.test","title":"A3"},
+		{"op":"delete","id":99},
+		{"op":"move","id":1},
+		{"op":"create","url":"ftp://x.test","title":"X"}
+	]}`)
+	want := []int{201, 409, 200, 404, 400, 400}
+	if code != http.StatusOK || !slices.Equal(statuses(resp), want) {
+		t.Fatalf("status = %d, results = %v, want %v",
+			code, statuses(resp), want)
+	}
+	if resp.Succeeded != 2 || resp.Failed != 4 {
+		t.Errorf("succeeded = %d, failed = %d", resp.Succeeded, resp.Failed)
+	}
+	// title を省略するとバックグラウンドで取得する
+	created := resp.Results[0].Bookmark
+	if created == nil || created.Title != "https://b.test" ||
+		!created.MetadataPending || !slices.Equal(created.Tags, []string{"go"}) {
+		t.Errorf("created = %+v", created)
+	}
+	if e := resp.Results[1].Error; e == nil ||
+		e.Code != "duplicate_bookmark" || e.ExistingID != a.ID {
+		t.Errorf("duplicate: error = %+v", e)
+	}
+
+	// atomic では失敗した操作のステータスで応答し、何も反映しない
+	code, resp = do(`{"atomic":true,"operations":[
+		{"op":"create","url":"https://c.test","title":"C"},
+		{"op":"delete","id":1},
+		{"op":"delete","id":99}
+	]}`)
+	want = []int{424, 424, 404}
+	if code != http.StatusNotFound || !slices.Equal(statuses(resp), want) {
+		t.Fatalf("atomic: status = %d, results = %v, want %v",
+			code, statuses(resp), want)
+	}
+	req := httptest.NewRequest("GET", "/bookmarks/1", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("rolled back delete: status = %d", rec.Code)
+	}
+
+	// 検証で失敗した場合もストアに渡さない
+	code, resp = do(`{"atomic":true,"operations":[
+		{"op":"create","url":"https://c.test","title":"C"},
+		{"op":"update","id":1,"url":"https://a.test"}
+	]}`)
+	if code != http.StatusBadRequest ||
+		!slices.Equal(statuses(resp), []int{424, 400}) {
+		t.Errorf("atomic invalid: status = %d, results = %v",
+			code, statuses(resp))
+	}
+
+	code, _ = do(`{"operations":[]}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("empty: status = %d, want 400", code)
+	}
+}
+
+// slowBatchStore は一括操作の1回ごとに delay だけ待つストア。
+// slowURL を登録する操作は ctx が終わるまで応答しない。
+type slowBatchStore struct {
+	repository.BookmarkStore
+	delay time.Duration
+}
+
+const slowURL = "https://slow.test"
+
+func (s slowBatchStore) Batch(
+	ctx context.Context, ownerID int64,
+	ops []repository.BatchOp, atomic bool,
+) ([]repository.BatchResult, error) {
+	for _, op := range ops {
+		if op.Create.URL == slowURL {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.BookmarkStore.Batch(ctx, ownerID, ops, atomic)
+}
+
+func TestBatch_timeout(t *testing.T) {
+	h := New(
+		slowBatchStore{repository.NewMemory(), 15 * time.Millisecond},
+		WithQueryTimeout(40*time.Millisecond),
+	)
+	m := http.NewServeMux()
+	h.Routes(m)
+	mux := asUser(m, testUserID)
+
+	do := func(body string) (int, model.BatchResponse) {
+		req := httptest.NewRequest("POST", "/bookmarks/batch",
+			strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var resp model.BatchResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	// 制限時間は1件ごとなので、合計で超えても続ける。
+	// 制限時間切れで中断したら、それまでの結果を返す
+	code, resp := do(`{"operations":[
+		{"op":"create","url":"https://a.test","title":"A"},
+		{"op":"create","url":"https://b.test","title":"B"},
+		{"op":"create","url":"https://c.test","title":"C"},
+		{"op":"create","url":"https://slow.test","title":"S"},
+		{"op":"create","url":"ftp://x.test","title":"X"},
+		{"op":"create","url":"https://d.test","title":"D"}
+	]}`)
+	var got []int
+	for _, r := range resp.Results {
+		got = append(got, r.Status)
+	}
+	want := []int{201, 201, 201, 504, 400, 424}
+	if code != http.StatusOK || !slices.Equal(got, want) {
+		t.Fatalf("status = %d, results = %v, want %v",
+			code, got, want)
+	}
+	if resp.Succeeded != 3 || resp.Failed != 3 {
+		t.Errorf("succeeded = %d, failed = %d",
+			resp.Succeeded, resp.Failed)
+	}
+	if e := resp.Results[5].Error; e == nil || e.Code != "not_executed" {
+		t.Errorf("not executed: error = %+v", e)
+	}
+
+	// atomic は操作数分の制限時間で、切れたら何も反映しない
+	code, _ = do(`{"atomic":true,"operations":[
+		{"op":"create","url":"https://e.test","title":"E"},
+		{"op":"create","url":"https://slow.test","title":"S"}
+	]}`)
+	if code != http.StatusGatewayTimeout {
+		t.Errorf("atomic: status = %d, want 504", code)
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/netscape"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
+)
+
+// maxImportSize はインポートするファイルの最大バイト数。
+const maxImportSize = 10 << 20
+
+// importBookmarks はブラウザから書き出した HTML を取り込む。
+// 本文にファイルをそのまま送るほか、フォームの
+// file フィールドでの送信 (multipart/form-data) も受け付ける。
+// フォルダ名はタグに、ADD_DATE は登録日時になる。
+func (h *Handler) importBookmarks(
+	w http.ResponseWriter, r *http.Request,
+) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	src, err := importSource(r)
+	if err != nil {
+		writeImportError(w, r, err)
+		return
+	}
+	entries, err := netscape.Parse(src)
+	if err != nil {
+		writeImportError(w, r, err)
+		return
+	}
+
+	report := model.ImportReport{
+		Items: make([]model.ImportItem, 0, len(entries)),
+	}
+	for _, e := range entries {
+		item, err := h.importEntry(r.Context(), ownerID(r), e)
+		if err != nil {
+			// 登録済みの分はそのまま残る。同じファイルを
+			// 送り直せば、残りだけが登録される
+			writeStoreError(w, r, err,
+				"インポートに失敗しました")
+			return
+		}
+		switch item.Status {
+		case model.ImportCreated:
+			report.Created++
+		case model.ImportSkipped:
+			report.Skipped++
+		case model.ImportRejected:
+			report.Rejected++
+		}
+		report.Items = append(report.Items, item)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// importSource はリクエストからファイルの中身を取り出す。
+func importSource(r *http.Request) (io.Reader, error) {
+	mt, _, _ := mime.ParseMediaType(
+		r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		return r.Body, nil
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeImportError(
+	w http.ResponseWriter, r *http.Request, err error,
+) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, r, probTooLarge,
+			"ファイルは10MB以下にしてください")
+		return
+	}
+	writeProblem(w, r, probInvalidFile, "")
+}
+
+// importEntry は1件を登録する。登録できなかった理由は
+// 結果に含め、ストアの障害のときだけ error を返す。
+// 件数が多くても途中で制限時間切れにならないよう、
+// 制限時間は1件ごとに設ける。
+func (h *Handler) importEntry(
+	ctx context.Context, owner int64, e netscape.Entry,
+) (model.ImportItem, error) {
+	item := model.ImportItem{URL: e.URL, Title: e.Title}
+	if err := urlnorm.Validate(e.URL); err != nil {
+		item.Status = model.ImportRejected
+		item.Reason = invalidURLMessage
+		return item, nil
+	}
+	if item.Title == "" {
+		item.Title = e.URL
+	}
+	// 長すぎるフォルダ名などタグにできないものは使わない
+	var tags []string
+	for _, name := range append(e.Folders, e.Tags...) {
+		if _, ok := normalizeTag(name); ok {
+			tags = append(tags, name)
+		}
+	}
+	tags, _ = normalizeTags(tags)
+
+	ctx, cancel := context.WithTimeout(ctx, h.queryTimeout)
+	defer cancel()
+	bm, err := h.repo.Create(ctx, owner, model.CreateBookmarkRequest{
+		URL: e.URL, Title: item.Title, Tags: tags,
+		CreatedAt: e.AddDate,
+	})
+	var dup *repository.DuplicateError
+	if errors.As(err, &dup) {
+		item.Status = model.ImportSkipped
+		item.ID = dup.ID
+		item.Reason = "同じURLのブックマークが既にあります"
+		return item, nil
+	}
+	if err != nil {
+		return item, err
+	}
+	item.Status = model.ImportCreated
+	item.ID = bm.ID
+	return item, nil
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// defaultCheckTimeout は POST /bookmarks/{id}/check で
+// 相手のサーバーの応答を待つ既定の制限時間。
+const defaultCheckTimeout = 10 * time.Second
+
+// checkBookmark はブックマークのリンクをすぐに確かめ、
+// 結果を記録したブックマークを返す。バックグラウンドの
+// チェックを待たずに、直したリンクなどを確かめ直すためのもの。
+func (h *Handler) checkBookmark(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	owner := ownerID(r)
+	ctx, cancel := context.WithTimeout(
+		r.Context(), h.queryTimeout)
+	bm, err := h.repo.FindByID(ctx, owner, id)
+	cancel()
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+
+	res := h.checker.Check(r.Context(), bm.URL)
+	if r.Context().Err() != nil {
+		// 中断による失敗はリンク切れとして記録しない
+		writeStoreError(w, r, r.Context().Err(),
+			"チェックに失敗しました")
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(
+		r.Context(), h.queryTimeout)
+	defer cancel()
+	err = h.repo.RecordCheck(ctx, id, res)
+	if err == nil {
+		bm, err = h.repo.FindByID(ctx, owner, id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// チェック中に削除された
+		writeProblem(w, r, probNotFound, bookmarkNotFoundMessage)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"チェック結果の記録に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, bm)
+}
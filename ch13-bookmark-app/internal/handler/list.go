@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// 一覧の1ページあたりの既定件数と上限。
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor はカーソルをクライアントから見て
+// 不透明な文字列にする。中身の形式に依存させないため、
+// URL セーフな Base64 で包む。
+func encodeCursor(c repository.Cursor) string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339) +
+		"," + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(raw),
+	)
+}
+
+func decodeCursor(s string) (repository.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return repository.Cursor{}, errInvalidCursor
+	}
+	return repository.Cursor{
+		CreatedAt: createdAt, ID: n,
+	}, nil
+}
+
+// linkStatuses は status パラメータの値。
+var linkStatuses = map[string]repository.LinkStatus{
+	"":          repository.LinkAny,
+	"broken":    repository.LinkBroken,
+	"ok":        repository.LinkOK,
+	"unchecked": repository.LinkUnchecked,
+}
+
+// listOptions はクエリ文字列から絞り込み条件を作る。
+// ?tag=go&tag=http&match=any のように指定し、
+// match を省略した場合はすべてのタグを持つもの (all) に絞る。
+// status=broken ならリンク切れのものだけを返す。
+// limit と after はページ送りに使う。
+// 不正なパラメータは v に加える。
+func listOptions(
+	r *http.Request, v *validation,
+) repository.ListOptions {
+	q := r.URL.Query()
+	opts := repository.ListOptions{
+		Tags:  checkTags(v, q["tag"]),
+		Limit: parseLimit(v, q.Get("limit")),
+	}
+	switch q.Get("match") {
+	case "", "all":
+		opts.MatchAll = true
+	case "any":
+	default:
+		v.add("match", "match は all か any で指定してください")
+	}
+	link, ok := linkStatuses[q.Get("status")]
+	if !ok {
+		v.add("status",
+			"status は broken, ok, unchecked のいずれかで指定してください")
+	}
+	opts.Link = link
+	if s := q.Get("after"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			v.add("after", "after が不正です")
+		}
+		opts.After = &c
+	}
+	return opts
+}
+
+// parseLimit はページ送りの limit を読む。
+// 省略時は defaultPageLimit を返す。
+func parseLimit(v *validation, s string) int {
+	if s == "" {
+		return defaultPageLimit
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxPageLimit {
+		v.add("limit", "limit は1〜"+
+			strconv.Itoa(maxPageLimit)+"で指定してください")
+	}
+	return n
+}
+
+// listBookmarks は一覧を1ページ分返す。
+// 続きがある場合は、次のページの URL を
+// Link ヘッダ (rel="next") で知らせる。
+func (h *Handler) listBookmarks(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var v validation
+	opts := listOptions(r, &v)
+	if v.write(w, r) {
+		return
+	}
+	limit := opts.Limit
+	// 1件多く読み、次のページがあるかを判定する
+	opts.Limit++
+	bookmarks := make([]model.Bookmark, 0, limit)
+	hasNext := false
+	bms := h.repo.Iter(r.Context(), ownerID(r), opts)
+	for b, err := range bms {
+		if err != nil {
+			writeStoreError(w, r, err,
+				"取得に失敗しました")
+			return
+		}
+		if len(bookmarks) == limit {
+			hasNext = true
+			break
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	if hasNext {
+		last := bookmarks[len(bookmarks)-1]
+		w.Header().Set("Link",
+			nextLink(r, encodeCursor(repository.CursorOf(last))))
+	}
+	writeJSON(w, http.StatusOK, bookmarks)
+}
+
+// nextLink は現在のクエリを引き継ぎ、
+// after だけを差し替えた次ページへのリンクを作る。
+func nextLink(r *http.Request, after string) string {
+	q := r.URL.Query()
+	q.Set("after", after)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return "<" + u.RequestURI() + `>; rel="next"`
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec は API の OpenAPI 3.1 ドキュメント。
+// エンドポイントやモデルを変えたら合わせて更新する。
+// 漏れは TestOpenAPI で検出する。
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage は openAPISpec を読み込んで表示するページ。
+// 外部のスクリプトに頼らず、このファイルだけで表示できる。
+//
+//go:embed docs.html
+var docsPage []byte
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func serveDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'self'; script-src 'unsafe-inline'; "+
+			"style-src 'unsafe-inline'")
+	w.Write(docsPage)
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPISchema struct {
+	Ref        string                     `json:"$ref"`
+	Properties map[string]json.RawMessage `json:"properties"`
+	AllOf      []openAPISchema            `json:"allOf"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	t.Helper()
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return doc
+}
+
+// properties は allOf で参照したスキーマも含めたプロパティ名を返す。
+func (d openAPIDoc) properties(s openAPISchema) []string {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		return d.properties(d.Components.Schemas[name])
+	}
+	var names []string
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	for _, part := range s.AllOf {
+		names = append(names, d.properties(part)...)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// jsonFields は t を JSON にしたときのフィールド名を返す。
+// 埋め込んだ構造体のフィールドも含める。
+func jsonFields(t reflect.Type) []string {
+	var names []string
+	for f := range t.Fields() {
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			names = append(names, jsonFields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// TestOpenAPI_routes は登録したエンドポイントと
+// openapi.json の paths が一致することを確かめる。
+func TestOpenAPI_routes(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	registered := map[string]bool{}
+	routes := append((&Handler{}).routes(), (&AuthHandler{}).routes()...)
+	for _, rt := range routes {
+		registered[rt.pattern] = true
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("openapi.json に %s がありません", rt.pattern)
+		}
+	}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			pattern := strings.ToUpper(method) + " " + path
+			if !registered[pattern] {
+				t.Errorf("openapi.json の %s は登録されていません", pattern)
+			}
+		}
+	}
+}
+
+// TestOpenAPI_schemas はモデルの JSON のフィールドと
+// openapi.json のスキーマのプロパティが一致することを確かめる。
+func TestOpenAPI_schemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	models := map[string]reflect.Type{
+		"Bookmark":              reflect.TypeFor[model.Bookmark](),
+		"CreateBookmarkRequest": reflect.TypeFor[model.CreateBookmarkRequest](),
+		"UpdateBookmarkRequest": reflect.TypeFor[model.UpdateBookmarkRequest](),
+		// PATCH の本文は UpdateBookmarkRequest にマージする
+		"BookmarkPatch":       reflect.TypeFor[model.UpdateBookmarkRequest](),
+		"SearchResult":        reflect.TypeFor[model.SearchResult](),
+		"Tag":                 reflect.TypeFor[model.Tag](),
+		"RenameTagRequest":    reflect.TypeFor[model.RenameTagRequest](),
+		"MergeTagRequest":     reflect.TypeFor[model.MergeTagRequest](),
+		"Folder":              reflect.TypeFor[model.Folder](),
+		"CreateFolderRequest": reflect.TypeFor[model.CreateFolderRequest](),
+		"UpdateFolderRequest": reflect.TypeFor[model.UpdateFolderRequest](),
+		"MoveFolderRequest":   reflect.TypeFor[model.MoveFolderRequest](),
+		"MoveBookmarkRequest": reflect.TypeFor[model.MoveBookmarkRequest](),
+		"FolderTree":          reflect.TypeFor[model.FolderTree](),
+		"ImportReport":        reflect.TypeFor[model.ImportReport](),
+		"ImportItem":          reflect.TypeFor[model.ImportItem](),
+		"AuditEntry":          reflect.TypeFor[model.AuditEntry](),
+		"BatchRequest":        reflect.TypeFor[model.BatchRequest](),
+		"BatchOperation":      reflect.TypeFor[model.BatchOperation](),
+		"BatchResponse":       reflect.TypeFor[model.BatchResponse](),
+		"BatchResult":         reflect.TypeFor[model.BatchResult](),
+		"Problem":             reflect.TypeFor[model.Problem](),
+		"FieldError":          reflect.TypeFor[model.FieldError](),
+		"User":                reflect.TypeFor[model.User](),
+		"Credentials":         reflect.TypeFor[model.Credentials](),
+		"APIToken":            reflect.TypeFor[model.APIToken](),
+		"CreateTokenRequest":  reflect.TypeFor[model.CreateTokenRequest](),
+		"CreatedToken":        reflect.TypeFor[model.CreatedToken](),
+	}
+	for name, typ := range models {
+		s, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("openapi.json にスキーマ %s がありません", name)
+			continue
+		}
+		got := doc.properties(s)
+		for _, f := range jsonFields(typ) {
+			if !slices.Contains(got, f) {
+				t.Errorf("%s: openapi.json に %s がありません", name, f)
+			}
+		}
+		for _, p := range got {
+			if !slices.Contains(jsonFields(typ), p) {
+				t.Errorf("%s: %s は %s にないフィールドです", name, p, typ)
+			}
+		}
+	}
+	for name := range doc.Components.Schemas {
+		if _, ok := models[name]; !ok {
+			t.Errorf("スキーマ %s に対応するモデルがテストにありません", name)
+		}
+	}
+}
+
+func TestOpenAPI_serve(t *testing.T) {
+	a := NewAuth(nil)
+	mux := http.NewServeMux()
+	(&Handler{}).Routes(mux)
+	srv := a.Authenticate(mux)
+
+	for path, ct := range map[string]string{
+		"/openapi.json": "application/json",
+		"/docs":         "text/html; charset=utf-8",
+	} {
+		// ログインしていなくても見られる
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", path, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != ct {
+			t.Errorf("%s: Content-Type = %q, want %q", path, got, ct)
+		}
+	}
+}
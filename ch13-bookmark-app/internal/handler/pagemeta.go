@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// defaultFetchTimeout はタイトルを省略した登録で
+// ページの取得を待つ既定の制限時間。
+const defaultFetchTimeout = 5 * time.Second
+
+// fillMetadata は req.URL のページを取得し、
+// タイトルとメタデータを req に設定する。
+// 取得に失敗した場合は URL をタイトルにして、
+// バックグラウンドで取得し直す印を付ける。
+// ページにタイトルがなければ URL をタイトルにする。
+func (h *Handler) fillMetadata(
+	ctx context.Context, req *model.CreateBookmarkRequest,
+) {
+	meta, err := h.fetcher.Fetch(ctx, req.URL)
+	if err != nil {
+		slog.InfoContext(ctx, "メタデータの取得失敗",
+			"url", req.URL, "error", err)
+		req.Title = req.URL
+		req.MetadataPending = true
+		return
+	}
+	req.Meta = meta
+	req.Title = meta.Title
+	if req.Title == "" {
+		req.Title = req.URL
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// applyMergePatch は current に patch を適用した結果を返す。
+// JSON として往復させることで、フィールドが増えても
+// マージ処理を書き換えずに済むようにしている。
+func applyMergePatch(
+	current model.UpdateBookmarkRequest,
+	patch any,
+) (model.UpdateBookmarkRequest, error) {
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return current, err
+	}
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return current, err
+	}
+	merged, err := json.Marshal(
+		mergePatch(doc, patch),
+	)
+	if err != nil {
+		return current, err
+	}
+	var req model.UpdateBookmarkRequest
+	err = json.Unmarshal(merged, &req)
+	return req, err
+}
+
+// mergePatch は RFC 7396 のアルゴリズムそのもの。
+// patch がオブジェクトでなければ target を丸ごと置き換え、
+// 値が null のキーは target から削除する。
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
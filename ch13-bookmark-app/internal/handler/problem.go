@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+// problemTypeBase は Problem.Type の URI の接頭辞。
+const problemTypeBase = "urn:bookmarks:problem:"
+
+// problemKind はエラーの種類。code はクライアントが
+// 処理を分けるための識別子で、一度公開したら変えない。
+type problemKind struct {
+	code   string
+	status int
+	title  string
+}
+
+// エラーの種類の一覧。README の「エラーレスポンス」の表と
+// 合わせておく。
+var (
+	probInvalidJSON = problemKind{"invalid_json",
+		http.StatusBadRequest, "リクエストの本文を JSON として読めません"}
+	probValidation = problemKind{"validation_failed",
+		http.StatusBadRequest, "入力内容に誤りがあります"}
+	probInvalidPatch = problemKind{"invalid_patch",
+		http.StatusBadRequest, "パッチを適用できません"}
+	probInvalidFile = problemKind{"invalid_file",
+		http.StatusBadRequest, "ファイルを読み込めませんでした"}
+	probUnauthorized = problemKind{"unauthorized",
+		http.StatusUnauthorized, "ログインが必要です"}
+	probInvalidCredentials = problemKind{"invalid_credentials",
+		http.StatusUnauthorized, "ユーザー名またはパスワードが違います"}
+	probInvalidToken = problemKind{"invalid_token",
+		http.StatusUnauthorized, "トークンが無効です"}
+	probForbidden = problemKind{"forbidden",
+		http.StatusForbidden, "権限がありません"}
+	probSessionRequired = problemKind{"session_required",
+		http.StatusForbidden, "パスワードでのログインが必要です"}
+	probInsufficientScope = problemKind{"insufficient_scope",
+		http.StatusForbidden, "トークンの権限が足りません"}
+	probNotFound = problemKind{"not_found",
+		http.StatusNotFound, "見つかりません"}
+	probDuplicate = problemKind{"duplicate_bookmark",
+		http.StatusConflict, "同じURLのブックマークが既にあります"}
+	probTagExists = problemKind{"tag_exists",
+		http.StatusConflict, "同名のタグが既にあります"}
+	probFolderCycle = problemKind{"folder_cycle",
+		http.StatusConflict, "フォルダを自分自身やその中には移動できません"}
+	probUsernameTaken = problemKind{"username_taken",
+		http.StatusConflict, "そのユーザー名は既に使われています"}
+	probNotAcceptable = problemKind{"not_acceptable",
+		http.StatusNotAcceptable, "対応していない形式です"}
+	probTooLarge = problemKind{"payload_too_large",
+		http.StatusRequestEntityTooLarge, "リクエストが大きすぎます"}
+	probRateLimited = problemKind{"rate_limited",
+		http.StatusTooManyRequests, "リクエストが多すぎます"}
+	probCanceled = problemKind{"canceled",
+		http.StatusServiceUnavailable, "処理が中断されました"}
+	probTimeout = problemKind{"timeout",
+		http.StatusGatewayTimeout, "処理が制限時間内に終わりませんでした"}
+	probInternal = problemKind{"internal_error",
+		http.StatusInternalServerError, "サーバーでエラーが発生しました"}
+)
+
+// problem は r へのエラーレスポンスを作る。
+func (k problemKind) problem(
+	r *http.Request, detail string,
+) model.Problem {
+	return model.Problem{
+		Type:      problemTypeBase + k.code,
+		Code:      k.code,
+		Title:     k.title,
+		Status:    k.status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestid.FromContext(r.Context()),
+	}
+}
+
+// writeProblem は kind のエラーを返す。
+// detail はこの発生に固有の説明で、空でもよい。
+func writeProblem(
+	w http.ResponseWriter, r *http.Request,
+	kind problemKind, detail string,
+) {
+	writeProblemValue(w, kind.problem(r, detail))
+}
+
+func writeProblemValue(w http.ResponseWriter, p model.Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// validation は入力の検証エラーを集める。最初のエラーで
+// 止めずにすべてのフィールドを確かめ、まとめて返すために使う。
+type validation []model.FieldError
+
+func (v *validation) add(field, reason string) {
+	*v = append(*v, model.FieldError{Field: field, Reason: reason})
+}
+
+// write はエラーがあれば 400 を返して true を返す。
+func (v validation) write(
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	if len(v) == 0 {
+		return false
+	}
+	p := probValidation.problem(r, "")
+	p.Errors = v
+	writeProblemValue(w, p)
+	return true
+}
+
+// writeFieldError は1つのフィールドの検証エラーを返す。
+func writeFieldError(
+	w http.ResponseWriter, r *http.Request,
+	field, reason string,
+) {
+	v := validation{}
+	v.add(field, reason)
+	v.write(w, r)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/ratelimit"
+)
+
+// RateLimiter は呼び出し元ごとにリクエスト数を制限する。
+// ログインしていればユーザーごと、していなければクライアントの
+// IP アドレスごとに数え、読み取り (GET, HEAD) と書き込みは
+// 別々に数える。publicPaths は監視に使うため制限しない。
+// 認証に失敗したリクエストは、ユーザーを特定できないため
+// IP アドレスの分として数える。
+type RateLimiter struct {
+	read  *ratelimit.Limiter
+	write *ratelimit.Limiter
+	ips   clientip.Resolver
+}
+
+// NewRateLimiter は RateLimiter を生成する。Rate が 0 以下の
+// 制限は使わない。ips はログインしていない呼び出し元の
+// アドレスを求めるのに使う。
+func NewRateLimiter(
+	read, write ratelimit.Limit, ips clientip.Resolver,
+) *RateLimiter {
+	l := &RateLimiter{ips: ips}
+	if read.Rate > 0 {
+		l.read = ratelimit.New(read)
+	}
+	if write.Rate > 0 {
+		l.write = ratelimit.New(write)
+	}
+	return l
+}
+
+// allow はリクエストを数え、RateLimit-* ヘッダーを付ける。
+// 上限を超えていれば 429 を返して false を返す。
+func (l *RateLimiter) allow(
+	w http.ResponseWriter, r *http.Request, id *identity,
+) bool {
+	if slices.Contains(publicPaths, r.URL.Path) {
+		return true
+	}
+	lim := l.write
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		lim = l.read
+	}
+	key := l.ipKey(r)
+	if id != nil {
+		key = "user:" + strconv.FormatInt(id.user.ID, 10)
+	}
+	return take(w, r, lim, key)
+}
+
+// allowFailure は認証に失敗したリクエストを、クライアントの
+// IP アドレスの分として数える。トークンの総当たりを防ぐため、
+// publicPaths も含めて、読み取りでも書き込みの上限で数える。
+func (l *RateLimiter) allowFailure(
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	lim := cmp.Or(l.write, l.read)
+	return take(w, r, lim, l.ipKey(r))
+}
+
+// ipKey はログインしていない呼び出し元のキー。
+// IPv6 は1つの契約で /64 をまとめて割り当てられることが多いため、
+// /64 ごとに数える。
+func (l *RateLimiter) ipKey(r *http.Request) string {
+	ip := l.ips.ClientIP(r).Unmap()
+	if ip.Is6() {
+		p, _ := ip.Prefix(64)
+		return "ip:" + p.String()
+	}
+	return "ip:" + ip.String()
+}
+
+// take は lim から key の分を1つ使う。lim が nil なら制限しない。
+func take(
+	w http.ResponseWriter, r *http.Request,
+	lim *ratelimit.Limiter, key string,
+) bool {
+	if lim == nil {
+		return true
+	}
+	res := lim.Allow(key)
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", seconds(res.Reset))
+	if res.Allowed {
+		return true
+	}
+	h.Set("Retry-After", seconds(max(res.RetryAfter, time.Second)))
+	writeProblem(w, r, probRateLimited,
+		"Retry-After の秒数が経ってから再度送信してください")
+	return false
+}
+
+// seconds は d を切り上げた秒数の文字列にする。
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/clientip"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/ratelimit"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+func TestRateLimit(t *testing.T) {
+	// 補充はテスト中に起きないほど遅くする
+	limiter := NewRateLimiter(
+		ratelimit.Limit{Rate: 0.001, Burst: 3},
+		ratelimit.Limit{Rate: 0.001, Burst: 2},
+		clientip.Resolver{})
+	a := NewAuth(repository.NewMemoryUsers(), WithRateLimit(limiter))
+	mux := http.NewServeMux()
+	a.Routes(mux)
+	New(repository.NewMemory()).Routes(mux)
+	srv := a.Authenticate(mux)
+
+	do := func(method, path, remote string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path,
+			strings.NewReader(`{"username":"alice","password":"password1"}`))
+		req.RemoteAddr = remote
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 未ログインの書き込みは IP アドレスごとに数える
+	rec := do("POST", "/auth/register", "198.51.100.1:1", nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("RateLimit-Remaining"); got != "1" {
+		t.Errorf("RateLimit-Remaining = %q, want 1", got)
+	}
+	rec = do("POST", "/auth/login", "198.51.100.1:1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status = %d: %s", rec.Code, rec.Body)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	rec = do("POST", "/auth/login", "198.51.100.1:1", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("3rd write: status = %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" ||
+		rec.Header().Get("RateLimit-Limit") != "2" ||
+		rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+	var p model.Problem
+	json.NewDecoder(rec.Body).Decode(&p)
+	if p.Code != "rate_limited" || p.Status != http.StatusTooManyRequests {
+		t.Errorf("problem = %+v", p)
+	}
+
+	// 別のアドレスからは受け付ける
+	if rec := do("POST", "/auth/login", "198.51.100.2:1", nil); rec.Code != http.StatusOK {
+		t.Errorf("other address: status = %d", rec.Code)
+	}
+
+	// ログイン後はアドレスが変わってもユーザーごとに数え、
+	// 読み取りは書き込みと別に数える
+	for i, remote := range []string{"203.0.113.1:1", "203.0.113.2:1", "203.0.113.3:1"} {
+		if rec := do("GET", "/bookmarks", remote, cookie); rec.Code != http.StatusOK {
+			t.Fatalf("read %d: status = %d", i, rec.Code)
+		}
+	}
+	if rec := do("GET", "/bookmarks", "203.0.113.4:1", cookie); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("4th read: status = %d, want 429", rec.Code)
+	}
+
+	// ドキュメントなど publicPaths は制限しない
+	for range 5 {
+		rec := do("GET", "/openapi.json", "198.51.100.1:1", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/openapi.json: status = %d", rec.Code)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "" {
+			t.Error("/openapi.json: RateLimit-Limit is set")
+		}
+	}
+}
+
+func TestRateLimit_failedAuth(t *testing.T) {
+	limiter := NewRateLimiter(
+		ratelimit.Limit{Rate: 0.001, Burst: 5},
+		ratelimit.Limit{Rate: 0.001, Burst: 2},
+		clientip.Resolver{})
+	a := NewAuth(repository.NewMemoryUsers(), WithRateLimit(limiter))
+	mux := http.NewServeMux()
+	a.Routes(mux)
+	New(repository.NewMemory()).Routes(mux)
+	srv := a.Authenticate(mux)
+
+	do := func(
+		method, path, remote, token string, c *http.Cookie,
+	) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path,
+			strings.NewReader(`{"username":"alice","password":"password1"}`))
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do("POST", "/auth/register", "192.0.2.1:1", "", nil)
+	cookie := do("POST", "/auth/login", "192.0.2.1:1", "", nil).
+		Result().Cookies()[0]
+
+	// 無効なトークンは読み取りでも publicPaths でも、
+	// IP アドレスごとに書き込みの上限で数える
+	attacker := "198.51.100.1:1"
+	for i, path := range []string{"/bookmarks", "/healthz"} {
+		if rec := do("GET", path, attacker, "bad", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i, rec.Code)
+		}
+	}
+	if rec := do("GET", "/healthz", attacker, "bad", nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("3rd attempt: status = %d, want 429", rec.Code)
+	}
+	// 同じアドレスでも、ログイン済みのユーザーは自分の分で数える
+	if rec := do("GET", "/bookmarks", attacker, "", cookie); rec.Code != http.StatusOK {
+		t.Errorf("valid user: status = %d, want 200", rec.Code)
+	}
+
+	// IPv6 は /64 ごとに数える
+	for i, remote := range []string{"[2001:db8::1]:1", "[2001:db8::2]:1"} {
+		if rec := do("GET", "/bookmarks", remote, "bad", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("ipv6 attempt %d: status = %d, want 401", i, rec.Code)
+		}
+	}
+	if rec := do("GET", "/bookmarks", "[2001:db8::ffff]:1", "bad", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("same /64: status = %d, want 429", rec.Code)
+	}
+	if rec := do("GET", "/bookmarks", "[2001:db8:0:1::1]:1", "bad", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other /64: status = %d, want 401", rec.Code)
+	}
+}
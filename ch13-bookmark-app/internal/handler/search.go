@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 検索結果の既定件数と上限。
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+func (h *Handler) searchBookmarks(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var v validation
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		v.add("q", "q は必須です")
+	}
+	limit := defaultSearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			v.add("limit", "limit は1〜100で指定してください")
+		}
+		limit = n
+	}
+	if v.write(w, r) {
+		return
+	}
+	results, err := h.repo.Search(
+		r.Context(), ownerID(r), q, limit,
+	)
+	if err != nil {
+		writeStoreError(w, r, err,
+			"検索に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
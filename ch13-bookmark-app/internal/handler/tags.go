@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// maxTagLength はタグ名の最大文字数。
+const maxTagLength = 50
+
+const invalidTagMessage = "タグは1〜50文字で指定してください"
+
+// normalizeTag は前後の空白を除いて小文字にそろえる。
+// "Go" と "go" を別のタグとして扱わないため。
+func normalizeTag(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	n := utf8.RuneCountInString(name)
+	return name, n > 0 && n <= maxTagLength
+}
+
+// normalizeTags は各タグを正規化し、
+// 重複を除いて名前順に並べる。
+func normalizeTags(tags []string) ([]string, bool) {
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		name, ok := normalizeTag(t)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), true
+}
+
+// checkTag は field のタグを正規化し、不正なら v に加える。
+func checkTag(v *validation, field, name string) string {
+	name, ok := normalizeTag(name)
+	if !ok {
+		v.add(field, invalidTagMessage)
+	}
+	return name
+}
+
+// checkTags は各タグを正規化し、重複を除いて名前順に並べる。
+// 不正なタグは tags[1] のように位置を付けて v に加える。
+func checkTags(v *validation, tags []string) []string {
+	out := make([]string, 0, len(tags))
+	for i, t := range tags {
+		name, ok := normalizeTag(t)
+		if !ok {
+			v.add("tags["+strconv.Itoa(i)+"]", invalidTagMessage)
+			continue
+		}
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+func (h *Handler) listTags(
+	w http.ResponseWriter, r *http.Request,
+) {
+	tags, err := h.repo.Tags(r.Context(), ownerID(r))
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (h *Handler) renameTag(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req model.RenameTagRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	var v validation
+	from := checkTag(&v, "tag", r.PathValue("name"))
+	to := checkTag(&v, "name", req.Name)
+	if v.write(w, r) {
+		return
+	}
+	err := h.repo.RenameTag(r.Context(), ownerID(r), from, to)
+	if errors.Is(err, repository.ErrTagExists) {
+		writeProblem(w, r, probTagExists,
+			"統合する場合は merge を使ってください")
+		return
+	}
+	h.writeTagResult(w, r, err)
+}
+
+func (h *Handler) mergeTags(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req model.MergeTagRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	var v validation
+	from := checkTag(&v, "tag", r.PathValue("name"))
+	into := checkTag(&v, "into", req.Into)
+	if v.write(w, r) {
+		return
+	}
+	err := h.repo.MergeTags(r.Context(), ownerID(r), from, into)
+	h.writeTagResult(w, r, err)
+}
+
+// writeTagResult はタグ操作の結果を返す。
+// 成功時は変更後のタグ一覧を返す。
+func (h *Handler) writeTagResult(
+	w http.ResponseWriter, r *http.Request,
+	err error,
+) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, "タグが見つかりません")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"更新に失敗しました")
+		return
+	}
+	tags, err := h.repo.Tags(r.Context(), ownerID(r))
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/auth"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// tokenPrefix は API トークンの先頭に付ける文字列。
+// 漏えいしたトークンをシークレットスキャナで見つけやすくする。
+const tokenPrefix = "bm_"
+
+// maxTokenNameLength はトークン名の最大文字数。
+const maxTokenNameLength = 100
+
+// createToken は API トークンを作成する。
+// トークンの文字列はこのレスポンスでしか返さない。
+func (a *AuthHandler) createToken(
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req model.CreateTokenRequest
+	if err := json.NewDecoder(r.Body).
+		Decode(&req); err != nil {
+		writeProblem(w, r, probInvalidJSON, "")
+		return
+	}
+	var v validation
+	req.Name = strings.TrimSpace(req.Name)
+	if n := utf8.RuneCountInString(req.Name); n == 0 ||
+		n > maxTokenNameLength {
+		v.add("name", "name は1〜100文字で指定してください")
+	}
+	scopes, ok := normalizeScopes(req.Scopes)
+	if !ok {
+		v.add("scopes", "scopes は "+strings.Join(model.Scopes, ", ")+
+			" から1つ以上指定してください")
+	}
+	if req.ExpiresAt != nil &&
+		!req.ExpiresAt.After(time.Now()) {
+		v.add("expires_at", "expires_at は未来の日時で指定してください")
+	}
+	if v.write(w, r) {
+		return
+	}
+
+	token := tokenPrefix + auth.NewToken()
+	t, err := a.users.CreateToken(r.Context(), ownerID(r),
+		auth.HashToken(token), model.APIToken{
+			Name: req.Name, Scopes: scopes,
+			ExpiresAt: req.ExpiresAt,
+		})
+	if err != nil {
+		writeStoreError(w, r, err,
+			"作成に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusCreated, model.CreatedToken{
+		APIToken: t, Token: token,
+	})
+}
+
+// normalizeScopes は重複を除いて名前順に並べる。
+// 未知のスコープを含むか、空なら false を返す。
+func normalizeScopes(scopes []string) ([]string, bool) {
+	if len(scopes) == 0 {
+		return nil, false
+	}
+	out := slices.Clone(scopes)
+	for _, s := range out {
+		if !slices.Contains(model.Scopes, s) {
+			return nil, false
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out), true
+}
+
+func (a *AuthHandler) listTokens(
+	w http.ResponseWriter, r *http.Request,
+) {
+	tokens, err := a.users.Tokens(r.Context(), ownerID(r))
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// revokeToken はトークンを失効させる。
+// 失効したトークンは次のリクエストから使えない。
+func (a *AuthHandler) revokeToken(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	err := a.users.RevokeToken(r.Context(), ownerID(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, "トークンが見つかりません")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"失効に失敗しました")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
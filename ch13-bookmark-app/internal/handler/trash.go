@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+const trashNotFoundMessage = "ゴミ箱にブックマークが見つかりません"
+
+func (h *Handler) listTrash(
+	w http.ResponseWriter, r *http.Request,
+) {
+	bookmarks, err := h.repo.Trash(r.Context(), ownerID(r))
+	if err != nil {
+		writeStoreError(w, r, err,
+			"取得に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, bookmarks)
+}
+
+// restoreBookmark はゴミ箱から元に戻す。
+// 同じ URL を登録し直していれば 409 を返す。
+func (h *Handler) restoreBookmark(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	bm, err := h.repo.Restore(r.Context(), ownerID(r), id)
+	if writeDuplicate(w, r, err) {
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, trashNotFoundMessage)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"復元に失敗しました")
+		return
+	}
+	writeJSON(w, http.StatusOK, bm)
+}
+
+// deletePermanently はゴミ箱の中のものを完全に削除する。
+// ゴミ箱に入っていないものは 404 を返す。
+func (h *Handler) deletePermanently(
+	w http.ResponseWriter, r *http.Request,
+) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	err := h.repo.DeletePermanently(r.Context(), ownerID(r), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeProblem(w, r, probNotFound, trashNotFoundMessage)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err,
+			"削除に失敗しました")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
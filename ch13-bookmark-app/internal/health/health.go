@@ -0,0 +1,95 @@
+// Package health はオーケストレーターやロードバランサー向けの
+// 死活監視のエンドポイントを提供する。
+//
+//   - /healthz はプロセスが応答できれば常に 200 を返す (liveness)
+//   - /readyz は各 Check がすべて成功すれば 200、
+//     1つでも失敗するかシャットダウン中なら 503 を返す (readiness)
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout は Check 1つあたりの制限時間。
+const checkTimeout = 2 * time.Second
+
+// Check はリクエストを受け付ける準備ができているかの確認。
+type Check struct {
+	Name string
+	Func func(ctx context.Context) error
+}
+
+// Checker は /healthz と /readyz を処理する。
+// 複数の goroutine から同時に使ってよい。
+type Checker struct {
+	checks       []Check
+	shuttingDown atomic.Bool
+}
+
+// New は checks で準備を確かめる Checker を生成する。
+func New(checks ...Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Routes はエンドポイントを mux に登録する。
+func (c *Checker) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", c.healthz)
+	mux.HandleFunc("GET /readyz", c.readyz)
+}
+
+// ShutDown は /readyz が 503 を返すようにする。
+// ロードバランサーが新しいリクエストを送らなくなるよう、
+// サーバーを止める前に呼ぶ。
+func (c *Checker) ShutDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Status は /healthz と /readyz のレスポンスの形式。
+type Status struct {
+	Status string `json:"status"`
+	// Checks は Check の名前ごとの結果で、"ok" か "fail"。
+	// 認証なしで見られるため、失敗の理由はログにだけ残す。
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (c *Checker) healthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, Status{Status: "ok"})
+}
+
+func (c *Checker) readyz(w http.ResponseWriter, r *http.Request) {
+	if c.shuttingDown.Load() {
+		writeStatus(w, http.StatusServiceUnavailable,
+			Status{Status: "shutting_down"})
+		return
+	}
+	st := Status{Status: "ok", Checks: map[string]string{}}
+	code := http.StatusOK
+	for _, chk := range c.checks {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		err := chk.Func(ctx)
+		cancel()
+		if err != nil {
+			slog.WarnContext(r.Context(), "readiness チェック失敗",
+				"check", chk.Name, "error", err)
+			st.Status = "unavailable"
+			st.Checks[chk.Name] = "fail"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		st.Checks[chk.Name] = "ok"
+	}
+	writeStatus(w, code, st)
+}
+
+func writeStatus(w http.ResponseWriter, code int, st Status) {
+	w.Header().Set("Content-Type", "application/json")
+	// 古い結果をプロキシなどに返させない
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,58 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func get(t *testing.T, c *Checker, path string) (int, Status) {
+	t.Helper()
+	mux := http.NewServeMux()
+	c.Routes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	var st Status
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return rec.Code, st
+}
+
+func TestChecker(t *testing.T) {
+	var dbErr error
+	c := New(
+		Check{"database", func(context.Context) error { return dbErr }},
+		Check{"migrations", func(context.Context) error { return nil }},
+	)
+
+	if code, st := get(t, c, "/readyz"); code != http.StatusOK ||
+		st.Checks["database"] != "ok" || st.Checks["migrations"] != "ok" {
+		t.Errorf("ready: %d %+v", code, st)
+	}
+
+	dbErr = errors.New("database is locked")
+	code, st := get(t, c, "/readyz")
+	if code != http.StatusServiceUnavailable ||
+		st.Checks["database"] != "fail" ||
+		st.Checks["migrations"] != "ok" {
+		t.Errorf("database down: %d %+v", code, st)
+	}
+	// 準備ができていなくても、プロセスは生きている
+	if code, _ := get(t, c, "/healthz"); code != http.StatusOK {
+		t.Errorf("healthz: %d, want 200", code)
+	}
+
+	dbErr = nil
+	c.ShutDown()
+	if code, st := get(t, c, "/readyz"); code != http.StatusServiceUnavailable ||
+		st.Status != "shutting_down" {
+		t.Errorf("shutting down: %d %+v", code, st)
+	}
+	if code, _ := get(t, c, "/healthz"); code != http.StatusOK {
+		t.Errorf("healthz while shutting down: %d, want 200", code)
+	}
+}
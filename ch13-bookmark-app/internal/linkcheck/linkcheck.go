@@ -0,0 +1,107 @@
+// Package linkcheck はブックマークの URL にアクセスして、
+// リンクが切れていないかを確かめる。
+//
+// Checker は URL 1件を確かめ、Worker はチェックが必要な
+// ブックマークを定期的に選んで、ホストごとに間隔を空けながら
+// 並行して確かめ、結果をストアに記録する。
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
+)
+
+// UserAgent はチェック時に送る User-Agent。
+const UserAgent = "bookmark-app-linkcheck/1.0"
+
+// discardLimit は GET の本文を読み捨てる上限。
+// 接続を再利用できるよう少しだけ読み、残りは捨てる。
+const discardLimit = 4 << 10
+
+// Checker は URL が到達可能かを確かめる。
+// 複数の goroutine から同時に使ってよい。
+type Checker struct {
+	client *http.Client
+}
+
+// NewChecker は client で要求を送る Checker を生成する。
+// client にはリダイレクトの追跡と制限時間を設定しておく。
+// 利用者の URL を扱うため、通常は safehttp.NewClient を使う。
+func NewChecker(client *http.Client) *Checker {
+	return &Checker{client: client}
+}
+
+// Check は rawURL に HEAD を送り、結果を返す。
+// HEAD に対応していないサーバーもあるため、
+// エラーのステータスが返った場合は GET で確かめ直す。
+// リダイレクトは追跡し、最終的な URL を記録する。
+//
+// ctx がキャンセルされた場合も接続できなかった結果を返すため、
+// 呼び出し側は記録する前に ctx.Err() を確認する。
+func (c *Checker) Check(
+	ctx context.Context, rawURL string,
+) model.LinkCheck {
+	res := model.LinkCheck{CheckedAt: time.Now()}
+	resp, err := c.request(ctx, http.MethodHead, rawURL)
+	if err == nil && resp.StatusCode >= 400 {
+		resp, err = c.request(ctx, http.MethodGet, rawURL)
+	}
+	if err != nil {
+		res.Error = reason(err)
+		return res
+	}
+	res.Status = resp.StatusCode
+	if final := resp.Request.URL.String(); !sameURL(final, rawURL) {
+		res.RedirectURL = final
+	}
+	return res
+}
+
+// request は要求を送り、本文を読み捨てて閉じた応答を返す。
+func (c *Checker) request(
+	ctx context.Context, method, rawURL string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.CopyN(io.Discard, resp.Body, discardLimit)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// reason は利用者に見せるエラーの理由を返す。
+// *url.Error が前に付ける "Head "https://..."" は
+// ブックマーク自身の URL なので取り除く。
+func reason(err error) string {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+	return err.Error()
+}
+
+// sameURL は正規化すると同じ URL になるかを返す。
+// 末尾のスラッシュを補うだけのリダイレクトなどは
+// リダイレクトとして記録しない。
+func sameURL(a, b string) bool {
+	na, errA := urlnorm.Normalize(a)
+	nb, errB := urlnorm.Normalize(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return na == nb
+}
@@ -0,0 +1,208 @@
+package linkcheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/safehttp"
+)
+
+func newTestChecker() *Checker {
+	return NewChecker(safehttp.NewClient(safehttp.Options{
+		Timeout: 2 * time.Second, AllowPrivate: true,
+	}))
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	// HEAD を受け付けないサーバー
+	mux.HandleFunc("/get-only", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/ua", func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != UserAgent {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestChecker(t *testing.T) {
+	srv := newTestServer(t)
+	c := newTestChecker()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantRedir  string
+		wantBroken bool
+	}{
+		{"/ok", http.StatusOK, "", false},
+		{"/gone", http.StatusGone, "", true},
+		{"/get-only", http.StatusOK, "", false},
+		{"/moved", http.StatusOK, srv.URL + "/ok", false},
+		{"/ua", http.StatusOK, "", false},
+		{"/missing", http.StatusNotFound, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			res := c.Check(t.Context(), srv.URL+tt.path)
+			if res.Status != tt.wantStatus {
+				t.Errorf("Status = %d, want %d (error %q)",
+					res.Status, tt.wantStatus, res.Error)
+			}
+			if res.RedirectURL != tt.wantRedir {
+				t.Errorf("RedirectURL = %q, want %q",
+					res.RedirectURL, tt.wantRedir)
+			}
+			if res.Broken() != tt.wantBroken {
+				t.Errorf("Broken() = %v, want %v",
+					res.Broken(), tt.wantBroken)
+			}
+			if res.CheckedAt.IsZero() {
+				t.Error("CheckedAt is zero")
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		dead := httptest.NewServer(http.NotFoundHandler())
+		u := dead.URL
+		dead.Close()
+		res := c.Check(t.Context(), u)
+		if res.Status != 0 || res.Error == "" || !res.Broken() {
+			t.Errorf("res = %+v, want connection error", res)
+		}
+	})
+
+	t.Run("private address blocked", func(t *testing.T) {
+		c := NewChecker(safehttp.NewClient(safehttp.Options{
+			Timeout: time.Second,
+		}))
+		res := c.Check(t.Context(), srv.URL+"/ok")
+		if res.Status != 0 || res.Error == "" {
+			t.Errorf("res = %+v, want blocked", res)
+		}
+	})
+}
+
+func TestWorker_RunOnce(t *testing.T) {
+	srv := newTestServer(t)
+	store := repository.NewMemory()
+	ctx := t.Context()
+	ids := map[string]int64{}
+	for i, path := range []string{"/ok", "/gone", "/moved"} {
+		b, err := store.Create(ctx, int64(i%2+1),
+			model.CreateBookmarkRequest{
+				URL: srv.URL + path, Title: path,
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[path] = b.ID
+	}
+
+	w := NewWorker(store, newTestChecker(),
+		WithHostDelay(time.Millisecond))
+	checked, broken, err := w.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 3 || broken != 1 {
+		t.Errorf("checked, broken = %d, %d, want 3, 1",
+			checked, broken)
+	}
+
+	gone, _ := store.FindByID(ctx, 2, ids["/gone"])
+	if gone.LastCheckedAt == nil || gone.HTTPStatus != 410 ||
+		!gone.Broken() {
+		t.Errorf("/gone = %+v", gone)
+	}
+	moved, _ := store.FindByID(ctx, 1, ids["/moved"])
+	if moved.RedirectURL != srv.URL+"/ok" {
+		t.Errorf("/moved RedirectURL = %q", moved.RedirectURL)
+	}
+
+	// 確かめたばかりのものは対象にならない
+	checked, _, err = w.RunOnce(ctx)
+	if err != nil || checked != 0 {
+		t.Errorf("second RunOnce = %d, %v, want 0", checked, err)
+	}
+}
+
+func TestWorker_hostDelay(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		}))
+	defer srv.Close()
+
+	store := repository.NewMemory()
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if _, err := store.Create(t.Context(), 1,
+			model.CreateBookmarkRequest{
+				URL: srv.URL + p, Title: p,
+			}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const delay = 50 * time.Millisecond
+	w := NewWorker(store, newTestChecker(),
+		WithHostDelay(delay), WithConcurrency(3))
+	if _, _, err := w.RunOnce(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 3 {
+		t.Fatalf("requests = %d, want 3", len(times))
+	}
+	// 同じホストへの要求は並行せず、間隔を空けて送る
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < delay {
+			t.Errorf("gap %d = %v, want >= %v", i, gap, delay)
+		}
+	}
+}
+
+func TestWorker_canceled(t *testing.T) {
+	srv := newTestServer(t)
+	store := repository.NewMemory()
+	b, err := store.Create(t.Context(), 1,
+		model.CreateBookmarkRequest{
+			URL: srv.URL + "/ok", Title: "ok",
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	w := NewWorker(store, newTestChecker())
+	w.Run(ctx)
+
+	// 中断されたチェックは記録しない
+	got, _ := store.FindByID(t.Context(), 1, b.ID)
+	if got.LastCheckedAt != nil {
+		t.Errorf("LastCheckedAt = %v, want nil", got.LastCheckedAt)
+	}
+}
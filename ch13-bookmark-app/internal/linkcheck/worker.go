@@ -0,0 +1,257 @@
+package linkcheck
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// batchSize は1回にストアから読むブックマークの件数。
+const batchSize = 100
+
+// Store はチェック対象の取得と結果の記録先。
+// repository.BookmarkStore が満たす。
+type Store interface {
+	DueForCheck(ctx context.Context, before time.Time,
+		limit int) ([]model.Bookmark, error)
+	RecordCheck(ctx context.Context, id int64,
+		c model.LinkCheck) error
+}
+
+// Worker はバックグラウンドでリンク切れを確かめる。
+type Worker struct {
+	store       Store
+	checker     *Checker
+	interval    time.Duration
+	maxAge      time.Duration
+	concurrency int
+	hostDelay   time.Duration
+
+	mu sync.Mutex
+	// lastVisit はホストごとの最後の要求の終了時刻。
+	lastVisit map[string]time.Time
+}
+
+// Option は Worker の設定を変更する。
+type Option func(*Worker)
+
+// WithInterval はチェックを行う間隔を設定する。
+func WithInterval(d time.Duration) Option {
+	return func(w *Worker) { w.interval = d }
+}
+
+// WithMaxAge は再チェックするまでの期間を設定する。
+// 前回のチェックからこの期間が経ったものを確かめ直す。
+func WithMaxAge(d time.Duration) Option {
+	return func(w *Worker) { w.maxAge = d }
+}
+
+// WithConcurrency は同時にチェックするホストの数を設定する。
+func WithConcurrency(n int) Option {
+	return func(w *Worker) { w.concurrency = n }
+}
+
+// WithHostDelay は同じホストへ続けて要求を送るときの
+// 間隔を設定する。相手のサーバーに負荷をかけないためのもの。
+func WithHostDelay(d time.Duration) Option {
+	return func(w *Worker) { w.hostDelay = d }
+}
+
+// NewWorker は Worker を生成する。
+func NewWorker(
+	store Store, checker *Checker, opts ...Option,
+) *Worker {
+	w := &Worker{
+		store:       store,
+		checker:     checker,
+		interval:    time.Hour,
+		maxAge:      7 * 24 * time.Hour,
+		concurrency: 4,
+		hostDelay:   time.Second,
+		lastVisit:   map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run は ctx がキャンセルされるまで、起動直後と
+// interval ごとに RunOnce を呼ぶ。
+// キャンセル後は実行中のチェックが終わるのを待って戻る。
+func (w *Worker) Run(ctx context.Context) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		checked, broken, err := w.RunOnce(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			slog.Error("リンク切れチェック失敗",
+				"error", err)
+		case checked > 0:
+			slog.Info("リンク切れチェック完了",
+				"checked", checked, "broken", broken)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce はチェックが必要なブックマークがなくなるまで
+// 確かめて結果を記録し、確かめた件数とそのうちの
+// リンク切れの件数を返す。
+func (w *Worker) RunOnce(
+	ctx context.Context,
+) (checked, broken int, err error) {
+	// 記録する日時は秒単位に切り捨てるため、基準も揃える。
+	// そうしないと記録した直後の行が再び対象になる
+	before := time.Now().Add(-w.maxAge).Truncate(time.Second)
+	for ctx.Err() == nil {
+		bms, err := w.store.DueForCheck(ctx, before, batchSize)
+		if err != nil {
+			return checked, broken, err
+		}
+		if len(bms) == 0 {
+			break
+		}
+		c, b := w.checkBatch(ctx, bms)
+		checked += c
+		broken += b
+		if c == 0 {
+			// 1件も記録できなければ同じ行を選び続けてしまう
+			break
+		}
+	}
+	return checked, broken, nil
+}
+
+// checkBatch は bms をホストごとにまとめ、ホスト単位で
+// 並行して確かめる。同じホストのものは順番に確かめる。
+func (w *Worker) checkBatch(
+	ctx context.Context, bms []model.Bookmark,
+) (checked, broken int) {
+	var hosts []string
+	byHost := map[string][]model.Bookmark{}
+	for _, b := range bms {
+		h := hostOf(b.URL)
+		if _, ok := byHost[h]; !ok {
+			hosts = append(hosts, h)
+		}
+		byHost[h] = append(byHost[h], b)
+	}
+	w.forget()
+
+	var nChecked, nBroken atomic.Int64
+	sem := make(chan struct{}, w.concurrency)
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			for _, b := range byHost[h] {
+				res, ok := w.check(ctx, h, b)
+				if !ok {
+					return
+				}
+				nChecked.Add(1)
+				if res.Broken() {
+					nBroken.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return int(nChecked.Load()), int(nBroken.Load())
+}
+
+// check は前回の要求から hostDelay 待ってから b を確かめ、
+// 結果を記録する。中断された場合は記録せずに false を返す。
+func (w *Worker) check(
+	ctx context.Context, host string, b model.Bookmark,
+) (model.LinkCheck, bool) {
+	if err := w.wait(ctx, host); err != nil {
+		return model.LinkCheck{}, false
+	}
+	res := w.checker.Check(ctx, b.URL)
+	w.visited(host)
+	// 中断による失敗をリンク切れとして記録しない
+	if ctx.Err() != nil {
+		return model.LinkCheck{}, false
+	}
+	err := w.store.RecordCheck(ctx, b.ID, res)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// チェック中に削除された
+	case err != nil:
+		slog.Error("チェック結果の記録失敗",
+			"id", b.ID, "error", err)
+		return model.LinkCheck{}, false
+	}
+	return res, true
+}
+
+// wait は host への前回の要求から hostDelay が経つまで待つ。
+func (w *Worker) wait(ctx context.Context, host string) error {
+	w.mu.Lock()
+	last := w.lastVisit[host]
+	w.mu.Unlock()
+	d := time.Until(last.Add(w.hostDelay))
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (w *Worker) visited(host string) {
+	w.mu.Lock()
+	w.lastVisit[host] = time.Now()
+	w.mu.Unlock()
+}
+
+// forget は待つ必要がなくなったホストの記録を消し、
+// lastVisit が際限なく大きくならないようにする。
+func (w *Worker) forget() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for h, t := range w.lastVisit {
+		if time.Since(t) >= w.hostDelay {
+			delete(w.lastVisit, h)
+		}
+	}
+}
+
+// hostOf は丁寧さの単位にするホスト名を返す。
+// ポートが違っても同じサーバーとみなす。
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
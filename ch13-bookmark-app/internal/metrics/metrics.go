@@ -0,0 +1,360 @@
+// Package metrics はサーバーの状態を Prometheus の
+// テキスト形式 (exposition format 0.0.4) で公開する。
+//
+// エンドポイントごとのリクエスト数とレイテンシ、
+// データベースの接続プール、Go のランタイム、
+// ブックマークの件数を出力する。エンドポイントは
+// ServeMux のパターンで区別し、/bookmarks/1 と /bookmarks/2 を
+// 同じ /bookmarks/{id} として数える。
+package metrics
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/respwriter"
+)
+
+// latencyBuckets はレイテンシのヒストグラムの区切り (秒)。
+// Prometheus のクライアントライブラリの既定値と同じ。
+var latencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// countTimeout はブックマークの件数を数えるクエリの制限時間。
+const countTimeout = 5 * time.Second
+
+// unmatchedRoute はどのパターンにも一致しなかった
+// リクエストの route ラベル。
+const unmatchedRoute = "unmatched"
+
+// BookmarkCounter はブックマークの件数を返す。
+// repository.BookmarkStore が満たす。
+type BookmarkCounter interface {
+	CountBookmarks(ctx context.Context) (int, error)
+}
+
+// Metrics はリクエストの統計を集め、/metrics で公開する。
+// 複数の goroutine から同時に使ってよい。
+type Metrics struct {
+	db        *sql.DB
+	bookmarks BookmarkCounter
+
+	inFlight atomic.Int64
+
+	mu     sync.Mutex
+	routes map[routeKey]*routeStats
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type routeStats struct {
+	// codes はステータスコードの百の位ごとの件数。
+	codes [6]uint64
+	// buckets は latencyBuckets の各区間に入った件数で、
+	// 出力するときに累積する。
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// New は Metrics を生成する。db が nil なら接続プールの、
+// bookmarks が nil ならブックマークの件数の統計を出力しない。
+func New(db *sql.DB, bookmarks BookmarkCounter) *Metrics {
+	return &Metrics{
+		db:        db,
+		bookmarks: bookmarks,
+		routes:    map[routeKey]*routeStats{},
+	}
+}
+
+// Middleware は next へのリクエストを数え、処理時間を計る。
+// route ラベルには、mux でそのリクエストに一致する
+// パターンを使う。認証で拒否したリクエストも数えられるよう、
+// 認証のミドルウェアより外側に置く。
+func (m *Metrics) Middleware(
+	mux *http.ServeMux, next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		_, pattern := mux.Handler(r)
+		key := routeOf(r, pattern)
+		m.inFlight.Add(1)
+		start := time.Now()
+		rw := respwriter.Wrap(w)
+		defer func() {
+			m.inFlight.Add(-1)
+			m.observe(key, rw.Status(), time.Since(start))
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// knownMethods は method ラベルにそのまま使うメソッド。
+// 任意の文字列でラベルが増え続けないよう、
+// ほかは OTHER にまとめる。
+var knownMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost,
+	http.MethodPut, http.MethodPatch, http.MethodDelete,
+	http.MethodOptions,
+}
+
+// routeOf は "GET /bookmarks/{id}" のようなパターンを
+// メソッドとパスに分ける。
+func routeOf(r *http.Request, pattern string) routeKey {
+	if pattern == "" {
+		method := r.Method
+		if !slices.Contains(knownMethods, method) {
+			method = "OTHER"
+		}
+		return routeKey{method, unmatchedRoute}
+	}
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		return routeKey{"ANY", pattern}
+	}
+	return routeKey{method, path}
+}
+
+func (m *Metrics) observe(
+	key routeKey, status int, d time.Duration,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.routes[key]
+	if !ok {
+		s = &routeStats{
+			buckets: make([]uint64, len(latencyBuckets)),
+		}
+		m.routes[key] = s
+	}
+	s.codes[min(max(status/100, 1), 5)]++
+	sec := d.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, sec); i < len(s.buckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += sec
+}
+
+// snapshot は出力用に統計を route, method の順に並べて複製する。
+func (m *Metrics) snapshot() ([]routeKey, []routeStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]routeKey, 0, len(m.routes))
+	for k := range m.routes {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b routeKey) int {
+		return cmp.Or(cmp.Compare(a.route, b.route),
+			cmp.Compare(a.method, b.method))
+	})
+	stats := make([]routeStats, len(keys))
+	for i, k := range keys {
+		stats[i] = *m.routes[k]
+		stats[i].buckets = slices.Clone(stats[i].buckets)
+	}
+	return keys, stats
+}
+
+// ServeHTTP は統計を Prometheus のテキスト形式で返す。
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type",
+		"text/plain; version=0.0.4; charset=utf-8")
+	e := &exposition{w: bufio.NewWriter(w)}
+	m.writeHTTP(e)
+	if m.db != nil {
+		writeDBStats(e, m.db.Stats())
+	}
+	if m.bookmarks != nil {
+		m.writeBookmarks(r.Context(), e)
+	}
+	writeRuntime(e)
+	e.w.Flush()
+}
+
+func (m *Metrics) writeHTTP(e *exposition) {
+	keys, stats := m.snapshot()
+
+	e.family("bookmarks_http_requests_total", "counter",
+		"エンドポイントとステータスコードの種類ごとのリクエスト数。")
+	for i, k := range keys {
+		for class, n := range stats[i].codes {
+			if n == 0 {
+				continue
+			}
+			e.sample("bookmarks_http_requests_total", float64(n),
+				"method", k.method, "route", k.route,
+				"code", strconv.Itoa(class)+"xx")
+		}
+	}
+
+	e.family("bookmarks_http_request_duration_seconds", "histogram",
+		"エンドポイントごとのリクエストの処理時間。")
+	for i, k := range keys {
+		s := stats[i]
+		var cum uint64
+		for j, le := range latencyBuckets {
+			cum += s.buckets[j]
+			e.sample("bookmarks_http_request_duration_seconds_bucket",
+				float64(cum), "method", k.method, "route", k.route,
+				"le", formatFloat(le))
+		}
+		e.sample("bookmarks_http_request_duration_seconds_bucket",
+			float64(s.count), "method", k.method, "route", k.route,
+			"le", "+Inf")
+		e.sample("bookmarks_http_request_duration_seconds_sum",
+			s.sum, "method", k.method, "route", k.route)
+		e.sample("bookmarks_http_request_duration_seconds_count",
+			float64(s.count), "method", k.method, "route", k.route)
+	}
+
+	e.family("bookmarks_http_requests_in_flight", "gauge",
+		"処理中のリクエスト数。")
+	e.sample("bookmarks_http_requests_in_flight",
+		float64(m.inFlight.Load()))
+}
+
+func writeDBStats(e *exposition, s sql.DBStats) {
+	gauges := []struct {
+		name, help string
+		value      int
+	}{
+		{"bookmarks_db_max_open_connections",
+			"接続数の上限。0 は無制限。", s.MaxOpenConnections},
+		{"bookmarks_db_open_connections",
+			"開いている接続数。", s.OpenConnections},
+		{"bookmarks_db_in_use_connections",
+			"使用中の接続数。", s.InUse},
+		{"bookmarks_db_idle_connections",
+			"待機中の接続数。", s.Idle},
+	}
+	for _, g := range gauges {
+		e.family(g.name, "gauge", g.help)
+		e.sample(g.name, float64(g.value))
+	}
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"bookmarks_db_wait_count_total",
+			"接続が空くのを待った回数。", float64(s.WaitCount)},
+		{"bookmarks_db_wait_duration_seconds_total",
+			"接続が空くのを待った時間の合計。", s.WaitDuration.Seconds()},
+		{"bookmarks_db_max_idle_closed_total",
+			"待機中の接続数の上限により閉じた接続数。",
+			float64(s.MaxIdleClosed)},
+		{"bookmarks_db_max_idle_time_closed_total",
+			"待機時間の上限により閉じた接続数。",
+			float64(s.MaxIdleTimeClosed)},
+		{"bookmarks_db_max_lifetime_closed_total",
+			"接続の寿命により閉じた接続数。",
+			float64(s.MaxLifetimeClosed)},
+	}
+	for _, c := range counters {
+		e.family(c.name, "counter", c.help)
+		e.sample(c.name, c.value)
+	}
+}
+
+// writeBookmarks はブックマークの件数を出力する。
+// 数えられなかった場合は、誤った値を出さないよう省く。
+func (m *Metrics) writeBookmarks(ctx context.Context, e *exposition) {
+	ctx, cancel := context.WithTimeout(ctx, countTimeout)
+	defer cancel()
+	n, err := m.bookmarks.CountBookmarks(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "ブックマークの件数の取得失敗",
+			"error", err)
+		return
+	}
+	e.family("bookmarks_total", "gauge",
+		"ゴミ箱の中のものを除いたブックマークの件数。")
+	e.sample("bookmarks_total", float64(n))
+}
+
+func writeRuntime(e *exposition) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	e.family("go_info", "gauge", "Go のバージョン。")
+	e.sample("go_info", 1, "version", runtime.Version())
+	e.family("go_goroutines", "gauge", "goroutine の数。")
+	e.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	gauges := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"go_memstats_alloc_bytes",
+			"割り当て中のヒープのバイト数。", ms.Alloc},
+		{"go_memstats_heap_inuse_bytes",
+			"使用中のヒープのスパンのバイト数。", ms.HeapInuse},
+		{"go_memstats_heap_objects",
+			"割り当て中のオブジェクトの数。", ms.HeapObjects},
+		{"go_memstats_sys_bytes",
+			"OS から確保したバイト数。", ms.Sys},
+	}
+	for _, g := range gauges {
+		e.family(g.name, "gauge", g.help)
+		e.sample(g.name, float64(g.value))
+	}
+	e.family("go_gc_cycles_total", "counter", "完了した GC の回数。")
+	e.sample("go_gc_cycles_total", float64(ms.NumGC))
+	e.family("go_gc_pause_seconds_total", "counter",
+		"GC による停止時間の合計。")
+	e.sample("go_gc_pause_seconds_total",
+		time.Duration(ms.PauseTotalNs).Seconds())
+}
+
+// exposition は Prometheus のテキスト形式で書き出す。
+type exposition struct {
+	w *bufio.Writer
+}
+
+// family は HELP と TYPE の行を書く。
+func (e *exposition) family(name, typ, help string) {
+	e.w.WriteString("# HELP " + name + " " + help + "\n")
+	e.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample は1つの値を書く。labels は名前と値を交互に並べる。
+func (e *exposition) sample(name string, v float64, labels ...string) {
+	e.w.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			e.w.WriteByte('{')
+		} else {
+			e.w.WriteByte(',')
+		}
+		e.w.WriteString(labels[i] + `="` +
+			labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	if len(labels) > 0 {
+		e.w.WriteByte('}')
+	}
+	e.w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// labelEscaper はラベルの値の \ " 改行をエスケープする。
+var labelEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`,
+)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
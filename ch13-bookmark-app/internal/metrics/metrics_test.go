@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+type countFunc func(ctx context.Context) (int, error)
+
+func (f countFunc) CountBookmarks(ctx context.Context) (int, error) {
+	return f(ctx)
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New(nil, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bookmarks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "404" {
+			http.NotFound(w, r)
+		}
+	})
+	h := m.Middleware(mux, mux)
+	for _, path := range []string{"/bookmarks/1", "/bookmarks/2", "/bookmarks/404", "/nope"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	req := httptest.NewRequest("BREW", "/nope", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		"# TYPE bookmarks_http_requests_total counter\n",
+		// ID ごとではなくパターンごとに数える
+		`bookmarks_http_requests_total{method="GET",route="/bookmarks/{id}",code="2xx"} 2` + "\n",
+		`bookmarks_http_requests_total{method="GET",route="/bookmarks/{id}",code="4xx"} 1` + "\n",
+		`bookmarks_http_requests_total{method="GET",route="unmatched",code="4xx"} 1` + "\n",
+		// 未知のメソッドはまとめる
+		`bookmarks_http_requests_total{method="OTHER",route="unmatched",code="4xx"} 1` + "\n",
+		"# TYPE bookmarks_http_request_duration_seconds histogram\n",
+		`bookmarks_http_request_duration_seconds_bucket{method="GET",route="/bookmarks/{id}",le="+Inf"} 3` + "\n",
+		`bookmarks_http_request_duration_seconds_count{method="GET",route="/bookmarks/{id}"} 3` + "\n",
+		"bookmarks_http_requests_in_flight 0\n",
+		"go_goroutines ",
+		"go_memstats_alloc_bytes ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"/bookmarks/1", "bookmarks_db_", "bookmarks_total"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("unexpected %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestServeHTTP_sources(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	m := New(db, countFunc(func(context.Context) (int, error) {
+		return 42, nil
+	}))
+	out := scrape(t, m)
+	for _, want := range []string{
+		"bookmarks_db_max_open_connections 1\n",
+		"# TYPE bookmarks_db_wait_count_total counter\n",
+		"# TYPE bookmarks_total gauge\n",
+		"bookmarks_total 42\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q:\n%s", want, out)
+		}
+	}
+
+	// 数えられなければ件数を出さない
+	m = New(nil, countFunc(func(context.Context) (int, error) {
+		return 0, errors.New("boom")
+	}))
+	if out := scrape(t, m); strings.Contains(out, "bookmarks_total") {
+		t.Errorf("bookmarks_total on error:\n%s", out)
+	}
+}
+
+func TestObserve_buckets(t *testing.T) {
+	m := New(nil, nil)
+	key := routeKey{"GET", "/x"}
+	m.observe(key, 200, 0)
+	m.observe(key, 200, 50_000_000)     // 0.05 秒はちょうど le="0.05" に入る
+	m.observe(key, 500, 60_000_000_000) // どの区切りより遅い
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		`bookmarks_http_request_duration_seconds_bucket{method="GET",route="/x",le="0.005"} 1` + "\n",
+		`bookmarks_http_request_duration_seconds_bucket{method="GET",route="/x",le="0.05"} 2` + "\n",
+		`bookmarks_http_request_duration_seconds_bucket{method="GET",route="/x",le="10"} 2` + "\n",
+		`bookmarks_http_request_duration_seconds_bucket{method="GET",route="/x",le="+Inf"} 3` + "\n",
+		`bookmarks_http_request_duration_seconds_sum{method="GET",route="/x"} 60.05` + "\n",
+		`bookmarks_http_requests_total{method="GET",route="/x",code="5xx"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q:\n%s", want, out)
+		}
+	}
+}
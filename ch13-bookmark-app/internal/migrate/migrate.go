@@ -0,0 +1,435 @@
+// Package migrate はデータベースのスキーマを
+// 番号付きの SQL ファイルで段階的に更新する。
+//
+// マイグレーションは migrations/ に
+// NNNN_名前.up.sql と NNNN_名前.down.sql の組で置き、
+// バイナリに埋め込む。適用済みの番号は
+// schema_migrations テーブルに記録する。
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// ErrSchemaTooNew はデータベースのスキーマが、
+// このバイナリが知っている最新版より新しいことを表す。
+// 古いバイナリで新しいDBを書き換えないために使う。
+var ErrSchemaTooNew = errors.New(
+	"database schema is newer than this binary")
+
+// ErrPending は適用していないマイグレーションがあることを表す。
+var ErrPending = errors.New("database has pending migrations")
+
+// Migration は1つのスキーマ変更。
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Direction は適用の向き。
+type Direction string
+
+const (
+	DirUp   Direction = "up"
+	DirDown Direction = "down"
+)
+
+// Step は実行計画の1段階。
+type Step struct {
+	Migration
+	Direction Direction
+}
+
+// SQL は Direction に応じて実行する SQL を返す。
+func (s Step) SQL() string {
+	if s.Direction == DirDown {
+		return s.Down
+	}
+	return s.Up
+}
+
+// Migrator はマイグレーションを適用する。
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New は埋め込まれたマイグレーションを読み込んで
+// Migrator を生成する。
+func New(db *sql.DB) (*Migrator, error) {
+	ms, err := load(migrationFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+// load は dir 以下の SQL ファイルを番号順に読み込む。
+// 番号は1から欠番なく続いていなければならない。
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		base, ok := strings.CutSuffix(name, ".sql")
+		if !ok {
+			continue
+		}
+		base, d, ok := cutDirection(base)
+		if !ok {
+			return nil, fmt.Errorf(
+				"migrate: %s: want .up.sql or .down.sql",
+				name)
+		}
+		num, label, ok := strings.Cut(base, "_")
+		v, err := strconv.Atoi(num)
+		if !ok || err != nil || v < 1 {
+			return nil, fmt.Errorf(
+				"migrate: %s: want NNNN_name prefix", name)
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: label}
+			byVersion[v] = m
+		}
+		if m.Name != label {
+			return nil, fmt.Errorf(
+				"migrate: version %d has two names: %s, %s",
+				v, m.Name, label)
+		}
+		if d == DirUp {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	ms := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Version < ms[j].Version
+	})
+	for i, m := range ms {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf(
+				"migrate: version %d is missing", i+1)
+		}
+		if m.Up == "" {
+			return nil, fmt.Errorf(
+				"migrate: version %d has no up migration",
+				m.Version)
+		}
+	}
+	return ms, nil
+}
+
+func cutDirection(s string) (string, Direction, bool) {
+	if b, ok := strings.CutSuffix(s, ".up"); ok {
+		return b, DirUp, true
+	}
+	if b, ok := strings.CutSuffix(s, ".down"); ok {
+		return b, DirDown, true
+	}
+	return s, "", false
+}
+
+// Latest はこのバイナリが知っている最新のバージョン。
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// ensureTable は適用履歴のテーブルを作成する。
+func (m *Migrator) ensureTable(
+	ctx context.Context,
+) error {
+	_, err := m.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)`)
+	return err
+}
+
+// Current はデータベースに適用済みのバージョンを返す。
+// 未適用なら 0 を返す。
+func (m *Migrator) Current(
+	ctx context.Context,
+) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	var v int
+	err := m.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0)
+		 FROM schema_migrations`,
+	).Scan(&v)
+	return v, err
+}
+
+// Check はデータベースのスキーマが
+// このバイナリで扱えるかを確かめる。
+func (m *Migrator) Check(ctx context.Context) error {
+	cur, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+	if cur > m.Latest() {
+		return fmt.Errorf("%w: database=%d, binary=%d",
+			ErrSchemaTooNew, cur, m.Latest())
+	}
+	return nil
+}
+
+// CheckApplied はこのバイナリのマイグレーションが
+// すべて適用済みかを確かめる。稼働中の確認に使うため、
+// Check と違い適用履歴のテーブルを作らず、読み取りだけを行う。
+func (m *Migrator) CheckApplied(ctx context.Context) error {
+	var cur int
+	err := m.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0)
+		 FROM schema_migrations`,
+	).Scan(&cur)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cur < m.Latest():
+		return fmt.Errorf("%w: database=%d, binary=%d",
+			ErrPending, cur, m.Latest())
+	case cur > m.Latest():
+		return fmt.Errorf("%w: database=%d, binary=%d",
+			ErrSchemaTooNew, cur, m.Latest())
+	}
+	return nil
+}
+
+// legacyObjects は InitTable でスキーマを作っていた頃の
+// バイナリが作ったもの。バージョン i+1 のマイグレーションが
+// 作るものと同じで、InitTable はこの順に追加していった。
+var legacyObjects = []string{
+	`SELECT COUNT(*) FROM sqlite_master
+	 WHERE type = 'table' AND name = 'bookmarks'`,
+	`SELECT COUNT(*) FROM pragma_table_info('bookmarks')
+	 WHERE name = 'updated_at'`,
+	`SELECT COUNT(*) FROM sqlite_master
+	 WHERE type = 'table' AND name = 'bookmark_tags'`,
+	`SELECT COUNT(*) FROM sqlite_master
+	 WHERE type = 'table' AND name = 'bookmarks_fts'`,
+	`SELECT COUNT(*) FROM sqlite_master
+	 WHERE type = 'index' AND name = 'bookmarks_created_at'`,
+}
+
+// legacyVersion は適用履歴のないデータベースが、InitTable で
+// どのバージョンまでのスキーマを作られているかを返す。
+// 既に作られた表や列を作り直そうとして失敗しないよう、
+// そのバージョンまでは適用済みとみなす。
+func (m *Migrator) legacyVersion(
+	ctx context.Context,
+) (int, error) {
+	for i, q := range legacyObjects {
+		var n int
+		if err := m.db.QueryRowContext(ctx, q).
+			Scan(&n); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return i, nil
+		}
+	}
+	return len(legacyObjects), nil
+}
+
+// Plan は現在のバージョンから target までの
+// 実行計画を返す。target が現在より小さければ
+// down を新しい順に並べる。
+func (m *Migrator) Plan(
+	ctx context.Context, target int,
+) ([]Step, error) {
+	steps, _, err := m.plan(ctx, target)
+	return steps, err
+}
+
+// plan は Plan の実行計画と、適用履歴がないものの
+// InitTable で作られていて適用済みとみなすバージョンを返す。
+func (m *Migrator) plan(
+	ctx context.Context, target int,
+) ([]Step, int, error) {
+	if target < 0 || target > m.Latest() {
+		return nil, 0, fmt.Errorf(
+			"migrate: target %d is out of range 0-%d",
+			target, m.Latest())
+	}
+	if err := m.Check(ctx); err != nil {
+		return nil, 0, err
+	}
+	cur, err := m.Current(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	adopted := 0
+	if cur == 0 {
+		if adopted, err = m.legacyVersion(ctx); err != nil {
+			return nil, 0, err
+		}
+		cur = adopted
+	}
+	var steps []Step
+	for v := cur + 1; v <= target; v++ {
+		steps = append(steps, Step{
+			Migration: m.migrations[v-1],
+			Direction: DirUp,
+		})
+	}
+	for v := cur; v > target; v-- {
+		mg := m.migrations[v-1]
+		if mg.Down == "" {
+			return nil, 0, fmt.Errorf(
+				"migrate: version %d has no down migration",
+				v)
+		}
+		steps = append(steps, Step{
+			Migration: mg, Direction: DirDown,
+		})
+	}
+	return steps, adopted, nil
+}
+
+// Up は最新のバージョンまで適用する。
+func (m *Migrator) Up(ctx context.Context) ([]Step, error) {
+	return m.Migrate(ctx, m.Latest(), false)
+}
+
+// Migrate は target のバージョンまで適用またはロールバックする。
+// 各段階は履歴の記録と合わせて1つのトランザクションで実行し、
+// 失敗した段階は丸ごと取り消される。
+//
+// dryRun が true の場合は、すべての段階を1つの
+// トランザクションで実行したうえでロールバックする。
+// SQL が通ることを確かめつつ、データベースは変更しない。
+func (m *Migrator) Migrate(
+	ctx context.Context, target int, dryRun bool,
+) ([]Step, error) {
+	steps, adopted, err := m.plan(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		tx, err := m.db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if err := m.adopt(ctx, tx, adopted); err != nil {
+			return nil, err
+		}
+		for _, s := range steps {
+			if err := apply(ctx, tx, s); err != nil {
+				return nil, err
+			}
+		}
+		return steps, nil
+	}
+	if adopted > 0 {
+		tx, err := m.db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if err := m.adopt(ctx, tx, adopted); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range steps {
+		if err := m.applyTx(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// adopt は InitTable で作られていたバージョンを
+// 適用済みとして記録する。
+func (m *Migrator) adopt(
+	ctx context.Context, tx *sql.Tx, version int,
+) error {
+	for _, mg := range m.migrations[:version] {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations
+			 (version, name, applied_at)
+			 VALUES (?, ?, ?)`,
+			mg.Version, mg.Name,
+			time.Now().UTC().Format(time.RFC3339),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) applyTx(
+	ctx context.Context, s Step,
+) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := apply(ctx, tx, s); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func apply(
+	ctx context.Context, tx *sql.Tx, s Step,
+) error {
+	if _, err := tx.ExecContext(ctx, s.SQL()); err != nil {
+		return fmt.Errorf("migrate: %04d_%s %s: %w",
+			s.Version, s.Name, s.Direction, err)
+	}
+	var err error
+	if s.Direction == DirUp {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations
+			 (version, name, applied_at)
+			 VALUES (?, ?, ?)`,
+			s.Version, s.Name,
+			time.Now().UTC().Format(time.RFC3339),
+		)
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM schema_migrations
+			 WHERE version = ?`, s.Version,
+		)
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// :memory: は接続ごとに別のDBになるため1本に固定する
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func tableExists(
+	t *testing.T, db *sql.DB, name string,
+) bool {
+	t.Helper()
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master
+		 WHERE name = ?`, name,
+	).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestMigrator_upAndDown(t *testing.T) {
+	db := setupTestDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	steps, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != m.Latest() {
+		t.Errorf("applied = %d, want %d",
+			len(steps), m.Latest())
+	}
+	if cur, _ := m.Current(ctx); cur != m.Latest() {
+		t.Errorf("current = %d, want %d",
+			cur, m.Latest())
+	}
+	// 2回目は何もしない
+	if steps, _ := m.Up(ctx); len(steps) != 0 {
+		t.Errorf("second up applied %d steps",
+			len(steps))
+	}
+
+	if _, err := m.Migrate(ctx, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "tags") {
+		t.Error("tags still exists after rollback to 1")
+	}
+	if !tableExists(t, db, "bookmarks") {
+		t.Error("bookmarks was dropped by rollback to 1")
+	}
+	if _, err := m.Migrate(ctx, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "bookmarks") {
+		t.Error("bookmarks still exists after rollback to 0")
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("re-apply after rollback: %v", err)
+	}
+}
+
+func TestMigrator_dryRun(t *testing.T) {
+	db := setupTestDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	steps, err := m.Migrate(ctx, m.Latest(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != m.Latest() {
+		t.Errorf("planned = %d, want %d",
+			len(steps), m.Latest())
+	}
+	if cur, _ := m.Current(ctx); cur != 0 {
+		t.Errorf("current = %d, want 0", cur)
+	}
+	if tableExists(t, db, "bookmarks") {
+		t.Error("dry run left bookmarks table")
+	}
+}
+
+// InitTable で作られた既存のDBを取り込めることを確認する。
+func TestMigrator_adoptsInitTableSchema(t *testing.T) {
+	db := setupTestDB(t)
+	_, err := db.Exec(`CREATE TABLE bookmarks (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		url        TEXT NOT NULL,
+		title      TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	INSERT INTO bookmarks (url, title, created_at)
+	VALUES ('https://go.dev', 'Go言語の教科書',
+		'2025-01-02T03:04:05Z')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var updatedAt string
+	db.QueryRow(
+		`SELECT updated_at FROM bookmarks`,
+	).Scan(&updatedAt)
+	if updatedAt != "2025-01-02T03:04:05Z" {
+		t.Errorf("updated_at = %q, want created_at",
+			updatedAt)
+	}
+	var n int
+	db.QueryRow(
+		`SELECT COUNT(*) FROM bookmarks_fts
+		 WHERE bookmarks_fts MATCH '教科書'`,
+	).Scan(&n)
+	if n != 1 {
+		t.Errorf("fts matches = %d, want 1", n)
+	}
+}
+
+// InitTable が updated_at やタグ、検索の索引を作るようになった
+// 後のバイナリで作られたDBも、同じものを作り直さずに取り込めることを
+// 確認する。
+func TestMigrator_adoptsLaterInitTableSchemas(t *testing.T) {
+	bookmarks := `CREATE TABLE bookmarks (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		url        TEXT NOT NULL,
+		title      TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+	INSERT INTO bookmarks (url, title, created_at, updated_at)
+	VALUES ('https://go.dev', 'Go言語の教科書',
+		'2025-01-02T03:04:05Z', '2025-02-03T04:05:06Z');`
+	tags := `CREATE TABLE tags (
+		id   INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE bookmark_tags (
+		bookmark_id INTEGER NOT NULL REFERENCES bookmarks(id),
+		tag_id      INTEGER NOT NULL REFERENCES tags(id),
+		PRIMARY KEY (bookmark_id, tag_id)
+	);
+	CREATE INDEX bookmark_tags_tag_id ON bookmark_tags(tag_id);`
+	fts := `CREATE VIRTUAL TABLE bookmarks_fts USING fts5(
+		title, url, content = 'bookmarks',
+		content_rowid = 'id', tokenize = 'trigram'
+	);
+	CREATE TRIGGER bookmarks_fts_ai AFTER INSERT ON bookmarks BEGIN
+		INSERT INTO bookmarks_fts (rowid, title, url)
+		VALUES (new.id, new.title, new.url);
+	END;
+	CREATE TRIGGER bookmarks_fts_ad AFTER DELETE ON bookmarks BEGIN
+		INSERT INTO bookmarks_fts (bookmarks_fts, rowid, title, url)
+		VALUES ('delete', old.id, old.title, old.url);
+	END;
+	CREATE TRIGGER bookmarks_fts_au AFTER UPDATE ON bookmarks BEGIN
+		INSERT INTO bookmarks_fts (bookmarks_fts, rowid, title, url)
+		VALUES ('delete', old.id, old.title, old.url);
+		INSERT INTO bookmarks_fts (rowid, title, url)
+		VALUES (new.id, new.title, new.url);
+	END;
+	INSERT INTO bookmarks_fts (bookmarks_fts) VALUES ('rebuild');`
+	index := `CREATE INDEX bookmarks_created_at
+		ON bookmarks(created_at, id);`
+
+	tests := []struct {
+		name    string
+		schema  string
+		adopted int
+	}{
+		{"updated_at", bookmarks, 2},
+		{"tags", bookmarks + tags, 3},
+		{"fts", bookmarks + tags + fts, 4},
+		{"index", bookmarks + tags + fts + index, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			if _, err := db.Exec(tt.schema); err != nil {
+				t.Fatal(err)
+			}
+			m, err := New(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			steps, err := m.Up(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != m.Latest()-tt.adopted {
+				t.Errorf("steps = %d, want %d",
+					len(steps), m.Latest()-tt.adopted)
+			}
+			if err := m.CheckApplied(ctx); err != nil {
+				t.Errorf("CheckApplied() = %v", err)
+			}
+			// 既存の更新日時はそのまま残る
+			var updatedAt string
+			db.QueryRow(
+				`SELECT updated_at FROM bookmarks`,
+			).Scan(&updatedAt)
+			if updatedAt != "2025-02-03T04:05:06Z" {
+				t.Errorf("updated_at = %q", updatedAt)
+			}
+			var n int
+			db.QueryRow(
+				`SELECT COUNT(*) FROM bookmarks_fts
+				 WHERE bookmarks_fts MATCH '教科書'`,
+			).Scan(&n)
+			if n != 1 {
+				t.Errorf("fts matches = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestMigrator_schemaTooNew(t *testing.T) {
+	db := setupTestDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO schema_migrations
+		 (version, name, applied_at)
+		 VALUES (?, 'future', '')`, m.Latest()+1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Check() = %v, want ErrSchemaTooNew", err)
+	}
+	if _, err := m.Up(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Up() = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestLoad_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fs   fstest.MapFS
+	}{
+		{"欠番", fstest.MapFS{
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1")},
+			"m/0003_c.up.sql": {Data: []byte("SELECT 1")},
+		}},
+		{"upがない", fstest.MapFS{
+			"m/0001_a.down.sql": {Data: []byte("SELECT 1")},
+		}},
+		{"向きがない", fstest.MapFS{
+			"m/0001_a.sql": {Data: []byte("SELECT 1")},
+		}},
+		{"番号がない", fstest.MapFS{
+			"m/init.up.sql": {Data: []byte("SELECT 1")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(tt.fs, "m"); err == nil {
+				t.Error("load() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestMigrator_checkApplied(t *testing.T) {
+	db := setupTestDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := t.Context()
+
+	// 適用履歴のテーブルがなければエラーにし、作らない
+	if err := m.CheckApplied(ctx); err == nil {
+		t.Error("CheckApplied on empty database: err = nil")
+	}
+	if tableExists(t, db, "schema_migrations") {
+		t.Error("CheckApplied created schema_migrations")
+	}
+
+	if _, err := m.Migrate(ctx, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckApplied(ctx); !errors.Is(err, ErrPending) {
+		t.Errorf("CheckApplied at 1: err = %v, want ErrPending", err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckApplied(ctx); err != nil {
+		t.Errorf("CheckApplied at latest: err = %v", err)
+	}
+}
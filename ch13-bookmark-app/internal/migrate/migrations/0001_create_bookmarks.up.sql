@@ -0,0 +1,8 @@
+-- InitTable で作られていた最初のスキーマ。
+-- 既存の bookmarks.db をそのまま取り込めるよう IF NOT EXISTS にする。
+CREATE TABLE IF NOT EXISTS bookmarks (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	url        TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
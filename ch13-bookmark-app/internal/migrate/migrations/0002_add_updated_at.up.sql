@@ -0,0 +1,5 @@
+ALTER TABLE bookmarks
+	ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+
+-- 既存の行は作成日時を更新日時とみなす
+UPDATE bookmarks SET updated_at = created_at;
@@ -0,0 +1,12 @@
+CREATE TABLE tags (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE bookmark_tags (
+	bookmark_id INTEGER NOT NULL REFERENCES bookmarks(id),
+	tag_id      INTEGER NOT NULL REFERENCES tags(id),
+	PRIMARY KEY (bookmark_id, tag_id)
+);
+
+CREATE INDEX bookmark_tags_tag_id ON bookmark_tags(tag_id);
@@ -0,0 +1,4 @@
+DROP TRIGGER bookmarks_fts_au;
+DROP TRIGGER bookmarks_fts_ad;
+DROP TRIGGER bookmarks_fts_ai;
+DROP TABLE bookmarks_fts;
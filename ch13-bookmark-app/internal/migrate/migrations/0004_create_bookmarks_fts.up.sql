@@ -0,0 +1,29 @@
+-- bookmarks を元にした FTS5 の外部コンテンツテーブル。
+-- 日本語は単語の区切りが空白ではないため、
+-- 3文字単位で索引を作る trigram トークナイザを使う。
+CREATE VIRTUAL TABLE bookmarks_fts USING fts5(
+	title, url,
+	content = 'bookmarks',
+	content_rowid = 'id',
+	tokenize = 'trigram'
+);
+
+CREATE TRIGGER bookmarks_fts_ai AFTER INSERT ON bookmarks BEGIN
+	INSERT INTO bookmarks_fts (rowid, title, url)
+	VALUES (new.id, new.title, new.url);
+END;
+
+CREATE TRIGGER bookmarks_fts_ad AFTER DELETE ON bookmarks BEGIN
+	INSERT INTO bookmarks_fts (bookmarks_fts, rowid, title, url)
+	VALUES ('delete', old.id, old.title, old.url);
+END;
+
+CREATE TRIGGER bookmarks_fts_au AFTER UPDATE ON bookmarks BEGIN
+	INSERT INTO bookmarks_fts (bookmarks_fts, rowid, title, url)
+	VALUES ('delete', old.id, old.title, old.url);
+	INSERT INTO bookmarks_fts (rowid, title, url)
+	VALUES (new.id, new.title, new.url);
+END;
+
+-- 既存の行を索引に取り込む
+INSERT INTO bookmarks_fts (bookmarks_fts) VALUES ('rebuild');
@@ -0,0 +1,2 @@
+-- 一覧のページ送り (created_at, id) 用の索引
+CREATE INDEX bookmarks_created_at ON bookmarks(created_at, id);
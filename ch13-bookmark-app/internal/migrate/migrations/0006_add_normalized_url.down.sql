@@ -0,0 +1,2 @@
+DROP INDEX bookmarks_normalized_url;
+ALTER TABLE bookmarks DROP COLUMN normalized_url;
@@ -0,0 +1,8 @@
+-- 重複判定用に正規化した URL。既存の行は NULL のままにしておき、
+-- サーバー起動時に Go 側で正規化して埋める
+-- (repository.BackfillNormalizedURLs)。
+-- UNIQUE 索引は NULL 同士を重複とみなさない。
+ALTER TABLE bookmarks ADD COLUMN normalized_url TEXT;
+
+CREATE UNIQUE INDEX bookmarks_normalized_url
+	ON bookmarks(normalized_url);
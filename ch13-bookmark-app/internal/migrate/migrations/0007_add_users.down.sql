@@ -0,0 +1,11 @@
+DROP INDEX bookmarks_owner_created_at;
+CREATE INDEX bookmarks_created_at ON bookmarks(created_at, id);
+
+-- ユーザーをまたいで同じ URL があると失敗する
+DROP INDEX bookmarks_owner_normalized_url;
+CREATE UNIQUE INDEX bookmarks_normalized_url
+	ON bookmarks(normalized_url);
+
+ALTER TABLE bookmarks DROP COLUMN owner_id;
+DROP TABLE sessions;
+DROP TABLE users;
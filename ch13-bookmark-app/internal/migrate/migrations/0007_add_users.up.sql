@@ -0,0 +1,35 @@
+CREATE TABLE users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- 大文字小文字の違いで別のユーザーを作れないよう、
+	-- 小文字にそろえて保存する
+	username      TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	created_at    TEXT NOT NULL
+);
+
+-- ログイン中のセッション。トークンそのものは保存せず、
+-- SHA-256 のハッシュだけを持つ
+CREATE TABLE sessions (
+	token_hash TEXT PRIMARY KEY,
+	user_id    INTEGER NOT NULL
+		REFERENCES users(id) ON DELETE CASCADE,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+);
+CREATE INDEX sessions_user_id ON sessions(user_id);
+
+-- 既存の行は NULL のままにしておき、運用者が指定した
+-- ユーザーのものにする (cmd/migrate -claim-legacy)。
+-- REFERENCES を付けると down で列を削除できないため付けない。
+ALTER TABLE bookmarks ADD COLUMN owner_id INTEGER;
+
+-- 重複の判定はユーザーごとに行う。所有者のいない行同士も
+-- 重複とみなすよう、NULL を 0 に置き換えた値で索引を作る
+DROP INDEX bookmarks_normalized_url;
+CREATE UNIQUE INDEX bookmarks_owner_normalized_url
+	ON bookmarks(IFNULL(owner_id, 0), normalized_url);
+
+-- 一覧はユーザーごとに (created_at, id) の順で読む
+DROP INDEX bookmarks_created_at;
+CREATE INDEX bookmarks_owner_created_at
+	ON bookmarks(owner_id, created_at, id);
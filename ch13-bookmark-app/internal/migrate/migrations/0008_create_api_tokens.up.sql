@@ -0,0 +1,17 @@
+-- CI やブラウザ拡張から使う個人用のアクセストークン。
+-- セッションと同じく、トークンそのものは保存せず
+-- SHA-256 のハッシュだけを持つ
+CREATE TABLE api_tokens (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER NOT NULL
+		REFERENCES users(id) ON DELETE CASCADE,
+	name         TEXT NOT NULL,
+	token_hash   TEXT NOT NULL UNIQUE,
+	-- 空白区切りのスコープ (bookmarks:read bookmarks:write)
+	scopes       TEXT NOT NULL,
+	created_at   TEXT NOT NULL,
+	-- NULL なら無期限
+	expires_at   TEXT,
+	last_used_at TEXT
+);
+CREATE INDEX api_tokens_user_id ON api_tokens(user_id);
@@ -0,0 +1,5 @@
+DROP INDEX bookmarks_last_checked_at;
+ALTER TABLE bookmarks DROP COLUMN check_error;
+ALTER TABLE bookmarks DROP COLUMN redirect_url;
+ALTER TABLE bookmarks DROP COLUMN http_status;
+ALTER TABLE bookmarks DROP COLUMN last_checked_at;
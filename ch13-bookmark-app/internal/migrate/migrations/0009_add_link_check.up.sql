@@ -0,0 +1,11 @@
+-- リンク切れチェックの結果。一度もチェックしていない行は
+-- last_checked_at が NULL。http_status が 0 なら
+-- 接続できなかったことを表し、理由を check_error に持つ
+ALTER TABLE bookmarks ADD COLUMN last_checked_at TEXT;
+ALTER TABLE bookmarks ADD COLUMN http_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE bookmarks ADD COLUMN redirect_url TEXT;
+ALTER TABLE bookmarks ADD COLUMN check_error TEXT;
+
+-- チェック対象を古い順に選ぶための索引
+CREATE INDEX bookmarks_last_checked_at
+	ON bookmarks(last_checked_at, id);
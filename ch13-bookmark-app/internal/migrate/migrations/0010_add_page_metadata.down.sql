@@ -0,0 +1,5 @@
+DROP INDEX bookmarks_metadata_retry_at;
+ALTER TABLE bookmarks DROP COLUMN metadata_retry_at;
+ALTER TABLE bookmarks DROP COLUMN favicon_url;
+ALTER TABLE bookmarks DROP COLUMN image_url;
+ALTER TABLE bookmarks DROP COLUMN description;
@@ -0,0 +1,12 @@
+-- 登録時にページから取得したメタデータ。
+-- 取得に失敗した行は metadata_retry_at に次に取得し直す
+-- 日時を持ち、取得できたか諦めたら NULL に戻す
+ALTER TABLE bookmarks ADD COLUMN description TEXT;
+ALTER TABLE bookmarks ADD COLUMN image_url TEXT;
+ALTER TABLE bookmarks ADD COLUMN favicon_url TEXT;
+ALTER TABLE bookmarks ADD COLUMN metadata_retry_at TEXT;
+
+-- 取得し直す行だけを索引に載せる
+CREATE INDEX bookmarks_metadata_retry_at
+	ON bookmarks(metadata_retry_at, id)
+	WHERE metadata_retry_at IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX bookmarks_folder_id;
+ALTER TABLE bookmarks DROP COLUMN folder_id;
+DROP TABLE folders;
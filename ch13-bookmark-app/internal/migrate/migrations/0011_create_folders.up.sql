@@ -0,0 +1,18 @@
+-- ブックマークをまとめるフォルダの階層。
+-- parent_id が NULL なら最上位のフォルダ。
+-- 親子関係の整合性 (循環の禁止、削除時の中身の扱い) は
+-- Go 側でトランザクションの中で保つ
+CREATE TABLE folders (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner_id   INTEGER NOT NULL,
+	parent_id  INTEGER,
+	name       TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE INDEX folders_owner_parent ON folders(owner_id, parent_id);
+
+-- NULL ならどのフォルダにも入っていない。
+-- down で削除できるよう REFERENCES は付けない
+ALTER TABLE bookmarks ADD COLUMN folder_id INTEGER;
+CREATE INDEX bookmarks_folder_id ON bookmarks(folder_id);
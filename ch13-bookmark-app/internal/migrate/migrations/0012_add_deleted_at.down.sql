@@ -0,0 +1,12 @@
+-- ゴミ箱の中のものは、元の UNIQUE 索引と重複しうるため完全に削除する
+DROP INDEX bookmarks_deleted_at;
+DELETE FROM bookmark_tags WHERE bookmark_id IN (
+	SELECT id FROM bookmarks WHERE deleted_at IS NOT NULL);
+DELETE FROM bookmarks WHERE deleted_at IS NOT NULL;
+DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM bookmark_tags);
+
+DROP INDEX bookmarks_owner_normalized_url;
+CREATE UNIQUE INDEX bookmarks_owner_normalized_url
+	ON bookmarks(IFNULL(owner_id, 0), normalized_url);
+
+ALTER TABLE bookmarks DROP COLUMN deleted_at;
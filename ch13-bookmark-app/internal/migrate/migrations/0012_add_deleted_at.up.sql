@@ -0,0 +1,15 @@
+-- 削除したブックマークはすぐには消さず、deleted_at を設定して
+-- ゴミ箱に移す。保存期間を過ぎたものはサーバーが完全に削除する
+ALTER TABLE bookmarks ADD COLUMN deleted_at TEXT;
+
+-- ゴミ箱の中のものとは重複とみなさず、同じ URL を登録し直せる
+-- ようにする。復元するときに重複していれば復元できない
+DROP INDEX bookmarks_owner_normalized_url;
+CREATE UNIQUE INDEX bookmarks_owner_normalized_url
+	ON bookmarks(IFNULL(owner_id, 0), normalized_url)
+	WHERE deleted_at IS NULL;
+
+-- ゴミ箱の一覧と期限切れの削除のため、削除済みの行だけを載せる
+CREATE INDEX bookmarks_deleted_at
+	ON bookmarks(deleted_at, id)
+	WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,18 @@
+-- ブックマークの変更履歴。変更と同じトランザクションで書き込む。
+-- ブックマークを完全に削除しても履歴は残すため、
+-- bookmark_id に REFERENCES は付けない
+CREATE TABLE audit_log (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	bookmark_id INTEGER NOT NULL,
+	owner_id    INTEGER NOT NULL,
+	-- 変更したユーザー。バックグラウンドの処理なら NULL
+	actor_id    INTEGER,
+	action      TEXT NOT NULL,
+	request_id  TEXT,
+	created_at  TEXT NOT NULL,
+	-- 変更前後のブックマークの JSON。作成前と削除後は NULL
+	before      TEXT,
+	after       TEXT
+);
+CREATE INDEX audit_log_bookmark_id ON audit_log(bookmark_id, id);
+CREATE INDEX audit_log_created_at ON audit_log(created_at, id);
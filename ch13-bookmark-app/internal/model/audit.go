@@ -0,0 +1,34 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 監査ログに記録する操作の種類。
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	// AuditDelete はゴミ箱に移したことを表す。
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	// AuditPurge はゴミ箱から完全に削除したことを表す。
+	AuditPurge = "purge"
+)
+
+// AuditEntry はブックマークへの変更1件分の記録。
+type AuditEntry struct {
+	ID         int64  `json:"id"`
+	BookmarkID int64  `json:"bookmark_id"`
+	OwnerID    int64  `json:"owner_id"`
+	Action     string `json:"action"`
+	// ActorID は変更したユーザーの ID。
+	// バックグラウンドの処理による変更なら 0。
+	ActorID   int64     `json:"actor_id"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Before と After は変更前後のブックマーク。
+	// 作成前と完全に削除した後は null。
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
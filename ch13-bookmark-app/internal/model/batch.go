@@ -0,0 +1,52 @@
+package model
+
+// 一括操作の種類。
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchRequest は一括操作のリクエストの形式。
+type BatchRequest struct {
+	// Atomic が true なら、1件でも失敗した場合は
+	// すべての操作を取り消す。false なら失敗したものを
+	// 飛ばして残りを実行する。
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation は一括操作の1件分。
+// create は url・title・tags・folder_id を、
+// update は id と url・title・tags (全項目の置き換え) を、
+// delete は id を使う。
+type BatchOperation struct {
+	Op       string   `json:"op"`
+	ID       int64    `json:"id,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	FolderID *int64   `json:"folder_id,omitempty"`
+}
+
+// BatchResponse は一括操作の結果。
+type BatchResponse struct {
+	Atomic    bool `json:"atomic"`
+	Succeeded int  `json:"succeeded"`
+	Failed    int  `json:"failed"`
+	// Results はリクエストと同じ順に並べた各操作の結果。
+	Results []BatchResult `json:"results"`
+}
+
+// BatchResult は1件分の結果。Status は同じ操作を
+// 単独のエンドポイントで行った場合の HTTP ステータス。
+type BatchResult struct {
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	// ID は登録・更新・削除したブックマークの ID。
+	ID       int64     `json:"id,omitempty"`
+	Bookmark *Bookmark `json:"bookmark,omitempty"`
+	// Error は失敗したとき、単独のエンドポイントで
+	// 返すものと同じエラーの内容。
+	Error *Problem `json:"error,omitempty"`
+}
@@ -7,11 +7,69 @@ type Bookmark struct {
 	ID        int64     `json:"id"`
 	URL       string    `json:"url"`
 	Title     string    `json:"title"`
+	Tags      []string  `json:"tags"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// OwnerID は所有するユーザーの ID。
+	// 本人にしか返さないため、レスポンスには含めない。
+	OwnerID int64 `json:"-"`
+	// FolderID は入っているフォルダの ID。
+	// どのフォルダにも入っていなければ nil。
+	FolderID *int64 `json:"folder_id,omitempty"`
+	// DeletedAt はゴミ箱に移した日時。
+	// ゴミ箱の一覧でだけ設定される。
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// 以下は登録時にページから取得したメタデータ。
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	FaviconURL  string `json:"favicon_url,omitempty"`
+	// MetadataPending はメタデータの取得に失敗し、
+	// 後で取得し直す予定であることを表す。
+	MetadataPending bool `json:"metadata_pending,omitempty"`
+
+	// 以下はリンク切れチェックの結果。
+	// 一度もチェックしていなければ LastCheckedAt は nil。
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+	// HTTPStatus は最後のチェックで得たステータスコード。
+	// 接続できなかった場合は 0 で、理由を CheckError に持つ。
+	HTTPStatus int `json:"http_status,omitempty"`
+	// RedirectURL はリダイレクトされた場合の最終的な URL。
+	RedirectURL string `json:"redirect_url,omitempty"`
+	CheckError  string `json:"check_error,omitempty"`
+}
+
+// Broken はチェック済みで、リンクが切れているかを返す。
+func (b Bookmark) Broken() bool {
+	return b.LastCheckedAt != nil &&
+		LinkCheck{Status: b.HTTPStatus}.Broken()
 }
 
 // CreateBookmarkRequest は登録リクエストの形式。
 type CreateBookmarkRequest struct {
-	URL   string `json:"url"`
-	Title string `json:"title"`
+	URL   string   `json:"url"`
+	Title string   `json:"title"`
+	Tags  []string `json:"tags,omitempty"`
+	// FolderID は入れるフォルダ。省略すると
+	// どのフォルダにも入れない。
+	FolderID *int64 `json:"folder_id,omitempty"`
+	// CreatedAt は登録日時の指定。ゼロ値なら現在時刻。
+	// インポートで元の日時を引き継ぐためのもので、
+	// API からは指定できない。
+	CreatedAt time.Time `json:"-"`
+	// Meta はページから取得したメタデータ。
+	// タイトルを省略した登録でサーバーが設定する。
+	Meta PageMeta `json:"-"`
+	// MetadataPending が true なら、メタデータを
+	// 後で取得し直す。
+	MetadataPending bool `json:"-"`
+}
+
+// UpdateBookmarkRequest は更新リクエストの形式。
+// PUT では全項目を置き換え、PATCH では
+// 既存値にマージした結果をこの形で受け渡す。
+type UpdateBookmarkRequest struct {
+	URL   string   `json:"url"`
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
 }
@@ -0,0 +1,46 @@
+package model
+
+import "time"
+
+// Folder はブックマークをまとめるフォルダ。
+// フォルダの中にフォルダを入れて階層を作れる。
+type Folder struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// ParentID は親フォルダの ID。最上位なら nil。
+	ParentID  *int64    `json:"parent_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	OwnerID   int64     `json:"-"`
+}
+
+// CreateFolderRequest はフォルダ作成リクエストの形式。
+type CreateFolderRequest struct {
+	Name     string `json:"name"`
+	ParentID *int64 `json:"parent_id"`
+}
+
+// UpdateFolderRequest はフォルダ名の変更リクエストの形式。
+type UpdateFolderRequest struct {
+	Name string `json:"name"`
+}
+
+// MoveFolderRequest はフォルダの移動リクエストの形式。
+// ParentID が nil なら最上位に移す。
+type MoveFolderRequest struct {
+	ParentID *int64 `json:"parent_id"`
+}
+
+// MoveBookmarkRequest はブックマークの移動リクエストの形式。
+// FolderID が nil ならどのフォルダにも入れない。
+type MoveBookmarkRequest struct {
+	FolderID *int64 `json:"folder_id"`
+}
+
+// FolderTree はフォルダとその中身を入れ子にしたもの。
+// フォルダは名前順、ブックマークは登録順に並ぶ。
+type FolderTree struct {
+	Folder
+	Folders   []FolderTree `json:"folders"`
+	Bookmarks []Bookmark   `json:"bookmarks"`
+}
@@ -0,0 +1,28 @@
+package model
+
+// インポート結果の各エントリの状態。
+const (
+	ImportCreated  = "created"
+	ImportSkipped  = "skipped"
+	ImportRejected = "rejected"
+)
+
+// ImportReport はインポートの結果。
+type ImportReport struct {
+	Created  int `json:"created"`
+	Skipped  int `json:"skipped"`
+	Rejected int `json:"rejected"`
+	// Items はファイル中の順に並べた各エントリの結果。
+	Items []ImportItem `json:"items"`
+}
+
+// ImportItem は1件分のインポート結果。
+type ImportItem struct {
+	URL    string `json:"url"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	// ID は登録したブックマークの ID。
+	// 重複で飛ばした場合は既存のブックマークの ID。
+	ID     int64  `json:"id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
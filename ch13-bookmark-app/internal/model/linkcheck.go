@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// LinkCheck はブックマークの URL に対する1回分の
+// リンク切れチェックの結果。
+type LinkCheck struct {
+	CheckedAt time.Time
+	// Status は HTTP ステータスコード。
+	// 接続できなかった場合は 0。
+	Status int
+	// RedirectURL はリダイレクト先。
+	// リダイレクトされなければ空。
+	RedirectURL string
+	// Error は接続できなかった理由。
+	Error string
+}
+
+// Broken はリンクが切れているかを返す。
+// 接続できなかった場合と、4xx・5xx を切れているとみなす。
+func (c LinkCheck) Broken() bool {
+	return c.Status == 0 || c.Status >= 400
+}
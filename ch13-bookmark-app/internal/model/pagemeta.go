@@ -0,0 +1,11 @@
+package model
+
+// PageMeta はページの HTML から取り出したメタデータ。
+// 見つからなかった項目は空になる。
+type PageMeta struct {
+	// Title は og:title か、なければ <title> の内容。
+	Title       string
+	Description string
+	ImageURL    string
+	FaviconURL  string
+}
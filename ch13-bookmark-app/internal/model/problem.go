@@ -0,0 +1,33 @@
+package model
+
+// Problem はエラーレスポンスの形式。RFC 9457 の
+// application/problem+json に従う。
+type Problem struct {
+	// Type は問題の種類を表す URI。Code と1対1に対応する。
+	Type string `json:"type"`
+	// Code はクライアントが処理を分けるための識別子。
+	// 一度公開した値は変えない。
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail はこの発生に固有の説明。
+	Detail string `json:"detail,omitempty"`
+	// Instance はエラーになったリクエストのパス。
+	Instance string `json:"instance,omitempty"`
+	// RequestID はサーバーのログと突き合わせるための ID。
+	RequestID string `json:"request_id,omitempty"`
+	// Errors は入力の検証エラーのとき、
+	// 不正なフィールドとその理由の一覧。
+	Errors []FieldError `json:"errors,omitempty"`
+	// ExistingID は重複エラーのとき、
+	// 既に登録されているブックマークの ID。
+	ExistingID int64 `json:"existing_id,omitempty"`
+}
+
+// FieldError は不正なフィールド1つ分の理由。
+// Field は JSON のキーかクエリパラメータの名前で、
+// 配列の要素は tags[1] のように添字を付ける。
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
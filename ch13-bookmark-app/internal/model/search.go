@@ -0,0 +1,11 @@
+package model
+
+// SearchResult は全文検索の1件分の結果。
+// Snippet は一致箇所を <mark> と </mark> で囲んだ抜粋で、
+// タイトルや URL の < や & などは HTML としてエスケープ済み。
+// Rank は bm25 のスコア（小さいほど関連度が高い）。
+type SearchResult struct {
+	Bookmark
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
@@ -0,0 +1,17 @@
+package model
+
+// Tag はタグ名と、そのタグが付いたブックマーク数。
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// RenameTagRequest はタグ名変更リクエストの形式。
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+// MergeTagRequest はタグ統合リクエストの形式。
+type MergeTagRequest struct {
+	Into string `json:"into"`
+}
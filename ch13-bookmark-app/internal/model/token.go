@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// API トークンに付けられるスコープ。
+// 読み取りと書き込みは独立していて、
+// 書き込みのスコープだけでは一覧や取得はできない。
+const (
+	ScopeBookmarksRead  = "bookmarks:read"
+	ScopeBookmarksWrite = "bookmarks:write"
+)
+
+// Scopes は有効なスコープの一覧。
+var Scopes = []string{ScopeBookmarksRead, ScopeBookmarksWrite}
+
+// APIToken は個人用のアクセストークン。
+// トークンの文字列は作成時に一度だけ返し、保存しない。
+type APIToken struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt が nil なら無期限。
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateTokenRequest はトークン作成リクエストの形式。
+type CreateTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreatedToken は作成したトークンのレスポンス。
+// Token はこのときにしか取得できない。
+type CreatedToken struct {
+	APIToken
+	Token string `json:"token"`
+}
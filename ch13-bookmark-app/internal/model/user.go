@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// User はブックマークを所有する利用者。
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	// PasswordHash はレスポンスに含めない。
+	PasswordHash string `json:"-"`
+}
+
+// Credentials は登録とログインのリクエストの形式。
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,306 @@
+// Package netscape はブラウザのブックマークの書き出し形式
+// (Netscape Bookmark File Format) を読み書きする。
+//
+// Chrome や Firefox の「HTML としてエクスポート」で作られる
+// 次のような形式で、<DL> の入れ子がフォルダの階層を表す。
+//
+//	<!DOCTYPE NETSCAPE-Bookmark-file-1>
+//	<DL><p>
+//	    <DT><H3 ADD_DATE="1700000000">Go</H3>
+//	    <DL><p>
+//	        <DT><A HREF="https://go.dev/" ADD_DATE="1700000000">Go</A>
+//	    </DL><p>
+//	</DL><p>
+package netscape
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry はファイル中の1件のブックマーク。
+type Entry struct {
+	URL   string
+	Title string
+	// AddDate は ADD_DATE 属性の日時。なければゼロ値。
+	AddDate time.Time
+	// Folders はルートからのフォルダ名の並び。
+	// ブラウザの「ブックマークバー」のような
+	// 特別なフォルダは含まない。
+	Folders []string
+	// Tags は Firefox が書き出す TAGS 属性の値。
+	Tags []string
+}
+
+// specialFolderAttrs はブラウザが自動で作るフォルダに付く属性。
+// これらのフォルダ名はタグとして意味を持たないため無視する。
+var specialFolderAttrs = []string{
+	"personal_toolbar_folder",
+	"unfiled_bookmarks_folder",
+}
+
+// Parse は r からブックマークを読み込む。
+// 形式が崩れていても、読み取れた範囲のエントリを返す。
+func Parse(r io.Reader) ([]Entry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: string(data)}
+	return p.parse(), nil
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+// folder はフォルダ階層の1段。
+// 特別なフォルダは name を空にして積む。
+type folder struct {
+	name string
+}
+
+func (p *parser) parse() []Entry {
+	var entries []Entry
+	var stack []folder
+	// H3 の直後の <DL> がそのフォルダの中身になる
+	var pending *folder
+	for {
+		name, attrs, ok := p.nextTag()
+		if !ok {
+			return entries
+		}
+		switch name {
+		case "h3":
+			f := folder{name: p.textUntil("h3")}
+			for _, a := range specialFolderAttrs {
+				if _, ok := attrs[a]; ok {
+					f.name = ""
+				}
+			}
+			pending = &f
+		case "dl":
+			if pending != nil {
+				stack = append(stack, *pending)
+				pending = nil
+			} else {
+				stack = append(stack, folder{})
+			}
+		case "/dl":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case "a":
+			e := Entry{
+				URL:   attrs["href"],
+				Title: p.textUntil("a"),
+			}
+			if s := attrs["add_date"]; s != "" {
+				e.AddDate = parseUnix(s)
+			}
+			if s := attrs["tags"]; s != "" {
+				e.Tags = splitTags(s)
+			}
+			for _, f := range stack {
+				if f.name != "" {
+					e.Folders = append(e.Folders, f.name)
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+}
+
+// nextTag は次のタグまで読み進め、小文字のタグ名と
+// 属性を返す。終了タグの名前は "/dl" のようになる。
+func (p *parser) nextTag() (
+	string, map[string]string, bool,
+) {
+	for {
+		i := strings.IndexByte(p.src[p.pos:], '<')
+		if i < 0 {
+			return "", nil, false
+		}
+		start := p.pos + i + 1
+		end := strings.IndexByte(p.src[start:], '>')
+		if end < 0 {
+			return "", nil, false
+		}
+		p.pos = start + end + 1
+		body := p.src[start : start+end]
+		if strings.HasPrefix(body, "!") {
+			// DOCTYPE やコメントは読み飛ばす。
+			// コメント中の > で終わらないよう --> を探す
+			if strings.HasPrefix(body, "!--") &&
+				!strings.HasSuffix(body, "--") {
+				j := strings.Index(
+					p.src[start:], "-->")
+				if j < 0 {
+					return "", nil, false
+				}
+				p.pos = start + j + 3
+			}
+			continue
+		}
+		name, rest, _ := strings.Cut(
+			strings.TrimSpace(body), " ")
+		name = strings.ToLower(
+			strings.TrimSuffix(name, "/"))
+		if name == "" {
+			continue
+		}
+		return name, parseAttrs(rest), true
+	}
+}
+
+// textUntil は </name> までのテキストを返す。
+// 文字参照 (&amp; など) は元の文字に戻す。
+func (p *parser) textUntil(name string) string {
+	rest := p.src[p.pos:]
+	i := strings.Index(
+		strings.ToLower(rest), "</"+name)
+	if i < 0 {
+		p.pos = len(p.src)
+		return strings.TrimSpace(html.UnescapeString(rest))
+	}
+	text := rest[:i]
+	p.pos += i
+	return strings.TrimSpace(html.UnescapeString(text))
+}
+
+// parseAttrs は NAME="value" の並びを読み、
+// 名前を小文字にした map を返す。
+// 引用符なしの値と値のない属性も受け付ける。
+func parseAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			return attrs
+		}
+		i := strings.IndexAny(s, "= \t\r\n")
+		if i < 0 {
+			attrs[strings.ToLower(s)] = ""
+			return attrs
+		}
+		name := strings.ToLower(s[:i])
+		s = strings.TrimLeft(s[i:], " \t\r\n")
+		if !strings.HasPrefix(s, "=") {
+			attrs[name] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t\r\n")
+		var value string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			q := s[0]
+			end := strings.IndexByte(s[1:], q)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(s, " \t\r\n")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		attrs[name] = html.UnescapeString(value)
+	}
+}
+
+func parseUnix(s string) time.Time {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}
+	}
+	// Firefox の一部のバージョンはマイクロ秒で書き出す
+	if n > 1e14 {
+		return time.UnixMicro(n).UTC()
+	}
+	return time.Unix(n, 0).UTC()
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for t := range strings.SplitSeq(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// Writer はブラウザで読み込める形式で書き出す。
+// 1件ずつ書き込むため、全件をメモリに載せずに済む。
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter はヘッダを書き込んだ Writer を返す。
+func NewWriter(w io.Writer) *Writer {
+	nw := &Writer{w: bufio.NewWriter(w)}
+	nw.printf(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+	return nw
+}
+
+// Write は1件のブックマークを書き込む。
+// Folders は無視し、Tags を TAGS 属性に書き出す。
+func (nw *Writer) Write(e Entry) error {
+	nw.printf(`    <DT><A HREF="%s"`,
+		html.EscapeString(e.URL))
+	if !e.AddDate.IsZero() {
+		nw.printf(` ADD_DATE="%d"`, e.AddDate.Unix())
+	}
+	if len(e.Tags) > 0 {
+		nw.printf(` TAGS="%s"`, html.EscapeString(
+			strings.Join(e.Tags, ",")))
+	}
+	nw.printf(">%s</A>\n", html.EscapeString(e.Title))
+	return nw.err
+}
+
+// Close はフッタを書き込んでバッファを吐き出す。
+// 元の io.Writer は閉じない。
+func (nw *Writer) Close() error {
+	nw.printf("</DL><p>\n")
+	if nw.err != nil {
+		return nw.err
+	}
+	return nw.w.Flush()
+}
+
+// Flush はバッファの内容を書き出す。
+func (nw *Writer) Flush() error {
+	if nw.err != nil {
+		return nw.err
+	}
+	return nw.w.Flush()
+}
+
+func (nw *Writer) printf(format string, args ...any) {
+	if nw.err != nil {
+		return
+	}
+	if len(args) == 0 {
+		_, nw.err = nw.w.WriteString(format)
+		return
+	}
+	_, nw.err = fmt.Fprintf(nw.w, format, args...)
+}
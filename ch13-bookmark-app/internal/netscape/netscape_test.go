@@ -0,0 +1,142 @@
+package netscape
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Chrome が書き出すファイルを簡略化したもの
+const chromeExport = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1700000000" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DL><p>
+        <DT><A HREF="https://go.dev/" ADD_DATE="1700000001" ICON="data:image/png;base64,AAAA">Go</A>
+        <DT><H3 ADD_DATE="1700000000">Dev</H3>
+        <DL><p>
+            <DT><H3>Go &amp; Tools</H3>
+            <DL><p>
+                <DT><A HREF="https://pkg.go.dev/?q=a&amp;b=c" ADD_DATE="1700000002">pkg.go.dev &lt;docs&gt;</A>
+            </DL><p>
+            <DT><a href='https://example.com' tags="Ref, Web,">
+              Example
+            </a>
+        </DL><p>
+    </DL><p>
+    <DT><A HREF="javascript:alert(1)">bookmarklet</A>
+</DL><p>
+`
+
+func TestParse(t *testing.T) {
+	got, err := Parse(strings.NewReader(chromeExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{
+			URL: "https://go.dev/", Title: "Go",
+			AddDate: time.Unix(1700000001, 0).UTC(),
+		},
+		{
+			URL:     "https://pkg.go.dev/?q=a&b=c",
+			Title:   "pkg.go.dev <docs>",
+			AddDate: time.Unix(1700000002, 0).UTC(),
+			Folders: []string{"Dev", "Go & Tools"},
+		},
+		{
+			URL: "https://example.com", Title: "Example",
+			Folders: []string{"Dev"},
+			Tags:    []string{"Ref", "Web"},
+		},
+		{URL: "javascript:alert(1)", Title: "bookmarklet"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v",
+			len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.URL != w.URL || g.Title != w.Title ||
+			!g.AddDate.Equal(w.AddDate) ||
+			!slices.Equal(g.Folders, w.Folders) ||
+			!slices.Equal(g.Tags, w.Tags) {
+			t.Errorf("entry %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestParse_malformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  int
+	}{
+		{"empty", "", 0},
+		{"unclosed tag", `<DL><p><DT><A HREF="https://go.dev"`, 0},
+		{"unclosed anchor", `<DT><A HREF="https://go.dev">Go`, 1},
+		{"unbalanced dl", `</DL></DL><DT><A HREF="https://go.dev">Go</A>`, 1},
+		{"comment with tag", `<!-- <A HREF="https://x.test">x</A> --><A HREF="https://go.dev">Go</A>`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d entries, want %d: %+v",
+					len(got), tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWriter_roundTrip(t *testing.T) {
+	in := []Entry{
+		{
+			URL:     "https://pkg.go.dev/?q=a&b=c",
+			Title:   `"Go" <packages>`,
+			AddDate: time.Unix(1700000000, 0).UTC(),
+			Tags:    []string{"go", "docs"},
+		},
+		{URL: "https://go.dev/", Title: "Go"},
+	}
+	var buf bytes.Buffer
+	nw := NewWriter(&buf)
+	for _, e := range in {
+		if err := nw.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(),
+		"<!DOCTYPE NETSCAPE-Bookmark-file-1>") {
+		t.Errorf("missing doctype:\n%s", buf.String())
+	}
+
+	out, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("got %d entries, want %d", len(out), len(in))
+	}
+	for i := range in {
+		g, w := out[i], in[i]
+		if g.URL != w.URL || g.Title != w.Title ||
+			!g.AddDate.Equal(w.AddDate) ||
+			!slices.Equal(g.Tags, w.Tags) {
+			t.Errorf("entry %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pagemeta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// UserAgent はページの取得時に送る User-Agent。
+const UserAgent = "bookmark-app-pagemeta/1.0"
+
+// DefaultMaxBytes は読み込む本文の既定の上限。
+// メタデータは <head> にあるため、先頭だけで足りる。
+const DefaultMaxBytes = 512 << 10
+
+// Fetcher はページを取得してメタデータを取り出す。
+// 複数の goroutine から同時に使ってよい。
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewFetcher は client でページを取得する Fetcher を生成する。
+// client には制限時間を設定しておく。利用者の URL を
+// 扱うため、通常は safehttp.NewClient を使う。
+// 本文は maxBytes までしか読まない。
+func NewFetcher(client *http.Client, maxBytes int64) *Fetcher {
+	return &Fetcher{client: client, maxBytes: maxBytes}
+}
+
+// Fetch は rawURL のページを取得してメタデータを返す。
+// 接続できないか、2xx 以外が返った場合はエラーを返す。
+// HTML 以外 (PDF や画像など) はメタデータを持たないため、
+// エラーにせず空の PageMeta を返す。
+func (f *Fetcher) Fetch(
+	ctx context.Context, rawURL string,
+) (model.PageMeta, error) {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return model.PageMeta{}, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept",
+		"text/html,application/xhtml+xml;q=0.9,*/*;q=0.1")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return model.PageMeta{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return model.PageMeta{}, fmt.Errorf(
+			"%s: %s", rawURL, resp.Status)
+	}
+	if !isHTML(resp.Header.Get("Content-Type")) {
+		return model.PageMeta{}, nil
+	}
+	body, err := io.ReadAll(
+		io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return model.PageMeta{}, err
+	}
+	// 相対 URL はリダイレクト後の URL を基準にする
+	return Parse(string(body), resp.Request.URL), nil
+}
+
+// isHTML は Content-Type が HTML かを判定する。
+// 指定がなければ HTML とみなす。
+func isHTML(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
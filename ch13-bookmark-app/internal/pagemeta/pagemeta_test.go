@@ -0,0 +1,214 @@
+package pagemeta
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/safehttp"
+)
+
+func TestParse(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/post")
+	tests := []struct {
+		name string
+		src  string
+		want model.PageMeta
+	}{
+		{
+			name: "open graph",
+			src: `<!DOCTYPE html><html><head>
+<meta charset="utf-8">
+<title>Post | Example Blog</title>
+<meta property="og:title" content="Post">
+<meta property="og:description" content="A &amp; B &gt; C">
+<meta property="og:image" content="/img/cover.png">
+<link rel="shortcut icon" href="//cdn.example.com/fav.png">
+</head><body>...</body></html>`,
+			want: model.PageMeta{
+				Title:       "Post",
+				Description: "A & B > C",
+				ImageURL:    "https://example.com/img/cover.png",
+				FaviconURL:  "https://cdn.example.com/fav.png",
+			},
+		},
+		{
+			name: "fallbacks",
+			src: `<HTML><HEAD><TITLE>
+  Go   入門
+</TITLE>
+<META NAME="description" CONTENT='説明文'>
+</HEAD>`,
+			want: model.PageMeta{
+				Title:       "Go 入門",
+				Description: "説明文",
+				FaviconURL:  "https://example.com/favicon.ico",
+			},
+		},
+		{
+			name: "quoted greater-than and comments",
+			src: `<head>
+<!-- <title>commented</title> -->
+<script>document.write("<title>script</title>")</script>
+<meta content="x > y" name="description">
+<title>Real</title>
+<link href="icon.svg" rel=icon>
+</head>`,
+			want: model.PageMeta{
+				Title:       "Real",
+				Description: "x > y",
+				FaviconURL:  "https://example.com/blog/icon.svg",
+			},
+		},
+		{
+			name: "stops at body",
+			src:  `<head></head><body><title>not this</title></body>`,
+			want: model.PageMeta{
+				FaviconURL: "https://example.com/favicon.ico",
+			},
+		},
+		{
+			name: "unsafe and non-utf8",
+			src: "<head><title>\x82\xa0</title>" +
+				`<meta property="og:image" content="javascript:alert(1)">` +
+				`<link rel="icon" href="data:image/png;base64,AAAA">`,
+			want: model.PageMeta{
+				FaviconURL: "https://example.com/favicon.ico",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.src, base); got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	long := "<title>" + strings.Repeat("あ", 500) + "</title>"
+	if got := Parse(long, base).Title; len([]rune(got)) != maxTitleLength {
+		t.Errorf("title length = %d, want %d", len([]rune(got)), maxTitleLength)
+	}
+}
+
+func newTestFetcher(maxBytes int64) *Fetcher {
+	return NewFetcher(safehttp.NewClient(safehttp.Options{
+		Timeout: time.Second, AllowPrivate: true,
+	}), maxBytes)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<head><title>Page</title>` +
+			`<link rel="icon" href="/i.png"></head>`))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(strings.Repeat(" ", 1<<10) + "<title>Late</title>"))
+	})
+	mux.HandleFunc("/file.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF-1.7"))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetcher(t *testing.T) {
+	srv := newTestServer(t)
+	f := newTestFetcher(DefaultMaxBytes)
+
+	m, err := f.Fetch(t.Context(), srv.URL+"/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 相対 URL はリダイレクト後のページを基準に解決する
+	want := model.PageMeta{Title: "Page", FaviconURL: srv.URL + "/i.png"}
+	if m != want {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+
+	if m, err := f.Fetch(t.Context(), srv.URL+"/file.pdf"); err != nil || m != (model.PageMeta{}) {
+		t.Errorf("pdf: got %+v, %v, want empty", m, err)
+	}
+	// 上限を超えた部分は読まない
+	small := newTestFetcher(512)
+	if m, err := small.Fetch(t.Context(), srv.URL+"/big"); err != nil || m.Title != "" {
+		t.Errorf("big: got %+v, %v, want no title", m, err)
+	}
+	for _, path := range []string{"/missing", "/slow"} {
+		if _, err := f.Fetch(t.Context(), srv.URL+path); err == nil {
+			t.Errorf("%s: err = nil", path)
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	srv := newTestServer(t)
+	store := repository.NewMemory()
+	ctx := t.Context()
+	create := func(path string) model.Bookmark {
+		t.Helper()
+		b, err := store.Create(ctx, 1, model.CreateBookmarkRequest{
+			URL: srv.URL + path, Title: srv.URL + path,
+			MetadataPending: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ok := create("/page")
+	failing := create("/missing")
+
+	w := NewWorker(store, newTestFetcher(DefaultMaxBytes),
+		WithInterval(time.Hour))
+	n, err := w.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("fetched = %d, want 1", n)
+	}
+	b, _ := store.FindByID(ctx, 1, ok.ID)
+	if b.Title != "Page" || b.MetadataPending {
+		t.Errorf("ok = %+v", b)
+	}
+	b, _ = store.FindByID(ctx, 1, failing.ID)
+	if !b.MetadataPending {
+		t.Errorf("failing: MetadataPending = false, want true")
+	}
+
+	// 諦める期間を過ぎたものは取得し直さない
+	w = NewWorker(store, newTestFetcher(DefaultMaxBytes),
+		WithInterval(time.Hour), WithGiveUpAfter(0))
+	past := time.Now().Add(-time.Minute)
+	if err := store.RecordMetadata(ctx, failing.ID, model.PageMeta{}, &past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = store.FindByID(ctx, 1, failing.ID)
+	if b.MetadataPending {
+		t.Errorf("gave up: MetadataPending = true, want false")
+	}
+}
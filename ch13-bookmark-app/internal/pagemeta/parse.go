@@ -0,0 +1,261 @@
+// Package pagemeta はウェブページを取得して、タイトルや
+// 説明文、サムネイル画像、favicon といったメタデータを取り出す。
+//
+// 必要な情報はどれも <head> にあるため、HTML 全体を
+// 解析せず、<head> の中のタグだけを読む。
+package pagemeta
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// 取り出したテキストの最大文字数。
+// 長すぎる値で一覧が埋まらないよう切り詰める。
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+)
+
+// Parse は HTML の src からメタデータを取り出す。
+// 相対 URL は base を基準に解決する。
+// タイトルは og:title を優先し、なければ <title> を使う。
+// 説明文も og:description を優先し、なければ
+// <meta name="description"> を使う。
+// favicon の指定がなければ、慣例の /favicon.ico を返す。
+//
+// UTF-8 として正しくないテキストは、文字コードを
+// 変換できないため見つからなかったものとして扱う。
+func Parse(src string, base *url.URL) model.PageMeta {
+	var m model.PageMeta
+	var title, description string
+	p := &parser{src: src}
+	for {
+		name, attrs, ok := p.nextTag()
+		if !ok || name == "/head" || name == "body" {
+			break
+		}
+		switch name {
+		case "title":
+			if title == "" {
+				title = text(p.textUntil("title"))
+			}
+		case "script", "style":
+			// 中身に "<title>" などの文字列があっても
+			// タグとして読まないよう読み飛ばす
+			p.textUntil(name)
+		case "meta":
+			key := attrs["property"]
+			if key == "" {
+				key = attrs["name"]
+			}
+			content := attrs["content"]
+			switch strings.ToLower(key) {
+			case "og:title":
+				m.Title = text(content)
+			case "og:description":
+				m.Description = text(content)
+			case "description":
+				description = text(content)
+			case "og:image":
+				m.ImageURL = resolve(base, content)
+			}
+		case "link":
+			if m.FaviconURL == "" && isIcon(attrs["rel"]) {
+				m.FaviconURL = resolve(base, attrs["href"])
+			}
+		}
+	}
+	if m.Title == "" {
+		m.Title = title
+	}
+	if m.Description == "" {
+		m.Description = description
+	}
+	m.Title = truncate(m.Title, maxTitleLength)
+	m.Description = truncate(m.Description, maxDescriptionLength)
+	if m.FaviconURL == "" && base != nil {
+		m.FaviconURL = resolve(base, "/favicon.ico")
+	}
+	return m
+}
+
+// isIcon は rel 属性が favicon を表すかを判定する。
+// "icon" と "shortcut icon" を受け付ける。
+func isIcon(rel string) bool {
+	for t := range strings.FieldsSeq(strings.ToLower(rel)) {
+		if t == "icon" {
+			return true
+		}
+	}
+	return false
+}
+
+// text は空白をまとめ、UTF-8 でなければ空にする。
+func text(s string) string {
+	if !utf8.ValidString(s) {
+		return ""
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// resolve は ref を base を基準に解決する。
+// http と https 以外の URL (data: や javascript:) は捨てる。
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" ||
+		u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+// nextTag は次のタグまで読み進め、小文字のタグ名と
+// 属性を返す。終了タグの名前は "/head" のようになる。
+func (p *parser) nextTag() (
+	string, map[string]string, bool,
+) {
+	for {
+		i := strings.IndexByte(p.src[p.pos:], '<')
+		if i < 0 {
+			return "", nil, false
+		}
+		start := p.pos + i + 1
+		if strings.HasPrefix(p.src[start:], "!--") {
+			// コメント中の > で終わらないよう --> を探す
+			j := strings.Index(p.src[start:], "-->")
+			if j < 0 {
+				return "", nil, false
+			}
+			p.pos = start + j + 3
+			continue
+		}
+		end := tagEnd(p.src[start:])
+		if end < 0 {
+			return "", nil, false
+		}
+		p.pos = start + end + 1
+		body := p.src[start : start+end]
+		if strings.HasPrefix(body, "!") ||
+			strings.HasPrefix(body, "?") {
+			continue
+		}
+		name, rest := body, ""
+		if j := strings.IndexAny(body, " \t\r\n/"); j > 0 {
+			name, rest = body[:j], body[j:]
+		}
+		name = strings.ToLower(name)
+		if name == "" {
+			continue
+		}
+		return name, parseAttrs(rest), true
+	}
+}
+
+// tagEnd はタグを閉じる > の位置を返す。
+// content="a > b" のような属性値の中の > では終わらない。
+// 引用符は = の直後のものだけを値の始まりとみなし、
+// 本文中の ' でタグの終わりを見失わないようにする。
+func tagEnd(s string) int {
+	var quote, prev byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && prev == '=':
+			quote = c
+		case c == '>':
+			return i
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			prev = c
+		}
+	}
+	return -1
+}
+
+// textUntil は </name> までのテキストを返す。
+// 文字参照 (&amp; など) は元の文字に戻す。
+func (p *parser) textUntil(name string) string {
+	rest := p.src[p.pos:]
+	i := strings.Index(strings.ToLower(rest), "</"+name)
+	if i < 0 {
+		p.pos = len(p.src)
+		return html.UnescapeString(rest)
+	}
+	p.pos += i
+	return html.UnescapeString(rest[:i])
+}
+
+// parseAttrs は name="value" の並びを読み、
+// 名前を小文字にした map を返す。
+// 引用符なしの値と値のない属性も受け付ける。
+func parseAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			return attrs
+		}
+		i := strings.IndexAny(s, "= \t\r\n")
+		if i < 0 {
+			attrs[strings.ToLower(s)] = ""
+			return attrs
+		}
+		name := strings.ToLower(s[:i])
+		s = strings.TrimLeft(s[i:], " \t\r\n")
+		if !strings.HasPrefix(s, "=") {
+			attrs[name] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t\r\n")
+		var value string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			q := s[0]
+			end := strings.IndexByte(s[1:], q)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(s, " \t\r\n")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = html.UnescapeString(value)
+		}
+	}
+}
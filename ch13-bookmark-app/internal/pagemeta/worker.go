@@ -0,0 +1,140 @@
+package pagemeta
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// batchSize は1回にストアから読むブックマークの件数。
+const batchSize = 100
+
+// Store は取得し直す対象の取得と結果の記録先。
+// repository.BookmarkStore が満たす。
+type Store interface {
+	DueForMetadata(ctx context.Context, now time.Time,
+		limit int) ([]model.Bookmark, error)
+	RecordMetadata(ctx context.Context, id int64,
+		m model.PageMeta, retryAt *time.Time) error
+}
+
+// Worker は登録時に取得できなかったメタデータを
+// バックグラウンドで取得し直す。
+type Worker struct {
+	store    Store
+	fetcher  *Fetcher
+	interval time.Duration
+	giveUp   time.Duration
+}
+
+// Option は Worker の設定を変更する。
+type Option func(*Worker)
+
+// WithInterval は取得し直す間隔を設定する。
+func WithInterval(d time.Duration) Option {
+	return func(w *Worker) { w.interval = d }
+}
+
+// WithGiveUpAfter は登録からこの期間が経っても
+// 取得できないものを諦める期間を設定する。
+func WithGiveUpAfter(d time.Duration) Option {
+	return func(w *Worker) { w.giveUp = d }
+}
+
+// NewWorker は Worker を生成する。
+func NewWorker(
+	store Store, fetcher *Fetcher, opts ...Option,
+) *Worker {
+	w := &Worker{
+		store:    store,
+		fetcher:  fetcher,
+		interval: 15 * time.Minute,
+		giveUp:   24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run は ctx がキャンセルされるまで、interval ごとに
+// RunOnce を呼ぶ。
+func (w *Worker) Run(ctx context.Context) {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fetched, err := w.RunOnce(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			slog.Error("メタデータの再取得失敗",
+				"error", err)
+		case fetched > 0:
+			slog.Info("メタデータを再取得",
+				"count", fetched)
+		}
+	}
+}
+
+// RunOnce は取得し直す時期が来たものをすべて処理し、
+// 取得できた件数を返す。失敗したものは interval 後に
+// 取得し直すか、登録から giveUp が経っていれば諦める。
+func (w *Worker) RunOnce(ctx context.Context) (int, error) {
+	now := time.Now().Truncate(time.Second)
+	fetched := 0
+	for ctx.Err() == nil {
+		bms, err := w.store.DueForMetadata(ctx, now, batchSize)
+		if err != nil {
+			return fetched, err
+		}
+		if len(bms) == 0 {
+			break
+		}
+		for _, b := range bms {
+			ok, err := w.refetch(ctx, b)
+			if err != nil {
+				return fetched, err
+			}
+			if ok {
+				fetched++
+			}
+		}
+	}
+	return fetched, nil
+}
+
+// refetch は b のメタデータを取得し直して記録し、
+// 取得できたかを返す。
+func (w *Worker) refetch(
+	ctx context.Context, b model.Bookmark,
+) (bool, error) {
+	m, fetchErr := w.fetcher.Fetch(ctx, b.URL)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	var retryAt *time.Time
+	if fetchErr != nil {
+		if time.Since(b.CreatedAt) < w.giveUp {
+			next := time.Now().Add(w.interval)
+			retryAt = &next
+		} else {
+			slog.Info("メタデータの取得を中止",
+				"id", b.ID, "error", fetchErr)
+		}
+	}
+	err := w.store.RecordMetadata(ctx, b.ID, m, retryAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	return fetchErr == nil, nil
+}
@@ -0,0 +1,130 @@
+// Package ratelimit はキーごとのリクエスト数を
+// トークンバケットで制限する。
+//
+// バケットには Burst 個までトークンがたまり、1秒に Rate 個ずつ
+// 補充される。リクエストごとに1個使い、空なら拒否する。
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval は使われなくなったバケットを捨てる間隔。
+const sweepInterval = time.Minute
+
+// Limit はトークンバケットの大きさと補充の速さ。
+type Limit struct {
+	// Rate は1秒あたりに補充するトークン数。
+	Rate float64
+	// Burst はためておけるトークンの上限。
+	Burst int
+}
+
+// PerMinute は1分あたり n 回、連続して burst 回まで許す制限を返す。
+func PerMinute(n, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// Result は1回の判定の結果。
+type Result struct {
+	// Allowed はリクエストを許すかどうか。
+	Allowed bool
+	// Limit はバケットの大きさ。
+	Limit int
+	// Remaining は判定後に残っているトークン数。
+	Remaining int
+	// Reset はバケットが満杯に戻るまでの時間。
+	Reset time.Duration
+	// RetryAfter は拒否したとき、次のトークンがたまるまでの時間。
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter はキーごとのバケットを持つ。
+// 複数の goroutine から同時に使える。
+type Limiter struct {
+	limit Limit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New は limit で制限する Limiter を返す。
+func New(limit Limit) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow は key のバケットからトークンを1個使う。
+func (l *Limiter) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = min(burst, b.tokens+max(elapsed, 0)*l.limit.Rate)
+	b.last = now
+
+	res := Result{Limit: l.limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.wait(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = l.wait(burst - b.tokens)
+	return res
+}
+
+// wait はトークンが n 個たまるまでの時間を返す。
+func (l *Limiter) wait(n float64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	if l.limit.Rate <= 0 {
+		return math.MaxInt64
+	}
+	return time.Duration(n / l.limit.Rate * float64(time.Second))
+}
+
+// sweep は満杯に戻ったバケットを捨てる。満杯のバケットは
+// 新しく作るものと同じなので、捨てても結果は変わらない。
+// クライアントの数だけバケットが増え続けないようにする。
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := l.wait(float64(l.limit.Burst))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len は保持しているバケットの数を返す。
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock は進めた分だけ時刻が変わる時計。
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newLimiter(limit Limit) (*Limiter, *fakeClock) {
+	c := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(limit)
+	l.now = c.now
+	l.lastSweep = c.t
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, clock := newLimiter(PerMinute(60, 3))
+
+	for i := range 3 {
+		res := l.Allow("a")
+		if !res.Allowed {
+			t.Fatalf("request %d: denied", i)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("request %d: Remaining = %d, want %d",
+				i, res.Remaining, 2-i)
+		}
+	}
+	res := l.Allow("a")
+	if res.Allowed {
+		t.Fatal("4th request: allowed")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", res.RetryAfter)
+	}
+	if res.Reset != 3*time.Second {
+		t.Errorf("Reset = %v, want 3s", res.Reset)
+	}
+
+	// キーごとに別のバケットを使う
+	if !l.Allow("b").Allowed {
+		t.Error("other key: denied")
+	}
+
+	// 1秒で1個補充される
+	clock.add(time.Second)
+	if !l.Allow("a").Allowed {
+		t.Error("after refill: denied")
+	}
+	if l.Allow("a").Allowed {
+		t.Error("after refill: 2nd request allowed")
+	}
+
+	// 長く空けても Burst を超えてはたまらない
+	clock.add(time.Hour)
+	for range 3 {
+		l.Allow("a")
+	}
+	if l.Allow("a").Allowed {
+		t.Error("after idle: more than Burst allowed")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, clock := newLimiter(PerMinute(60, 10))
+	l.Allow("idle")
+	clock.add(sweepInterval - 5*time.Second)
+	l.Allow("busy")
+
+	// idle は10秒で満杯に戻るので捨てる。busy はまだ残す
+	clock.add(5 * time.Second)
+	l.Allow("busy")
+	if l.Len() != 1 {
+		t.Errorf("Len = %d, want 1", l.Len())
+	}
+
+	clock.add(sweepInterval)
+	l.Allow("new")
+	if l.Len() != 1 {
+		t.Errorf("after idle: Len = %d, want 1", l.Len())
+	}
+}
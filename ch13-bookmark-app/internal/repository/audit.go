@@ -0,0 +1,233 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+type actorKey struct{}
+
+// WithActor は ctx に変更を行うユーザーを設定する。
+// 監査ログには、ctx の actor と requestid のリクエスト ID を
+// 記録する。actor のない変更はバックグラウンドの処理として扱う。
+func WithActor(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, actorKey{}, userID)
+}
+
+func actorFrom(ctx context.Context) int64 {
+	id, _ := ctx.Value(actorKey{}).(int64)
+	return id
+}
+
+// AuditOptions は監査ログの取得条件。
+type AuditOptions struct {
+	// Since がゼロ値でなければ、その日時以降のものだけを返す。
+	Since time.Time
+	// After が正なら、その ID より後ろから返す。
+	After int64
+	// Limit が正なら最大件数、0 なら無制限。
+	Limit int
+}
+
+const auditColumns = `id, bookmark_id, owner_id,
+	COALESCE(actor_id, 0), action, COALESCE(request_id, ''),
+	created_at, before, after`
+
+func scanAudit(s rowScanner) (model.AuditEntry, error) {
+	var e model.AuditEntry
+	var createdAt string
+	var before, after sql.NullString
+	if err := s.Scan(
+		&e.ID, &e.BookmarkID, &e.OwnerID,
+		&e.ActorID, &e.Action, &e.RequestID,
+		&createdAt, &before, &after,
+	); err != nil {
+		return model.AuditEntry{}, err
+	}
+	e.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	if before.Valid {
+		e.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		e.After = json.RawMessage(after.String)
+	}
+	return e, nil
+}
+
+// recordAudit は変更前後のブックマークを監査ログに書き込む。
+// 作成なら before を、完全な削除なら after を nil にする。
+// 変更と同じトランザクションの q で呼ぶ。
+func recordAudit(
+	ctx context.Context, q queryer,
+	action string, before, after *model.Bookmark,
+) error {
+	b := after
+	if b == nil {
+		b = before
+	}
+	beforeJSON, err := snapshotJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := snapshotJSON(after)
+	if err != nil {
+		return err
+	}
+	var actor any
+	if id := actorFrom(ctx); id != 0 {
+		actor = id
+	}
+	_, err = q.ExecContext(ctx,
+		`INSERT INTO audit_log
+		 (bookmark_id, owner_id, actor_id, action,
+		  request_id, created_at, before, after)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.ID, b.OwnerID, actor, action,
+		nullString(requestid.FromContext(ctx)),
+		time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339),
+		beforeJSON, afterJSON,
+	)
+	return err
+}
+
+func snapshotJSON(b *model.Bookmark) (any, error) {
+	if b == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// snapshot は所有者やゴミ箱の状態によらず id のブックマークを返す。
+// 監査ログに記録する変更前後の状態の取得に使う。
+func snapshot(
+	ctx context.Context, q queryer, id int64,
+) (model.Bookmark, error) {
+	return scanBookmark(q.QueryRowContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b WHERE b.id = ?`, id))
+}
+
+// auditEach は fn で ids のブックマークをまとめて変更し、
+// それぞれの変更前後の状態を監査ログに記録する。
+// fn の後に存在しないものは完全に削除したものとして記録する。
+func auditEach(
+	ctx context.Context, q queryer, action string,
+	ids []int64, fn func() error,
+) error {
+	before := make([]model.Bookmark, len(ids))
+	for i, id := range ids {
+		b, err := snapshot(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		before[i] = b
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		var after *model.Bookmark
+		b, err := snapshot(ctx, q, id)
+		switch {
+		case err == nil:
+			after = &b
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+		if err := recordAudit(
+			ctx, q, action, &before[i], after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectIDs は ID を1列だけ返すクエリの結果を読む。
+func selectIDs(
+	ctx context.Context, q queryer,
+	query string, args ...any,
+) ([]int64, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// History はユーザーのブックマークの変更履歴を古い順に返す。
+// 完全に削除したものの履歴も返す。履歴がなければ
+// sql.ErrNoRows を返す。
+func (r *BookmarkRepository) History(
+	ctx context.Context, ownerID, id int64,
+) ([]model.AuditEntry, error) {
+	entries, err := queryAudit(ctx, r.db,
+		`SELECT `+auditColumns+` FROM audit_log
+		 WHERE bookmark_id = ? AND owner_id = ?
+		 ORDER BY id`, id, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return entries, nil
+}
+
+// AuditLog はすべてのユーザーの監査ログを古い順に返す。
+func (r *BookmarkRepository) AuditLog(
+	ctx context.Context, opts AuditOptions,
+) ([]model.AuditEntry, error) {
+	query := `SELECT ` + auditColumns + ` FROM audit_log
+		WHERE created_at >= ? AND id > ?
+		ORDER BY id`
+	args := []any{
+		opts.Since.UTC().Format(time.RFC3339), opts.After,
+	}
+	if opts.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, opts.Limit)
+	}
+	return queryAudit(ctx, r.db, query, args...)
+}
+
+func queryAudit(
+	ctx context.Context, q queryer,
+	query string, args ...any,
+) ([]model.AuditEntry, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []model.AuditEntry{}
+	for rows.Next() {
+		e, err := scanAudit(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
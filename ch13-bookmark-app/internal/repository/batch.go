@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// BatchOp は Batch で実行する操作1件。Op が
+// model.BatchCreate なら Create を、model.BatchUpdate なら
+// ID と Update を、model.BatchDelete なら ID を使う。
+type BatchOp struct {
+	Op     string
+	ID     int64
+	Create model.CreateBookmarkRequest
+	Update model.UpdateBookmarkRequest
+}
+
+// BatchResult は BatchOp 1件の結果。Err には単独で
+// 実行した場合と同じく *DuplicateError、sql.ErrNoRows、
+// ErrFolderNotFound が入る。削除では Bookmark はゼロ値。
+type BatchResult struct {
+	Bookmark model.Bookmark
+	Err      error
+}
+
+// BatchError は atomic な Batch が Index 番目の操作で
+// 失敗し、すべての操作を取り消したことを表す。
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// isOpError は操作の内容による失敗かを判定する。
+// それ以外のエラーはストアの障害として Batch 全体を止める。
+func isOpError(err error) bool {
+	return errors.Is(err, ErrDuplicate) ||
+		errors.Is(err, sql.ErrNoRows) ||
+		errors.Is(err, ErrFolderNotFound)
+}
+
+// errUnknownOp は BatchOp.Op が不正なことを表す。
+// 呼び出し元で検証しておくため、通常は起きない。
+var errUnknownOp = errors.New("unknown batch operation")
+
+// Batch は ops を順に実行し、同じ順で結果を返す。
+//
+// atomic なら1つのトランザクションで実行し、1件でも
+// 失敗すればすべて取り消して *BatchError を返す。
+// そうでなければ1件ずつ確定し、失敗した操作は
+// 結果の Err に入れて残りを続ける。
+func (r *BookmarkRepository) Batch(
+	ctx context.Context, ownerID int64,
+	ops []BatchOp, atomic bool,
+) ([]BatchResult, error) {
+	if !atomic {
+		results := make([]BatchResult, len(ops))
+		for i, op := range ops {
+			res, err := r.applyOne(ctx, ownerID, op)
+			if err != nil && !isOpError(err) {
+				return nil, err
+			}
+			results[i] = BatchResult{Bookmark: res, Err: err}
+		}
+		return results, nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		res, err := applyBatchOp(ctx, tx, ownerID, op)
+		if isOpError(err) {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i] = BatchResult{Bookmark: res}
+	}
+	return results, tx.Commit()
+}
+
+// applyOne は1件を1つのトランザクションで実行する。
+func (r *BookmarkRepository) applyOne(
+	ctx context.Context, ownerID int64, op BatchOp,
+) (model.Bookmark, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := applyBatchOp(ctx, tx, ownerID, op)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	return res, tx.Commit()
+}
+
+func applyBatchOp(
+	ctx context.Context, q queryer,
+	ownerID int64, op BatchOp,
+) (model.Bookmark, error) {
+	switch op.Op {
+	case model.BatchCreate:
+		return insertBookmark(ctx, q, ownerID, op.Create)
+	case model.BatchUpdate:
+		return updateBookmark(ctx, q, ownerID, op.ID, op.Update)
+	case model.BatchDelete:
+		return model.Bookmark{},
+			trashBookmark(ctx, q, ownerID, op.ID)
+	}
+	return model.Bookmark{}, errUnknownOp
+}
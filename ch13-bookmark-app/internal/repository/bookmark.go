@@ -1,10 +1,15 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"iter"
+	"strings"
 	"time"
 
 	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
 )
 
 // BookmarkRepository はブックマークの永続化を担当する。
@@ -17,111 +22,552 @@ func New(db *sql.DB) *BookmarkRepository {
 	return &BookmarkRepository{db: db}
 }
 
-// InitTable はブックマーク用テーブルを作成する。
-func (r *BookmarkRepository) InitTable() error {
-	query := `CREATE TABLE IF NOT EXISTS bookmarks (
-		id         INTEGER PRIMARY KEY AUTOINCREMENT,
-		url        TEXT NOT NULL,
-		title      TEXT NOT NULL,
-		created_at TEXT NOT NULL
-	)`
-	_, err := r.db.Exec(query)
-	return err
+// ListOptions は一覧取得の絞り込み条件。
+type ListOptions struct {
+	// Tags が空でなければ、タグで絞り込む。
+	Tags []string
+	// MatchAll が true なら Tags をすべて持つもの (AND)、
+	// false ならいずれかを持つもの (OR) を返す。
+	MatchAll bool
+	// After が nil でなければ、その位置より後ろから返す。
+	After *Cursor
+	// Limit が正なら最大件数、0 なら無制限。
+	Limit int
+	// Link はリンク切れチェックの結果で絞り込む。
+	Link LinkStatus
 }
 
-// Create はブックマークを登録する。
+// LinkStatus はリンク切れチェックの結果による絞り込み条件。
+type LinkStatus int
+
+const (
+	// LinkAny は絞り込まない。
+	LinkAny LinkStatus = iota
+	// LinkBroken はリンク切れのものだけを返す。
+	LinkBroken
+	// LinkOK はチェック済みで切れていないものだけを返す。
+	LinkOK
+	// LinkUnchecked は未チェックのものだけを返す。
+	LinkUnchecked
+)
+
+// linkFilters は LinkStatus ごとの WHERE 句。
+// model.LinkCheck.Broken と同じ条件で判定する。
+var linkFilters = map[LinkStatus]string{
+	LinkBroken: `(b.last_checked_at IS NOT NULL
+		AND (b.http_status = 0 OR b.http_status >= 400))`,
+	LinkOK: `(b.last_checked_at IS NOT NULL
+		AND b.http_status BETWEEN 1 AND 399)`,
+	LinkUnchecked: `b.last_checked_at IS NULL`,
+}
+
+// Cursor は一覧の並び順 (created_at, id) 上の位置。
+// created_at が同じ行も id で一意に順序付けられる。
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// CursorOf は b の位置を指すカーソルを返す。
+func CursorOf(b model.Bookmark) Cursor {
+	return Cursor{CreatedAt: b.CreatedAt, ID: b.ID}
+}
+
+// bookmarkColumns は SELECT 時の列の並び。
+// scanBookmark の引数順と一致させる。
+// タグは相関サブクエリで JSON 配列にまとめて取得し、
+// 行ごとに追加のクエリを発行しないようにする。
+const bookmarkColumns = `b.id, b.url, b.title,
+	b.created_at, b.updated_at, COALESCE(b.owner_id, 0),
+	b.folder_id, b.deleted_at, b.last_checked_at, b.http_status,
+	COALESCE(b.redirect_url, ''), COALESCE(b.check_error, ''),
+	COALESCE(b.description, ''), COALESCE(b.image_url, ''),
+	COALESCE(b.favicon_url, ''), b.metadata_retry_at IS NOT NULL,
+	(SELECT json_group_array(t.name ORDER BY t.name)
+	 FROM bookmark_tags bt
+	 JOIN tags t ON t.id = bt.tag_id
+	 WHERE bt.bookmark_id = b.id)`
+
+// rowScanner は *sql.Row と *sql.Rows の共通部分。
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanBookmark(
+	s rowScanner,
+) (model.Bookmark, error) {
+	var b model.Bookmark
+	var createdAt, updatedAt, tags string
+	var checkedAt, deletedAt sql.NullString
+	var folderID sql.NullInt64
+	if err := s.Scan(
+		&b.ID, &b.URL, &b.Title,
+		&createdAt, &updatedAt, &b.OwnerID,
+		&folderID, &deletedAt, &checkedAt, &b.HTTPStatus,
+		&b.RedirectURL, &b.CheckError,
+		&b.Description, &b.ImageURL,
+		&b.FaviconURL, &b.MetadataPending, &tags,
+	); err != nil {
+		return model.Bookmark{}, err
+	}
+	// Create/Update で RFC3339 形式に統一しているため
+	// パースエラーは発生しない
+	b.CreatedAt, _ = time.Parse(
+		time.RFC3339, createdAt,
+	)
+	b.UpdatedAt, _ = time.Parse(
+		time.RFC3339, updatedAt,
+	)
+	b.LastCheckedAt = parseNullTime(checkedAt)
+	b.FolderID = parseNullID(folderID)
+	b.DeletedAt = parseNullTime(deletedAt)
+	// json_group_array は常に配列を返す
+	if err := json.Unmarshal(
+		[]byte(tags), &b.Tags,
+	); err != nil {
+		return model.Bookmark{}, err
+	}
+	return b, nil
+}
+
+// Create はブックマークをタグとともに登録する。
+// 正規化した URL が同じブックマークが既にあれば
+// *DuplicateError を返す。
 func (r *BookmarkRepository) Create(
+	ctx context.Context, ownerID int64,
 	req model.CreateBookmarkRequest,
 ) (model.Bookmark, error) {
-	now := time.Now().UTC()
-	result, err := r.db.Exec(
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	defer tx.Rollback()
+
+	bm, err := insertBookmark(ctx, tx, ownerID, req)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, tx.Commit()
+}
+
+// insertBookmark は Create の本体。
+// Batch と共通にするためトランザクションの q で実行する。
+func insertBookmark(
+	ctx context.Context, q queryer, ownerID int64,
+	req model.CreateBookmarkRequest,
+) (model.Bookmark, error) {
+	key, err := urlnorm.Normalize(req.URL)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if err := checkFolder(
+		ctx, q, ownerID, req.FolderID); err != nil {
+		return model.Bookmark{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	ts := now.Format(time.RFC3339)
+	created := ts
+	if !req.CreatedAt.IsZero() {
+		created = req.CreatedAt.UTC().
+			Truncate(time.Second).Format(time.RFC3339)
+	}
+	// メタデータの取得に失敗したものは、次の再取得の
+	// 機会にすぐ対象になるよう現在時刻を設定する
+	var retryAt any
+	if req.MetadataPending {
+		retryAt = ts
+	}
+	result, err := q.ExecContext(ctx,
 		`INSERT INTO bookmarks
-		 (url, title, created_at)
-		 VALUES (?, ?, ?)`,
-		req.URL, req.Title,
-		now.Format(time.RFC3339),
+		 (owner_id, url, normalized_url, title,
+		  created_at, updated_at, folder_id,
+		  description, image_url, favicon_url,
+		  metadata_retry_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ownerID, req.URL, key, req.Title, created, ts,
+		req.FolderID,
+		nullString(req.Meta.Description),
+		nullString(req.Meta.ImageURL),
+		nullString(req.Meta.FaviconURL), retryAt,
 	)
 	if err != nil {
-		return model.Bookmark{}, err
+		return model.Bookmark{}, duplicateOf(
+			ctx, q, ownerID, key, err)
 	}
 	// SQLite は LastInsertId を常にサポートする
 	id, _ := result.LastInsertId()
-	return model.Bookmark{
-		ID: id, URL: req.URL,
-		Title: req.Title, CreatedAt: now,
-	}, nil
-}
-
-// All は全ブックマークを取得する。
-func (r *BookmarkRepository) All() (
-	[]model.Bookmark, error,
-) {
-	rows, err := r.db.Query(
-		`SELECT id, url, title, created_at
-		 FROM bookmarks ORDER BY id`)
+	if err := setTags(ctx, q, id, req.Tags); err != nil {
+		return model.Bookmark{}, err
+	}
+	bm, err := findByID(ctx, q, ownerID, id)
 	if err != nil {
-		return nil, err
+		return model.Bookmark{}, err
 	}
-	defer rows.Close()
+	if err := recordAudit(
+		ctx, q, model.AuditCreate, nil, &bm); err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, nil
+}
+
+// All はユーザーの全ブックマークを取得する。
+func (r *BookmarkRepository) All(
+	ctx context.Context, ownerID int64,
+) ([]model.Bookmark, error) {
+	return r.List(ctx, ownerID, ListOptions{})
+}
 
+// List は条件に合うブックマークを取得する。
+func (r *BookmarkRepository) List(
+	ctx context.Context, ownerID int64, opts ListOptions,
+) ([]model.Bookmark, error) {
 	var bookmarks []model.Bookmark
-	for rows.Next() {
-		var b model.Bookmark
-		var createdAt string
-		if err := rows.Scan(
-			&b.ID, &b.URL,
-			&b.Title, &createdAt,
-		); err != nil {
+	for b, err := range r.Iter(ctx, ownerID, opts) {
+		if err != nil {
 			return nil, err
 		}
-		// Create で RFC3339 形式に統一しているため
-		// パースエラーは発生しない
-		b.CreatedAt, _ = time.Parse(
-			time.RFC3339, createdAt,
-		)
 		bookmarks = append(bookmarks, b)
 	}
-	return bookmarks, rows.Err()
+	return bookmarks, nil
+}
+
+// Iter は条件に合うブックマークを (created_at, id) の順に
+// 1件ずつ返す。全件をスライスに読み込まないため、
+// 件数が多くてもメモリ使用量は一定に保たれる。
+// ループを途中で抜けるとカーソルは閉じられる。
+func (r *BookmarkRepository) Iter(
+	ctx context.Context, ownerID int64, opts ListOptions,
+) iter.Seq2[model.Bookmark, error] {
+	return func(
+		yield func(model.Bookmark, error) bool,
+	) {
+		query, args := listQuery(ownerID, opts)
+		rows, err := r.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			yield(model.Bookmark{}, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			b, err := scanBookmark(rows)
+			if !yield(b, err) || err != nil {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(model.Bookmark{}, err)
+		}
+	}
+}
+
+// listQuery は ListOptions から SELECT 文を組み立てる。
+func listQuery(
+	ownerID int64, opts ListOptions,
+) (string, []any) {
+	where := []string{`b.owner_id = ?`, `b.deleted_at IS NULL`}
+	args := []any{ownerID}
+	if len(opts.Tags) > 0 {
+		where = append(where, `b.id IN (`+
+			tagFilter(opts.Tags, opts.MatchAll)+`)`)
+		for _, t := range opts.Tags {
+			args = append(args, t)
+		}
+		if opts.MatchAll {
+			args = append(args, len(opts.Tags))
+		}
+	}
+	if f, ok := linkFilters[opts.Link]; ok {
+		where = append(where, f)
+	}
+	if opts.After != nil {
+		// 行値の比較で (created_at, id) の辞書順に
+		// 後ろの行だけを索引から読む
+		where = append(where,
+			`(b.created_at, b.id) > (?, ?)`)
+		args = append(args,
+			opts.After.CreatedAt.UTC().
+				Format(time.RFC3339),
+			opts.After.ID)
+	}
+
+	query := `SELECT ` + bookmarkColumns + `
+		FROM bookmarks b
+		WHERE ` + strings.Join(where, ` AND `) + `
+		ORDER BY b.created_at, b.id`
+	if opts.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, opts.Limit)
+	}
+	return query, args
+}
+
+// tagFilter は指定タグを持つブックマークIDを返す
+// サブクエリを組み立てる。AND の場合は、一致した
+// タグ数が指定数と等しいものだけを残す。
+func tagFilter(tags []string, all bool) string {
+	q := `SELECT bt.bookmark_id
+		FROM bookmark_tags bt
+		JOIN tags t ON t.id = bt.tag_id
+		WHERE t.name IN (` + placeholders(len(tags)) + `)`
+	if all {
+		q += ` GROUP BY bt.bookmark_id
+		HAVING COUNT(DISTINCT t.id) = ?`
+	}
+	return q
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(
+		strings.Repeat("?, ", n), ", ",
+	)
 }
 
 // FindByID は指定IDのブックマークを取得する。
 func (r *BookmarkRepository) FindByID(
-	id int64,
+	ctx context.Context, ownerID, id int64,
 ) (model.Bookmark, error) {
-	var b model.Bookmark
-	var createdAt string
-	err := r.db.QueryRow(
-		`SELECT id, url, title, created_at
-		 FROM bookmarks WHERE id = ?`, id,
-	).Scan(
-		&b.ID, &b.URL,
-		&b.Title, &createdAt,
+	return findByID(ctx, r.db, ownerID, id)
+}
+
+// queryer は *sql.DB と *sql.Tx の共通部分。
+// トランザクションの内外で同じ処理を使い回すために使う。
+type queryer interface {
+	ExecContext(ctx context.Context, query string,
+		args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string,
+		args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string,
+		args ...any) *sql.Row
+}
+
+func findByID(
+	ctx context.Context, q queryer, ownerID, id int64,
+) (model.Bookmark, error) {
+	return scanBookmark(q.QueryRowContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.id = ? AND b.owner_id = ?
+		   AND b.deleted_at IS NULL`,
+		id, ownerID,
+	))
+}
+
+// Update は指定IDのブックマークを置き換える。
+// created_at は維持し、updated_at を現在時刻にする。
+// タグも req.Tags の内容で置き換える。
+// URL が変わった場合はリンク切れチェックの結果を消す。
+// 変更後の URL がほかのブックマークと重複する場合は
+// *DuplicateError を返す。
+func (r *BookmarkRepository) Update(
+	ctx context.Context, ownerID int64,
+	id int64, req model.UpdateBookmarkRequest,
+) (model.Bookmark, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	defer tx.Rollback()
+
+	bm, err := updateBookmark(ctx, tx, ownerID, id, req)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, tx.Commit()
+}
+
+// updateBookmark は Update の本体。
+func updateBookmark(
+	ctx context.Context, q queryer, ownerID int64,
+	id int64, req model.UpdateBookmarkRequest,
+) (model.Bookmark, error) {
+	key, err := urlnorm.Normalize(req.URL)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	before, err := findByID(ctx, q, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	// SET の右辺は更新前の値で評価されるため、
+	// normalized_url の比較は古い URL とのものになる
+	_, err = q.ExecContext(ctx,
+		`UPDATE bookmarks
+		 SET url = ?, normalized_url = ?,
+		     title = ?, updated_at = ?,
+		     last_checked_at = IIF(normalized_url IS ?,
+		         last_checked_at, NULL),
+		     http_status = IIF(normalized_url IS ?,
+		         http_status, 0),
+		     redirect_url = IIF(normalized_url IS ?,
+		         redirect_url, NULL),
+		     check_error = IIF(normalized_url IS ?,
+		         check_error, NULL)
+		 WHERE id = ? AND owner_id = ?
+		   AND deleted_at IS NULL`,
+		req.URL, key, req.Title,
+		now.Format(time.RFC3339), key, key, key, key,
+		id, ownerID,
 	)
 	if err != nil {
+		return model.Bookmark{}, duplicateOf(
+			ctx, q, ownerID, key, err)
+	}
+	if err := setTags(ctx, q, id, req.Tags); err != nil {
 		return model.Bookmark{}, err
 	}
-	// Create と同じ RFC3339 形式のためパースは安全
-	b.CreatedAt, _ = time.Parse(
-		time.RFC3339, createdAt,
+	bm, err := findByID(ctx, q, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if err := recordAudit(
+		ctx, q, model.AuditUpdate, &before, &bm); err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, nil
+}
+
+// duplicateOf は err が正規化 URL の UNIQUE 制約違反なら、
+// 重複している既存のブックマークを指す *DuplicateError に
+// 置き換える。それ以外のエラーはそのまま返す。
+func duplicateOf(
+	ctx context.Context, q queryer,
+	ownerID int64, key string, err error,
+) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+	var id int64
+	if err := q.QueryRowContext(ctx,
+		`SELECT id FROM bookmarks
+		 WHERE owner_id = ? AND normalized_url = ?
+		   AND deleted_at IS NULL`,
+		ownerID, key,
+	).Scan(&id); err != nil {
+		return err
+	}
+	return &DuplicateError{ID: id}
+}
+
+// BackfillNormalizedURLs は正規化 URL が未設定の行を埋め、
+// 埋めた件数を返す。重複判定を導入する前に登録された
+// 行のためにサーバー起動時に呼ぶ。不正な URL の行や、
+// 既存の行と重複する行は NULL のまま残す。
+func (r *BookmarkRepository) BackfillNormalizedURLs(
+	ctx context.Context,
+) (int, error) {
+	type row struct {
+		id  int64
+		url string
+	}
+	var pending []row
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, url FROM bookmarks
+		 WHERE normalized_url IS NULL ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var p row
+		if err := rows.Scan(&p.id, &p.url); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	filled := 0
+	for _, p := range pending {
+		key, err := urlnorm.Normalize(p.url)
+		if err != nil {
+			continue
+		}
+		// 重複する行は OR IGNORE で飛ばす
+		result, err := r.db.ExecContext(ctx,
+			`UPDATE OR IGNORE bookmarks
+			 SET normalized_url = ? WHERE id = ?`,
+			key, p.id,
+		)
+		if err != nil {
+			return filled, err
+		}
+		n, _ := result.RowsAffected()
+		filled += int(n)
+	}
+	return filled, nil
+}
+
+// ClaimUnowned はユーザー管理を導入する前に登録された、
+// 所有者のいないブックマークを ownerID のものにし、その件数を返す。
+// 運用者が cmd/migrate の -claim-legacy で明示的に実行する。
+// ownerID が既に持っている URL と重複するものは所有者のいないまま残す。
+func (r *BookmarkRepository) ClaimUnowned(
+	ctx context.Context, ownerID int64,
+) (int, error) {
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE OR IGNORE bookmarks SET owner_id = ?
+		 WHERE owner_id IS NULL`, ownerID,
 	)
-	return b, nil
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
 }
 
-// Delete は指定IDのブックマークを削除する。
+// Delete は指定IDのブックマークをゴミ箱に移す。
+// 復元できるよう、タグはそのまま残す。
 func (r *BookmarkRepository) Delete(
-	id int64,
+	ctx context.Context, ownerID, id int64,
 ) error {
-	result, err := r.db.Exec(
-		`DELETE FROM bookmarks WHERE id = ?`,
-		id,
-	)
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	// 0行影響なら対象不在を呼び出し元に伝える
-	n, _ := result.RowsAffected()
-	if n == 0 {
-		return sql.ErrNoRows
+	defer tx.Rollback()
+
+	if err := trashBookmark(ctx, tx, ownerID, id); err != nil {
+		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+// trashBookmark は Delete の本体。
+func trashBookmark(
+	ctx context.Context, q queryer, ownerID, id int64,
+) error {
+	before, err := findByID(ctx, q, ownerID, id)
+	if err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx,
+		`UPDATE bookmarks SET deleted_at = ? WHERE id = ?`,
+		time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339), id,
+	); err != nil {
+		return err
+	}
+	after, err := findTrashed(ctx, q, ownerID, id)
+	if err != nil {
+		return err
+	}
+	return recordAudit(
+		ctx, q, model.AuditDelete, &before, &after)
+}
+
+// CountBookmarks はゴミ箱の中のものを除いた全ユーザーの
+// ブックマークの件数を返す。
+func (r *BookmarkRepository) CountBookmarks(
+	ctx context.Context,
+) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM bookmarks
+		 WHERE deleted_at IS NULL`).Scan(&n)
+	return n, err
 }
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrDuplicate は同じページを指すブックマークが
+// 既に登録されていることを表す。
+// 既存のブックマークの ID は DuplicateError から取り出せる。
+var ErrDuplicate = errors.New("bookmark already exists")
+
+// DuplicateError は重複した既存のブックマークを指す。
+// errors.Is(err, ErrDuplicate) で判定できる。
+type DuplicateError struct {
+	ID int64
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%v: id=%d", ErrDuplicate, e.ID)
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return ErrDuplicate
+}
+
+// isUniqueViolation は UNIQUE 制約違反かを判定する。
+func isUniqueViolation(err error) bool {
+	var se *sqlite.Error
+	return errors.As(err, &se) &&
+		se.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
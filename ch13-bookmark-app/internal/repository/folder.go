@@ -0,0 +1,463 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// ErrFolderNotFound は親フォルダや移動先に指定した
+// フォルダが存在しないことを表す。
+// 操作対象のフォルダ自体がない場合は sql.ErrNoRows を返す。
+var ErrFolderNotFound = errors.New("folder not found")
+
+// ErrFolderCycle はフォルダを自分自身か、
+// その子孫のフォルダの中に移動しようとしたことを表す。
+var ErrFolderCycle = errors.New("folder cannot contain itself")
+
+// DeleteMode はフォルダを削除するときの中身の扱い。
+type DeleteMode int
+
+const (
+	// DeleteCascade は中のフォルダもすべて削除し、
+	// 中のブックマークはゴミ箱に移す。
+	DeleteCascade DeleteMode = iota + 1
+	// DeleteReparent は中のフォルダとブックマークを
+	// 削除するフォルダの親 (最上位なら最上位) に移す。
+	DeleteReparent
+)
+
+const folderColumns = `f.id, f.name, f.parent_id,
+	f.created_at, f.updated_at, f.owner_id`
+
+// subtreeQuery は ? のフォルダと、その子孫のフォルダの
+// ID を返すサブクエリ。UNION で重複を除くため、
+// 万一循環していても終わる。
+const subtreeQuery = `WITH RECURSIVE subtree(id) AS (
+		SELECT ?
+		UNION
+		SELECT f.id FROM folders f
+		JOIN subtree s ON f.parent_id = s.id
+	) SELECT id FROM subtree`
+
+func scanFolder(s rowScanner) (model.Folder, error) {
+	var f model.Folder
+	var parentID sql.NullInt64
+	var createdAt, updatedAt string
+	if err := s.Scan(
+		&f.ID, &f.Name, &parentID,
+		&createdAt, &updatedAt, &f.OwnerID,
+	); err != nil {
+		return model.Folder{}, err
+	}
+	f.ParentID = parseNullID(parentID)
+	f.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	f.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return f, nil
+}
+
+func parseNullID(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+func findFolder(
+	ctx context.Context, q queryer, ownerID, id int64,
+) (model.Folder, error) {
+	return scanFolder(q.QueryRowContext(ctx,
+		`SELECT `+folderColumns+`
+		 FROM folders f
+		 WHERE f.id = ? AND f.owner_id = ?`,
+		id, ownerID,
+	))
+}
+
+// checkFolder は id がユーザーのフォルダであることを確かめる。
+// id が nil (フォルダなし) なら何もしない。
+func checkFolder(
+	ctx context.Context, q queryer, ownerID int64, id *int64,
+) error {
+	if id == nil {
+		return nil
+	}
+	_, err := findFolder(ctx, q, ownerID, *id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFolderNotFound
+	}
+	return err
+}
+
+// CreateFolder はフォルダを作成する。
+func (r *BookmarkRepository) CreateFolder(
+	ctx context.Context, ownerID int64,
+	req model.CreateFolderRequest,
+) (model.Folder, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	defer tx.Rollback()
+
+	if err := checkFolder(
+		ctx, tx, ownerID, req.ParentID); err != nil {
+		return model.Folder{}, err
+	}
+	ts := time.Now().UTC().Truncate(time.Second).
+		Format(time.RFC3339)
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO folders
+		 (owner_id, parent_id, name, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?)`,
+		ownerID, req.ParentID, req.Name, ts, ts,
+	)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	id, _ := result.LastInsertId()
+	f, err := findFolder(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	return f, tx.Commit()
+}
+
+// Folders はユーザーのすべてのフォルダを名前順に返す。
+func (r *BookmarkRepository) Folders(
+	ctx context.Context, ownerID int64,
+) ([]model.Folder, error) {
+	return queryFolders(ctx, r.db,
+		`SELECT `+folderColumns+`
+		 FROM folders f WHERE f.owner_id = ?
+		 ORDER BY f.name, f.id`, ownerID)
+}
+
+func queryFolders(
+	ctx context.Context, q queryer,
+	query string, args ...any,
+) ([]model.Folder, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []model.Folder{}
+	for rows.Next() {
+		f, err := scanFolder(rows)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
+
+// FindFolder は指定IDのフォルダを取得する。
+func (r *BookmarkRepository) FindFolder(
+	ctx context.Context, ownerID, id int64,
+) (model.Folder, error) {
+	return findFolder(ctx, r.db, ownerID, id)
+}
+
+// RenameFolder はフォルダ名を変更する。
+func (r *BookmarkRepository) RenameFolder(
+	ctx context.Context, ownerID, id int64, name string,
+) (model.Folder, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE folders SET name = ?, updated_at = ?
+		 WHERE id = ? AND owner_id = ?`,
+		name, time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339),
+		id, ownerID,
+	)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return model.Folder{}, sql.ErrNoRows
+	}
+	f, err := findFolder(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	return f, tx.Commit()
+}
+
+// MoveFolder はフォルダを parentID の中に移す。
+// parentID が nil なら最上位に移す。
+// 自分自身か子孫の中には移せず、ErrFolderCycle を返す。
+func (r *BookmarkRepository) MoveFolder(
+	ctx context.Context, ownerID, id int64, parentID *int64,
+) (model.Folder, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := findFolder(ctx, tx, ownerID, id); err != nil {
+		return model.Folder{}, err
+	}
+	if err := checkFolder(
+		ctx, tx, ownerID, parentID); err != nil {
+		return model.Folder{}, err
+	}
+	if parentID != nil {
+		// 移動先が自分の部分木に含まれていれば循環する
+		var cycle bool
+		if err := tx.QueryRowContext(ctx,
+			`SELECT ? IN (`+subtreeQuery+`)`,
+			*parentID, id,
+		).Scan(&cycle); err != nil {
+			return model.Folder{}, err
+		}
+		if cycle {
+			return model.Folder{}, ErrFolderCycle
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE folders SET parent_id = ?, updated_at = ?
+		 WHERE id = ?`,
+		parentID, time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339), id,
+	); err != nil {
+		return model.Folder{}, err
+	}
+	f, err := findFolder(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Folder{}, err
+	}
+	return f, tx.Commit()
+}
+
+// DeleteFolder はフォルダを削除する。
+// 中のフォルダとブックマークは mode に従って
+// 一緒に削除 (ブックマークはゴミ箱に移す) するか、親フォルダに移す。
+func (r *BookmarkRepository) DeleteFolder(
+	ctx context.Context, ownerID, id int64, mode DeleteMode,
+) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	f, err := findFolder(ctx, tx, ownerID, id)
+	if err != nil {
+		return err
+	}
+	// 中のブックマークへの変更を監査ログに記録する
+	var action, query string
+	switch mode {
+	case DeleteReparent:
+		action = model.AuditUpdate
+		query = `SELECT id FROM bookmarks WHERE folder_id = ?`
+	case DeleteCascade:
+		action = model.AuditDelete
+		query = `SELECT id FROM bookmarks
+			WHERE folder_id IN (` + subtreeQuery + `)
+			  AND deleted_at IS NULL`
+	default:
+		return fmt.Errorf("unknown delete mode: %d", mode)
+	}
+	ids, err := selectIDs(ctx, tx, query, id)
+	if err != nil {
+		return err
+	}
+	err = auditEach(ctx, tx, action, ids, func() error {
+		if mode == DeleteReparent {
+			return reparentContents(ctx, tx, f)
+		}
+		return deleteSubtree(ctx, tx, id)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reparentContents は f の中身を f の親に移してから f を削除する。
+func reparentContents(
+	ctx context.Context, q queryer, f model.Folder,
+) error {
+	if _, err := q.ExecContext(ctx,
+		`UPDATE folders SET parent_id = ?
+		 WHERE parent_id = ?`, f.ParentID, f.ID,
+	); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx,
+		`UPDATE bookmarks SET folder_id = ?
+		 WHERE folder_id = ?`, f.ParentID, f.ID,
+	); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx,
+		`DELETE FROM folders WHERE id = ?`, f.ID)
+	return err
+}
+
+// deleteSubtree は id のフォルダと子孫のフォルダを削除し、
+// 中のブックマークをゴミ箱に移す。ゴミ箱の中のものは
+// 削除したフォルダを指したままになるが、復元時に最上位に戻す。
+func deleteSubtree(
+	ctx context.Context, q queryer, id int64,
+) error {
+	if _, err := q.ExecContext(ctx,
+		`UPDATE bookmarks SET deleted_at = ?
+		 WHERE folder_id IN (`+subtreeQuery+`)
+		   AND deleted_at IS NULL`,
+		time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339), id,
+	); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx,
+		`DELETE FROM folders
+		 WHERE id IN (`+subtreeQuery+`)`, id)
+	return err
+}
+
+// MoveBookmark はブックマークを folderID のフォルダに移す。
+// folderID が nil ならどのフォルダにも入れない。
+func (r *BookmarkRepository) MoveBookmark(
+	ctx context.Context, ownerID, id int64, folderID *int64,
+) (model.Bookmark, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	defer tx.Rollback()
+
+	if err := checkFolder(
+		ctx, tx, ownerID, folderID); err != nil {
+		return model.Bookmark{}, err
+	}
+	before, err := findByID(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE bookmarks SET folder_id = ?, updated_at = ?
+		 WHERE id = ?`,
+		folderID, time.Now().UTC().Truncate(time.Second).
+			Format(time.RFC3339), id,
+	); err != nil {
+		return model.Bookmark{}, err
+	}
+	bm, err := findByID(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if err := recordAudit(
+		ctx, tx, model.AuditUpdate, &before, &bm); err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, tx.Commit()
+}
+
+// FolderTree は id のフォルダを根とする部分木を返す。
+func (r *BookmarkRepository) FolderTree(
+	ctx context.Context, ownerID, id int64,
+) (model.FolderTree, error) {
+	root, err := findFolder(ctx, r.db, ownerID, id)
+	if err != nil {
+		return model.FolderTree{}, err
+	}
+	folders, err := queryFolders(ctx, r.db,
+		`SELECT `+folderColumns+`
+		 FROM folders f
+		 WHERE f.id IN (`+subtreeQuery+`) AND f.id != ?`,
+		id, id)
+	if err != nil {
+		return model.FolderTree{}, err
+	}
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.folder_id IN (`+subtreeQuery+`)
+		   AND b.deleted_at IS NULL`, id)
+	if err != nil {
+		return model.FolderTree{}, err
+	}
+	defer rows.Close()
+	var bookmarks []model.Bookmark
+	for rows.Next() {
+		b, err := scanBookmark(rows)
+		if err != nil {
+			return model.FolderTree{}, err
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	if err := rows.Err(); err != nil {
+		return model.FolderTree{}, err
+	}
+	return buildTree(root, folders, bookmarks), nil
+}
+
+// buildTree は root と、その子孫のフォルダとブックマークから
+// 入れ子の木を組み立てる。並び順は model.FolderTree の説明のとおり。
+func buildTree(
+	root model.Folder,
+	folders []model.Folder, bookmarks []model.Bookmark,
+) model.FolderTree {
+	children := map[int64][]model.Folder{}
+	for _, f := range folders {
+		if f.ParentID != nil {
+			children[*f.ParentID] = append(
+				children[*f.ParentID], f)
+		}
+	}
+	contents := map[int64][]model.Bookmark{}
+	for _, b := range bookmarks {
+		if b.FolderID != nil {
+			contents[*b.FolderID] = append(
+				contents[*b.FolderID], b)
+		}
+	}
+	var build func(f model.Folder) model.FolderTree
+	build = func(f model.Folder) model.FolderTree {
+		t := model.FolderTree{
+			Folder:    f,
+			Folders:   []model.FolderTree{},
+			Bookmarks: contents[f.ID],
+		}
+		if t.Bookmarks == nil {
+			t.Bookmarks = []model.Bookmark{}
+		}
+		slices.SortFunc(t.Bookmarks, func(a, b model.Bookmark) int {
+			return compareCursor(CursorOf(a), CursorOf(b))
+		})
+		kids := children[f.ID]
+		slices.SortFunc(kids, compareFolders)
+		for _, c := range kids {
+			t.Folders = append(t.Folders, build(c))
+		}
+		return t
+	}
+	return build(root)
+}
+
+// compareFolders はフォルダを名前、ID の順に並べる。
+func compareFolders(a, b model.Folder) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// DueForCheck は最後のチェックが before より前か、
+// まだチェックしていないブックマークを、未チェックのもの、
+// チェックが古いものの順に最大 limit 件返す。
+// リンク切れチェックはユーザーをまたいで行うため、
+// 所有者では絞り込まない。ゴミ箱の中のものは除く。
+func (r *BookmarkRepository) DueForCheck(
+	ctx context.Context, before time.Time, limit int,
+) ([]model.Bookmark, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.deleted_at IS NULL
+		   AND (b.last_checked_at IS NULL
+		        OR b.last_checked_at < ?)
+		 ORDER BY b.last_checked_at IS NOT NULL,
+		          b.last_checked_at, b.id
+		 LIMIT ?`,
+		before.UTC().Format(time.RFC3339), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []model.Bookmark
+	for rows.Next() {
+		b, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// RecordCheck はリンク切れチェックの結果を記録する。
+// 利用者による変更ではないため updated_at は変えない。
+func (r *BookmarkRepository) RecordCheck(
+	ctx context.Context, id int64, c model.LinkCheck,
+) error {
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE bookmarks
+		 SET last_checked_at = ?, http_status = ?,
+		     redirect_url = ?, check_error = ?
+		 WHERE id = ?`,
+		c.CheckedAt.UTC().Truncate(time.Second).
+			Format(time.RFC3339),
+		c.Status, nullString(c.RedirectURL),
+		nullString(c.Error), id,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
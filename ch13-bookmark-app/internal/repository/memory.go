@@ -0,0 +1,605 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
+)
+
+// MemoryStore はブックマークをメモリ上に保持する BookmarkStore。
+// テストや、永続化が不要な用途で使う。
+// 複数の goroutine から同時に使ってよい。
+// 処理は一瞬で終わるため、ctx は各メソッドの開始時と
+// Iter の各行の前にだけ確認する。
+type MemoryStore struct {
+	mu        sync.RWMutex
+	lastID    int64
+	bookmarks map[int64]model.Bookmark
+	// retryAt はメタデータを取得し直す日時。
+	// MetadataPending のものだけを持つ。
+	retryAt map[int64]time.Time
+	// byURL はユーザーと正規化した URL から ID を引く索引。
+	// SQLite 実装の UNIQUE 索引に相当する。
+	byURL map[urlKey]int64
+
+	lastFolderID int64
+	folders      map[int64]model.Folder
+
+	lastAuditID int64
+	audit       []model.AuditEntry
+}
+
+type urlKey struct {
+	ownerID int64
+	url     string
+}
+
+// NewMemory は空の MemoryStore を生成する。
+func NewMemory() *MemoryStore {
+	return &MemoryStore{
+		bookmarks: map[int64]model.Bookmark{},
+		retryAt:   map[int64]time.Time{},
+		byURL:     map[urlKey]int64{},
+		folders:   map[int64]model.Folder{},
+	}
+}
+
+// clone は呼び出し元がスライスやポインタの先を書き換えても
+// 保持している値に影響しないよう複製する。
+func clone(b model.Bookmark) model.Bookmark {
+	b.FolderID = cloneID(b.FolderID)
+	b.Tags = slices.Clone(b.Tags)
+	if b.Tags == nil {
+		b.Tags = []string{}
+	}
+	return b
+}
+
+// sortedTags は SQLite 実装と同じく、
+// 重複を除いて名前順に並べる。
+func sortedTags(tags []string) []string {
+	out := slices.Clone(tags)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// Create はブックマークを登録する。
+// ID は SQLite の AUTOINCREMENT と同じく再利用しない。
+func (s *MemoryStore) Create(
+	ctx context.Context, ownerID int64,
+	req model.CreateBookmarkRequest,
+) (model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Bookmark{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.create(ctx, ownerID, req)
+}
+
+// create は Create の本体。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) create(
+	ctx context.Context, ownerID int64,
+	req model.CreateBookmarkRequest,
+) (model.Bookmark, error) {
+	u, err := urlnorm.Normalize(req.URL)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	key := urlKey{ownerID, u}
+	if !s.folderExists(ownerID, req.FolderID) {
+		return model.Bookmark{}, ErrFolderNotFound
+	}
+	if id, ok := s.byURL[key]; ok {
+		return model.Bookmark{}, &DuplicateError{ID: id}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	s.lastID++
+	b := model.Bookmark{
+		ID: s.lastID, URL: req.URL,
+		Title: req.Title, Tags: sortedTags(req.Tags),
+		CreatedAt: now, UpdatedAt: now,
+		OwnerID:         ownerID,
+		FolderID:        cloneID(req.FolderID),
+		Description:     req.Meta.Description,
+		ImageURL:        req.Meta.ImageURL,
+		FaviconURL:      req.Meta.FaviconURL,
+		MetadataPending: req.MetadataPending,
+	}
+	if !req.CreatedAt.IsZero() {
+		b.CreatedAt = req.CreatedAt.UTC().
+			Truncate(time.Second)
+	}
+	s.bookmarks[b.ID] = b
+	s.byURL[key] = b.ID
+	if b.MetadataPending {
+		s.retryAt[b.ID] = now
+	}
+	if err := s.record(ctx, model.AuditCreate, nil, &b); err != nil {
+		return model.Bookmark{}, err
+	}
+	return clone(b), nil
+}
+
+// Iter は条件に合うブックマークを (created_at, id) の順に返す。
+// 呼び出し時点のスナップショットを返すため、ループ中に
+// ほかのメソッドを呼んでもデッドロックしない。
+func (s *MemoryStore) Iter(
+	ctx context.Context, ownerID int64, opts ListOptions,
+) iter.Seq2[model.Bookmark, error] {
+	s.mu.RLock()
+	var list []model.Bookmark
+	for _, b := range s.bookmarks {
+		if b.OwnerID != ownerID || b.DeletedAt != nil {
+			continue
+		}
+		if opts.After != nil &&
+			compareCursor(CursorOf(b), *opts.After) <= 0 {
+			continue
+		}
+		if !hasTags(b.Tags, opts.Tags, opts.MatchAll) {
+			continue
+		}
+		if !hasLinkStatus(b, opts.Link) {
+			continue
+		}
+		list = append(list, clone(b))
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b model.Bookmark) int {
+		return compareCursor(CursorOf(a), CursorOf(b))
+	})
+	if opts.Limit > 0 && len(list) > opts.Limit {
+		list = list[:opts.Limit]
+	}
+	return func(
+		yield func(model.Bookmark, error) bool,
+	) {
+		for _, b := range list {
+			if err := ctx.Err(); err != nil {
+				yield(model.Bookmark{}, err)
+				return
+			}
+			if !yield(b, nil) {
+				return
+			}
+		}
+	}
+}
+
+func compareCursor(a, b Cursor) int {
+	if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// hasTags は have が want を満たすかを判定する。
+// want が空なら常に true。
+func hasTags(have, want []string, all bool) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		found := slices.Contains(have, w)
+		if all && !found {
+			return false
+		}
+		if !all && found {
+			return true
+		}
+	}
+	return all
+}
+
+// hasLinkStatus は b が want の条件を満たすかを判定する。
+func hasLinkStatus(b model.Bookmark, want LinkStatus) bool {
+	switch want {
+	case LinkBroken:
+		return b.Broken()
+	case LinkOK:
+		return b.LastCheckedAt != nil && !b.Broken()
+	case LinkUnchecked:
+		return b.LastCheckedAt == nil
+	}
+	return true
+}
+
+// FindByID は指定IDのブックマークを取得する。
+func (s *MemoryStore) FindByID(
+	ctx context.Context, ownerID, id int64,
+) (model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Bookmark{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.owned(ownerID, id)
+	if !ok {
+		return model.Bookmark{}, sql.ErrNoRows
+	}
+	return clone(b), nil
+}
+
+// owned はユーザーが所有する、ゴミ箱に入っていない
+// ブックマークを返す。ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) owned(
+	ownerID, id int64,
+) (model.Bookmark, bool) {
+	b, ok := s.bookmarks[id]
+	if !ok || b.OwnerID != ownerID || b.DeletedAt != nil {
+		return model.Bookmark{}, false
+	}
+	return b, true
+}
+
+// Update は指定IDのブックマークを置き換える。
+func (s *MemoryStore) Update(
+	ctx context.Context, ownerID int64,
+	id int64, req model.UpdateBookmarkRequest,
+) (model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Bookmark{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(ctx, ownerID, id, req)
+}
+
+// update は Update の本体。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) update(
+	ctx context.Context, ownerID int64,
+	id int64, req model.UpdateBookmarkRequest,
+) (model.Bookmark, error) {
+	u, err := urlnorm.Normalize(req.URL)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	key := urlKey{ownerID, u}
+	b, ok := s.owned(ownerID, id)
+	if !ok {
+		return model.Bookmark{}, sql.ErrNoRows
+	}
+	if other, ok := s.byURL[key]; ok && other != id {
+		return model.Bookmark{}, &DuplicateError{ID: other}
+	}
+	before := b
+	if s.byURL[key] != id {
+		// URL が変わったらチェック結果は当てにならない
+		b.LastCheckedAt = nil
+		b.HTTPStatus = 0
+		b.RedirectURL = ""
+		b.CheckError = ""
+	}
+	s.dropURL(id)
+	s.byURL[key] = id
+	b.URL = req.URL
+	b.Title = req.Title
+	b.Tags = sortedTags(req.Tags)
+	b.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	s.bookmarks[id] = b
+	if err := s.record(ctx, model.AuditUpdate, &before, &b); err != nil {
+		return model.Bookmark{}, err
+	}
+	return clone(b), nil
+}
+
+// Delete は指定IDのブックマークをゴミ箱に移す。
+func (s *MemoryStore) Delete(
+	ctx context.Context, ownerID, id int64,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(ctx, ownerID, id)
+}
+
+// delete は Delete の本体。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) delete(
+	ctx context.Context, ownerID, id int64,
+) error {
+	b, ok := s.owned(ownerID, id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	return s.moveToTrash(ctx, b, time.Now())
+}
+
+// moveToTrash は b をゴミ箱に移し、監査ログに記録する。
+// ゴミ箱の中のものは重複の判定に使わないため、
+// URL の索引から外す。ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) moveToTrash(
+	ctx context.Context, b model.Bookmark, now time.Time,
+) error {
+	before := b
+	at := now.UTC().Truncate(time.Second)
+	b.DeletedAt = &at
+	s.bookmarks[b.ID] = b
+	s.dropURL(b.ID)
+	return s.record(ctx, model.AuditDelete, &before, &b)
+}
+
+// dropURL は id の索引を削除する。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) dropURL(id int64) {
+	for key, v := range s.byURL {
+		if v == id {
+			delete(s.byURL, key)
+			return
+		}
+	}
+}
+
+// DueForCheck はチェックが必要なブックマークを返す。
+// 並び順は SQLite 実装と同じ。
+func (s *MemoryStore) DueForCheck(
+	ctx context.Context, before time.Time, limit int,
+) ([]model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	before = before.UTC().Truncate(time.Second)
+	s.mu.RLock()
+	var list []model.Bookmark
+	for _, b := range s.bookmarks {
+		if b.DeletedAt != nil {
+			continue
+		}
+		if b.LastCheckedAt == nil ||
+			b.LastCheckedAt.Before(before) {
+			list = append(list, clone(b))
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b model.Bookmark) int {
+		switch {
+		case a.LastCheckedAt == nil && b.LastCheckedAt != nil:
+			return -1
+		case a.LastCheckedAt != nil && b.LastCheckedAt == nil:
+			return 1
+		case a.LastCheckedAt != nil:
+			c := a.LastCheckedAt.Compare(*b.LastCheckedAt)
+			if c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// RecordCheck はリンク切れチェックの結果を記録する。
+func (s *MemoryStore) RecordCheck(
+	ctx context.Context, id int64, c model.LinkCheck,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.bookmarks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	at := c.CheckedAt.UTC().Truncate(time.Second)
+	b.LastCheckedAt = &at
+	b.HTTPStatus = c.Status
+	b.RedirectURL = c.RedirectURL
+	b.CheckError = c.Error
+	s.bookmarks[id] = b
+	return nil
+}
+
+// DueForMetadata はメタデータを取得し直す時期が来たものを返す。
+// 並び順は SQLite 実装と同じ。
+func (s *MemoryStore) DueForMetadata(
+	ctx context.Context, now time.Time, limit int,
+) ([]model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now = now.UTC().Truncate(time.Second)
+	s.mu.RLock()
+	var list []model.Bookmark
+	for id, at := range s.retryAt {
+		if !at.After(now) && s.bookmarks[id].DeletedAt == nil {
+			list = append(list, clone(s.bookmarks[id]))
+		}
+	}
+	retryAt := maps.Clone(s.retryAt)
+	s.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b model.Bookmark) int {
+		if c := retryAt[a.ID].Compare(retryAt[b.ID]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// RecordMetadata は取得し直したメタデータを記録する。
+func (s *MemoryStore) RecordMetadata(
+	ctx context.Context, id int64,
+	m model.PageMeta, retryAt *time.Time,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.bookmarks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.Title != "" && b.Title == b.URL {
+		b.Title = m.Title
+	}
+	b.Description = cmp.Or(m.Description, b.Description)
+	b.ImageURL = cmp.Or(m.ImageURL, b.ImageURL)
+	b.FaviconURL = cmp.Or(m.FaviconURL, b.FaviconURL)
+	b.MetadataPending = retryAt != nil
+	if retryAt != nil {
+		s.retryAt[id] = retryAt.UTC().Truncate(time.Second)
+	} else {
+		delete(s.retryAt, id)
+	}
+	s.bookmarks[id] = b
+	return nil
+}
+
+// Tags はユーザーが使用中のタグを件数付きで名前順に返す。
+func (s *MemoryStore) Tags(
+	ctx context.Context, ownerID int64,
+) ([]model.Tag, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, b := range s.bookmarks {
+		if b.OwnerID != ownerID || b.DeletedAt != nil {
+			continue
+		}
+		for _, t := range b.Tags {
+			counts[t]++
+		}
+	}
+	tags := []model.Tag{}
+	for name, n := range counts {
+		tags = append(tags,
+			model.Tag{Name: name, Count: n})
+	}
+	slices.SortFunc(tags, func(a, b model.Tag) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return tags, nil
+}
+
+// tagInUse はユーザーがタグを使っているかを判定する。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) tagInUse(
+	ownerID int64, name string,
+) bool {
+	for _, b := range s.bookmarks {
+		if b.OwnerID == ownerID && b.DeletedAt == nil &&
+			slices.Contains(b.Tags, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RenameTag はタグ名を変更する。
+// 変更先の名前が既にあれば ErrTagExists を返す。
+func (s *MemoryStore) RenameTag(
+	ctx context.Context, ownerID int64, from, to string,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.tagInUse(ownerID, from) {
+		return sql.ErrNoRows
+	}
+	if from == to {
+		return nil
+	}
+	if s.tagInUse(ownerID, to) {
+		return ErrTagExists
+	}
+	return s.replaceTag(ctx, ownerID, from, to)
+}
+
+// MergeTags は from のタグを into に統合する。
+func (s *MemoryStore) MergeTags(
+	ctx context.Context, ownerID int64, from, into string,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.tagInUse(ownerID, from) {
+		return sql.ErrNoRows
+	}
+	if from == into {
+		return nil
+	}
+	return s.replaceTag(ctx, ownerID, from, into)
+}
+
+// replaceTag はユーザーの from を持つすべてのブックマークで
+// from を to に置き換え、updated_at を更新する。
+// ゴミ箱の中のものは置き換えない。
+func (s *MemoryStore) replaceTag(
+	ctx context.Context, ownerID int64, from, to string,
+) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, id := range s.bookmarkIDs(func(b model.Bookmark) bool {
+		return b.OwnerID == ownerID && b.DeletedAt == nil &&
+			slices.Contains(b.Tags, from)
+	}) {
+		b := s.bookmarks[id]
+		before := b
+		tags := slices.Clone(b.Tags)
+		tags[slices.Index(tags, from)] = to
+		b.Tags = sortedTags(tags)
+		b.UpdatedAt = now
+		s.bookmarks[id] = b
+		if err := s.record(
+			ctx, model.AuditUpdate, &before, &b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountBookmarks はゴミ箱の中のものを除いた全ユーザーの
+// ブックマークの件数を返す。
+func (s *MemoryStore) CountBookmarks(
+	ctx context.Context,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, b := range s.bookmarks {
+		if b.DeletedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+// bookmarkIDs は match を満たすブックマークの ID を昇順に返す。
+// まとめて変更するときに、SQLite 実装と同じ順で
+// 監査ログに記録するために使う。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) bookmarkIDs(
+	match func(model.Bookmark) bool,
+) []int64 {
+	var ids []int64
+	for id, b := range s.bookmarks {
+		if match(b) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// record は監査ログに1件追加する。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) record(
+	ctx context.Context, action string,
+	before, after *model.Bookmark,
+) error {
+	b := after
+	if b == nil {
+		b = before
+	}
+	e := model.AuditEntry{
+		BookmarkID: b.ID,
+		OwnerID:    b.OwnerID,
+		Action:     action,
+		ActorID:    actorFrom(ctx),
+		RequestID:  requestid.FromContext(ctx),
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	var err error
+	if e.Before, err = memorySnapshot(before); err != nil {
+		return err
+	}
+	if e.After, err = memorySnapshot(after); err != nil {
+		return err
+	}
+	s.lastAuditID++
+	e.ID = s.lastAuditID
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+// memorySnapshot は SQLite 実装と同じ形の JSON にする。
+func memorySnapshot(b *model.Bookmark) (json.RawMessage, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return json.Marshal(clone(*b))
+}
+
+// History はユーザーのブックマークの変更履歴を古い順に返す。
+func (s *MemoryStore) History(
+	ctx context.Context, ownerID, id int64,
+) ([]model.AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []model.AuditEntry
+	for _, e := range s.audit {
+		if e.BookmarkID == id && e.OwnerID == ownerID {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return entries, nil
+}
+
+// AuditLog はすべてのユーザーの監査ログを古い順に返す。
+func (s *MemoryStore) AuditLog(
+	ctx context.Context, opts AuditOptions,
+) ([]model.AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	since := opts.Since.UTC().Truncate(time.Second)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []model.AuditEntry{}
+	for _, e := range s.audit {
+		if e.ID <= opts.After || e.CreatedAt.Before(since) {
+			continue
+		}
+		entries = append(entries, e)
+		if opts.Limit > 0 && len(entries) == opts.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
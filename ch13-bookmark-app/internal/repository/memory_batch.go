@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// memoryState は atomic な Batch が失敗したときに
+// 戻すための、ブックマークの操作で変わる状態の複製。
+// 値の中のスライスやポインタは書き換えずに
+// 差し替えるため、浅い複製でよい。
+type memoryState struct {
+	lastID      int64
+	bookmarks   map[int64]model.Bookmark
+	retryAt     map[int64]time.Time
+	byURL       map[urlKey]int64
+	lastAuditID int64
+	audit       int
+}
+
+// Batch は ops を順に実行し、同じ順で結果を返す。
+// atomic で失敗した場合は実行前の状態に戻す。
+func (s *MemoryStore) Batch(
+	ctx context.Context, ownerID int64,
+	ops []BatchOp, atomic bool,
+) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var saved memoryState
+	if atomic {
+		saved = memoryState{
+			lastID:      s.lastID,
+			bookmarks:   maps.Clone(s.bookmarks),
+			retryAt:     maps.Clone(s.retryAt),
+			byURL:       maps.Clone(s.byURL),
+			lastAuditID: s.lastAuditID,
+			audit:       len(s.audit),
+		}
+	}
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		res, err := s.applyBatchOp(ctx, ownerID, op)
+		if err == nil || (!atomic && isOpError(err)) {
+			results[i] = BatchResult{Bookmark: res, Err: err}
+			continue
+		}
+		if atomic {
+			s.lastID = saved.lastID
+			s.bookmarks = saved.bookmarks
+			s.retryAt = saved.retryAt
+			s.byURL = saved.byURL
+			s.lastAuditID = saved.lastAuditID
+			s.audit = s.audit[:saved.audit]
+		}
+		if isOpError(err) {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+// applyBatchOp はロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) applyBatchOp(
+	ctx context.Context, ownerID int64, op BatchOp,
+) (model.Bookmark, error) {
+	switch op.Op {
+	case model.BatchCreate:
+		return s.create(ctx, ownerID, op.Create)
+	case model.BatchUpdate:
+		return s.update(ctx, ownerID, op.ID, op.Update)
+	case model.BatchDelete:
+		return model.Bookmark{}, s.delete(ctx, ownerID, op.ID)
+	}
+	return model.Bookmark{}, errUnknownOp
+}
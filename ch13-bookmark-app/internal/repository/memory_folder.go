@@ -0,0 +1,287 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+func cloneID(id *int64) *int64 {
+	if id == nil {
+		return nil
+	}
+	v := *id
+	return &v
+}
+
+func cloneFolder(f model.Folder) model.Folder {
+	f.ParentID = cloneID(f.ParentID)
+	return f
+}
+
+// folderExists は id がユーザーのフォルダかを判定する。
+// id が nil (フォルダなし) なら true。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) folderExists(ownerID int64, id *int64) bool {
+	if id == nil {
+		return true
+	}
+	f, ok := s.folders[*id]
+	return ok && f.OwnerID == ownerID
+}
+
+// subtree は id のフォルダと子孫のフォルダの ID を返す。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) subtree(id int64) map[int64]bool {
+	ids := map[int64]bool{id: true}
+	for changed := true; changed; {
+		changed = false
+		for _, f := range s.folders {
+			if f.ParentID != nil && ids[*f.ParentID] &&
+				!ids[f.ID] {
+				ids[f.ID] = true
+				changed = true
+			}
+		}
+	}
+	return ids
+}
+
+// CreateFolder はフォルダを作成する。
+func (s *MemoryStore) CreateFolder(
+	ctx context.Context, ownerID int64,
+	req model.CreateFolderRequest,
+) (model.Folder, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Folder{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.folderExists(ownerID, req.ParentID) {
+		return model.Folder{}, ErrFolderNotFound
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	s.lastFolderID++
+	f := model.Folder{
+		ID: s.lastFolderID, Name: req.Name,
+		ParentID:  cloneID(req.ParentID),
+		CreatedAt: now, UpdatedAt: now,
+		OwnerID: ownerID,
+	}
+	s.folders[f.ID] = f
+	return cloneFolder(f), nil
+}
+
+// Folders はユーザーのすべてのフォルダを名前順に返す。
+func (s *MemoryStore) Folders(
+	ctx context.Context, ownerID int64,
+) ([]model.Folder, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	folders := []model.Folder{}
+	for _, f := range s.folders {
+		if f.OwnerID == ownerID {
+			folders = append(folders, cloneFolder(f))
+		}
+	}
+	slices.SortFunc(folders, compareFolders)
+	return folders, nil
+}
+
+// FindFolder は指定IDのフォルダを取得する。
+func (s *MemoryStore) FindFolder(
+	ctx context.Context, ownerID, id int64,
+) (model.Folder, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Folder{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.ownedFolder(ownerID, id)
+	if !ok {
+		return model.Folder{}, sql.ErrNoRows
+	}
+	return cloneFolder(f), nil
+}
+
+// ownedFolder はユーザーが所有するフォルダを返す。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) ownedFolder(
+	ownerID, id int64,
+) (model.Folder, bool) {
+	f, ok := s.folders[id]
+	if !ok || f.OwnerID != ownerID {
+		return model.Folder{}, false
+	}
+	return f, true
+}
+
+// RenameFolder はフォルダ名を変更する。
+func (s *MemoryStore) RenameFolder(
+	ctx context.Context, ownerID, id int64, name string,
+) (model.Folder, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Folder{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.ownedFolder(ownerID, id)
+	if !ok {
+		return model.Folder{}, sql.ErrNoRows
+	}
+	f.Name = name
+	f.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	s.folders[id] = f
+	return cloneFolder(f), nil
+}
+
+// MoveFolder はフォルダを parentID の中に移す。
+func (s *MemoryStore) MoveFolder(
+	ctx context.Context, ownerID, id int64, parentID *int64,
+) (model.Folder, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Folder{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.ownedFolder(ownerID, id)
+	if !ok {
+		return model.Folder{}, sql.ErrNoRows
+	}
+	if !s.folderExists(ownerID, parentID) {
+		return model.Folder{}, ErrFolderNotFound
+	}
+	if parentID != nil && s.subtree(id)[*parentID] {
+		return model.Folder{}, ErrFolderCycle
+	}
+	f.ParentID = cloneID(parentID)
+	f.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	s.folders[id] = f
+	return cloneFolder(f), nil
+}
+
+// DeleteFolder はフォルダを削除する。
+func (s *MemoryStore) DeleteFolder(
+	ctx context.Context, ownerID, id int64, mode DeleteMode,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.ownedFolder(ownerID, id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	switch mode {
+	case DeleteReparent:
+		for cid, c := range s.folders {
+			if c.ParentID != nil && *c.ParentID == id {
+				c.ParentID = cloneID(f.ParentID)
+				s.folders[cid] = c
+			}
+		}
+		for _, bid := range s.bookmarkIDs(func(b model.Bookmark) bool {
+			return b.FolderID != nil && *b.FolderID == id
+		}) {
+			b := s.bookmarks[bid]
+			before := b
+			b.FolderID = cloneID(f.ParentID)
+			s.bookmarks[bid] = b
+			if err := s.record(
+				ctx, model.AuditUpdate, &before, &b); err != nil {
+				return err
+			}
+		}
+		delete(s.folders, id)
+	case DeleteCascade:
+		ids := s.subtree(id)
+		now := time.Now()
+		for _, bid := range s.bookmarkIDs(func(b model.Bookmark) bool {
+			return b.FolderID != nil && ids[*b.FolderID] &&
+				b.DeletedAt == nil
+		}) {
+			if err := s.moveToTrash(
+				ctx, s.bookmarks[bid], now); err != nil {
+				return err
+			}
+		}
+		for fid := range ids {
+			delete(s.folders, fid)
+		}
+	default:
+		return fmt.Errorf("unknown delete mode: %d", mode)
+	}
+	return nil
+}
+
+// MoveBookmark はブックマークを folderID のフォルダに移す。
+func (s *MemoryStore) MoveBookmark(
+	ctx context.Context, ownerID, id int64, folderID *int64,
+) (model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Bookmark{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.folderExists(ownerID, folderID) {
+		return model.Bookmark{}, ErrFolderNotFound
+	}
+	b, ok := s.owned(ownerID, id)
+	if !ok {
+		return model.Bookmark{}, sql.ErrNoRows
+	}
+	before := b
+	b.FolderID = cloneID(folderID)
+	b.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	s.bookmarks[id] = b
+	if err := s.record(ctx, model.AuditUpdate, &before, &b); err != nil {
+		return model.Bookmark{}, err
+	}
+	return clone(b), nil
+}
+
+// FolderTree は id のフォルダを根とする部分木を返す。
+func (s *MemoryStore) FolderTree(
+	ctx context.Context, ownerID, id int64,
+) (model.FolderTree, error) {
+	if err := ctx.Err(); err != nil {
+		return model.FolderTree{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	root, ok := s.ownedFolder(ownerID, id)
+	if !ok {
+		return model.FolderTree{}, sql.ErrNoRows
+	}
+	ids := s.subtree(id)
+	var folders []model.Folder
+	for fid := range ids {
+		if fid != id {
+			folders = append(folders, cloneFolder(s.folders[fid]))
+		}
+	}
+	var bookmarks []model.Bookmark
+	for _, b := range s.bookmarks {
+		if b.FolderID != nil && ids[*b.FolderID] &&
+			b.DeletedAt == nil {
+			bookmarks = append(bookmarks, clone(b))
+		}
+	}
+	return buildTree(cloneFolder(root), folders, bookmarks), nil
+}
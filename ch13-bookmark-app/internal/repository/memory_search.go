@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// Search は q のすべての語をタイトルか URL に含む
+// ブックマークを返す。SQLite 実装の bm25 の代わりに、
+// タイトルに含まれる語の数が多い順、同じなら新しい順に
+// 並べる。大文字小文字は区別しない。
+func (s *MemoryStore) Search(
+	ctx context.Context, ownerID int64,
+	q string, limit int,
+) ([]model.SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	terms := strings.Fields(q)
+	results := []model.SearchResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	s.mu.RLock()
+	for _, b := range s.bookmarks {
+		if b.OwnerID != ownerID || b.DeletedAt != nil {
+			continue
+		}
+		if res, ok := matchBookmark(b, terms); ok {
+			results = append(results, res)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(results, func(a, b model.SearchResult) int {
+		if c := cmp.Compare(a.Rank, b.Rank); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// matchBookmark は b がすべての語を含むかを返す。
+// 順位はタイトルに含まれる語の数を負にしたもの、抜粋は
+// タイトルに含まれる語があればタイトル、なければ URL に
+// 印を付けたもの。
+func matchBookmark(
+	b model.Bookmark, terms []string,
+) (model.SearchResult, bool) {
+	title := strings.ToLower(b.Title)
+	u := strings.ToLower(b.URL)
+	inTitle := 0
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		switch {
+		case strings.Contains(title, t):
+			inTitle++
+		case !strings.Contains(u, t):
+			return model.SearchResult{}, false
+		}
+	}
+	snippet := b.URL
+	if inTitle > 0 {
+		snippet = b.Title
+	}
+	return model.SearchResult{
+		Bookmark: clone(b),
+		Snippet:  highlight(snippet, terms),
+		Rank:     -float64(inTitle),
+	}, true
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
+)
+
+// trashed はユーザーのゴミ箱の中のブックマークを返す。
+// ロックを取得済みの状態で呼ぶ。
+func (s *MemoryStore) trashed(
+	ownerID, id int64,
+) (model.Bookmark, bool) {
+	b, ok := s.bookmarks[id]
+	if !ok || b.OwnerID != ownerID || b.DeletedAt == nil {
+		return model.Bookmark{}, false
+	}
+	return b, true
+}
+
+// Trash はゴミ箱の中のブックマークを、削除した日時の
+// 新しい順に返す。
+func (s *MemoryStore) Trash(
+	ctx context.Context, ownerID int64,
+) ([]model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	list := []model.Bookmark{}
+	for _, b := range s.bookmarks {
+		if b.OwnerID == ownerID && b.DeletedAt != nil {
+			list = append(list, clone(b))
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b model.Bookmark) int {
+		if c := b.DeletedAt.Compare(*a.DeletedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return list, nil
+}
+
+// Restore はゴミ箱の中のブックマークを元に戻す。
+func (s *MemoryStore) Restore(
+	ctx context.Context, ownerID, id int64,
+) (model.Bookmark, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Bookmark{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.trashed(ownerID, id)
+	if !ok {
+		return model.Bookmark{}, sql.ErrNoRows
+	}
+	// 登録時に正規化できているため失敗しない
+	u, _ := urlnorm.Normalize(b.URL)
+	key := urlKey{ownerID, u}
+	if other, ok := s.byURL[key]; ok {
+		return model.Bookmark{}, &DuplicateError{ID: other}
+	}
+	before := b
+	if !s.folderExists(ownerID, b.FolderID) {
+		b.FolderID = nil
+	}
+	b.DeletedAt = nil
+	s.bookmarks[id] = b
+	s.byURL[key] = id
+	if err := s.record(ctx, model.AuditRestore, &before, &b); err != nil {
+		return model.Bookmark{}, err
+	}
+	return clone(b), nil
+}
+
+// DeletePermanently はゴミ箱の中のブックマークを完全に削除する。
+func (s *MemoryStore) DeletePermanently(
+	ctx context.Context, ownerID, id int64,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.trashed(ownerID, id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.bookmarks, id)
+	delete(s.retryAt, id)
+	return s.record(ctx, model.AuditPurge, &b, nil)
+}
+
+// PurgeTrash は before より前にゴミ箱に移したものを
+// 完全に削除し、削除した件数を返す。
+func (s *MemoryStore) PurgeTrash(
+	ctx context.Context, before time.Time,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	before = before.UTC().Truncate(time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := s.bookmarkIDs(func(b model.Bookmark) bool {
+		return b.DeletedAt != nil && b.DeletedAt.Before(before)
+	})
+	for _, id := range ids {
+		b := s.bookmarks[id]
+		delete(s.bookmarks, id)
+		delete(s.retryAt, id)
+		if err := s.record(ctx, model.AuditPurge, &b, nil); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// MemoryUserStore はユーザーと認証情報をメモリ上に保持する
+// UserStore。MemoryStore と組み合わせてテストに使う。
+// 複数の goroutine から同時に使ってよい。
+type MemoryUserStore struct {
+	mu       sync.RWMutex
+	lastID   int64
+	users    map[string]model.User
+	sessions map[string]memorySession
+
+	lastTokenID int64
+	tokens      map[int64]memoryToken
+}
+
+type memorySession struct {
+	userID    int64
+	expiresAt time.Time
+}
+
+// NewMemoryUsers は空の MemoryUserStore を生成する。
+func NewMemoryUsers() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:    map[string]model.User{},
+		sessions: map[string]memorySession{},
+		tokens:   map[int64]memoryToken{},
+	}
+}
+
+// Create はユーザーを登録する。
+func (s *MemoryUserStore) Create(
+	ctx context.Context, username, passwordHash string,
+) (model.User, error) {
+	if err := ctx.Err(); err != nil {
+		return model.User{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; ok {
+		return model.User{}, ErrUserExists
+	}
+	s.lastID++
+	u := model.User{
+		ID: s.lastID, Username: username,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	s.users[username] = u
+	return u, nil
+}
+
+// FindByName は名前でユーザーを取得する。
+func (s *MemoryUserStore) FindByName(
+	ctx context.Context, username string,
+) (model.User, error) {
+	if err := ctx.Err(); err != nil {
+		return model.User{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return model.User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+// CreateSession はセッションを登録する。
+// あわせて期限切れのセッションを削除する。
+func (s *MemoryUserStore) CreateSession(
+	ctx context.Context, userID int64,
+	tokenHash string, expiresAt time.Time,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for h, sess := range s.sessions {
+		if !sess.expiresAt.After(now) {
+			delete(s.sessions, h)
+		}
+	}
+	s.sessions[tokenHash] = memorySession{
+		userID:    userID,
+		expiresAt: expiresAt.Truncate(time.Second),
+	}
+	return nil
+}
+
+// SessionUser は有効なセッションのユーザーを返す。
+func (s *MemoryUserStore) SessionUser(
+	ctx context.Context, tokenHash string,
+) (model.User, error) {
+	if err := ctx.Err(); err != nil {
+		return model.User{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess, ok := s.sessions[tokenHash]
+	if !ok || !sess.expiresAt.After(time.Now()) {
+		return model.User{}, sql.ErrNoRows
+	}
+	return s.byID(sess.userID)
+}
+
+// byID はロックを取得済みの状態で呼ぶ。
+func (s *MemoryUserStore) byID(id int64) (model.User, error) {
+	for _, u := range s.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return model.User{}, sql.ErrNoRows
+}
+
+// DeleteSession はセッションを削除する。
+func (s *MemoryUserStore) DeleteSession(
+	ctx context.Context, tokenHash string,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+type memoryToken struct {
+	userID int64
+	hash   string
+	token  model.APIToken
+}
+
+// CreateToken は API トークンを登録する。
+func (s *MemoryUserStore) CreateToken(
+	ctx context.Context, userID int64,
+	tokenHash string, t model.APIToken,
+) (model.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return model.APIToken{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastTokenID++
+	t.ID = s.lastTokenID
+	t.Scopes = slices.Clone(t.Scopes)
+	t.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if t.ExpiresAt != nil {
+		e := t.ExpiresAt.UTC().Truncate(time.Second)
+		t.ExpiresAt = &e
+	}
+	t.LastUsedAt = nil
+	s.tokens[t.ID] = memoryToken{
+		userID: userID, hash: tokenHash, token: t,
+	}
+	return t, nil
+}
+
+// Tokens はユーザーのトークンを作成順に返す。
+func (s *MemoryUserStore) Tokens(
+	ctx context.Context, userID int64,
+) ([]model.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := []model.APIToken{}
+	for _, mt := range s.tokens {
+		if mt.userID == userID {
+			t := mt.token
+			t.Scopes = slices.Clone(t.Scopes)
+			tokens = append(tokens, t)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b model.APIToken) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return tokens, nil
+}
+
+// RevokeToken はトークンを削除する。
+func (s *MemoryUserStore) RevokeToken(
+	ctx context.Context, userID, id int64,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mt, ok := s.tokens[id]
+	if !ok || mt.userID != userID {
+		return sql.ErrNoRows
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+// TokenUser は有効なトークンとそのユーザーを返す。
+func (s *MemoryUserStore) TokenUser(
+	ctx context.Context, tokenHash string,
+) (model.User, model.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return model.User{}, model.APIToken{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for id, mt := range s.tokens {
+		if mt.hash != tokenHash {
+			continue
+		}
+		t := mt.token
+		if t.ExpiresAt != nil && !t.ExpiresAt.After(now) {
+			break
+		}
+		u, err := s.byID(mt.userID)
+		if err != nil {
+			return model.User{}, model.APIToken{}, err
+		}
+		if t.LastUsedAt == nil ||
+			now.Sub(*t.LastUsedAt) >= lastUsedInterval {
+			t.LastUsedAt = &now
+			mt.token = t
+			s.tokens[id] = mt
+		}
+		t.Scopes = slices.Clone(t.Scopes)
+		return u, t, nil
+	}
+	return model.User{}, model.APIToken{}, sql.ErrNoRows
+}
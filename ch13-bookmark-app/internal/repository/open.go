@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// connParams は接続ごとに設定する SQLite のパラメータ。
+// database/sql は接続を複数張るため、PRAGMA を一度実行するのではなく
+// DSN に含めて新しい接続のたびに適用させる。
+//   - busy_timeout: 書き込み中の接続があれば最大5秒待つ
+//   - journal_mode(WAL): 読み込みのカーソルを開いたままでも書き込める
+//   - foreign_keys: REFERENCES の制約を有効にする
+//   - _txlock=immediate: トランザクションの開始時に書き込みのロックを取り、
+//     読んだ後に書き込むトランザクション同士が SQLITE_BUSY にならないようにする
+var connParams = []string{
+	"_pragma=busy_timeout(5000)",
+	"_pragma=journal_mode(WAL)",
+	"_pragma=foreign_keys(1)",
+	"_txlock=immediate",
+}
+
+// Open は path の SQLite データベースを開く。
+// path に既にパラメータがあれば、その後ろに connParams を加える。
+func Open(path string) (*sql.DB, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return sql.Open("sqlite", path+sep+strings.Join(connParams, "&"))
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"iter"
+	"path/filepath"
+	"testing"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/migrate"
+)
+
+// Iter のカーソルを開いたままでも、ほかの接続から書き込めることを確認する。
+// WAL でなければ書き込みはカーソルが閉じるまで待たされ、
+// busy_timeout を過ぎて失敗する。
+func TestOpen_writeWhileIterating(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	mustCreate(t, s, "https://a.test", "A", "go")
+	mustCreate(t, s, "https://b.test", "B")
+
+	next, stop := iter.Pull2(s.Iter(t.Context(), testOwner, ListOptions{}))
+	defer stop()
+	if _, err, ok := next(); !ok || err != nil {
+		t.Fatalf("first = %v, %v", ok, err)
+	}
+
+	c := mustCreate(t, s, "https://c.test", "C", "go")
+	if err := s.Delete(t.Context(), testOwner, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeletePermanently(t.Context(), testOwner, c.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err, ok := next(); !ok || err != nil {
+		t.Fatalf("second = %v, %v", ok, err)
+	}
+	if _, _, ok := next(); ok {
+		t.Error("iterator yielded more than 2 bookmarks")
+	}
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// DueForMetadata はメタデータを取得し直す時期が now までに
+// 来たブックマークを、時期の早い順に最大 limit 件返す。
+// バックグラウンドで使うため、所有者では絞り込まない。
+// ゴミ箱の中のものは除く。
+func (r *BookmarkRepository) DueForMetadata(
+	ctx context.Context, now time.Time, limit int,
+) ([]model.Bookmark, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.metadata_retry_at IS NOT NULL
+		   AND b.metadata_retry_at <= ?
+		   AND b.deleted_at IS NULL
+		 ORDER BY b.metadata_retry_at, b.id
+		 LIMIT ?`,
+		now.UTC().Format(time.RFC3339), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []model.Bookmark
+	for rows.Next() {
+		b, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// RecordMetadata は取得し直したメタデータを記録し、
+// 次に取得し直す日時を retryAt にする (nil なら取得し直さない)。
+// 空の項目は既存の値を残す。タイトルは URL を仮に
+// 入れてある場合だけ置き換え、利用者が付けたものは変えない。
+// updated_at は変えない。
+func (r *BookmarkRepository) RecordMetadata(
+	ctx context.Context, id int64,
+	m model.PageMeta, retryAt *time.Time,
+) error {
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE bookmarks
+		 SET title = IIF(? != '' AND title = url, ?, title),
+		     description = COALESCE(?, description),
+		     image_url = COALESCE(?, image_url),
+		     favicon_url = COALESCE(?, favicon_url),
+		     metadata_retry_at = ?
+		 WHERE id = ?`,
+		m.Title, m.Title,
+		nullString(m.Description), nullString(m.ImageURL),
+		nullString(m.FaviconURL), formatNullTime(retryAt),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// trigramLen は trigram トークナイザが索引を使える
+// 検索語の最小文字数。
+const trigramLen = 3
+
+// 検索結果の抜粋で一致箇所を囲む印。
+const (
+	markOpen  = "<mark>"
+	markClose = "</mark>"
+)
+
+// 抜粋を作る間、一致箇所を囲んでおく制御文字。タイトルや URL に
+// 含まれる < などと区別できるよう、HTML のエスケープを済ませてから
+// markOpen と markClose に置き換える。
+const (
+	sentinelOpen  = "\x01"
+	sentinelClose = "\x02"
+)
+
+// sentinelReplacer は抜粋の制御文字を HTML の印に置き換える。
+var sentinelReplacer = strings.NewReplacer(
+	sentinelOpen, markOpen, sentinelClose, markClose,
+)
+
+// renderSnippet は一致箇所を制御文字で囲んだ抜粋を
+// HTML として安全に表示できる形にする。タイトルや URL は
+// エスケープし、一致箇所だけを <mark> で囲む。
+func renderSnippet(s string) string {
+	return sentinelReplacer.Replace(html.EscapeString(s))
+}
+
+// Search は q に一致するブックマークを関連度順に返す。
+// q は空白区切りで、すべての語を含むものに一致する。
+// 3文字以上の語は FTS5 の索引で検索して bm25 で順位付けし
+// (タイトルの一致を URL より重く扱う)、
+// 2文字以下の語は trigram の索引を使えないため
+// LIKE による部分一致で絞り込む。
+func (r *BookmarkRepository) Search(
+	ctx context.Context, ownerID int64,
+	q string, limit int,
+) ([]model.SearchResult, error) {
+	terms := strings.Fields(q)
+	if len(terms) == 0 {
+		return []model.SearchResult{}, nil
+	}
+	var match []string
+	var likes []string
+	var likeArgs []any
+	for _, t := range terms {
+		if utf8.RuneCountInString(t) >= trigramLen {
+			match = append(match, quoteTerm(t))
+			continue
+		}
+		likes = append(likes,
+			`(f.title LIKE ? ESCAPE '\' `+
+				`OR f.url LIKE ? ESCAPE '\')`)
+		p := "%" + escapeLike(t) + "%"
+		likeArgs = append(likeArgs, p, p)
+	}
+
+	var query string
+	var args []any
+	if len(match) > 0 {
+		query = `SELECT ` + bookmarkColumns + `,
+			snippet(bookmarks_fts, -1, char(1), char(2),
+				'…', 16),
+			bm25(bookmarks_fts, 10.0, 1.0) AS score
+			FROM bookmarks_fts f
+			JOIN bookmarks b ON b.id = f.rowid
+			WHERE bookmarks_fts MATCH ?
+			AND b.owner_id = ? AND b.deleted_at IS NULL`
+		args = append(args, strings.Join(match, " "))
+	} else {
+		// MATCH がないと snippet と bm25 は使えないため、
+		// 抜粋は Go 側で作り、順位は新しい順にする
+		query = `SELECT ` + bookmarkColumns + `,
+			'', 0.0 AS score
+			FROM bookmarks_fts f
+			JOIN bookmarks b ON b.id = f.rowid
+			WHERE b.owner_id = ? AND b.deleted_at IS NULL`
+	}
+	args = append(args, ownerID)
+	for _, l := range likes {
+		query += ` AND ` + l
+	}
+	args = append(args, likeArgs...)
+	query += ` ORDER BY score, b.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []model.SearchResult{}
+	for rows.Next() {
+		var res model.SearchResult
+		b, err := scanBookmark(scanFunc(
+			func(dest ...any) error {
+				return rows.Scan(append(dest,
+					&res.Snippet, &res.Rank)...)
+			},
+		))
+		if err != nil {
+			return nil, err
+		}
+		res.Bookmark = b
+		if res.Snippet == "" {
+			res.Snippet = highlight(b.Title, terms)
+		} else {
+			res.Snippet = renderSnippet(res.Snippet)
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// scanFunc は関数を rowScanner として扱うための型。
+// 追加の列を scanBookmark の後ろに読み込むときに使う。
+type scanFunc func(dest ...any) error
+
+func (f scanFunc) Scan(dest ...any) error {
+	return f(dest...)
+}
+
+// quoteTerm は検索語を FTS5 のフレーズとして囲む。
+// AND や * などが演算子として解釈されないようにする。
+func quoteTerm(t string) string {
+	return `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+}
+
+var likeEscaper = strings.NewReplacer(
+	`\`, `\\`, `%`, `\%`, `_`, `\_`,
+)
+
+func escapeLike(t string) string {
+	return likeEscaper.Replace(t)
+}
+
+// highlight は s の中で terms に一致する箇所を
+// 大文字小文字を区別せずに印で囲み、renderSnippet で
+// HTML にした抜粋を返す。
+func highlight(s string, terms []string) string {
+	lower := strings.ToLower(s)
+	// 小文字化でバイト長が変わる文字を含む場合は
+	// 位置を対応付けられないので印を付けない
+	if len(lower) != len(s) {
+		return html.EscapeString(s)
+	}
+	marked := make([]bool, len(s))
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		for i := 0; ; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(t); k++ {
+				marked[k] = true
+			}
+			i += j + len(t)
+		}
+	}
+	var sb strings.Builder
+	in := false
+	for i := 0; i < len(s); i++ {
+		if marked[i] != in {
+			if marked[i] {
+				sb.WriteString(sentinelOpen)
+			} else {
+				sb.WriteString(sentinelClose)
+			}
+			in = marked[i]
+		}
+		sb.WriteByte(s[i])
+	}
+	if in {
+		sb.WriteString(sentinelClose)
+	}
+	return renderSnippet(sb.String())
+}
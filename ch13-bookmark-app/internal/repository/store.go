@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// BookmarkStore はブックマークの保存先を抽象化する。
+// SQLite を使う BookmarkRepository と、メモリ上に保持する
+// MemoryStore の2つの実装があり、どちらも同じ振る舞いをする。
+//
+// すべての操作は ownerID のユーザーが所有するものだけを
+// 対象にする。ほかのユーザーのブックマークは存在しないものと
+// 同じく扱い、タグやURLの重複もユーザーごとに判定する。
+//
+// 削除したブックマークはゴミ箱に入り、Trash・Restore・
+// DeletePermanently 以外の操作からは存在しないものとして扱う。
+//
+// ブックマークを変更する操作は、変更前後の状態を
+// WithActor で設定したユーザーとともに監査ログに記録する。
+// バックグラウンドで記録するチェック結果とメタデータは
+// 記録しない。
+//
+// 対象が存在しない場合は sql.ErrNoRows を返す。
+// ctx がキャンセルされるか期限を過ぎると、処理を中断して
+// ctx.Err() をラップしたエラーを返す。
+type BookmarkStore interface {
+	Create(ctx context.Context, ownerID int64,
+		req model.CreateBookmarkRequest,
+	) (model.Bookmark, error)
+	Iter(ctx context.Context, ownerID int64,
+		opts ListOptions,
+	) iter.Seq2[model.Bookmark, error]
+	FindByID(ctx context.Context, ownerID int64,
+		id int64,
+	) (model.Bookmark, error)
+	Update(ctx context.Context, ownerID int64,
+		id int64, req model.UpdateBookmarkRequest,
+	) (model.Bookmark, error)
+	// Delete はブックマークをゴミ箱に移す。
+	Delete(ctx context.Context, ownerID int64, id int64) error
+
+	// Trash はゴミ箱の中のものを削除した日時の新しい順に返す。
+	Trash(ctx context.Context,
+		ownerID int64) ([]model.Bookmark, error)
+	// Restore はゴミ箱から元に戻す。同じ URL のブックマークが
+	// 登録し直されていれば *DuplicateError を返す。
+	Restore(ctx context.Context, ownerID int64,
+		id int64) (model.Bookmark, error)
+	// DeletePermanently はゴミ箱の中のものを完全に削除する。
+	DeletePermanently(ctx context.Context,
+		ownerID int64, id int64) error
+
+	// Batch は登録・更新・削除をまとめて実行し、
+	// ops と同じ順で結果を返す。atomic なら1件でも失敗すると
+	// すべて取り消して *BatchError を返す。
+	Batch(ctx context.Context, ownerID int64,
+		ops []BatchOp, atomic bool) ([]BatchResult, error)
+
+	Tags(ctx context.Context, ownerID int64) ([]model.Tag, error)
+	RenameTag(ctx context.Context, ownerID int64,
+		from, to string) error
+	MergeTags(ctx context.Context, ownerID int64,
+		from, into string) error
+
+	Search(ctx context.Context, ownerID int64,
+		q string, limit int,
+	) ([]model.SearchResult, error)
+
+	FolderStore
+
+	// History はブックマークの変更履歴を古い順に返す。
+	// 完全に削除したものの履歴も返す。
+	History(ctx context.Context, ownerID int64,
+		id int64) ([]model.AuditEntry, error)
+	// AuditLog はすべてのユーザーの監査ログを古い順に返す。
+	// 管理者向けで ownerID を取らない。
+	AuditLog(ctx context.Context,
+		opts AuditOptions) ([]model.AuditEntry, error)
+
+	// 以下はリンク切れチェック、メタデータの再取得、
+	// ゴミ箱の期限切れの削除、メトリクス用で、
+	// バックグラウンドでユーザーをまたいで使うため
+	// ownerID を取らない。
+
+	// DueForCheck は最後のチェックが before より前か
+	// 未チェックのものを、未チェック、チェックが古い順に
+	// 最大 limit 件返す。
+	DueForCheck(ctx context.Context, before time.Time,
+		limit int) ([]model.Bookmark, error)
+	// RecordCheck はチェック結果を記録する。
+	// updated_at は変えない。
+	RecordCheck(ctx context.Context, id int64,
+		c model.LinkCheck) error
+
+	// DueForMetadata は登録時にメタデータを取得できず、
+	// 取得し直す時期が now までに来たものを返す。
+	DueForMetadata(ctx context.Context, now time.Time,
+		limit int) ([]model.Bookmark, error)
+	// RecordMetadata は取得し直したメタデータを記録し、
+	// 次に取得し直す日時を retryAt にする (nil なら終了)。
+	// タイトルは URL を仮に入れてある場合だけ置き換える。
+	RecordMetadata(ctx context.Context, id int64,
+		m model.PageMeta, retryAt *time.Time) error
+
+	// PurgeTrash は before より前にゴミ箱に移したものを
+	// 完全に削除し、削除した件数を返す。
+	PurgeTrash(ctx context.Context,
+		before time.Time) (int, error)
+
+	// CountBookmarks はすべてのユーザーのブックマークのうち、
+	// ゴミ箱の中のものを除いた件数を返す。
+	CountBookmarks(ctx context.Context) (int, error)
+}
+
+// FolderStore はフォルダの階層を扱う。フォルダの削除や
+// 移動はブックマークにも及ぶため、同じトランザクションで
+// 扱えるよう BookmarkStore の一部として実装する。
+//
+// 操作対象のフォルダがなければ sql.ErrNoRows を、
+// 親や移動先に指定したフォルダがなければ
+// ErrFolderNotFound を返す。
+type FolderStore interface {
+	CreateFolder(ctx context.Context, ownerID int64,
+		req model.CreateFolderRequest) (model.Folder, error)
+	// Folders はユーザーのすべてのフォルダを名前順に返す。
+	Folders(ctx context.Context,
+		ownerID int64) ([]model.Folder, error)
+	FindFolder(ctx context.Context,
+		ownerID, id int64) (model.Folder, error)
+	RenameFolder(ctx context.Context, ownerID, id int64,
+		name string) (model.Folder, error)
+	// MoveFolder はフォルダを parentID の中 (nil なら最上位) に
+	// 移す。自分自身か子孫の中へは移せず、ErrFolderCycle を返す。
+	MoveFolder(ctx context.Context, ownerID, id int64,
+		parentID *int64) (model.Folder, error)
+	// DeleteFolder はフォルダを削除し、中身を mode に従って
+	// 一緒に削除 (ブックマークはゴミ箱に移す) するか
+	// 親フォルダに移す。
+	DeleteFolder(ctx context.Context, ownerID, id int64,
+		mode DeleteMode) error
+	// MoveBookmark はブックマークを folderID のフォルダに移す。
+	// nil ならどのフォルダにも入れない。
+	MoveBookmark(ctx context.Context, ownerID, id int64,
+		folderID *int64) (model.Bookmark, error)
+	// FolderTree は id のフォルダを根とする部分木を返す。
+	FolderTree(ctx context.Context,
+		ownerID, id int64) (model.FolderTree, error)
+}
+
+// UserStore はユーザーと、ログインセッションや
+// API トークンといった認証情報の保存先。
+// SQLite を使う UserRepository と、メモリ上に保持する
+// MemoryUserStore の2つの実装がある。
+//
+// セッションと API トークンはハッシュで管理し、
+// トークンそのものは保存しない。
+type UserStore interface {
+	// Create はユーザーを登録する。同じ名前のユーザーが
+	// 既にあれば ErrUserExists を返す。
+	Create(ctx context.Context,
+		username, passwordHash string,
+	) (model.User, error)
+	FindByName(ctx context.Context,
+		username string) (model.User, error)
+
+	CreateSession(ctx context.Context, userID int64,
+		tokenHash string, expiresAt time.Time) error
+	// SessionUser は有効なセッションのユーザーを返す。
+	// 期限切れのセッションは存在しないものとして扱う。
+	SessionUser(ctx context.Context,
+		tokenHash string) (model.User, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+
+	// CreateToken は t の名前・スコープ・期限で
+	// API トークンを登録し、ID と作成日時を設定して返す。
+	CreateToken(ctx context.Context, userID int64,
+		tokenHash string, t model.APIToken,
+	) (model.APIToken, error)
+	// Tokens はユーザーのトークンを作成順に返す。
+	Tokens(ctx context.Context,
+		userID int64) ([]model.APIToken, error)
+	RevokeToken(ctx context.Context, userID, id int64) error
+	// TokenUser は有効なトークンとそのユーザーを返し、
+	// トークンの最終使用日時を更新する。
+	// 期限切れのトークンは存在しないものとして扱う。
+	TokenUser(ctx context.Context, tokenHash string,
+	) (model.User, model.APIToken, error)
+}
+
+// 両方の実装がインターフェースを満たすことをコンパイル時に確認する。
+var (
+	_ BookmarkStore = (*BookmarkRepository)(nil)
+	_ BookmarkStore = (*MemoryStore)(nil)
+	_ UserStore     = (*UserRepository)(nil)
+	_ UserStore     = (*MemoryUserStore)(nil)
+)
@@ -0,0 +1,1496 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/migrate"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/requestid"
+)
+
+// BookmarkStore の各実装に同じテストを実行し、
+// SQLite 版とメモリ版の振る舞いがずれないようにする。
+
+// testOwner はテストでブックマークを所有するユーザーの ID。
+// owner_id には外部キー制約がないため、users に行がなくてよい。
+const testOwner = 1
+
+func newSQLStore(t *testing.T) BookmarkStore {
+	t.Helper()
+	// 本番と同じく外部キーの制約を有効にして開く
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// :memory: は接続ごとに別のDBになるため1本に固定する
+	db.SetMaxOpenConns(1)
+	m, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	return New(db)
+}
+
+func TestBackfillNormalizedURLs(t *testing.T) {
+	r := newSQLStore(t).(*BookmarkRepository)
+	// 重複判定を導入する前に登録された行を再現する
+	_, err := r.db.Exec(`INSERT INTO bookmarks
+		(url, title, created_at, updated_at) VALUES
+		('https://go.dev/?utm_source=a', 'A', '', ''),
+		('https://GO.dev/', 'B', '', ''),
+		('javascript:alert(1)', 'C', '', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := r.BackfillNormalizedURLs(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// B は A と重複し、C は不正なため埋めない
+	if n != 1 {
+		t.Errorf("filled = %d, want 1", n)
+	}
+
+	// 所有者のいない行は、登録しただけのユーザーには渡さない
+	users := NewUsers(r.db)
+	first, err := users.Create(t.Context(), "first", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := users.Create(t.Context(), "second", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []model.User{first, second} {
+		if got, _ := r.All(t.Context(), u.ID); len(got) != 0 {
+			t.Errorf("%s has %d bookmarks, want 0", u.Username, len(got))
+		}
+	}
+
+	// 運用者が指定したユーザーだけが引き継ぐ。
+	// 既に持っている URL と重複する行は所有者のいないまま残す
+	own, err := r.Create(t.Context(), second.ID, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "own",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = r.ClaimUnowned(t.Context(), second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("claimed = %d, want 2", n)
+	}
+	if got, _ := r.All(t.Context(), first.ID); len(got) != 0 {
+		t.Errorf("first user has %d bookmarks, want 0", len(got))
+	}
+	if got, _ := r.All(t.Context(), second.ID); len(got) != 3 {
+		t.Errorf("second user has %d bookmarks, want 3", len(got))
+	}
+	_, err = r.Create(t.Context(), second.ID, model.CreateBookmarkRequest{
+		URL: "https://go.dev/?utm_source=x", Title: "dup",
+	})
+	var dup *DuplicateError
+	if !errors.As(err, &dup) || dup.ID != own.ID {
+		t.Errorf("err = %v, want DuplicateError{%d}", err, own.ID)
+	}
+}
+
+// PurgeTrash は定期的に呼ばれるため、期限切れのものがなければ
+// 使われていないタグの掃除も含めて何も書き込まない。
+func TestPurgeTrash_emptySweep(t *testing.T) {
+	r := newSQLStore(t).(*BookmarkRepository)
+	ctx := t.Context()
+	b := mustCreate(t, r, "https://a.test", "A", "old")
+	mustCreate(t, r, "https://b.test", "B", "go")
+	if err := r.Delete(ctx, testOwner, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	// 接続は1本なので total_changes() で書き込みの有無がわかる
+	changes := func() int {
+		var n int
+		if err := r.db.QueryRow(`SELECT total_changes()`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tags := func() int {
+		var n int
+		if err := r.db.QueryRow(`SELECT COUNT(*) FROM tags`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// 掃除が走ったかを確かめるため、参照されていないタグを置いておく
+	if _, err := r.db.Exec(`INSERT INTO tags (name) VALUES ('orphan')`); err != nil {
+		t.Fatal(err)
+	}
+
+	before := changes()
+	if n, err := r.PurgeTrash(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("PurgeTrash(old) = %d, %v, want 0", n, err)
+	}
+	if got := changes(); got != before {
+		t.Errorf("empty sweep made %d changes", got-before)
+	}
+	if got := tags(); got != 3 {
+		t.Errorf("tags after empty sweep = %d, want 3", got)
+	}
+
+	if n, err := r.PurgeTrash(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatalf("PurgeTrash = %d, %v, want 1", n, err)
+	}
+	// 完全に削除したものだけが使っていたタグは消える
+	if got := tags(); got != 1 {
+		t.Errorf("tags = %d, want 1", got)
+	}
+}
+
+func newMemoryStore(t *testing.T) BookmarkStore {
+	return NewMemory()
+}
+
+func TestBookmarkRepository(t *testing.T) {
+	runStoreTests(t, newSQLStore)
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, newMemoryStore)
+}
+
+func runStoreTests(
+	t *testing.T,
+	newStore func(t *testing.T) BookmarkStore,
+) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s BookmarkStore)
+	}{
+		{"CreateAndFind", testCreateAndFind},
+		{"NotFound", testNotFound},
+		{"Update", testUpdate},
+		{"Delete", testDelete},
+		{"Trash", testTrash},
+		{"Iter", testIter},
+		{"Tags", testTags},
+		{"RenameTag", testRenameTag},
+		{"MergeTags", testMergeTags},
+		{"TagsInTrash", testTagsInTrash},
+		{"Search", testSearch},
+		{"Concurrent", testConcurrent},
+		{"Canceled", testCanceled},
+		{"Duplicate", testDuplicate},
+		{"Owners", testOwners},
+		{"LinkCheck", testLinkCheck},
+		{"Metadata", testMetadata},
+		{"Folders", testFolders},
+		{"Audit", testAudit},
+		{"Batch", testBatch},
+		{"CountBookmarks", testCountBookmarks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func mustCreate(
+	t *testing.T, s BookmarkStore,
+	url, title string, tags ...string,
+) model.Bookmark {
+	t.Helper()
+	b, err := s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+		URL: url, Title: title, Tags: tags,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// backdate はブックマークの updated_at を過去にする。
+// 更新日時が変わったかを秒単位の時刻で判定できるようにする。
+func backdate(t *testing.T, s BookmarkStore, id int64, at time.Time) {
+	t.Helper()
+	switch s := s.(type) {
+	case *BookmarkRepository:
+		if _, err := s.db.Exec(
+			`UPDATE bookmarks SET updated_at = ? WHERE id = ?`,
+			at.UTC().Format(time.RFC3339), id); err != nil {
+			t.Fatal(err)
+		}
+	case *MemoryStore:
+		b := s.bookmarks[id]
+		b.UpdatedAt = at.UTC()
+		s.bookmarks[id] = b
+	default:
+		t.Fatalf("backdate: unsupported store %T", s)
+	}
+}
+
+func ids(t *testing.T, s BookmarkStore, opts ListOptions) []int64 {
+	t.Helper()
+	got := []int64{}
+	for b, err := range s.Iter(t.Context(), testOwner, opts) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b.ID)
+	}
+	return got
+}
+
+func testCreateAndFind(t *testing.T, s BookmarkStore) {
+	created := mustCreate(t, s,
+		"https://go.dev", "Go", "web", "go", "go")
+	if created.ID != 1 {
+		t.Errorf("id = %d, want 1", created.ID)
+	}
+	if !created.CreatedAt.Equal(created.UpdatedAt) {
+		t.Errorf("updated_at = %v, want created_at %v",
+			created.UpdatedAt, created.CreatedAt)
+	}
+	got, err := s.FindByID(t.Context(), testOwner, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != "https://go.dev" || got.Title != "Go" {
+		t.Errorf("got %+v", got)
+	}
+	if want := []string{"go", "web"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("tags = %v, want %v", got.Tags, want)
+	}
+	if !got.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("created_at = %v, want %v",
+			got.CreatedAt, created.CreatedAt)
+	}
+
+	// タグなしでも空配列を返す
+	b := mustCreate(t, s, "https://x.test", "X")
+	if b.Tags == nil || len(b.Tags) != 0 {
+		t.Errorf("tags = %#v, want empty slice", b.Tags)
+	}
+	if b.ID != 2 {
+		t.Errorf("id = %d, want 2", b.ID)
+	}
+
+	// 登録日時を指定した場合は created_at だけに反映する
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	old, err := s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+		URL: "https://old.test", Title: "Old", CreatedAt: at,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.FindByID(t.Context(), testOwner, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := at.Truncate(time.Second); !got.CreatedAt.Equal(want) {
+		t.Errorf("created_at = %v, want %v", got.CreatedAt, want)
+	}
+	if !got.UpdatedAt.After(at) {
+		t.Errorf("updated_at = %v, want now", got.UpdatedAt)
+	}
+}
+
+func testNotFound(t *testing.T, s BookmarkStore) {
+	if _, err := s.FindByID(t.Context(), testOwner, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("FindByID: err = %v, want sql.ErrNoRows", err)
+	}
+	_, err := s.Update(t.Context(), testOwner, 1, model.UpdateBookmarkRequest{
+		URL: "https://x.test", Title: "X",
+	})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Update: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.Delete(t.Context(), testOwner, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Delete: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testUpdate(t *testing.T, s BookmarkStore) {
+	b := mustCreate(t, s, "https://go.dev", "Go", "go")
+	got, err := s.Update(t.Context(), testOwner, b.ID, model.UpdateBookmarkRequest{
+		URL: "https://pkg.go.dev", Title: "Pkg",
+		Tags: []string{"pkg"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != "https://pkg.go.dev" || got.Title != "Pkg" ||
+		!slices.Equal(got.Tags, []string{"pkg"}) {
+		t.Errorf("got %+v", got)
+	}
+	if !got.CreatedAt.Equal(b.CreatedAt) {
+		t.Errorf("created_at changed")
+	}
+	// 使われなくなったタグは一覧から消える
+	tags, _ := s.Tags(t.Context(), testOwner)
+	want := []model.Tag{{Name: "pkg", Count: 1}}
+	if !slices.Equal(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+}
+
+func testDelete(t *testing.T, s BookmarkStore) {
+	b := mustCreate(t, s, "https://go.dev", "Go", "go")
+	if err := s.Delete(t.Context(), testOwner, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindByID(t.Context(), testOwner, b.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("FindByID after delete: err = %v", err)
+	}
+	if tags, _ := s.Tags(t.Context(), testOwner); len(tags) != 0 {
+		t.Errorf("tags = %v, want none", tags)
+	}
+	// 削除したIDは再利用しない
+	if b2 := mustCreate(t, s, "https://x.test", "X"); b2.ID == b.ID {
+		t.Errorf("id %d was reused", b2.ID)
+	}
+}
+
+func testTrash(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	a := mustCreate(t, s, "https://go.dev", "Go", "go")
+	c := mustCreate(t, s, "https://c.test", "C")
+	f, err := s.CreateFolder(ctx, testOwner,
+		model.CreateFolderRequest{Name: "F"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://b.test", Title: "B", FolderID: &f.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, testOwner, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	// ゴミ箱の中のものはほかの操作からは見えない
+	if got := ids(t, s, ListOptions{}); !slices.Equal(got, []int64{c.ID, b.ID}) {
+		t.Errorf("ids = %v, want %v", got, []int64{c.ID, b.ID})
+	}
+	if err := s.Delete(ctx, testOwner, a.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Delete twice: err = %v", err)
+	}
+	if _, err := s.Update(ctx, testOwner, a.ID,
+		model.UpdateBookmarkRequest{URL: a.URL, Title: "X"},
+	); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Update in trash: err = %v", err)
+	}
+	if res, _ := s.Search(ctx, testOwner, "go.dev", 10); len(res) != 0 {
+		t.Errorf("search found %d in trash", len(res))
+	}
+	if tags, _ := s.Tags(ctx, testOwner); len(tags) != 0 {
+		t.Errorf("tags = %v, want none", tags)
+	}
+	if err := s.DeletePermanently(ctx, testOwner, c.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeletePermanently outside trash: err = %v", err)
+	}
+
+	trash, err := s.Trash(ctx, testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != a.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("trash = %+v", trash)
+	}
+
+	// 同じ URL を登録し直せるが、そのままでは復元できない
+	// タグの付いたものも完全に削除できることを後で確認する
+	a2 := mustCreate(t, s, "https://go.dev/", "Go 2", "old")
+	var dup *DuplicateError
+	if _, err := s.Restore(ctx, testOwner, a.ID); !errors.As(err, &dup) ||
+		dup.ID != a2.ID {
+		t.Fatalf("Restore duplicate: err = %v", err)
+	}
+	if err := s.Delete(ctx, testOwner, a2.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Restore(ctx, testOwner, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeletedAt != nil || !slices.Equal(got.Tags, []string{"go"}) {
+		t.Errorf("restored = %+v", got)
+	}
+	if _, err := s.Restore(ctx, testOwner, a.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Restore twice: err = %v", err)
+	}
+
+	// フォルダごと削除したものは最上位に復元する
+	if err := s.DeleteFolder(ctx, testOwner, f.ID, DeleteCascade); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Restore(ctx, testOwner, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FolderID != nil {
+		t.Errorf("folder_id = %d, want nil", *got.FolderID)
+	}
+
+	if err := s.DeletePermanently(ctx, testOwner, a2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeletePermanently(ctx, testOwner, a2.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeletePermanently twice: err = %v", err)
+	}
+
+	if err := s.Delete(ctx, testOwner, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if n, err := s.PurgeTrash(ctx, now.Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("PurgeTrash(old) = %d, %v, want 0", n, err)
+	}
+	if n, err := s.PurgeTrash(ctx, now.Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("PurgeTrash = %d, %v, want 1", n, err)
+	}
+	if trash, _ := s.Trash(ctx, testOwner); len(trash) != 0 {
+		t.Errorf("trash = %+v, want empty", trash)
+	}
+}
+
+func testIter(t *testing.T, s BookmarkStore) {
+	mustCreate(t, s, "https://a.test", "A", "go", "web")
+	mustCreate(t, s, "https://b.test", "B", "go")
+	mustCreate(t, s, "https://c.test", "C", "web")
+	mustCreate(t, s, "https://d.test", "D")
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []int64
+	}{
+		{"全件", ListOptions{}, []int64{1, 2, 3, 4}},
+		{"AND", ListOptions{
+			Tags: []string{"go", "web"}, MatchAll: true,
+		}, []int64{1}},
+		{"OR", ListOptions{
+			Tags: []string{"go", "web"},
+		}, []int64{1, 2, 3}},
+		{"Limit", ListOptions{Limit: 2}, []int64{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(t, s, tt.opts); !slices.Equal(got, tt.want) {
+				t.Errorf("ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	b2, _ := s.FindByID(t.Context(), testOwner, 2)
+	c := CursorOf(b2)
+	got := ids(t, s, ListOptions{After: &c, Limit: 1})
+	if !slices.Equal(got, []int64{3}) {
+		t.Errorf("after 2: ids = %v, want [3]", got)
+	}
+
+	// 途中で抜けても問題なく次の操作ができる
+	for range s.Iter(t.Context(), testOwner, ListOptions{}) {
+		break
+	}
+	mustCreate(t, s, "https://e.test", "E")
+}
+
+func testTags(t *testing.T, s BookmarkStore) {
+	if tags, _ := s.Tags(t.Context(), testOwner); tags == nil || len(tags) != 0 {
+		t.Errorf("tags = %#v, want empty slice", tags)
+	}
+	mustCreate(t, s, "https://a.test", "A", "go", "web")
+	mustCreate(t, s, "https://b.test", "B", "go")
+	tags, err := s.Tags(t.Context(), testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.Tag{
+		{Name: "go", Count: 2}, {Name: "web", Count: 1},
+	}
+	if !slices.Equal(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+}
+
+func testRenameTag(t *testing.T, s BookmarkStore) {
+	mustCreate(t, s, "https://a.test", "A", "go", "web")
+	mustCreate(t, s, "https://b.test", "B", "go")
+
+	if err := s.RenameTag(t.Context(), testOwner, "none", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("missing: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RenameTag(t.Context(), testOwner, "go", "web"); !errors.Is(err, ErrTagExists) {
+		t.Errorf("existing: err = %v, want ErrTagExists", err)
+	}
+	if err := s.RenameTag(t.Context(), testOwner, "go", "go"); err != nil {
+		t.Errorf("same name: err = %v", err)
+	}
+	if err := s.RenameTag(t.Context(), testOwner, "go", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.FindByID(t.Context(), testOwner, 1)
+	if want := []string{"golang", "web"}; !slices.Equal(b.Tags, want) {
+		t.Errorf("tags = %v, want %v", b.Tags, want)
+	}
+	got := ids(t, s, ListOptions{Tags: []string{"golang"}})
+	if !slices.Equal(got, []int64{1, 2}) {
+		t.Errorf("ids = %v, want [1 2]", got)
+	}
+}
+
+func testMergeTags(t *testing.T, s BookmarkStore) {
+	mustCreate(t, s, "https://a.test", "A", "go", "golang")
+	mustCreate(t, s, "https://b.test", "B", "golang")
+	mustCreate(t, s, "https://c.test", "C", "web")
+	mustCreate(t, s, "https://d.test", "D", "go")
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for id := range int64(4) {
+		backdate(t, s, id+1, old)
+	}
+
+	if err := s.MergeTags(t.Context(), testOwner, "none", "go"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("missing: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.MergeTags(t.Context(), testOwner, "golang", "go"); err != nil {
+		t.Fatal(err)
+	}
+	// 未登録のタグへの統合は名前変更と同じ
+	if err := s.MergeTags(t.Context(), testOwner, "web", "http"); err != nil {
+		t.Fatal(err)
+	}
+	tags, _ := s.Tags(t.Context(), testOwner)
+	want := []model.Tag{
+		{Name: "go", Count: 3}, {Name: "http", Count: 1},
+	}
+	if !slices.Equal(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+	b, _ := s.FindByID(t.Context(), testOwner, 1)
+	if !slices.Equal(b.Tags, []string{"go"}) {
+		t.Errorf("tags = %v, want [go]", b.Tags)
+	}
+
+	// タグが変わったものだけ更新日時を進める。もともと go だけを
+	// 持っていた D は変わらない
+	for id, touched := range map[int64]bool{1: true, 2: true, 3: true, 4: false} {
+		b, _ := s.FindByID(t.Context(), testOwner, id)
+		if got := !b.UpdatedAt.Equal(old); got != touched {
+			t.Errorf("bookmark %d: touched = %v, want %v (updated_at %v)",
+				id, got, touched, b.UpdatedAt)
+		}
+	}
+}
+
+// タグの変更はゴミ箱の中のブックマークには及ばない。
+// ゴミ箱の中でだけ使われている名前は、使われていないものとして扱う。
+func testTagsInTrash(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	a := mustCreate(t, s, "https://a.test", "A", "go")
+	trashed := mustCreate(t, s, "https://t.test", "T", "go", "old")
+	if err := s.Delete(ctx, testOwner, trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	backdate(t, s, trashed.ID, past)
+
+	if err := s.RenameTag(ctx, testOwner, "old", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("rename tag only in trash: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RenameTag(ctx, testOwner, "go", "old"); err != nil {
+		t.Fatalf("rename into name only in trash: %v", err)
+	}
+	if err := s.MergeTags(ctx, testOwner, "old", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.FindByID(ctx, testOwner, a.ID)
+	if want := []string{"golang"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("live tags = %v, want %v", got.Tags, want)
+	}
+
+	trash, err := s.Trash(ctx, testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 {
+		t.Fatalf("trash = %+v", trash)
+	}
+	if want := []string{"go", "old"}; !slices.Equal(trash[0].Tags, want) {
+		t.Errorf("trashed tags = %v, want %v", trash[0].Tags, want)
+	}
+	if !trash[0].UpdatedAt.Equal(past) {
+		t.Errorf("trashed updated_at = %v, want %v", trash[0].UpdatedAt, past)
+	}
+
+	// 復元すると削除したときのタグに戻る
+	restored, err := s.Restore(ctx, testOwner, trashed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"go", "old"}; !slices.Equal(restored.Tags, want) {
+		t.Errorf("restored tags = %v, want %v", restored.Tags, want)
+	}
+}
+
+func testSearch(t *testing.T, s BookmarkStore) {
+	mustCreate(t, s, "https://go.dev/doc", "Go言語の教科書")
+	mustCreate(t, s, "https://example.com/rust", "Rust入門")
+	mustCreate(t, s, "https://example.com/book", "TypeScript入門")
+	mustCreate(t, s, "https://example.com/go-book", "Book")
+	mustCreate(t, s, "http://x/?a&b=2", "<b>x</b> evil 悪意")
+
+	// 順位の値や抜粋の切り出し方は実装ごとに異なるため、
+	// 一致する集合と、並び順のうち実装によらない部分を確かめる
+	tests := []struct {
+		name string
+		q    string
+		want []int64
+		// before は [a, b] の組で、a が b より前に並ぶこと
+		before [][2]int64
+		// mark は先頭の結果の抜粋に含まれる部分
+		mark string
+	}{
+		{"日本語", "教科書", []int64{1}, nil,
+			"<mark>教科書</mark>"},
+		{"2文字は部分一致で新しい順", "入門", []int64{2, 3},
+			[][2]int64{{3, 2}}, "<mark>入門</mark>"},
+		{"URLに一致", "go.dev", []int64{1}, nil,
+			"<mark>go.dev</mark>"},
+		{"タイトルの一致を優先", "book", []int64{3, 4},
+			[][2]int64{{4, 3}}, "<mark>Book</mark>"},
+		{"URLだけの一致", "example", []int64{2, 3, 4}, nil,
+			"<mark>example</mark>"},
+		{"タイトルとURLの両方", "rust", []int64{2}, nil,
+			"<mark>Rust</mark>"},
+		{"複数語はタイトルにも一致するものを優先", "example book",
+			[]int64{3, 4}, [][2]int64{{4, 3}}, ""},
+		{"AND", "example 入門 rust", []int64{2}, nil, ""},
+		// タイトルや URL は HTML としてエスケープし、印だけを残す
+		{"HTMLをエスケープ", "evil", []int64{5}, nil,
+			"<mark>evil</mark>"},
+		{"2文字でもエスケープ", "悪意", []int64{5}, nil,
+			"<mark>悪意</mark>"},
+		{"URLもエスケープ", "b=2", []int64{5}, nil,
+			"<mark>b=2</mark>"},
+		{"該当なし", "python", []int64{}, nil, ""},
+		{"空", " ", []int64{}, nil, ""},
+	}
+	unmark := strings.NewReplacer(markOpen, "", markClose, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.Search(t.Context(), testOwner, tt.q, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pos := map[int64]int{}
+			for i, r := range res {
+				pos[r.ID] = i
+			}
+			got := slices.Sorted(maps.Keys(pos))
+			if len(res) != len(got) || !slices.Equal(got, tt.want) {
+				t.Fatalf("ids = %v, want %v", got, tt.want)
+			}
+			for _, p := range tt.before {
+				if pos[p[0]] > pos[p[1]] {
+					t.Errorf("%d ranked below %d", p[0], p[1])
+				}
+			}
+			if tt.mark != "" &&
+				!strings.Contains(res[0].Snippet, tt.mark) {
+				t.Errorf("snippet = %q, want it to contain %q",
+					res[0].Snippet, tt.mark)
+			}
+			for _, r := range res {
+				text := unmark.Replace(r.Snippet)
+				if html.EscapeString(html.UnescapeString(text)) != text {
+					t.Errorf("snippet %q is not escaped", r.Snippet)
+				}
+			}
+		})
+	}
+
+	res, _ := s.Search(t.Context(), testOwner, "入門", 1)
+	if len(res) != 1 {
+		t.Errorf("limit: len = %d, want 1", len(res))
+	}
+}
+
+func testConcurrent(t *testing.T, s BookmarkStore) {
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			b, err := s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+				URL:   fmt.Sprintf("https://x.test/%d", i),
+				Title: "X", Tags: []string{"go"},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := s.FindByID(t.Context(), testOwner, b.ID); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	got := ids(t, s, ListOptions{})
+	if len(got) != n {
+		t.Errorf("len = %d, want %d", len(got), n)
+	}
+	tags, _ := s.Tags(t.Context(), testOwner)
+	if len(tags) != 1 || tags[0].Count != n {
+		t.Errorf("tags = %v, want go x %d", tags, n)
+	}
+
+	// 同じ URL の同時登録は1件だけ成功する
+	var mu sync.Mutex
+	created := 0
+	for range n {
+		wg.Go(func() {
+			_, err := s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+				URL: "https://same.test/", Title: "Same",
+			})
+			switch {
+			case err == nil:
+				mu.Lock()
+				created++
+				mu.Unlock()
+			case !errors.Is(err, ErrDuplicate):
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("created = %d, want 1", created)
+	}
+}
+
+func testDuplicate(t *testing.T, s BookmarkStore) {
+	orig := mustCreate(t, s,
+		"https://go.dev/doc/?utm_source=x#top", "Go")
+	other := mustCreate(t, s, "https://pkg.go.dev/", "Pkg")
+
+	_, err := s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+		URL: "HTTPS://GO.DEV:443/doc/", Title: "dup",
+	})
+	var dup *DuplicateError
+	if !errors.As(err, &dup) || dup.ID != orig.ID {
+		t.Fatalf("Create: err = %v, want DuplicateError{%d}",
+			err, orig.ID)
+	}
+	if !errors.Is(err, ErrDuplicate) {
+		t.Errorf("err does not match ErrDuplicate")
+	}
+
+	// 更新で別のブックマークと同じ URL にはできない
+	_, err = s.Update(t.Context(), testOwner, other.ID, model.UpdateBookmarkRequest{
+		URL: "https://go.dev/doc/", Title: "Pkg",
+	})
+	if !errors.As(err, &dup) || dup.ID != orig.ID {
+		t.Errorf("Update: err = %v, want DuplicateError{%d}",
+			err, orig.ID)
+	}
+	// 自分自身の URL のままの更新は重複ではない
+	_, err = s.Update(t.Context(), testOwner, orig.ID, model.UpdateBookmarkRequest{
+		URL: "https://go.dev/doc/", Title: "Go",
+	})
+	if err != nil {
+		t.Errorf("Update same url: err = %v", err)
+	}
+	// 元の URL は登録時の形のまま保存される
+	b, _ := s.FindByID(t.Context(), testOwner, other.ID)
+	if b.URL != "https://pkg.go.dev/" {
+		t.Errorf("url = %q", b.URL)
+	}
+
+	// 削除すると同じ URL を再登録できる
+	if err := s.Delete(t.Context(), testOwner, orig.ID); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, s, "https://go.dev/doc/", "Go")
+
+	// 不正な URL は保存しない
+	_, err = s.Create(t.Context(), testOwner, model.CreateBookmarkRequest{
+		URL: "javascript:alert(1)", Title: "XSS",
+	})
+	if err == nil {
+		t.Error("Create javascript: URL: err = nil")
+	}
+}
+
+func testCanceled(t *testing.T, s BookmarkStore) {
+	mustCreate(t, s, "https://go.dev", "Go", "go")
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://x.test", Title: "X",
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Create: err = %v, want context.Canceled", err)
+	}
+	if _, err := s.FindByID(ctx, testOwner, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("FindByID: err = %v, want context.Canceled", err)
+	}
+	if err := s.Delete(ctx, testOwner, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Delete: err = %v, want context.Canceled", err)
+	}
+	if _, err := s.Search(ctx, testOwner, "go.dev", 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("Search: err = %v, want context.Canceled", err)
+	}
+	for _, err := range s.Iter(ctx, testOwner, ListOptions{}) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Iter: err = %v, want context.Canceled", err)
+		}
+	}
+	// キャンセルされた操作は反映されていない
+	if got := ids(t, s, ListOptions{}); len(got) != 1 {
+		t.Errorf("ids = %v, want [1]", got)
+	}
+}
+
+func testOwners(t *testing.T, s BookmarkStore) {
+	const other = testOwner + 1
+	b := mustCreate(t, s, "https://go.dev", "Go", "go")
+
+	// ほかのユーザーからは存在しないものとして扱う
+	if _, err := s.FindByID(t.Context(), other, b.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("FindByID: err = %v, want sql.ErrNoRows", err)
+	}
+	_, err := s.Update(t.Context(), other, b.ID, model.UpdateBookmarkRequest{
+		URL: "https://x.test", Title: "X",
+	})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Update: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.Delete(t.Context(), other, b.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Delete: err = %v, want sql.ErrNoRows", err)
+	}
+	for range s.Iter(t.Context(), other, ListOptions{}) {
+		t.Error("Iter returned other user's bookmark")
+	}
+	if res, _ := s.Search(t.Context(), other, "go.dev", 10); len(res) != 0 {
+		t.Errorf("Search = %v, want empty", res)
+	}
+	if err := s.RenameTag(t.Context(), other, "go", "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RenameTag: err = %v, want sql.ErrNoRows", err)
+	}
+
+	// 同じ URL やタグ名でもユーザーごとに別に扱う
+	ob, err := s.Create(t.Context(), other, model.CreateBookmarkRequest{
+		URL: "https://go.dev/", Title: "Go", Tags: []string{"go", "web"},
+	})
+	if err != nil {
+		t.Fatalf("Create same URL for other user: %v", err)
+	}
+	if tags, _ := s.Tags(t.Context(), testOwner); len(tags) != 1 ||
+		tags[0] != (model.Tag{Name: "go", Count: 1}) {
+		t.Errorf("tags = %v", tags)
+	}
+	if err := s.RenameTag(t.Context(), other, "go", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MergeTags(t.Context(), other, "web", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.FindByID(t.Context(), testOwner, b.ID)
+	if want := []string{"go"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("owner tags = %v, want %v", got.Tags, want)
+	}
+	got, _ = s.FindByID(t.Context(), other, ob.ID)
+	if want := []string{"golang"}; !slices.Equal(got.Tags, want) {
+		t.Errorf("other tags = %v, want %v", got.Tags, want)
+	}
+	if got.OwnerID != other {
+		t.Errorf("owner_id = %d, want %d", got.OwnerID, other)
+	}
+}
+
+func testLinkCheck(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	ok := mustCreate(t, s, "https://go.dev", "Go")
+	gone := mustCreate(t, s, "https://gone.example", "Gone")
+	down := mustCreate(t, s, "https://down.example", "Down")
+	fresh := mustCreate(t, s, "https://fresh.example", "Fresh")
+	other, err := s.Create(ctx, testOwner+1, model.CreateBookmarkRequest{
+		URL: "https://other.example", Title: "Other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	old := now.Add(-48 * time.Hour)
+	for _, c := range []struct {
+		id  int64
+		res model.LinkCheck
+	}{
+		{ok.ID, model.LinkCheck{CheckedAt: old, Status: 200,
+			RedirectURL: "https://go.dev/home"}},
+		{gone.ID, model.LinkCheck{CheckedAt: now, Status: 410}},
+		{down.ID, model.LinkCheck{CheckedAt: old.Add(time.Hour),
+			Error: "connection refused"}},
+	} {
+		if err := s.RecordCheck(ctx, c.id, c.res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RecordCheck(ctx, 999, model.LinkCheck{CheckedAt: now}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RecordCheck missing: err = %v, want sql.ErrNoRows", err)
+	}
+
+	got, _ := s.FindByID(ctx, testOwner, ok.ID)
+	if got.LastCheckedAt == nil || !got.LastCheckedAt.Equal(old) ||
+		got.HTTPStatus != 200 || got.RedirectURL != "https://go.dev/home" ||
+		got.Broken() {
+		t.Errorf("ok = %+v", got)
+	}
+	// チェック結果の記録は利用者による変更ではない
+	if !got.UpdatedAt.Equal(ok.UpdatedAt) {
+		t.Errorf("updated_at changed: %v -> %v", ok.UpdatedAt, got.UpdatedAt)
+	}
+	got, _ = s.FindByID(ctx, testOwner, down.ID)
+	if got.HTTPStatus != 0 || got.CheckError != "connection refused" ||
+		!got.Broken() {
+		t.Errorf("down = %+v", got)
+	}
+
+	for _, tt := range []struct {
+		name string
+		link LinkStatus
+		want []int64
+	}{
+		{"broken", LinkBroken, []int64{gone.ID, down.ID}},
+		{"ok", LinkOK, []int64{ok.ID}},
+		{"unchecked", LinkUnchecked, []int64{fresh.ID}},
+	} {
+		got := ids(t, s, ListOptions{Link: tt.link})
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: ids = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// 未チェック、チェックが古い順に、ユーザーをまたいで選ぶ
+	due, err := s.DueForCheck(ctx, now.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dueIDs []int64
+	for _, b := range due {
+		dueIDs = append(dueIDs, b.ID)
+	}
+	if want := []int64{fresh.ID, other.ID, ok.ID, down.ID}; !slices.Equal(dueIDs, want) {
+		t.Errorf("DueForCheck = %v, want %v", dueIDs, want)
+	}
+	if due, _ := s.DueForCheck(ctx, now, 1); len(due) != 1 {
+		t.Errorf("DueForCheck limit: len = %d, want 1", len(due))
+	}
+
+	// URL を変えると結果は消え、タイトルだけなら残る
+	got, err = s.Update(ctx, testOwner, gone.ID, model.UpdateBookmarkRequest{
+		URL: "https://gone.example/", Title: "Renamed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastCheckedAt == nil || got.HTTPStatus != 410 {
+		t.Errorf("same URL: check result cleared: %+v", got)
+	}
+	got, err = s.Update(ctx, testOwner, gone.ID, model.UpdateBookmarkRequest{
+		URL: "https://moved.example", Title: "Moved",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastCheckedAt != nil || got.HTTPStatus != 0 {
+		t.Errorf("new URL: check result kept: %+v", got)
+	}
+}
+
+func testMetadata(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	meta := model.PageMeta{
+		Description: "The Go programming language",
+		ImageURL:    "https://go.dev/images/go-logo.png",
+		FaviconURL:  "https://go.dev/favicon.ico",
+	}
+	got, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "Go", Meta: meta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != meta.Description || got.ImageURL != meta.ImageURL ||
+		got.FaviconURL != meta.FaviconURL || got.MetadataPending {
+		t.Errorf("created = %+v", got)
+	}
+
+	// 取得に失敗したものは URL を仮のタイトルにして登録する
+	pending, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://slow.example", Title: "https://slow.example",
+		MetadataPending: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := s.Create(ctx, testOwner+1, model.CreateBookmarkRequest{
+		URL: "https://named.example", Title: "https://named.example",
+		MetadataPending: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending.MetadataPending {
+		t.Error("MetadataPending = false, want true")
+	}
+
+	now := time.Now().Add(time.Second)
+	due, err := s.DueForMetadata(ctx, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].ID != pending.ID || due[1].ID != named.ID {
+		t.Fatalf("DueForMetadata = %+v, want [%d %d]", due, pending.ID, named.ID)
+	}
+
+	// 失敗したら次の時期まで対象にならない
+	later := now.Add(time.Hour)
+	if err := s.RecordMetadata(ctx, pending.ID, model.PageMeta{}, &later); err != nil {
+		t.Fatal(err)
+	}
+	due, _ = s.DueForMetadata(ctx, now, 10)
+	if len(due) != 1 || due[0].ID != named.ID {
+		t.Errorf("DueForMetadata after retry = %+v, want [%d]", due, named.ID)
+	}
+	if b, _ := s.FindByID(ctx, testOwner, pending.ID); !b.MetadataPending {
+		t.Error("rescheduled: MetadataPending = false, want true")
+	}
+
+	// 仮のタイトルは置き換え、利用者が付けたタイトルは残す
+	if _, err := s.Update(ctx, testOwner+1, named.ID, model.UpdateBookmarkRequest{
+		URL: named.URL, Title: "My title",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	found := model.PageMeta{Title: "Slow", Description: "desc"}
+	for _, id := range []int64{pending.ID, named.ID} {
+		if err := s.RecordMetadata(ctx, id, found, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := s.FindByID(ctx, testOwner, pending.ID)
+	if b.Title != "Slow" || b.Description != "desc" || b.MetadataPending {
+		t.Errorf("pending = %+v", b)
+	}
+	b, _ = s.FindByID(ctx, testOwner+1, named.ID)
+	if b.Title != "My title" || b.Description != "desc" {
+		t.Errorf("named = %+v", b)
+	}
+	if due, _ := s.DueForMetadata(ctx, later, 10); len(due) != 0 {
+		t.Errorf("DueForMetadata after success = %+v, want empty", due)
+	}
+	if err := s.RecordMetadata(ctx, 999, found, nil); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RecordMetadata missing: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func mustCreateFolder(
+	t *testing.T, s BookmarkStore, name string, parent *int64,
+) model.Folder {
+	t.Helper()
+	f, err := s.CreateFolder(t.Context(), testOwner, model.CreateFolderRequest{
+		Name: name, ParentID: parent,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// treeShape は木を "名前[子...](ブックマークID...)" の形の文字列にする。
+func treeShape(t model.FolderTree) string {
+	out := t.Name + "["
+	for i, c := range t.Folders {
+		if i > 0 {
+			out += " "
+		}
+		out += treeShape(c)
+	}
+	out += "]("
+	for i, b := range t.Bookmarks {
+		if i > 0 {
+			out += " "
+		}
+		out += strconv.FormatInt(b.ID, 10)
+	}
+	return out + ")"
+}
+
+func testFolders(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	missing := int64(999)
+	dev := mustCreateFolder(t, s, "dev", nil)
+	golang := mustCreateFolder(t, s, "go", &dev.ID)
+	web := mustCreateFolder(t, s, "web", &golang.ID)
+	misc := mustCreateFolder(t, s, "misc", nil)
+	if golang.ParentID == nil || *golang.ParentID != dev.ID {
+		t.Errorf("parent_id = %v, want %d", golang.ParentID, dev.ID)
+	}
+
+	if _, err := s.CreateFolder(ctx, testOwner, model.CreateFolderRequest{
+		Name: "x", ParentID: &missing,
+	}); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("CreateFolder with missing parent: err = %v", err)
+	}
+	// ほかのユーザーのフォルダは存在しないものとして扱う
+	if _, err := s.CreateFolder(ctx, testOwner+1, model.CreateFolderRequest{
+		Name: "x", ParentID: &dev.ID,
+	}); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("CreateFolder in other user's folder: err = %v", err)
+	}
+	if _, err := s.FindFolder(ctx, testOwner+1, dev.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("FindFolder other user: err = %v", err)
+	}
+
+	b1, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "Go", FolderID: &golang.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1.FolderID == nil || *b1.FolderID != golang.ID {
+		t.Errorf("folder_id = %v, want %d", b1.FolderID, golang.ID)
+	}
+	if _, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://x.test", Title: "X", FolderID: &missing,
+	}); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("Create in missing folder: err = %v", err)
+	}
+	b2 := mustCreate(t, s, "https://developer.mozilla.org", "MDN", "web")
+	if b2, err = s.MoveBookmark(ctx, testOwner, b2.ID, &web.ID); err != nil {
+		t.Fatal(err)
+	}
+	b3 := mustCreate(t, s, "https://example.com", "Example")
+	if _, err := s.MoveBookmark(ctx, testOwner, b3.ID, &missing); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("MoveBookmark to missing folder: err = %v", err)
+	}
+	if _, err := s.MoveBookmark(ctx, testOwner+1, b3.ID, nil); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("MoveBookmark other user: err = %v", err)
+	}
+
+	tree, err := s.FolderTree(ctx, testOwner, dev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("dev[go[web[](%d)](%d)]()", b2.ID, b1.ID)
+	if got := treeShape(tree); got != want {
+		t.Errorf("tree = %s, want %s", got, want)
+	}
+
+	// 自分自身や子孫の中には移せない
+	for _, parent := range []int64{dev.ID, web.ID} {
+		if _, err := s.MoveFolder(ctx, testOwner, dev.ID, &parent); !errors.Is(err, ErrFolderCycle) {
+			t.Errorf("MoveFolder into %d: err = %v, want ErrFolderCycle", parent, err)
+		}
+	}
+	moved, err := s.MoveFolder(ctx, testOwner, web.ID, &misc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *moved.ParentID != misc.ID {
+		t.Errorf("moved parent = %d, want %d", *moved.ParentID, misc.ID)
+	}
+	if moved, err = s.MoveFolder(ctx, testOwner, web.ID, nil); err != nil || moved.ParentID != nil {
+		t.Errorf("MoveFolder to top: %+v, %v", moved, err)
+	}
+	if _, err := s.MoveFolder(ctx, testOwner, web.ID, &golang.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed, err := s.RenameFolder(ctx, testOwner, golang.ID, "golang")
+	if err != nil || renamed.Name != "golang" {
+		t.Errorf("RenameFolder = %+v, %v", renamed, err)
+	}
+	if _, err := s.RenameFolder(ctx, testOwner+1, golang.ID, "x"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RenameFolder other user: err = %v", err)
+	}
+	folders, err := s.Folders(ctx, testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range folders {
+		names = append(names, f.Name)
+	}
+	if want := []string{"dev", "golang", "misc", "web"}; !slices.Equal(names, want) {
+		t.Errorf("folders = %v, want %v", names, want)
+	}
+
+	// 中身を親に移して削除する
+	if err := s.DeleteFolder(ctx, testOwner, golang.ID, DeleteReparent); err != nil {
+		t.Fatal(err)
+	}
+	tree, _ = s.FolderTree(ctx, testOwner, dev.ID)
+	want = fmt.Sprintf("dev[web[](%d)](%d)", b2.ID, b1.ID)
+	if got := treeShape(tree); got != want {
+		t.Errorf("after reparent: tree = %s, want %s", got, want)
+	}
+
+	// 中身ごと削除する
+	if err := s.DeleteFolder(ctx, testOwner, dev.ID, DeleteCascade); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{b1.ID, b2.ID} {
+		if _, err := s.FindByID(ctx, testOwner, id); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("bookmark %d: err = %v, want deleted", id, err)
+		}
+	}
+	if _, err := s.FindFolder(ctx, testOwner, web.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("subfolder: err = %v, want deleted", err)
+	}
+	if tags, _ := s.Tags(ctx, testOwner); len(tags) != 0 {
+		t.Errorf("tags = %v, want none", tags)
+	}
+	if got := ids(t, s, ListOptions{}); !slices.Equal(got, []int64{b3.ID}) {
+		t.Errorf("remaining = %v, want [%d]", got, b3.ID)
+	}
+	// 削除したブックマークの URL は登録し直せる
+	mustCreate(t, s, "https://go.dev", "Go")
+	if err := s.DeleteFolder(ctx, testOwner, dev.ID, DeleteCascade); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DeleteFolder missing: err = %v", err)
+	}
+}
+
+func testAudit(t *testing.T, s BookmarkStore) {
+	ctx := requestid.NewContext(
+		WithActor(t.Context(), testOwner), "req-1")
+	b, err := s.Create(ctx, testOwner, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "Go", Tags: []string{"go"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Update(ctx, testOwner, b.ID, model.UpdateBookmarkRequest{
+		URL: b.URL, Title: "Go 2", Tags: b.Tags,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenameTag(ctx, testOwner, "go", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, testOwner, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Restore(ctx, testOwner, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, testOwner, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	// バックグラウンドの処理は actor もリクエスト ID も持たない
+	if _, err := s.PurgeTrash(t.Context(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 完全に削除した後も履歴は残る
+	entries, err := s.History(t.Context(), testOwner, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{
+		model.AuditCreate, model.AuditUpdate, model.AuditUpdate,
+		model.AuditDelete, model.AuditRestore, model.AuditDelete,
+		model.AuditPurge,
+	}
+	if !slices.Equal(actions, want) {
+		t.Fatalf("actions = %v, want %v", actions, want)
+	}
+	first, last := entries[0], entries[len(entries)-1]
+	if first.Before != nil || first.ActorID != testOwner ||
+		first.RequestID != "req-1" || first.OwnerID != testOwner {
+		t.Errorf("create entry = %+v", first)
+	}
+	if last.After != nil || last.Before == nil ||
+		last.ActorID != 0 || last.RequestID != "" {
+		t.Errorf("purge entry = %+v", last)
+	}
+	var renamed model.Bookmark
+	if err := json.Unmarshal(entries[2].After, &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Title != "Go 2" || !slices.Equal(renamed.Tags, []string{"golang"}) {
+		t.Errorf("after rename = %+v", renamed)
+	}
+	if _, err := s.History(t.Context(), testOwner+1, b.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("History of other owner: err = %v", err)
+	}
+	if _, err := s.History(t.Context(), testOwner, b.ID+100); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("History without entries: err = %v", err)
+	}
+
+	// 監査ログはユーザーをまたいで ID 順に返す
+	other := requestid.NewContext(WithActor(t.Context(), 2), "req-2")
+	if _, err := s.Create(other, 2, model.CreateBookmarkRequest{
+		URL: "https://other.test", Title: "Other",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all, err := s.AuditLog(t.Context(), AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(want)+1 || all[len(all)-1].OwnerID != 2 {
+		t.Fatalf("AuditLog = %+v", all)
+	}
+	page, err := s.AuditLog(t.Context(), AuditOptions{
+		After: all[2].ID, Limit: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].ID != all[3].ID || page[1].ID != all[4].ID {
+		t.Errorf("page = %+v", page)
+	}
+	page, err = s.AuditLog(t.Context(), AuditOptions{
+		Since: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("since future: %d entries", len(page))
+	}
+}
+
+func testBatch(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	a := mustCreate(t, s, "https://a.test", "A")
+	missing := int64(999)
+
+	// 失敗したものを飛ばして残りを実行する
+	results, err := s.Batch(ctx, testOwner, []BatchOp{
+		{Op: model.BatchCreate, Create: model.CreateBookmarkRequest{
+			URL: "https://b.test", Title: "B", Tags: []string{"go"}}},
+		{Op: model.BatchCreate, Create: model.CreateBookmarkRequest{
+			URL: "https://a.test/", Title: "A2"}},
+		{Op: model.BatchUpdate, ID: a.ID, Update: model.UpdateBookmarkRequest{
+			URL: a.URL, Title: "A3"}},
+		{Op: model.BatchDelete, ID: missing},
+		{Op: model.BatchCreate, Create: model.CreateBookmarkRequest{
+			URL: "https://c.test", Title: "C", FolderID: &missing}},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("len(results) = %d, want 5", len(results))
+	}
+	var dup *DuplicateError
+	if results[0].Err != nil || results[0].Bookmark.Title != "B" {
+		t.Errorf("create: %+v", results[0])
+	}
+	if !errors.As(results[1].Err, &dup) || dup.ID != a.ID {
+		t.Errorf("duplicate: err = %v", results[1].Err)
+	}
+	if results[2].Err != nil || results[2].Bookmark.Title != "A3" {
+		t.Errorf("update: %+v", results[2])
+	}
+	if !errors.Is(results[3].Err, sql.ErrNoRows) {
+		t.Errorf("delete missing: err = %v", results[3].Err)
+	}
+	if !errors.Is(results[4].Err, ErrFolderNotFound) {
+		t.Errorf("missing folder: err = %v", results[4].Err)
+	}
+	b := results[0].Bookmark
+
+	// atomic では1件の失敗ですべて取り消す
+	history, err := s.History(ctx, testOwner, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Batch(ctx, testOwner, []BatchOp{
+		{Op: model.BatchCreate, Create: model.CreateBookmarkRequest{
+			URL: "https://d.test", Title: "D"}},
+		{Op: model.BatchUpdate, ID: a.ID, Update: model.UpdateBookmarkRequest{
+			URL: a.URL, Title: "A4"}},
+		{Op: model.BatchDelete, ID: b.ID},
+		{Op: model.BatchDelete, ID: missing},
+	}, true)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 3 ||
+		!errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("atomic: err = %v", err)
+	}
+	if got := ids(t, s, ListOptions{}); !slices.Equal(got, []int64{a.ID, b.ID}) {
+		t.Errorf("ids = %v, want %v", got, []int64{a.ID, b.ID})
+	}
+	if got, _ := s.FindByID(ctx, testOwner, a.ID); got.Title != "A3" {
+		t.Errorf("title = %q, want A3", got.Title)
+	}
+	if got, _ := s.History(ctx, testOwner, a.ID); len(got) != len(history) {
+		t.Errorf("history = %d entries, want %d", len(got), len(history))
+	}
+
+	results, err = s.Batch(ctx, testOwner, []BatchOp{
+		{Op: model.BatchCreate, Create: model.CreateBookmarkRequest{
+			URL: "https://d.test", Title: "D"}},
+		{Op: model.BatchDelete, ID: b.ID},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := results[0].Bookmark
+	if got := ids(t, s, ListOptions{}); !slices.Equal(got, []int64{a.ID, d.ID}) {
+		t.Errorf("ids = %v, want %v", got, []int64{a.ID, d.ID})
+	}
+}
+
+func testCountBookmarks(t *testing.T, s BookmarkStore) {
+	ctx := t.Context()
+	a := mustCreate(t, s, "https://go.dev", "Go")
+	mustCreate(t, s, "https://pkg.go.dev", "Packages")
+	// ほかのユーザーのものも数える
+	if _, err := s.Create(ctx, testOwner+1, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "Go",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// ゴミ箱の中のものは数えない
+	if err := s.Delete(ctx, testOwner, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.CountBookmarks(ctx)
+	if err != nil || n != 2 {
+		t.Errorf("CountBookmarks = %d, %v, want 2", n, err)
+	}
+}
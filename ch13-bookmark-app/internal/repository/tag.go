@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// ErrTagExists は変更先のタグ名が既に使われていることを表す。
+var ErrTagExists = errors.New("tag already exists")
+
+// setTags はブックマークのタグを tags で置き換える。
+// 未登録のタグは作成し、どのブックマークからも
+// 参照されなくなったタグは削除する。
+func setTags(
+	ctx context.Context,
+	q queryer, bookmarkID int64, tags []string,
+) error {
+	if _, err := q.ExecContext(ctx,
+		`DELETE FROM bookmark_tags
+		 WHERE bookmark_id = ?`, bookmarkID,
+	); err != nil {
+		return err
+	}
+	for _, name := range tags {
+		if _, err := q.ExecContext(ctx,
+			`INSERT INTO tags (name) VALUES (?)
+			 ON CONFLICT (name) DO NOTHING`, name,
+		); err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx,
+			`INSERT OR IGNORE INTO bookmark_tags
+			 (bookmark_id, tag_id)
+			 SELECT ?, id FROM tags WHERE name = ?`,
+			bookmarkID, name,
+		); err != nil {
+			return err
+		}
+	}
+	return deleteUnusedTags(ctx, q)
+}
+
+func deleteUnusedTags(
+	ctx context.Context, q queryer,
+) error {
+	_, err := q.ExecContext(ctx,
+		`DELETE FROM tags WHERE id NOT IN
+		 (SELECT tag_id FROM bookmark_tags)`)
+	return err
+}
+
+// Tags はユーザーが使用中のタグを件数付きで名前順に返す。
+func (r *BookmarkRepository) Tags(
+	ctx context.Context, ownerID int64,
+) ([]model.Tag, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT t.name, COUNT(*)
+		 FROM tags t
+		 JOIN bookmark_tags bt ON bt.tag_id = t.id
+		 JOIN bookmarks b ON b.id = bt.bookmark_id
+		 WHERE b.owner_id = ? AND b.deleted_at IS NULL
+		 GROUP BY t.id ORDER BY t.name`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []model.Tag{}
+	for rows.Next() {
+		var t model.Tag
+		if err := rows.Scan(
+			&t.Name, &t.Count,
+		); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// RenameTag はタグ名を変更する。
+// 変更先の名前が既にあれば ErrTagExists を返す。
+// 統合したい場合は MergeTags を使う。
+//
+// tags テーブルはユーザー間で共有しているため、
+// 名前を書き換えるのではなく、ユーザーのブックマークだけを
+// 新しい名前のタグに付け替える。
+func (r *BookmarkRepository) RenameTag(
+	ctx context.Context, ownerID int64, from, to string,
+) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fromID, err := ownedTagID(ctx, tx, ownerID, from)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return tx.Commit()
+	}
+	_, err = ownedTagID(ctx, tx, ownerID, to)
+	if err == nil {
+		return ErrTagExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := retag(ctx, tx, ownerID, fromID, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeTags は from のタグを持つすべてのブックマークに
+// into のタグを付け替え、from を外す。
+// into が未登録なら作成する。
+func (r *BookmarkRepository) MergeTags(
+	ctx context.Context, ownerID int64, from, into string,
+) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fromID, err := ownedTagID(ctx, tx, ownerID, from)
+	if err != nil {
+		return err
+	}
+	if from == into {
+		return tx.Commit()
+	}
+	if err := retag(ctx, tx, ownerID, fromID, into); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retag はユーザーのブックマークに付いた fromID のタグを
+// into のタグに付け替え、変更を監査ログに記録する。
+// ゴミ箱の中のものはほかの操作と同じく対象にせず、
+// 削除したときのタグのまま残す。
+func retag(
+	ctx context.Context, q queryer,
+	ownerID, fromID int64, into string,
+) error {
+	ids, err := selectIDs(ctx, q,
+		`SELECT bt.bookmark_id
+		 FROM bookmark_tags bt
+		 JOIN bookmarks b ON b.id = bt.bookmark_id
+		 WHERE bt.tag_id = ? AND b.owner_id = ?
+		   AND b.deleted_at IS NULL`,
+		fromID, ownerID)
+	if err != nil {
+		return err
+	}
+	return auditEach(ctx, q, model.AuditUpdate, ids, func() error {
+		if err := replaceTag(ctx, q, ownerID, fromID, into); err != nil {
+			return err
+		}
+		return touchBookmarks(ctx, q, ids)
+	})
+}
+
+// replaceTag は retag の付け替えを行う。
+func replaceTag(
+	ctx context.Context, q queryer,
+	ownerID, fromID int64, into string,
+) error {
+	if _, err := q.ExecContext(ctx,
+		`INSERT INTO tags (name) VALUES (?)
+		 ON CONFLICT (name) DO NOTHING`, into,
+	); err != nil {
+		return err
+	}
+	intoID, err := tagID(ctx, q, into)
+	if err != nil {
+		return err
+	}
+	// 両方のタグを持つブックマークは重複しないよう
+	// OR IGNORE で付け替える
+	if _, err := q.ExecContext(ctx,
+		`INSERT OR IGNORE INTO bookmark_tags
+		 (bookmark_id, tag_id)
+		 SELECT bt.bookmark_id, ?
+		 FROM bookmark_tags bt
+		 JOIN bookmarks b ON b.id = bt.bookmark_id
+		 WHERE bt.tag_id = ? AND b.owner_id = ?
+		   AND b.deleted_at IS NULL`,
+		intoID, fromID, ownerID,
+	); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx,
+		`DELETE FROM bookmark_tags
+		 WHERE tag_id = ? AND bookmark_id IN (
+			SELECT id FROM bookmarks
+			WHERE owner_id = ? AND deleted_at IS NULL)`,
+		fromID, ownerID,
+	); err != nil {
+		return err
+	}
+	return deleteUnusedTags(ctx, q)
+}
+
+// tagID はタグ名からIDを引く。
+// 存在しなければ sql.ErrNoRows を返す。
+func tagID(
+	ctx context.Context, q queryer, name string,
+) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx,
+		`SELECT id FROM tags WHERE name = ?`, name,
+	).Scan(&id)
+	return id, err
+}
+
+// ownedTagID はユーザーが使っているタグのIDを引く。
+// ほかのユーザーだけが使っているタグや、ゴミ箱の中でだけ
+// 使われているタグは存在しないものとして sql.ErrNoRows を返す。
+func ownedTagID(
+	ctx context.Context, q queryer,
+	ownerID int64, name string,
+) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx,
+		`SELECT t.id FROM tags t
+		 JOIN bookmark_tags bt ON bt.tag_id = t.id
+		 JOIN bookmarks b ON b.id = bt.bookmark_id
+		 WHERE t.name = ? AND b.owner_id = ?
+		   AND b.deleted_at IS NULL
+		 LIMIT 1`, name, ownerID,
+	).Scan(&id)
+	return id, err
+}
+
+// touchBookmarks は ids のブックマークの updated_at を現在時刻にする。
+// タグを付け替えたものだけを渡し、もともと付け替え先のタグを
+// 持っていて変わらなかったものは更新しない。
+func touchBookmarks(
+	ctx context.Context, q queryer, ids []int64,
+) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, id := range ids {
+		if _, err := q.ExecContext(ctx,
+			`UPDATE bookmarks SET updated_at = ?
+			 WHERE id = ?`, now, id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// lastUsedInterval は最終使用日時を更新する間隔。
+// リクエストのたびに書き込まないよう、前回の更新から
+// この時間が経つまでは更新しない。
+const lastUsedInterval = time.Minute
+
+const tokenColumns = `t.id, t.name, t.scopes,
+	t.created_at, t.expires_at, t.last_used_at`
+
+func scanToken(s rowScanner) (model.APIToken, error) {
+	var t model.APIToken
+	var scopes, createdAt string
+	var expiresAt, lastUsedAt sql.NullString
+	if err := s.Scan(
+		&t.ID, &t.Name, &scopes,
+		&createdAt, &expiresAt, &lastUsedAt,
+	); err != nil {
+		return model.APIToken{}, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	t.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	t.ExpiresAt = parseNullTime(expiresAt)
+	t.LastUsedAt = parseNullTime(lastUsedAt)
+	return t, nil
+}
+
+func parseNullTime(s sql.NullString) *time.Time {
+	if !s.Valid {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func formatNullTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// CreateToken は API トークンを登録する。
+func (r *UserRepository) CreateToken(
+	ctx context.Context, userID int64,
+	tokenHash string, t model.APIToken,
+) (model.APIToken, error) {
+	t.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if t.ExpiresAt != nil {
+		e := t.ExpiresAt.UTC().Truncate(time.Second)
+		t.ExpiresAt = &e
+	}
+	t.LastUsedAt = nil
+	result, err := r.db.ExecContext(ctx,
+		`INSERT INTO api_tokens
+		 (user_id, name, token_hash, scopes,
+		  created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, t.Name, tokenHash,
+		strings.Join(t.Scopes, " "),
+		t.CreatedAt.Format(time.RFC3339),
+		formatNullTime(t.ExpiresAt),
+	)
+	if err != nil {
+		return model.APIToken{}, err
+	}
+	t.ID, _ = result.LastInsertId()
+	return t, nil
+}
+
+// Tokens はユーザーのトークンを作成順に返す。
+// 期限切れのものも、失効させるまでは一覧に含める。
+func (r *UserRepository) Tokens(
+	ctx context.Context, userID int64,
+) ([]model.APIToken, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+tokenColumns+`
+		 FROM api_tokens t
+		 WHERE t.user_id = ? ORDER BY t.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []model.APIToken{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken はトークンを削除する。
+// ほかのユーザーのトークンは sql.ErrNoRows になる。
+func (r *UserRepository) RevokeToken(
+	ctx context.Context, userID, id int64,
+) error {
+	result, err := r.db.ExecContext(ctx,
+		`DELETE FROM api_tokens
+		 WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TokenUser は有効なトークンとそのユーザーを返す。
+func (r *UserRepository) TokenUser(
+	ctx context.Context, tokenHash string,
+) (model.User, model.APIToken, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	row := r.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+`, `+tokenColumns+`
+		 FROM api_tokens t
+		 JOIN users u ON u.id = t.user_id
+		 WHERE t.token_hash = ?
+		   AND (t.expires_at IS NULL OR t.expires_at > ?)`,
+		tokenHash, now.Format(time.RFC3339),
+	)
+	// ユーザーとトークンの列を1行から続けて読む
+	var t model.APIToken
+	u, err := scanUser(scanFunc(func(ud ...any) error {
+		var err error
+		t, err = scanToken(scanFunc(func(td ...any) error {
+			return row.Scan(append(ud, td...)...)
+		}))
+		return err
+	}))
+	if err != nil {
+		return model.User{}, model.APIToken{}, err
+	}
+
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE api_tokens SET last_used_at = ?
+		 WHERE id = ? AND (last_used_at IS NULL
+		   OR last_used_at <= ?)`,
+		now.Format(time.RFC3339), t.ID,
+		now.Add(-lastUsedInterval).Format(time.RFC3339),
+	)
+	if err != nil {
+		return model.User{}, model.APIToken{}, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		t.LastUsedAt = &now
+	}
+	return u, t, nil
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/urlnorm"
+)
+
+func findTrashed(
+	ctx context.Context, q queryer, ownerID, id int64,
+) (model.Bookmark, error) {
+	return scanBookmark(q.QueryRowContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.id = ? AND b.owner_id = ?
+		   AND b.deleted_at IS NOT NULL`,
+		id, ownerID,
+	))
+}
+
+// Trash はゴミ箱の中のブックマークを、削除した日時の
+// 新しい順に返す。
+func (r *BookmarkRepository) Trash(
+	ctx context.Context, ownerID int64,
+) ([]model.Bookmark, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+bookmarkColumns+`
+		 FROM bookmarks b
+		 WHERE b.owner_id = ? AND b.deleted_at IS NOT NULL
+		 ORDER BY b.deleted_at DESC, b.id DESC`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookmarks := []model.Bookmark{}
+	for rows.Next() {
+		b, err := scanBookmark(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// Restore はゴミ箱の中のブックマークを元に戻す。
+// 入っていたフォルダが削除されていれば最上位に戻す。
+// ゴミ箱に移した後に同じ URL を登録し直していれば
+// *DuplicateError を返す。
+func (r *BookmarkRepository) Restore(
+	ctx context.Context, ownerID, id int64,
+) (model.Bookmark, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	defer tx.Rollback()
+
+	before, err := findTrashed(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE bookmarks
+		 SET deleted_at = NULL,
+		     folder_id = IIF(folder_id IN (
+		         SELECT id FROM folders WHERE owner_id = ?),
+		         folder_id, NULL)
+		 WHERE id = ?`,
+		ownerID, id,
+	); err != nil {
+		// 重複するのは正規化できた URL だけなので
+		// 正規化のエラーは起きない
+		key, _ := urlnorm.Normalize(before.URL)
+		return model.Bookmark{}, duplicateOf(
+			ctx, tx, ownerID, key, err)
+	}
+	bm, err := findByID(ctx, tx, ownerID, id)
+	if err != nil {
+		return model.Bookmark{}, err
+	}
+	if err := recordAudit(
+		ctx, tx, model.AuditRestore, &before, &bm); err != nil {
+		return model.Bookmark{}, err
+	}
+	return bm, tx.Commit()
+}
+
+// DeletePermanently はゴミ箱の中のブックマークを完全に削除する。
+// ゴミ箱に入っていないものは削除せず sql.ErrNoRows を返す。
+func (r *BookmarkRepository) DeletePermanently(
+	ctx context.Context, ownerID, id int64,
+) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := findTrashed(ctx, tx, ownerID, id)
+	if err != nil {
+		return err
+	}
+	// bookmark_tags が bookmarks を参照しているため、タグを先に外す
+	if err := setTags(ctx, tx, id, nil); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM bookmarks WHERE id = ?`, id,
+	); err != nil {
+		return err
+	}
+	if err := recordAudit(
+		ctx, tx, model.AuditPurge, &before, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeTrash は before より前にゴミ箱に移したブックマークを
+// 完全に削除し、削除した件数を返す。
+// バックグラウンドで使うため、所有者では絞り込まない。
+func (r *BookmarkRepository) PurgeTrash(
+	ctx context.Context, before time.Time,
+) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cutoff := before.UTC().Format(time.RFC3339)
+	ids, err := selectIDs(ctx, tx,
+		`SELECT id FROM bookmarks WHERE deleted_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	// 定期的に呼ばれるため、期限切れのものがなければ
+	// 使われていないタグの掃除も含めて何もしない
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	err = auditEach(ctx, tx, model.AuditPurge, ids, func() error {
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM bookmark_tags WHERE bookmark_id IN (
+			 SELECT id FROM bookmarks WHERE deleted_at < ?)`,
+			cutoff,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM bookmarks WHERE deleted_at < ?`, cutoff,
+		); err != nil {
+			return err
+		}
+		return deleteUnusedTags(ctx, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
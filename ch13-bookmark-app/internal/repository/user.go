@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// ErrUserExists は同じ名前のユーザーが既にいることを表す。
+var ErrUserExists = errors.New("user already exists")
+
+// UserRepository はユーザーとセッションの永続化を担当する。
+type UserRepository struct {
+	db *sql.DB
+}
+
+// NewUsers は UserRepository を生成する。
+func NewUsers(db *sql.DB) *UserRepository {
+	return &UserRepository{db: db}
+}
+
+// Create はユーザーを登録する。
+// 所有者のいないブックマークは引き継がない
+// (BookmarkRepository.ClaimUnowned を参照)。
+func (r *UserRepository) Create(
+	ctx context.Context, username, passwordHash string,
+) (model.User, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := r.db.ExecContext(ctx,
+		`INSERT INTO users
+		 (username, password_hash, created_at)
+		 VALUES (?, ?, ?)`,
+		username, passwordHash, now.Format(time.RFC3339),
+	)
+	if isUniqueViolation(err) {
+		return model.User{}, ErrUserExists
+	}
+	if err != nil {
+		return model.User{}, err
+	}
+	id, _ := result.LastInsertId()
+	return model.User{
+		ID: id, Username: username,
+		PasswordHash: passwordHash, CreatedAt: now,
+	}, nil
+}
+
+const userColumns = `u.id, u.username,
+	u.password_hash, u.created_at`
+
+func scanUser(s rowScanner) (model.User, error) {
+	var u model.User
+	var createdAt string
+	if err := s.Scan(
+		&u.ID, &u.Username, &u.PasswordHash, &createdAt,
+	); err != nil {
+		return model.User{}, err
+	}
+	u.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return u, nil
+}
+
+// FindByName は名前でユーザーを取得する。
+func (r *UserRepository) FindByName(
+	ctx context.Context, username string,
+) (model.User, error) {
+	return scanUser(r.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+`
+		 FROM users u WHERE u.username = ?`, username,
+	))
+}
+
+// CreateSession はセッションを登録する。
+// あわせて期限切れのセッションを削除する。
+func (r *UserRepository) CreateSession(
+	ctx context.Context, userID int64,
+	tokenHash string, expiresAt time.Time,
+) error {
+	now := time.Now().UTC()
+	if _, err := r.db.ExecContext(ctx,
+		`DELETE FROM sessions WHERE expires_at <= ?`,
+		now.Format(time.RFC3339),
+	); err != nil {
+		return err
+	}
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO sessions
+		 (token_hash, user_id, created_at, expires_at)
+		 VALUES (?, ?, ?, ?)`,
+		tokenHash, userID, now.Format(time.RFC3339),
+		expiresAt.UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// SessionUser は有効なセッションのユーザーを返す。
+func (r *UserRepository) SessionUser(
+	ctx context.Context, tokenHash string,
+) (model.User, error) {
+	// RFC3339 の UTC 表記は文字列の順序が時刻の順序と一致する
+	return scanUser(r.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+`
+		 FROM sessions s
+		 JOIN users u ON u.id = s.user_id
+		 WHERE s.token_hash = ? AND s.expires_at > ?`,
+		tokenHash, time.Now().UTC().Format(time.RFC3339),
+	))
+}
+
+// DeleteSession はセッションを削除する。
+// 存在しなくてもエラーにしない。
+func (r *UserRepository) DeleteSession(
+	ctx context.Context, tokenHash string,
+) error {
+	_, err := r.db.ExecContext(ctx,
+		`DELETE FROM sessions WHERE token_hash = ?`,
+		tokenHash,
+	)
+	return err
+}
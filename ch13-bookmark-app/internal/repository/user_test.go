@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+)
+
+// UserStore の各実装に同じテストを実行する。
+
+func TestUserRepository(t *testing.T) {
+	testUserStore(t, func(t *testing.T) UserStore {
+		return NewUsers(newSQLStore(t).(*BookmarkRepository).db)
+	})
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	testUserStore(t, func(*testing.T) UserStore {
+		return NewMemoryUsers()
+	})
+}
+
+func testUserStore(
+	t *testing.T, newStore func(*testing.T) UserStore,
+) {
+	t.Run("CreateAndFind", func(t *testing.T) {
+		s := newStore(t)
+		u, err := s.Create(t.Context(), "alice", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID == 0 || u.Username != "alice" || u.CreatedAt.IsZero() {
+			t.Errorf("user = %+v", u)
+		}
+		got, err := s.FindByName(t.Context(), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != u {
+			t.Errorf("FindByName = %+v, want %+v", got, u)
+		}
+		if _, err := s.FindByName(t.Context(), "bob"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("FindByName: err = %v, want sql.ErrNoRows", err)
+		}
+		if _, err := s.Create(t.Context(), "alice", "other"); !errors.Is(err, ErrUserExists) {
+			t.Errorf("Create: err = %v, want ErrUserExists", err)
+		}
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		s := newStore(t)
+		u, err := s.Create(t.Context(), "alice", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		future := time.Now().Add(time.Hour)
+		if err := s.CreateSession(t.Context(), u.ID, "live", future); err != nil {
+			t.Fatal(err)
+		}
+		past := time.Now().Add(-time.Hour)
+		if err := s.CreateSession(t.Context(), u.ID, "expired", past); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.SessionUser(t.Context(), "live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != u.ID {
+			t.Errorf("user = %+v, want %+v", got, u)
+		}
+		for _, h := range []string{"expired", "unknown"} {
+			if _, err := s.SessionUser(t.Context(), h); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("SessionUser(%q): err = %v, want sql.ErrNoRows", h, err)
+			}
+		}
+
+		if err := s.DeleteSession(t.Context(), "live"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SessionUser(t.Context(), "live"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("after delete: err = %v, want sql.ErrNoRows", err)
+		}
+		if err := s.DeleteSession(t.Context(), "live"); err != nil {
+			t.Errorf("delete twice: %v", err)
+		}
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		s := newStore(t)
+		alice, _ := s.Create(t.Context(), "alice", "hash")
+		bob, _ := s.Create(t.Context(), "bob", "hash")
+
+		expires := time.Now().Add(time.Hour)
+		created, err := s.CreateToken(t.Context(), alice.ID, "h1", model.APIToken{
+			Name:      "ci",
+			Scopes:    []string{model.ScopeBookmarksRead},
+			ExpiresAt: &expires,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID == 0 || created.CreatedAt.IsZero() || created.LastUsedAt != nil {
+			t.Errorf("created = %+v", created)
+		}
+		past := time.Now().Add(-time.Hour)
+		if _, err := s.CreateToken(t.Context(), alice.ID, "h2", model.APIToken{
+			Name: "old", Scopes: []string{model.ScopeBookmarksWrite}, ExpiresAt: &past,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		u, tok, err := s.TokenUser(t.Context(), "h1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != alice.ID || tok.ID != created.ID || tok.Name != "ci" ||
+			!slices.Equal(tok.Scopes, []string{model.ScopeBookmarksRead}) {
+			t.Errorf("TokenUser = %+v, %+v", u, tok)
+		}
+		if tok.LastUsedAt == nil {
+			t.Error("last_used_at not set")
+		}
+		if tok.ExpiresAt == nil || !tok.ExpiresAt.Equal(expires.Truncate(time.Second)) {
+			t.Errorf("expires_at = %v, want %v", tok.ExpiresAt, expires)
+		}
+		// 期限切れと未登録のトークンは使えない
+		for _, h := range []string{"h2", "unknown"} {
+			if _, _, err := s.TokenUser(t.Context(), h); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("TokenUser(%q): err = %v, want sql.ErrNoRows", h, err)
+			}
+		}
+
+		// 期限切れのものも一覧には残る
+		tokens, err := s.Tokens(t.Context(), alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 2 || tokens[0].Name != "ci" || tokens[1].Name != "old" {
+			t.Errorf("tokens = %+v", tokens)
+		}
+		if tokens[0].LastUsedAt == nil {
+			t.Error("last_used_at not stored")
+		}
+		if tokens, _ := s.Tokens(t.Context(), bob.ID); len(tokens) != 0 {
+			t.Errorf("bob's tokens = %+v", tokens)
+		}
+
+		// ほかのユーザーのトークンは失効させられない
+		if err := s.RevokeToken(t.Context(), bob.ID, created.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("RevokeToken by bob: err = %v, want sql.ErrNoRows", err)
+		}
+		if err := s.RevokeToken(t.Context(), alice.ID, created.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.TokenUser(t.Context(), "h1"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("after revoke: err = %v, want sql.ErrNoRows", err)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+// Package requestid はリクエストごとの ID を扱う。
+// 監査ログなどに記録し、あとから同じリクエストによる
+// 処理をたどれるようにする。
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+)
+
+// Header はリクエスト ID を受け渡す HTTP ヘッダー。
+const Header = "X-Request-ID"
+
+// maxLength は受け付けるリクエスト ID の最大長。
+const maxLength = 128
+
+type contextKey struct{}
+
+// NewContext は id を持つ ctx を返す。
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext は ctx のリクエスト ID を返す。
+// 設定されていなければ空文字列を返す。
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// New は新しいリクエスト ID を生成する。
+func New() string {
+	return rand.Text()
+}
+
+// Valid は外部から受け取った id をそのまま使えるかを判定する。
+// ログを崩さないよう、空白や制御文字を含まない
+// 表示可能な ASCII だけを受け付ける。
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware はリクエスト ID を ctx に設定し、レスポンスの
+// X-Request-ID にも付ける。前段のプロキシなどが X-Request-ID を
+// 付けていればそれを使い、なければ生成する。
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(
+		w http.ResponseWriter, r *http.Request,
+	) {
+		id := r.Header.Get(Header)
+		if !Valid(id) {
+			id = New()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(
+			NewContext(r.Context(), id)))
+	})
+}
@@ -0,0 +1,48 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"指定なし", "", false},
+		{"指定あり", "abc-123", true},
+		{"空白を含む", "abc 123", false},
+		{"改行を含む", "abc\n123", false},
+		{"長すぎる", strings.Repeat("a", maxLength+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := Middleware(http.HandlerFunc(func(
+				w http.ResponseWriter, r *http.Request,
+			) {
+				got = FromContext(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set(Header, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got == "" || !Valid(got) {
+				t.Fatalf("id = %q", got)
+			}
+			if echoed := rec.Header().Get(Header); echoed != got {
+				t.Errorf("response header = %q, want %q", echoed, got)
+			}
+			if (got == tt.header) != tt.keep {
+				t.Errorf("id = %q, header = %q, keep = %v",
+					got, tt.header, tt.keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package requestid
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogKey はログに出力するリクエスト ID の属性名。
+const LogKey = "request_id"
+
+// logHandler は ctx のリクエスト ID をログに加える。
+type logHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler は h を包み、slog.InfoContext などに渡した
+// ctx にリクエスト ID があれば request_id 属性として加える
+// slog.Handler を返す。WithGroup の後では属性もそのグループに入る。
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return logHandler{h}
+}
+
+func (h logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String(LogKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,31 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(
+		slog.NewTextHandler(&buf, nil))).With("app", "test")
+
+	ctx := NewContext(context.Background(), "req-1")
+	logger.InfoContext(ctx, "with id")
+	logger.Info("without id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines = %q", lines)
+	}
+	if !strings.Contains(lines[0], "app=test") ||
+		!strings.Contains(lines[0], "request_id=req-1") {
+		t.Errorf("with id: %s", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("without id: %s", lines[1])
+	}
+}
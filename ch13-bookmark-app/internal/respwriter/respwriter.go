@@ -0,0 +1,58 @@
+// Package respwriter は http.ResponseWriter を包み、
+// ハンドラが返したステータスコードと本文の大きさを記録する。
+// メトリクスやアクセスログで使う。
+package respwriter
+
+import "net/http"
+
+// Writer はステータスコードと書き込んだバイト数を記録する
+// http.ResponseWriter。Unwrap を持つため、
+// http.ResponseController の Flush などは元の
+// ResponseWriter にそのまま届く。
+type Writer struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// Wrap は w を包んだ Writer を返す。
+func Wrap(w http.ResponseWriter) *Writer {
+	return &Writer{ResponseWriter: w}
+}
+
+// WriteHeader は最初に送ったステータスコードを記録する。
+// 103 Early Hints などの 1xx は最終的な応答ではないため記録しない。
+func (w *Writer) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap は元の ResponseWriter を返す。
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status は送ったステータスコードを返す。何も書き込んで
+// いなければ、net/http が返すのと同じく 200 とする。
+func (w *Writer) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Size は書き込んだ本文のバイト数を返す。
+func (w *Writer) Size() int64 {
+	return w.size
+}
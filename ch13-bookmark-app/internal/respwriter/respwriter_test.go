@@ -0,0 +1,52 @@
+package respwriter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(w http.ResponseWriter)
+		status int
+		size   int64
+	}{
+		{"何も書かない", func(w http.ResponseWriter) {}, 200, 0},
+		{"本文だけ", func(w http.ResponseWriter) {
+			w.Write([]byte("hello"))
+		}, 200, 5},
+		{"ステータスと本文", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no"))
+			w.Write([]byte("pe"))
+		}, 404, 4},
+		{"1xx の後", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusCreated)
+		}, 201, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := Wrap(rec)
+			tt.handle(w)
+			if w.Status() != tt.status || w.Size() != tt.size {
+				t.Errorf("status, size = %d, %d, want %d, %d",
+					w.Status(), w.Size(), tt.status, tt.size)
+			}
+		})
+	}
+}
+
+func TestWriter_flush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := Wrap(rec)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if !rec.Flushed {
+		t.Error("元の ResponseWriter に Flush が届いていません")
+	}
+}
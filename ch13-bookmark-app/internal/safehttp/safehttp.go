@@ -0,0 +1,135 @@
+// Package safehttp は、利用者が登録した URL に
+// サーバーからアクセスするための HTTP クライアントを提供する。
+//
+// 任意の URL を取得できると、サーバーの内側にしか
+// 見えないアドレス (localhost やクラウドのメタデータなど) に
+// 外部から要求を送らせる攻撃 (SSRF) の踏み台になる。
+// このパッケージのクライアントは、名前解決後の接続先が
+// 公開アドレスでなければ接続しない。
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked は接続先が公開アドレスでないことを表す。
+var ErrBlocked = errors.New("非公開アドレスへの接続は許可されていません")
+
+// Options はクライアントの設定。
+type Options struct {
+	// Timeout はリダイレクトを含めた1回の要求全体の制限時間。
+	Timeout time.Duration
+	// AllowPrivate が true なら非公開アドレスにも接続する。
+	// テストや、社内のサイトを扱う場合に使う。
+	AllowPrivate bool
+	// CheckRedirect は http.Client.CheckRedirect に渡す。
+	CheckRedirect func(*http.Request, []*http.Request) error
+}
+
+// NewClient は接続先を検査する HTTP クライアントを生成する。
+// 環境変数のプロキシ設定は使わない。プロキシ経由では
+// 接続先のアドレスを検査できないため。
+func NewClient(opts Options) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !opts.AllowPrivate {
+		dialer.Control = checkAddress
+	}
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: opts.Timeout,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       30 * time.Second,
+			ForceAttemptHTTP2:     true,
+		},
+		CheckRedirect: opts.CheckRedirect,
+	}
+}
+
+// checkAddress は net.Dialer.Control として、名前解決後の
+// 実際の接続先を検査する。名前解決の結果を後から差し替える
+// 攻撃 (DNS rebinding) も、接続直前に調べることで防ぐ。
+func checkAddress(
+	network, address string, _ syscall.RawConn,
+) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%s: %w", address, ErrBlocked)
+	}
+	if !IsPublic(ap.Addr()) {
+		return fmt.Errorf("%s: %w", ap.Addr(), ErrBlocked)
+	}
+	return nil
+}
+
+// IsPublic は addr がインターネット上の公開アドレスかを返す。
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	switch {
+	case !addr.IsValid(),
+		addr.IsUnspecified(),
+		addr.IsLoopback(),
+		addr.IsPrivate(),
+		addr.IsLinkLocalUnicast(),
+		addr.IsLinkLocalMulticast(),
+		addr.IsInterfaceLocalMulticast(),
+		addr.IsMulticast():
+		return false
+	}
+	for _, p := range reserved {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	// IPv4 を埋め込んだ IPv6 は、変換先の IPv4 で判定する
+	if v4, ok := embeddedIPv4(addr); ok {
+		return IsPublic(v4)
+	}
+	return true
+}
+
+var (
+	// nat64 は NAT64 の Well-Known Prefix (RFC 6052)。
+	// 下位32ビットが変換先の IPv4 アドレス。
+	nat64 = netip.MustParsePrefix("64:ff9b::/96")
+	// sixToFour は 6to4 (RFC 3056)。
+	// 16ビット目からの32ビットが IPv4 アドレス。
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 は addr が NAT64 か 6to4 のアドレスなら、
+// 埋め込まれた IPv4 アドレスを返す。
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// reserved は netip.Addr のメソッドでは判定できない
+// 非公開のアドレス範囲。
+var reserved = []netip.Prefix{
+	// 共有アドレス (キャリアグレード NAT)
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// "this network"
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// ベンチマーク用
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// 将来の予約とブロードキャスト
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// ネットワーク内で使う NAT64 (RFC 8215)。
+	// 変換先の位置が決まっていないため、まとめて拒否する
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
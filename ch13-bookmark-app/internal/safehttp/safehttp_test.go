@@ -0,0 +1,89 @@
+package safehttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		// NAT64 と 6to4 は埋め込まれた IPv4 で判定する
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::5db8:d822", true},
+		{"64:ff9b:1::5db8:d822", false},
+		{"2002:7f00:1::", false},
+		{"2002:c0a8:101::1", false},
+		{"2002:5db8:d822::1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr := netip.MustParseAddr(tt.addr)
+			if got := IsPublic(addr); got != tt.want {
+				t.Errorf("IsPublic(%s) = %v, want %v",
+					tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer srv.Close()
+
+	t.Run("blocked", func(t *testing.T) {
+		c := NewClient(Options{Timeout: time.Second})
+		_, err := c.Get(srv.URL)
+		if !errors.Is(err, ErrBlocked) {
+			t.Fatalf("err = %v, want ErrBlocked", err)
+		}
+	})
+	// 127.0.0.1 を埋め込んだ IPv6 のアドレスも拒否する
+	for _, u := range []string{
+		"http://[64:ff9b::7f00:1]/",
+		"http://[2002:7f00:1::]/",
+	} {
+		t.Run(u, func(t *testing.T) {
+			c := NewClient(Options{Timeout: time.Second})
+			_, err := c.Get(u)
+			if !errors.Is(err, ErrBlocked) {
+				t.Fatalf("err = %v, want ErrBlocked", err)
+			}
+		})
+	}
+	t.Run("allow private", func(t *testing.T) {
+		c := NewClient(Options{
+			Timeout: time.Second, AllowPrivate: true,
+		})
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	})
+}
@@ -0,0 +1,75 @@
+// Package trash はゴミ箱の保存期間を過ぎたブックマークを
+// 完全に削除する。
+package trash
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Store は期限切れのものを削除する先。
+// repository.BookmarkStore が満たす。
+type Store interface {
+	PurgeTrash(ctx context.Context,
+		before time.Time) (int, error)
+}
+
+// Purger はゴミ箱に移してから retention が経ったものを
+// 定期的に完全に削除する。
+type Purger struct {
+	store     Store
+	retention time.Duration
+	interval  time.Duration
+}
+
+// Option は Purger の設定を変更する。
+type Option func(*Purger)
+
+// WithInterval は削除を行う間隔を設定する。
+func WithInterval(d time.Duration) Option {
+	return func(p *Purger) { p.interval = d }
+}
+
+// NewPurger は Purger を生成する。
+func NewPurger(
+	store Store, retention time.Duration, opts ...Option,
+) *Purger {
+	p := &Purger{
+		store:     store,
+		retention: retention,
+		interval:  time.Hour,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Run は ctx がキャンセルされるまで、起動時と
+// interval ごとに RunOnce を呼ぶ。
+func (p *Purger) Run(ctx context.Context) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		n, err := p.RunOnce(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			slog.Error("ゴミ箱の削除失敗", "error", err)
+		case n > 0:
+			slog.Info("ゴミ箱から削除", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce は保存期間を過ぎたものを削除し、その件数を返す。
+func (p *Purger) RunOnce(ctx context.Context) (int, error) {
+	return p.store.PurgeTrash(ctx, time.Now().Add(-p.retention))
+}
@@ -0,0 +1,76 @@
+package trash
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/model"
+	"github.com/forest6511/go-textbook-examples/ch13-bookmark-app/internal/repository"
+)
+
+// cutoffStore は PurgeTrash に渡された日時を記録する。
+type cutoffStore struct {
+	before chan time.Time
+}
+
+func (s cutoffStore) PurgeTrash(
+	_ context.Context, before time.Time,
+) (int, error) {
+	s.before <- before
+	return 0, nil
+}
+
+func TestRunOnce(t *testing.T) {
+	s := repository.NewMemory()
+	b, err := s.Create(t.Context(), 1, model.CreateBookmarkRequest{
+		URL: "https://go.dev", Title: "Go",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(t.Context(), 1, b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存期間内のものは残す
+	if n, err := NewPurger(s, time.Hour).RunOnce(t.Context()); err != nil || n != 0 {
+		t.Errorf("RunOnce = %d, %v, want 0", n, err)
+	}
+	if n, err := NewPurger(s, -time.Hour).RunOnce(t.Context()); err != nil || n != 1 {
+		t.Errorf("RunOnce = %d, %v, want 1", n, err)
+	}
+	if trash, _ := s.Trash(t.Context(), 1); len(trash) != 0 {
+		t.Errorf("trash = %+v, want empty", trash)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := cutoffStore{before: make(chan time.Time)}
+	p := NewPurger(s, 30*24*time.Hour,
+		WithInterval(time.Millisecond))
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+
+	// 起動してすぐに1回目を実行し、その後も繰り返す
+	for range 2 {
+		before := <-s.before
+		want := time.Now().Add(-30 * 24 * time.Hour)
+		if d := want.Sub(before); d < 0 || d > time.Minute {
+			t.Errorf("before = %v, want about %v", before, want)
+		}
+	}
+	cancel()
+	// Run が PurgeTrash を呼んでいる途中なら受け取って終わらせる
+	for {
+		select {
+		case <-s.before:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package urlnorm
+
+import "errors"
+
+// RFC 3492 の Punycode のパラメータ。
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+)
+
+var errPunycodeOverflow = errors.New("punycode: overflow")
+
+// encodePunycode は label を Punycode に変換する。
+// "xn--" の接頭辞は付けない。
+// 標準ライブラリには IDNA の実装がないため、
+// RFC 3492 6.3 節の手順をそのまま実装している。
+func encodePunycode(label string) (string, error) {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n := pcInitialN
+	delta := 0
+	bias := pcInitialBias
+	for handled < len(runes) {
+		// まだ処理していない最小のコードポイント
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (int(^uint32(0)>>1)-delta)/(handled+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := pcBase; ; k += pcBase {
+				t := k - bias
+				switch {
+				case t < pcTMin:
+					t = pcTMin
+				case t > pcTMax:
+					t = pcTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out,
+					encodeDigit(t+(q-t)%(pcBase-t)))
+				q = (q - t) / (pcBase - t)
+			}
+			out = append(out, encodeDigit(q))
+			bias = adapt(delta, handled+1,
+				handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func encodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func adapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
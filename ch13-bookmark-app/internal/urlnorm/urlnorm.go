@@ -0,0 +1,202 @@
+// Package urlnorm はブックマークの URL を検証し、
+// 重複判定に使う正規化した形に変換する。
+package urlnorm
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MaxLength は受け付ける URL の最大バイト数。
+const MaxLength = 2048
+
+// 検証エラー。呼び出し元が理由を判別できるよう公開する。
+var (
+	ErrInvalid  = errors.New("url is not valid")
+	ErrTooLong  = errors.New("url is too long")
+	ErrScheme   = errors.New("url scheme must be http or https")
+	ErrNoHost   = errors.New("url has no host")
+	ErrUserinfo = errors.New("url must not contain credentials")
+)
+
+// trackingParams は除去する計測用のクエリパラメータ。
+// utm_ で始まるものはすべて除去する。
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"gbraid":  true,
+	"wbraid":  true,
+	"msclkid": true,
+	"yclid":   true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"igshid":  true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+	"mkt_tok": true,
+}
+
+func isTracking(key string) bool {
+	k := strings.ToLower(key)
+	return strings.HasPrefix(k, "utm_") ||
+		trackingParams[k]
+}
+
+// defaultPorts はスキームごとの既定のポート。
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Validate は raw が登録できる URL かを確かめる。
+func Validate(raw string) error {
+	_, err := Normalize(raw)
+	return err
+}
+
+// Normalize は raw を検証し、正規化した URL を返す。
+// http と https の絶対 URL だけを受け付け、次の変換を行う。
+//
+//   - スキームとホストを小文字にする
+//   - 国際化ドメイン名を Punycode (xn--) にする
+//   - 既定のポート (:80, :443) を取り除く
+//   - フラグメント (#...) を取り除く
+//   - utm_* などの計測用パラメータを取り除く
+//   - クエリをキーの順に並べる
+//
+// 同じページを指す URL は同じ文字列になるため、
+// 重複の判定に使える。
+func Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > MaxLength {
+		return "", ErrTooLong
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ErrInvalid
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", ErrScheme
+	}
+	if u.Opaque != "" {
+		return "", ErrInvalid
+	}
+	if u.User != nil {
+		return "", ErrUserinfo
+	}
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", ErrInvalid
+		}
+		port = strconv.Itoa(n)
+	}
+	switch {
+	case port != "" && port != defaultPorts[u.Scheme]:
+		// IPv6 のリテラルも角括弧で囲まれる
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = normalizeQuery(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// normalizeHost はホスト名を小文字にし、
+// ASCII 以外を含むラベルを Punycode に変換する。
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return "", ErrNoHost
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	// 全角の句点やピリオドもラベルの区切りとして扱う
+	host = strings.NewReplacer(
+		"。", ".", "．", ".", "｡", ".",
+	).Replace(host)
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", ErrInvalid
+		}
+		if !isASCII(label) {
+			enc, err := encodePunycode(label)
+			if err != nil {
+				return "", ErrInvalid
+			}
+			label = "xn--" + enc
+		}
+		if len(label) > 63 || !isHostLabel(label) {
+			return "", ErrInvalid
+		}
+		labels[i] = label
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// isHostLabel は英小文字・数字・ハイフン・アンダースコアだけで
+// 構成されているかを判定する。
+func isHostLabel(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z',
+			'0' <= c && c <= '9',
+			c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeQuery は計測用パラメータを除き、キーの順に並べる。
+// 同じキーの値の順序は意味を持つことがあるため変えない。
+// 解析できないクエリはそのまま返す。
+func normalizeQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		return raw
+	}
+	for k := range q {
+		if isTracking(k) {
+			delete(q, k)
+		}
+	}
+	// Encode はキーの順に並べて出力する
+	return q.Encode()
+}